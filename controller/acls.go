@@ -1,6 +1,9 @@
 package controller
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,6 +19,7 @@ import (
 	"github.com/samber/lo"
 	"github.com/tailscale/hujson"
 	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
 	"tailscale.com/envknob"
 	"tailscale.com/tailcfg"
 )
@@ -27,6 +31,8 @@ const (
 	errInvalidTag        = Error("invalid tag")
 	errInvalidPortFormat = Error("invalid port format")
 	errWildcardIsNeeded  = Error("wildcard as port is required for the protocol")
+
+	ErrACLPolicyVersionMismatch = Error("ACL policy has been modified since it was read")
 )
 
 const (
@@ -83,8 +89,253 @@ func (h *Mirage) SaveACLPolicy(path string) error {
 	return nil
 }
 
-func (h *Mirage) SaveACLPolicyOfOrg(org *Organization) error {
-	return h.db.Select("AclPolicy").Save(org).Error
+func (h *Mirage) SaveACLPolicyOfOrg(org *Organization, user *User) error {
+	if err := org.syncACLPolicyText(); err != nil {
+		log.Warn().
+			Str("func", "SaveACLPolicyOfOrg").
+			Err(err).
+			Msg("Could not patch ACL policy source, falling back to generated text")
+		org.AclPolicyText = ""
+	}
+	policyText, err := org.GetACLPolicyText()
+	if err != nil {
+		return err
+	}
+
+	return h.db.Transaction(func(tx *gorm.DB) error {
+		current := Organization{}
+		if err := tx.Where(&Organization{ID: org.ID}).Take(&current).Error; err != nil {
+			return err
+		}
+		currentText, err := current.GetACLPolicyText()
+		if err != nil && !errors.Is(err, errEmptyPolicy) {
+			return err
+		}
+		if err := tx.Select("AclPolicy", "AclPolicyText").Save(org).Error; err != nil {
+			return err
+		}
+
+		return appendACLPolicyRevision(tx, &current, currentText, user, ACLPolicyRevisionTags, 0, string(policyText))
+	})
+}
+
+// UpdateACLPolicyTextOfOrg replaces the ACL policy of the organization with
+// the given HuJSON document and records it in the policy history. The update
+// is refused with ErrACLPolicyVersionMismatch if the stored policy is no
+// longer at version.
+func (h *Mirage) UpdateACLPolicyTextOfOrg(
+	org *Organization,
+	user *User,
+	policy *ACLPolicy,
+	policyText string,
+	version string,
+	action string,
+	rollbackFrom uint64,
+) error {
+	return h.db.Transaction(func(tx *gorm.DB) error {
+		current := Organization{}
+		if err := tx.Where(&Organization{ID: org.ID}).Take(&current).Error; err != nil {
+			return err
+		}
+		currentText, err := current.GetACLPolicyText()
+		if err != nil && !errors.Is(err, errEmptyPolicy) {
+			return err
+		}
+		if aclPolicyVersion(currentText) != version {
+			return ErrACLPolicyVersionMismatch
+		}
+
+		org.AclPolicy = policy
+		org.AclPolicyText = policyText
+		if err := tx.Select("AclPolicy", "AclPolicyText").Save(org).Error; err != nil {
+			return err
+		}
+
+		return appendACLPolicyRevision(tx, &current, currentText, user, action, rollbackFrom, policyText)
+	})
+}
+
+// aclPolicyVersion returns the version tag (used as ETag) of a policy document.
+func aclPolicyVersion(policyText []byte) string {
+	sum := sha256.Sum256(policyText)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// aclPolicyLineColumn converts a byte offset of the policy document into a
+// 1-based line and column.
+func aclPolicyLineColumn(policyText []byte, offset int) (int, int) {
+	if offset < 0 {
+		return 0, 0
+	}
+	if offset > len(policyText) {
+		offset = len(policyText)
+	}
+	line := 1 + bytes.Count(policyText[:offset], []byte("\n"))
+	column := 1 + offset - (bytes.LastIndexByte(policyText[:offset], '\n') + 1)
+
+	return line, column
+}
+
+// aclPolicyPointer builds a JSON pointer (RFC 6901) out of path tokens.
+func aclPolicyPointer(tokens ...string) string {
+	var sb strings.Builder
+	for _, s := range tokens {
+		s = strings.ReplaceAll(s, "~", "~0")
+		s = strings.ReplaceAll(s, "/", "~1")
+		sb.WriteString("/")
+		sb.WriteString(s)
+	}
+
+	return sb.String()
+}
+
+// newACLPolicyError locates the JSON pointer path inside the parsed document
+// and returns an error carrying its line and column.
+func newACLPolicyError(
+	ast *hujson.Value,
+	policyText []byte,
+	path string,
+	err error,
+) ACLPolicyError {
+	policyErr := ACLPolicyError{
+		Path:    path,
+		Message: err.Error(),
+	}
+	if ast == nil {
+		return policyErr
+	}
+	if v := ast.Find(path); v != nil {
+		policyErr.Line, policyErr.Column = aclPolicyLineColumn(policyText, v.StartOffset)
+	}
+
+	return policyErr
+}
+
+// ParseACLPolicyHuJSON parses a policy document in the HuJSON format.
+// The syntax and type errors are returned with their line and column.
+func ParseACLPolicyHuJSON(policyText []byte) (*ACLPolicy, *hujson.Value, []ACLPolicyError) {
+	// hujson aliases and standardizes the input buffer in place, keep
+	// the original text untouched for the position lookups.
+	ast, err := hujson.Parse(append([]byte{}, policyText...))
+	if err != nil {
+		policyErr := ACLPolicyError{
+			Message: err.Error(),
+		}
+		fmt.Sscanf(err.Error(), "hujson: line %d, column %d:", &policyErr.Line, &policyErr.Column)
+
+		return nil, nil, []ACLPolicyError{policyErr}
+	}
+	standard := ast.Clone()
+	standard.Standardize()
+
+	var policy ACLPolicy
+	err = json.Unmarshal(standard.Pack(), &policy)
+	if err != nil {
+		policyErr := ACLPolicyError{
+			Message: err.Error(),
+		}
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			policyErr.Line, policyErr.Column = aclPolicyLineColumn(policyText, int(syntaxErr.Offset))
+		case errors.As(err, &typeErr):
+			policyErr.Line, policyErr.Column = aclPolicyLineColumn(policyText, int(typeErr.Offset))
+		}
+
+		return nil, &ast, []ACLPolicyError{policyErr}
+	}
+
+	if policy.IsZero() {
+		return nil, &ast, []ACLPolicyError{{Message: errEmptyPolicy.Error()}}
+	}
+
+	return &policy, &ast, nil
+}
+
+// dryRunACLPolicyOfOrg compiles the policy against the machines of the
+// organization without applying it. Every ACL and SSH entry is compiled on
+// its own so that all broken entries are reported at once. When the policy
+// compiles, its tests are run against the generated rules.
+func (h *Mirage) dryRunACLPolicyOfOrg(
+	org *Organization,
+	user *User,
+	policy *ACLPolicy,
+	ast *hujson.Value,
+	policyText []byte,
+) ([]ACLPolicyError, []ACLTestResult) {
+	machines, err := h.ListMachinesByOrgID(org.ID)
+	if err != nil {
+		return []ACLPolicyError{{Message: err.Error()}}, nil
+	}
+	stripEmailDomain := h.cfg.OIDC.StripEmaildomain
+	policyErrs := []ACLPolicyError{}
+
+	for group := range policy.Groups {
+		if _, err := expandGroup(*policy, group, stripEmailDomain); err != nil {
+			policyErrs = append(policyErrs,
+				newACLPolicyError(ast, policyText, aclPolicyPointer("groups", group), err))
+		}
+	}
+
+	for tag := range policy.TagOwners {
+		if !strings.HasPrefix(tag, "tag:") {
+			policyErrs = append(policyErrs,
+				newACLPolicyError(ast, policyText, aclPolicyPointer("tagOwners", tag),
+					fmt.Errorf("%w: '%s' did not begin with 'tag:'", errInvalidTag, tag)))
+
+			continue
+		}
+		if _, err := expandTagOwners(*policy, tag, stripEmailDomain); err != nil {
+			policyErrs = append(policyErrs,
+				newACLPolicyError(ast, policyText, aclPolicyPointer("tagOwners", tag), err))
+		}
+	}
+
+	if err := policy.validatePostures(); err != nil {
+		policyErrs = append(policyErrs,
+			newACLPolicyError(ast, policyText, aclPolicyPointer("postures"), err))
+	}
+
+	for prefix := range policy.AutoApprovers.Routes {
+		if _, err := netip.ParsePrefix(prefix); err != nil {
+			policyErrs = append(policyErrs,
+				newACLPolicyError(ast, policyText, aclPolicyPointer("autoApprovers", "routes", prefix), err))
+		}
+	}
+
+	for index, acl := range policy.ACLs {
+		single := *policy
+		single.ACLs = []ACL{acl}
+		if _, _, err := h.generateACLRules(machines, user, single, stripEmailDomain); err != nil {
+			policyErrs = append(policyErrs,
+				newACLPolicyError(ast, policyText, aclPolicyPointer("acls", strconv.Itoa(index)), err))
+		}
+	}
+
+	for index, ssh := range policy.SSHs {
+		single := *policy
+		single.SSHs = []SSH{ssh}
+		tmpOrg := *org
+		tmpOrg.AclPolicy = &single
+		if _, err := h.generateSSHRulesOfOrg(machines, user.ID, &tmpOrg); err != nil {
+			policyErrs = append(policyErrs,
+				newACLPolicyError(ast, policyText, aclPolicyPointer("ssh", strconv.Itoa(index)), err))
+		}
+	}
+
+	if len(policyErrs) > 0 {
+		return policyErrs, nil
+	}
+
+	// The whole policy as one, the same way UpdateACLRulesOfOrg does it.
+	rules, _, err := h.generateACLRules(machines, user, *policy, stripEmailDomain)
+	if err != nil {
+		return []ACLPolicyError{{Message: err.Error()}}, nil
+	}
+
+	return nil, h.runACLPolicyTests(machines, user, policy, rules, ast, policyText)
 }
 func (h *Mirage) CreateDefaultACLPolicy() error {
 	h.aclPolicy = &ACLPolicy{
@@ -201,6 +452,7 @@ func (h *Mirage) UpdateACLRulesOfOrg(org *Organization, user *User) (bool, error
 	if err != nil {
 		return enableSelf, err
 	}
+	defer observeSince(aclCompileDuration, time.Now())
 	aclPolicy := org.AclPolicy
 	rules, enableSelf, err := h.generateACLRules(machines, user, *aclPolicy, h.cfg.OIDC.StripEmaildomain)
 
@@ -722,6 +974,25 @@ func (h *Mirage) expandAlias(
     return
 	}
 
+	// 处理 posture:，展开为符合该合规策略的设备
+	if strings.HasPrefix(alias, PosturePrefix) {
+		now := time.Now()
+		for pos := range machines {
+			matched, err := aclPolicy.machineMatchesPosture(&machines[pos], alias, now)
+			if err != nil {
+				resErr = err
+				return
+			}
+			if matched {
+				ips = append(ips, machines[pos].IPAddresses.ToStringSlice()...)
+				if autoAddRoute {
+					ips = append(ips, h.expandMachineRoutes(machines[pos])...)
+				}
+			}
+		}
+		return
+	}
+
 	if strings.HasPrefix(alias, "group:") {
 		users, err := expandGroup(aclPolicy, alias, stripEmailDomain)
 		if err != nil {
@@ -1007,3 +1278,183 @@ func expandGroup(
 
 	return outGroups, nil
 }
+
+// runACLPolicyTests evaluates the tests block of the policy against the
+// compiled filter rules and returns the result of every accept/deny entry.
+func (h *Mirage) runACLPolicyTests(
+	machines []Machine,
+	user *User,
+	policy *ACLPolicy,
+	rules []tailcfg.FilterRule,
+	ast *hujson.Value,
+	policyText []byte,
+) []ACLTestResult {
+	stripEmailDomain := h.cfg.OIDC.StripEmaildomain
+	results := []ACLTestResult{}
+
+	for index, test := range policy.Tests {
+		line, column := 0, 0
+		if ast != nil {
+			if v := ast.Find(aclPolicyPointer("tests", strconv.Itoa(index))); v != nil {
+				line, column = aclPolicyLineColumn(policyText, v.StartOffset)
+			}
+		}
+		newResult := func(dest string, expected string) ACLTestResult {
+			return ACLTestResult{
+				Test:        index,
+				Source:      test.Source,
+				Destination: dest,
+				Expected:    expected,
+				Line:        line,
+				Column:      column,
+			}
+		}
+
+		srcs, err := h.expandAlias(false, machines, user.ID, *policy, test.Source, stripEmailDomain)
+		srcAddrs := aclTestAddrs(machines, srcs)
+		if err == nil && len(srcAddrs) == 0 {
+			err = fmt.Errorf("source %s matches no address", test.Source)
+		}
+
+		expectations := map[string][]string{
+			ACLTestResultAccept: test.Accept,
+			ACLTestResultDeny:   test.Deny,
+		}
+		for _, expected := range []string{ACLTestResultAccept, ACLTestResultDeny} {
+			for _, dest := range expectations[expected] {
+				result := newResult(dest, expected)
+				if err != nil {
+					result.Actual = ACLTestResultUnresolved
+					result.Message = err.Error()
+					results = append(results, result)
+
+					continue
+				}
+				allAllowed, anyAllowed, destErr := h.evalACLTestDest(
+					machines, user, policy, rules, srcAddrs, dest)
+				switch {
+				case destErr != nil:
+					result.Actual = ACLTestResultUnresolved
+					result.Message = destErr.Error()
+				case expected == ACLTestResultAccept && allAllowed:
+					result.Actual = ACLTestResultAccept
+				case expected == ACLTestResultDeny && anyAllowed:
+					result.Actual = ACLTestResultAccept
+				default:
+					result.Actual = ACLTestResultDeny
+				}
+				results = append(results, result)
+			}
+		}
+	}
+
+	return results
+}
+
+// evalACLTestDest reports whether every source address can reach every
+// address and port of the host:port destination, and whether any of the pairs
+// is allowed. An accept expectation needs all pairs allowed, a deny
+// expectation fails as soon as any of the pairs is allowed.
+func (h *Mirage) evalACLTestDest(
+	machines []Machine,
+	user *User,
+	policy *ACLPolicy,
+	rules []tailcfg.FilterRule,
+	srcAddrs []netip.Addr,
+	dest string,
+) (bool, bool, error) {
+	tokens := strings.Split(dest, ":")
+	if len(tokens) < expectedTokenItems || len(tokens) > 3 {
+		return false, false, errInvalidPortFormat
+	}
+	alias := tokens[0]
+	if len(tokens) == 3 {
+		alias = fmt.Sprintf("%s:%s", tokens[0], tokens[1])
+	}
+	port, err := strconv.ParseUint(tokens[len(tokens)-1], Base10, BitSize16)
+	if err != nil {
+		return false, false, fmt.Errorf("%w: tests require a single port", errInvalidPortFormat)
+	}
+
+	dsts, err := h.expandAlias(false, machines, user.ID, *policy, alias, h.cfg.OIDC.StripEmaildomain)
+	if err != nil {
+		return false, false, err
+	}
+	dstAddrs := aclTestAddrs(machines, dsts)
+	if len(dstAddrs) == 0 {
+		return false, false, fmt.Errorf("destination %s matches no address", alias)
+	}
+
+	allowedCount := 0
+	for _, src := range srcAddrs {
+		for _, dst := range dstAddrs {
+			if aclRulesAllow(rules, src, dst, uint16(port)) {
+				allowedCount++
+			}
+		}
+	}
+
+	return allowedCount == len(srcAddrs)*len(dstAddrs), allowedCount > 0, nil
+}
+
+// aclTestAddrs converts the output of expandAlias into addresses, a prefix is
+// represented by its first address. The "*" wildcard becomes every machine
+// address plus the zero netip.Addr, which stands for an address outside the
+// network and is only matched by a "*" rule.
+func aclTestAddrs(machines []Machine, aliases []string) []netip.Addr {
+	addrs := []netip.Addr{}
+	for _, alias := range aliases {
+		if alias == "*" {
+			addrs = append(addrs, netip.Addr{})
+			for _, machine := range machines {
+				addrs = append(addrs, machine.IPAddresses...)
+			}
+		} else if addr, err := netip.ParseAddr(alias); err == nil {
+			addrs = append(addrs, addr)
+		} else if prefix, err := netip.ParsePrefix(alias); err == nil {
+			addrs = append(addrs, prefix.Masked().Addr())
+		}
+	}
+
+	return addrs
+}
+
+// aclIPMatches reports whether the IP field of a filter rule covers addr.
+// The zero addr is the wildcard of aclTestAddrs.
+func aclIPMatches(ruleIP string, addr netip.Addr) bool {
+	if ruleIP == "*" {
+		return true
+	}
+	if !addr.IsValid() {
+		return false
+	}
+	if prefix, err := netip.ParsePrefix(ruleIP); err == nil {
+		return prefix.Contains(addr)
+	}
+	if ip, err := netip.ParseAddr(ruleIP); err == nil {
+		return ip == addr
+	}
+
+	return false
+}
+
+// aclRulesAllow reports whether a TCP connection from src to dst:port is
+// allowed by the filter rules.
+func aclRulesAllow(rules []tailcfg.FilterRule, src, dst netip.Addr, port uint16) bool {
+	for _, rule := range rules {
+		if len(rule.IPProto) > 0 && !lo.Contains(rule.IPProto, protocolTCP) {
+			continue
+		}
+		if !lo.ContainsBy(rule.SrcIPs, func(ip string) bool { return aclIPMatches(ip, src) }) {
+			continue
+		}
+		for _, dstPort := range rule.DstPorts {
+			if aclIPMatches(dstPort.IP, dst) &&
+				dstPort.Ports.First <= port && port <= dstPort.Ports.Last {
+				return true
+			}
+		}
+	}
+
+	return false
+}
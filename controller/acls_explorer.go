@@ -0,0 +1,252 @@
+package controller
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+
+	"github.com/tailscale/hujson"
+	"tailscale.com/tailcfg"
+)
+
+// ACLAccessGrant names the ACL entry that allows a connection, together with
+// the source and destination of the compiled rule that matched.
+type ACLAccessGrant struct {
+	ACLIndex int      `json:"aclIndex"`
+	ACL      ACL      `json:"acl"`
+	Line     int      `json:"line"`
+	SrcIP    string   `json:"srcIP"`
+	DstIP    string   `json:"dstIP"`
+	Ports    []string `json:"ports"`
+	Via      string   `json:"via,omitempty"` // 经由子网路由访问时命中的路由前缀
+	Router   string   `json:"router,omitempty"`
+}
+
+// aclEntryRules holds the filter rules compiled from one ACL entry.
+type aclEntryRules struct {
+	index int
+	acl   ACL
+	line  int
+	rules []tailcfg.FilterRule
+}
+
+// aclAccessTarget is an address range that can be reached, either a machine
+// address or a subnet route enabled on a router.
+type aclAccessTarget struct {
+	prefix netip.Prefix
+	via    string
+	router string
+}
+
+// compileACLEntriesOfOrg compiles every ACL entry of the organization policy
+// on its own, so a matching rule can be traced back to the entry. The rules
+// are generated from the point of view of user, as the packet filter of the
+// destination machine would be.
+func (h *Mirage) compileACLEntriesOfOrg(
+	org *Organization,
+	machines []Machine,
+	user *User,
+) ([]aclEntryRules, error) {
+	if org.AclPolicy == nil {
+		return nil, errEmptyPolicy
+	}
+	var ast *hujson.Value
+	policyText, err := org.GetACLPolicyText()
+	if err == nil {
+		_, ast, _ = ParseACLPolicyHuJSON(policyText)
+	}
+
+	entries := []aclEntryRules{}
+	for index, acl := range org.AclPolicy.ACLs {
+		single := *org.AclPolicy
+		single.ACLs = []ACL{acl}
+		rules, _, err := h.generateACLRules(machines, user, single, h.cfg.OIDC.StripEmaildomain)
+		if err != nil {
+			return nil, fmt.Errorf("ACL %d: %w", index, err)
+		}
+		entry := aclEntryRules{
+			index: index,
+			acl:   acl,
+			rules: rules,
+		}
+		if ast != nil {
+			if v := ast.Find(aclPolicyPointer("acls", strconv.Itoa(index))); v != nil {
+				entry.line, _ = aclPolicyLineColumn(policyText, v.StartOffset)
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// machineAccessTargets returns the addresses of the machine and, if
+// withRoutes is set, the subnet routes enabled on it.
+func (h *Mirage) machineAccessTargets(machine *Machine, withRoutes bool) []aclAccessTarget {
+	targets := []aclAccessTarget{}
+	for _, addr := range machine.IPAddresses {
+		targets = append(targets, aclAccessTarget{
+			prefix: netip.PrefixFrom(addr, addr.BitLen()),
+		})
+	}
+	if !withRoutes {
+		return targets
+	}
+	routes, err := h.GetEnabledRoutes(machine)
+	if err != nil {
+		return targets
+	}
+	for _, route := range routes {
+		targets = append(targets, aclAccessTarget{
+			prefix: route,
+			via:    route.String(),
+			router: machine.GivenName,
+		})
+	}
+
+	return targets
+}
+
+// addrAccessTargets returns addr itself along with the enabled subnet routes
+// of the organization that contain it.
+func (h *Mirage) addrAccessTargets(machines []Machine, addr netip.Addr) []aclAccessTarget {
+	targets := []aclAccessTarget{}
+	for index := range machines {
+		routes, err := h.GetEnabledRoutes(&machines[index])
+		if err != nil {
+			continue
+		}
+		for _, route := range routes {
+			if route.Contains(addr) {
+				targets = append(targets, aclAccessTarget{
+					prefix: netip.PrefixFrom(addr, addr.BitLen()),
+					via:    route.String(),
+					router: machines[index].GivenName,
+				})
+			}
+		}
+	}
+	if len(targets) == 0 {
+		targets = append(targets, aclAccessTarget{
+			prefix: netip.PrefixFrom(addr, addr.BitLen()),
+		})
+	}
+
+	return targets
+}
+
+// aclIPOverlaps reports whether the IP field of a filter rule covers any
+// address of target.
+func aclIPOverlaps(ruleIP string, target netip.Prefix) bool {
+	if ruleIP == "*" {
+		return true
+	}
+	if prefix, err := netip.ParsePrefix(ruleIP); err == nil {
+		return prefix.Overlaps(target)
+	}
+	if ip, err := netip.ParseAddr(ruleIP); err == nil {
+		return target.Contains(ip)
+	}
+
+	return false
+}
+
+func portRangeString(ports tailcfg.PortRange) string {
+	switch {
+	case ports.First == portRangeBegin && ports.Last == portRangeEnd:
+		return "*"
+	case ports.First == ports.Last:
+		return strconv.Itoa(int(ports.First))
+	default:
+		return fmt.Sprintf("%d-%d", ports.First, ports.Last)
+	}
+}
+
+// explainACLAccess lists the ACL entries which let any of srcAddrs reach any
+// of the targets. port 0 matches every port.
+func explainACLAccess(
+	entries []aclEntryRules,
+	srcAddrs []netip.Addr,
+	targets []aclAccessTarget,
+	port uint16,
+) []ACLAccessGrant {
+	grants := []ACLAccessGrant{}
+	grantIndex := map[string]int{}
+
+	for _, entry := range entries {
+		for _, rule := range entry.rules {
+			srcIP := ""
+		SrcLoop:
+			for _, ruleSrc := range rule.SrcIPs {
+				for _, addr := range srcAddrs {
+					if aclIPMatches(ruleSrc, addr) {
+						srcIP = ruleSrc
+						break SrcLoop
+					}
+				}
+			}
+			if srcIP == "" {
+				continue
+			}
+
+			for _, dstPort := range rule.DstPorts {
+				if port != 0 && (port < dstPort.Ports.First || port > dstPort.Ports.Last) {
+					continue
+				}
+				for _, target := range targets {
+					if !aclIPOverlaps(dstPort.IP, target.prefix) {
+						continue
+					}
+					key := fmt.Sprintf("%d|%s|%s|%s", entry.index, srcIP, dstPort.IP, target.via)
+					if i, ok := grantIndex[key]; ok {
+						if !containsStr(grants[i].Ports, portRangeString(dstPort.Ports)) {
+							grants[i].Ports = append(grants[i].Ports, portRangeString(dstPort.Ports))
+						}
+
+						continue
+					}
+					grantIndex[key] = len(grants)
+					grants = append(grants, ACLAccessGrant{
+						ACLIndex: entry.index,
+						ACL:      entry.acl,
+						Line:     entry.line,
+						SrcIP:    srcIP,
+						DstIP:    dstPort.IP,
+						Ports:    []string{portRangeString(dstPort.Ports)},
+						Via:      target.via,
+						Router:   target.router,
+					})
+				}
+			}
+		}
+	}
+
+	return grants
+}
+
+// findOrgMachine looks up a machine of the list by ID, given name or address.
+func findOrgMachine(machines []Machine, ref string) *Machine {
+	if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		for index := range machines {
+			if machines[index].ID == id {
+				return &machines[index]
+			}
+		}
+	}
+	for index := range machines {
+		if machines[index].GivenName == ref {
+			return &machines[index]
+		}
+	}
+	if addr, err := netip.ParseAddr(ref); err == nil {
+		for index := range machines {
+			for _, machineAddr := range machines[index].IPAddresses {
+				if machineAddr == addr {
+					return &machines[index]
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package controller
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	ErrACLPolicyRevisionNotFound = Error("ACL policy revision not found")
+
+	ACLPolicyRevisionInitial  = "initial"  // 首次修改前的原策略
+	ACLPolicyRevisionSave     = "save"     // 通过策略编辑接口保存
+	ACLPolicyRevisionTags     = "tags"     // 通过标签管理接口修改
+	ACLPolicyRevisionRollback = "rollback" // 回滚至历史版本
+)
+
+// ACLPolicyRevision is an append-only record of every change made to the
+// ACL policy of an organization.
+type ACLPolicyRevision struct {
+	ID             uint64 `gorm:"primary_key"`
+	OrganizationID int64  `gorm:"index"`
+	UserID         int64
+	UserName       string
+	Action         string
+	RollbackFrom   uint64 // 回滚时所依据的版本记录ID
+	Version        string
+	PolicyText     string
+
+	CreatedAt time.Time
+}
+
+// appendACLPolicyRevision records policyText as the newest revision of the
+// organization. If the organization has no history yet, its current policy
+// is recorded first so that the very first edit can be rolled back too.
+func appendACLPolicyRevision(
+	tx *gorm.DB,
+	org *Organization,
+	previousText []byte,
+	user *User,
+	action string,
+	rollbackFrom uint64,
+	policyText string,
+) error {
+	var count int64
+	if err := tx.Model(&ACLPolicyRevision{}).
+		Where(&ACLPolicyRevision{OrganizationID: org.ID}).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 && len(previousText) > 0 {
+		initial := ACLPolicyRevision{
+			OrganizationID: org.ID,
+			Action:         ACLPolicyRevisionInitial,
+			Version:        aclPolicyVersion(previousText),
+			PolicyText:     string(previousText),
+			CreatedAt:      org.UpdatedAt,
+		}
+		if err := tx.Create(&initial).Error; err != nil {
+			return err
+		}
+	}
+
+	revision := ACLPolicyRevision{
+		OrganizationID: org.ID,
+		Action:         action,
+		RollbackFrom:   rollbackFrom,
+		Version:        aclPolicyVersion([]byte(policyText)),
+		PolicyText:     policyText,
+	}
+	if user != nil {
+		revision.UserID = user.ID
+		revision.UserName = user.Name
+	}
+
+	return tx.Create(&revision).Error
+}
+
+// ListACLPolicyRevisions returns the policy history of an organization,
+// newest first. The policy text is not loaded.
+func (h *Mirage) ListACLPolicyRevisions(orgID int64) ([]ACLPolicyRevision, error) {
+	revisions := []ACLPolicyRevision{}
+	err := h.db.Omit("PolicyText").
+		Where(&ACLPolicyRevision{OrganizationID: orgID}).
+		Order("id desc").
+		Find(&revisions).Error
+
+	return revisions, err
+}
+
+// GetACLPolicyRevision returns one revision of the policy of an organization.
+func (h *Mirage) GetACLPolicyRevision(orgID int64, id uint64) (*ACLPolicyRevision, error) {
+	revision := ACLPolicyRevision{}
+	err := h.db.Where(&ACLPolicyRevision{ID: id, OrganizationID: orgID}).Take(&revision).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrACLPolicyRevisionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &revision, nil
+}
+
+// ACLPolicyDiffLine is one line of a line based diff, Op is one of
+// " " (unchanged), "-" (only in the old text) and "+" (only in the new text).
+type ACLPolicyDiffLine struct {
+	Op      string `json:"op"`
+	OldLine int    `json:"oldLine,omitempty"`
+	NewLine int    `json:"newLine,omitempty"`
+	Text    string `json:"text"`
+}
+
+// diffACLPolicyText computes a line based diff of two policy documents using
+// the longest common subsequence of their lines. The subsequence is found with
+// Hirschberg's algorithm, so memory stays linear in the size of the policies.
+func diffACLPolicyText(oldText, newText string) []ACLPolicyDiffLine {
+	d := aclPolicyDiffer{
+		oldLines: strings.Split(oldText, "\n"),
+		newLines: strings.Split(newText, "\n"),
+	}
+	d.diff = make([]ACLPolicyDiffLine, 0, len(d.oldLines)+len(d.newLines))
+	d.run(0, len(d.oldLines), 0, len(d.newLines))
+
+	return d.diff
+}
+
+type aclPolicyDiffer struct {
+	oldLines []string
+	newLines []string
+	diff     []ACLPolicyDiffLine
+}
+
+func (d *aclPolicyDiffer) same(i, j int) {
+	d.diff = append(d.diff, ACLPolicyDiffLine{Op: " ", OldLine: i + 1, NewLine: j + 1, Text: d.oldLines[i]})
+}
+
+func (d *aclPolicyDiffer) removed(i int) {
+	d.diff = append(d.diff, ACLPolicyDiffLine{Op: "-", OldLine: i + 1, Text: d.oldLines[i]})
+}
+
+func (d *aclPolicyDiffer) added(j int) {
+	d.diff = append(d.diff, ACLPolicyDiffLine{Op: "+", NewLine: j + 1, Text: d.newLines[j]})
+}
+
+// run appends the diff of oldLines[oldLo:oldHi] and newLines[newLo:newHi].
+func (d *aclPolicyDiffer) run(oldLo, oldHi, newLo, newHi int) {
+	for oldLo < oldHi && newLo < newHi && d.oldLines[oldLo] == d.newLines[newLo] {
+		d.same(oldLo, newLo)
+		oldLo++
+		newLo++
+	}
+	suffix := 0
+	for oldHi-suffix > oldLo && newHi-suffix > newLo &&
+		d.oldLines[oldHi-suffix-1] == d.newLines[newHi-suffix-1] {
+		suffix++
+	}
+	defer func() {
+		for k := 0; k < suffix; k++ {
+			d.same(oldHi+k, newHi+k)
+		}
+	}()
+	oldHi -= suffix
+	newHi -= suffix
+
+	switch {
+	case oldLo == oldHi || newLo == newHi:
+		for i := oldLo; i < oldHi; i++ {
+			d.removed(i)
+		}
+		for j := newLo; j < newHi; j++ {
+			d.added(j)
+		}
+	case oldHi-oldLo == 1:
+		match := -1
+		for j := newLo; j < newHi; j++ {
+			if d.oldLines[oldLo] == d.newLines[j] {
+				match = j
+				break
+			}
+		}
+		if match < 0 {
+			d.removed(oldLo)
+			for j := newLo; j < newHi; j++ {
+				d.added(j)
+			}
+			return
+		}
+		for j := newLo; j < match; j++ {
+			d.added(j)
+		}
+		d.same(oldLo, match)
+		for j := match + 1; j < newHi; j++ {
+			d.added(j)
+		}
+	default:
+		// split the old lines in half and find where the new lines split so
+		// that the two halves keep the longest common subsequence
+		mid := (oldLo + oldHi) / 2
+		forward := lcsLengths(d.oldLines[oldLo:mid], d.newLines[newLo:newHi], false)
+		backward := lcsLengths(d.oldLines[mid:oldHi], d.newLines[newLo:newHi], true)
+		split, best := 0, -1
+		for k := range forward {
+			if length := forward[k] + backward[len(backward)-1-k]; length > best {
+				split, best = k, length
+			}
+		}
+		d.run(oldLo, mid, newLo, newLo+split)
+		d.run(mid, oldHi, newLo+split, newHi)
+	}
+}
+
+// lcsLengths returns, for every k, the LCS length of a and b[:k], or of a and
+// b[len(b)-k:] when reverse is set, keeping only one row of the table.
+func lcsLengths(a, b []string, reverse bool) []int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	at := func(lines []string, i int) string {
+		if reverse {
+			return lines[len(lines)-1-i]
+		}
+		return lines[i]
+	}
+	for i := range a {
+		for j := 1; j <= len(b); j++ {
+			if at(a, i) == at(b, j-1) {
+				cur[j] = prev[j-1] + 1
+			} else if prev[j] >= cur[j-1] {
+				cur[j] = prev[j]
+			} else {
+				cur[j] = cur[j-1]
+			}
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev
+}
@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDiffACLPolicyText(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomText := func() string {
+		lines := make([]string, rng.Intn(30))
+		for i := range lines {
+			lines[i] = string(rune('a' + rng.Intn(4)))
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	for n := 0; n < 500; n++ {
+		oldText, newText := randomText(), randomText()
+		diff := diffACLPolicyText(oldText, newText)
+
+		oldLines, newLines, same := []string{}, []string{}, 0
+		for _, line := range diff {
+			switch line.Op {
+			case " ":
+				oldLines = append(oldLines, line.Text)
+				newLines = append(newLines, line.Text)
+				same++
+			case "-":
+				oldLines = append(oldLines, line.Text)
+			case "+":
+				newLines = append(newLines, line.Text)
+			}
+		}
+		if strings.Join(oldLines, "\n") != oldText || strings.Join(newLines, "\n") != newText {
+			t.Fatalf("diff of %q and %q does not rebuild both texts: %+v", oldText, newText, diff)
+		}
+		if want := lcsLengths(strings.Split(oldText, "\n"), strings.Split(newText, "\n"), false); same != want[len(want)-1] {
+			t.Fatalf("diff of %q and %q keeps %d lines, want %d", oldText, newText, same, want[len(want)-1])
+		}
+	}
+}
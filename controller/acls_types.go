@@ -2,6 +2,7 @@ package controller
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/netip"
 	"strings"
 
@@ -18,6 +19,26 @@ type ACLPolicy struct {
 	Tests         []ACLTest     `json:"tests"         yaml:"tests"`
 	AutoApprovers AutoApprovers `json:"autoApprovers" yaml:"autoApprovers"`
 	SSHs          []SSH         `json:"ssh"           yaml:"ssh"`
+
+	Postures          Postures `json:"postures,omitempty"          yaml:"postures,omitempty"`
+	DefaultSrcPosture []string `json:"defaultSrcPosture,omitempty" yaml:"defaultSrcPosture,omitempty"`
+}
+
+// ACLPolicyError describes a problem found in a policy document.
+// Line and Column are 1-based and are 0 when the problem cannot be located.
+type ACLPolicyError struct {
+	Path    string `json:"path"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+func (e ACLPolicyError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+	}
+
+	return e.Message
 }
 
 // ACL is a basic rule for the ACL Policy.
@@ -37,13 +58,36 @@ type Hosts map[string]netip.Prefix
 // TagOwners specify what users (users?) are allow to use certain tags.
 type TagOwners map[string][]string
 
-// ACLTest is not implemented, but should be use to check if a certain rule is allowed.
+// ACLTest asserts that Source can (Accept) or cannot (Deny) reach the given
+// host:port destinations. Tests are evaluated every time the policy is saved.
 type ACLTest struct {
 	Source string   `json:"src"            yaml:"src"`
 	Accept []string `json:"accept"         yaml:"accept"`
 	Deny   []string `json:"deny,omitempty" yaml:"deny,omitempty"`
 }
 
+const (
+	ACLTestResultAccept     = "accept"
+	ACLTestResultDeny       = "deny"
+	ACLTestResultUnresolved = "unresolved"
+)
+
+// ACLTestResult is the outcome of one accept or deny entry of an ACLTest.
+type ACLTestResult struct {
+	Test        int    `json:"test"` // index of the test in ACLPolicy.Tests
+	Source      string `json:"src"`
+	Destination string `json:"dst"`
+	Expected    string `json:"expected"`
+	Actual      string `json:"actual"`
+	Message     string `json:"message,omitempty"`
+	Line        int    `json:"line"`
+	Column      int    `json:"column"`
+}
+
+func (r ACLTestResult) Passed() bool {
+	return r.Expected == r.Actual
+}
+
 // AutoApprovers specify which users (users?), groups or tags have their advertised routes
 // or exit node status automatically enabled.
 type AutoApprovers struct {
@@ -123,23 +167,41 @@ func (policy ACLPolicy) IsZero() bool {
 func (autoApprovers *AutoApprovers) GetRouteApprovers(
 	prefix netip.Prefix,
 ) ([]string, error) {
-	if prefix.Bits() == 0 {
-		return autoApprovers.ExitNode, nil // 0.0.0.0/0, ::/0 or equivalent
+	rules, err := autoApprovers.GetRouteApproverRules(prefix)
+	if err != nil {
+		return nil, err
 	}
 
 	approverAliases := []string{}
+	for _, aliases := range rules {
+		approverAliases = append(approverAliases, aliases...)
+	}
+
+	return approverAliases, nil
+}
 
-	for autoApprovedPrefix, autoApproverAliases := range autoApprovers.Routes {
-		autoApprovedPrefix, err := netip.ParsePrefix(autoApprovedPrefix)
+// GetRouteApproverRules returns the autoApprovers entries matching the given IPPrefix,
+// keyed by the prefix of the rule, or by "exitNode" for exit routes.
+func (autoApprovers *AutoApprovers) GetRouteApproverRules(
+	prefix netip.Prefix,
+) (map[string][]string, error) {
+	if prefix.Bits() == 0 {
+		return map[string][]string{"exitNode": autoApprovers.ExitNode}, nil // 0.0.0.0/0, ::/0 or equivalent
+	}
+
+	rules := map[string][]string{}
+
+	for autoApprovedPrefixStr, autoApproverAliases := range autoApprovers.Routes {
+		autoApprovedPrefix, err := netip.ParsePrefix(autoApprovedPrefixStr)
 		if err != nil {
 			return nil, err
 		}
 
 		if prefix.Bits() >= autoApprovedPrefix.Bits() &&
 			autoApprovedPrefix.Contains(prefix.Masked().Addr()) {
-			approverAliases = append(approverAliases, autoApproverAliases...)
+			rules[autoApprovedPrefixStr] = autoApproverAliases
 		}
 	}
 
-	return approverAliases, nil
+	return rules, nil
 }
@@ -0,0 +1,206 @@
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ErrAPIKeyNotFound     = Error("API key not found")
+	ErrAPIKeyExpired      = Error("API key expired")
+	ErrAPIKeyRevoked      = Error("API key revoked")
+	ErrAPIKeyInvalid      = Error("API key invalid")
+	ErrAPIKeyScopeInvalid = Error("API key scope invalid")
+	ErrAPIKeyForbidden    = Error("API key scope does not allow this request")
+
+	apiKeyPrefix       = "mskey-api-"
+	apiKeyIDLength     = 12
+	apiKeySecretLength = 32
+	apiKeySaltLength   = 16
+
+	apiKeyContextKey = contextKey("apiKey")
+)
+
+// API密钥的权限范围，由低到高：只读、读写、管理（可管理API密钥本身）
+const (
+	APIKeyScopeRead  = "read"
+	APIKeyScopeWrite = "write"
+	APIKeyScopeAdmin = "admin"
+)
+
+var apiKeyScopeLevel = map[string]int{
+	APIKeyScopeRead:  1,
+	APIKeyScopeWrite: 2,
+	APIKeyScopeAdmin: 3,
+}
+
+// APIKey 是绑定到用户的控制台API访问凭证，数据库中只保存加盐哈希
+type APIKey struct {
+	ID          uint64 `gorm:"primary_key"`
+	KeyID       string `gorm:"uniqueIndex"` // 明文前缀，用于查找与展示
+	Salt        string
+	Hash        string
+	UserID      int64 `gorm:"index"`
+	User        User
+	Scope       string
+	Description string
+
+	CreatedAt  *time.Time
+	Expiration *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func hashAPIKeySecret(salt, secret string) string {
+	sum := sha256.Sum256([]byte(salt + secret))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(size int) (string, error) {
+	bytes := make([]byte, size)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bytes), nil
+}
+
+// CreateAPIKey 创建API密钥，返回的完整密钥只在此时可见
+func (h *Mirage) CreateAPIKey(
+	user *User,
+	scope string,
+	description string,
+	expiration *time.Time,
+) (*APIKey, string, error) {
+	if _, ok := apiKeyScopeLevel[scope]; !ok {
+		return nil, "", ErrAPIKeyScopeInvalid
+	}
+
+	keyID, err := randomHex(apiKeyIDLength / 2)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(apiKeySecretLength)
+	if err != nil {
+		return nil, "", err
+	}
+	salt, err := randomHex(apiKeySaltLength)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now().UTC()
+	key := APIKey{
+		KeyID:       keyID,
+		Salt:        salt,
+		Hash:        hashAPIKeySecret(salt, secret),
+		UserID:      user.ID,
+		User:        *user,
+		Scope:       scope,
+		Description: description,
+		CreatedAt:   &now,
+		Expiration:  expiration,
+	}
+	if err := h.db.Omit("User").Create(&key).Error; err != nil {
+		return nil, "", err
+	}
+
+	return &key, apiKeyPrefix + keyID + "-" + secret, nil
+}
+
+// ListAPIKeys returns all API keys (including revoked and expired ones) of a user.
+func (h *Mirage) ListAPIKeys(userID int64) ([]APIKey, error) {
+	keys := []APIKey{}
+	if err := h.db.Preload("User").Where(&APIKey{UserID: userID}).Find(&keys).Error; err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (h *Mirage) RevokeAPIKey(key *APIKey) error {
+	now := time.Now().UTC()
+	key.RevokedAt = &now
+
+	return h.db.Model(key).Update("revoked_at", now).Error
+}
+
+func (key *APIKey) IsValid() bool {
+	if key.RevokedAt != nil {
+		return false
+	}
+	if key.Expiration != nil && key.Expiration.Before(time.Now()) {
+		return false
+	}
+
+	return true
+}
+
+// Allows 判断密钥的权限范围是否满足要求
+func (key *APIKey) Allows(scope string) bool {
+	return apiKeyScopeLevel[key.Scope] >= apiKeyScopeLevel[scope]
+}
+
+// checkAPIKey 校验完整的API密钥，成功后更新最后使用时间
+func (h *Mirage) checkAPIKey(fullKey string) (*APIKey, error) {
+	rest, ok := strings.CutPrefix(fullKey, apiKeyPrefix)
+	if !ok {
+		return nil, ErrAPIKeyInvalid
+	}
+	keyID, secret, ok := strings.Cut(rest, "-")
+	if !ok || len(keyID) != apiKeyIDLength || secret == "" {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	key := APIKey{}
+	if err := h.db.Where(&APIKey{KeyID: keyID}).Take(&key).Error; err != nil {
+		return nil, ErrAPIKeyNotFound
+	}
+	hash := hashAPIKeySecret(key.Salt, secret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(key.Hash)) != 1 {
+		return nil, ErrAPIKeyInvalid
+	}
+	if key.RevokedAt != nil {
+		return nil, ErrAPIKeyRevoked
+	}
+	if key.Expiration != nil && key.Expiration.Before(time.Now()) {
+		return nil, ErrAPIKeyExpired
+	}
+
+	now := time.Now().UTC()
+	h.db.Model(&key).Update("last_used_at", now)
+	key.LastUsedAt = &now
+
+	return &key, nil
+}
+
+// apiKeyScopeForRequest 只读密钥只能执行GET，API密钥及工作负载身份信任的管理需要admin权限
+func apiKeyScopeForRequest(r *http.Request) string {
+	if (strings.Contains(r.URL.Path, "/api/keys") || strings.Contains(r.URL.Path, "/api/workload-identities")) &&
+		r.Method != http.MethodGet {
+		return APIKeyScopeAdmin
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return APIKeyScopeRead
+	}
+
+	return APIKeyScopeWrite
+}
+
+func withAPIKey(r *http.Request, key *APIKey) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, key))
+}
+
+// apiKeyFromRequest 返回经由Bearer认证的API密钥，cookie会话返回nil
+func apiKeyFromRequest(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*APIKey)
+
+	return key
+}
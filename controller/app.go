@@ -8,14 +8,12 @@ import (
 	"io/fs"
 	"net"
 	"net/http"
-	"sort"
 	"sync"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/dexidp/dex/server"
 	"github.com/gorilla/mux"
-	"github.com/patrickmn/go-cache"
 	"github.com/puzpuzpuz/xsync/v2"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/oauth2"
@@ -33,15 +31,13 @@ const (
 	//	DexDBType    = "sqlite3"
 	AuthPrefix = "Bearer "
 
-	EphemeralNodeInactivityTimeout = 5 * time.Minute  //不得低于65s
-	NodeUpdateCheckInterval        = 10 * time.Second //不得大于60s
+	EphemeralNodeInactivityTimeout = 5 * time.Minute //不得低于65s
 	updateInterval                 = 5000
 	HTTPReadTimeout                = 30 * time.Second
 	HTTPShutdownTimeout            = 3 * time.Second
 	privateKeyFileMode             = 0o600
 
 	smsCacheExpiration = time.Minute * 5
-	smsCacheCleanup    = time.Minute * 5
 )
 
 // Mirage represents the base app of the service.
@@ -53,29 +49,39 @@ type Mirage struct {
 
 	noisePrivateKey *key.MachinePrivate
 	//	DERPMap         *tailcfg.DERPMap
-	DERPNCs    map[string]*controlclient.NoiseClient
-	DERPseqnum map[string]int
+	DERPNCs *xsync.MapOf[string, *controlclient.NoiseClient]
 
 	aclPolicy *ACLPolicy
 	aclRules  []tailcfg.FilterRule
 	sshPolicy *tailcfg.SSHPolicy
 
-	lastStateChange *xsync.MapOf[string, time.Time]
+	cluster       ClusterState
+	stateNotifier *stateNotifier
 
 	oidcProvider *oidc.Provider
 	oauth2Config *oauth2.Config
 
-	smsCodeCache *cache.Cache
+	workloadProviders *xsync.MapOf[string, *oidc.Provider]
 
-	aCodeCache              *cache.Cache
-	stateCodeCache          *cache.Cache
-	controlCodeCache        *cache.Cache
-	machineControlCodeCache *cache.Cache
+	postureStates *xsync.MapOf[int64, string] // 设备最近一次的合规状态，见recordMachinePosture
+
+	smsCodeCache *ClusterCache[UserReg]
+
+	aCodeCache              *ClusterCache[ACacheItem]
+	stateCodeCache          *ClusterCache[StateCacheItem]
+	controlCodeCache        *ClusterCache[ControlCacheItem]
+	machineControlCodeCache *ClusterCache[MachineControlCodeCacheItem]
+	oauthTokenCache         *ClusterCache[OAuthTokenItem]
+	oauthRevokedCache       *ClusterCache[bool]
 	//organizationCache       *cache.Cache
 
-	tcdCache *cache.Cache
+	tcdCache      *ClusterCache[string]
+	tcdOfferCache *ClusterCache[[]TCDOffer]
 
-	longPollChanPool map[string]chan string
+	longPollChanPool *xsync.MapOf[string, chan string]
+
+	instanceID     string        // 本副本的标识，用于司南发送队列的租约
+	naviOutboxKick chan struct{} // 唤醒司南发送队列的投递
 
 	ipAllocationMutex sync.Mutex
 
@@ -90,21 +96,28 @@ func NewMirage(cfg *Config, db *gorm.DB) (*Mirage, error) {
 		return nil, fmt.Errorf("failed to read or create Noise protocol private key: %w", err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	cluster, err := newClusterState(ctx, db)
+	if err != nil {
+		cancel()
+
+		return nil, err
+	}
+
 	//cgao6: 注册机制探索
-	aCodeCache := cache.New(0, 0)
-	stateCodeCache := cache.New(0, 0)
-	controlCodeCache := cache.New(0, 0)
-	machineControlCodeCache := cache.New(0, 0)
+	aCodeCache := newClusterCache[ACacheItem](cluster, cacheBucketACode)
+	stateCodeCache := newClusterCache[StateCacheItem](cluster, cacheBucketStateCode)
+	controlCodeCache := newClusterCache[ControlCacheItem](cluster, cacheBucketControlCode)
+	machineControlCodeCache := newClusterCache[MachineControlCodeCacheItem](cluster, cacheBucketMachineControl)
 
-	smsCodeCache := cache.New(
-		smsCacheExpiration,
-		smsCacheCleanup,
-	)
-	longPollChanPool := make(map[string]chan string, 0)
+	smsCodeCache := newClusterCache[UserReg](cluster, cacheBucketSMSCode)
+	longPollChanPool := xsync.NewMapOf[chan string]()
 
-	InitESLogger(cfg)
+	if err := InitLogSinks(cfg); err != nil {
+		log.Error().Caller().Err(err).Msg("Some log sinks could not be initialized")
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	netMapDebounce, netMapMaxDelay := loadStateNotifierConfig()
 
 	app := Mirage{
 		cfg:    cfg,
@@ -113,21 +126,30 @@ func NewMirage(cfg *Config, db *gorm.DB) (*Mirage, error) {
 		cancel: cancel,
 
 		noisePrivateKey: noisePrivateKey,
-		DERPNCs:         make(map[string]*controlclient.NoiseClient),
-		DERPseqnum:      make(map[string]int),
+		DERPNCs:         xsync.NewMapOf[*controlclient.NoiseClient](),
 		aclRules:        tailcfg.FilterAllowAll, // default allowall
 
 		aCodeCache:              aCodeCache,
 		stateCodeCache:          stateCodeCache,
 		controlCodeCache:        controlCodeCache,
 		machineControlCodeCache: machineControlCodeCache,
-		tcdCache:                cache.New(0, 0),
+		oauthTokenCache:         newClusterCache[OAuthTokenItem](cluster, cacheBucketOAuthToken),
+		oauthRevokedCache:       newClusterCache[bool](cluster, cacheBucketOAuthRevoked),
+		tcdCache:                newClusterCache[string](cluster, cacheBucketTCD),
+		tcdOfferCache:           newClusterCache[[]TCDOffer](cluster, cacheBucketTCDOffers),
 		longPollChanPool:        longPollChanPool,
+		instanceID:              newInstanceID(),
+		naviOutboxKick:          make(chan struct{}, 1),
 		smsCodeCache:            smsCodeCache,
 		shutdownChan:            make(chan struct{}),
 		pollNetMapStreamWG:      sync.WaitGroup{},
-		lastStateChange:         xsync.NewMapOf[time.Time](),
+		cluster:                 cluster,
+		stateNotifier:           newStateNotifier(netMapDebounce, netMapMaxDelay),
+		workloadProviders:       xsync.NewMapOf[*oidc.Provider](),
+		postureStates:           xsync.NewIntegerMapOf[int64, string](),
 	}
+	cluster.Subscribe(clusterTopicStateChange, app.handleClusterStateChange)
+	cluster.Subscribe(clusterTopicLogin, app.handleClusterLogin)
 
 	nrs := app.ListNaviRegions()
 	for _, nr := range nrs {
@@ -139,8 +161,7 @@ func NewMirage(cfg *Config, db *gorm.DB) (*Mirage, error) {
 			if err != nil {
 				log.Error().Err(err).Msg("GetNaviNoiseClient Error: " + err.Error())
 			}
-			app.DERPNCs[nn.ID] = nc
-			app.DERPseqnum[nn.ID] = 0
+			app.DERPNCs.Store(nn.ID, nc)
 		}
 	}
 
@@ -343,6 +364,9 @@ func (h *Mirage) initRouter(router *mux.Router) {
 	router.HandleFunc("/a/oauth_response", h.selectOrgForLogin).Methods(http.MethodPost)
 	router.HandleFunc("/a/{aCode}", h.deviceReg).Methods(http.MethodPost)
 
+	// OAuth客户端凭证换取访问令牌
+	router.HandleFunc("/api/v2/oauth/token", h.OAuthTokenHandler).Methods(http.MethodPost)
+
 	// 控制台所需的全部API接口（由APIAuth身份验证放行）
 	api_router := router.PathPrefix("/admin/api").Subrouter()
 	api_router.Use(h.APIAuth)
@@ -356,20 +380,43 @@ func (h *Mirage) initRouter(router *mux.Router) {
 	console_router.HandleFunc("/api/users", h.CAPIGetUsers).Methods(http.MethodGet)
 	console_router.HandleFunc("/api/machines", h.ConsoleMachinesAPI).Methods(http.MethodGet)
 	console_router.HandleFunc("/api/machine-debug", h.ConsoleMachineDebugAPI).Methods(http.MethodGet)
+	console_router.HandleFunc("/api/routes", h.CAPIGetRoutes).Methods(http.MethodGet)
+	console_router.HandleFunc("/api/route-groups", h.CAPIGetRouteGroups).Methods(http.MethodGet)
 	console_router.HandleFunc("/api/dns", h.CAPIGetDNS).Methods(http.MethodGet)
 	console_router.HandleFunc("/api/tcd/offers", h.CAPIGetTCDOffers).Methods(http.MethodGet)
 	console_router.HandleFunc("/api/netsettings", h.getNetSettingAPI).Methods(http.MethodGet)
+	console_router.HandleFunc("/api/netsetting/expirynotice", h.CAPIGetExpiryNotice).Methods(http.MethodGet)
+	console_router.HandleFunc("/api/machines/expiring", h.CAPIGetExpiringMachines).Methods(http.MethodGet)
 	console_router.HandleFunc("/api/keys", h.CAPIGetKeys).Methods(http.MethodGet)
+	console_router.HandleFunc("/api/workload-identities", h.CAPIGetWorkloadIdentities).Methods(http.MethodGet)
+	console_router.HandleFunc("/api/acls", h.CAPIGetACLPolicy).Methods(http.MethodGet)
+	console_router.HandleFunc("/api/acls/revisions", h.CAPIGetACLPolicyRevisions).Methods(http.MethodGet)
+	console_router.HandleFunc("/api/acls/revisions/{id}", h.CAPIGetACLPolicyRevision).Methods(http.MethodGet)
+	console_router.HandleFunc("/api/acls/diff", h.CAPIGetACLPolicyDiff).Methods(http.MethodGet)
+	console_router.HandleFunc("/api/acls/access", h.CAPIGetACLAccess).Methods(http.MethodGet)
+	console_router.HandleFunc("/api/acls/access/peers", h.CAPIGetACLAccessPeers).Methods(http.MethodGet)
 	console_router.HandleFunc("/api/acls/tags", h.CAPIGetTags).Methods(http.MethodGet)
 	console_router.HandleFunc("/api/subscription", h.CAPIGetSubscription).Methods(http.MethodGet)
+	console_router.HandleFunc("/api/audit", h.CAPIGetAuditEvents).Methods(http.MethodGet)
+	console_router.HandleFunc("/api/audit/export", h.CAPIExportAuditEvents).Methods(http.MethodGet)
 	console_router.HandleFunc("/api/derp/query", h.CAPIQueryDERP).Methods(http.MethodGet)
 
 	// POST(更新类)API
 	console_router.HandleFunc("/api/users", h.CAPIPostUsers).Methods(http.MethodPost)
 	console_router.HandleFunc("/api/machines", h.ConsoleMachinesUpdateAPI).Methods(http.MethodPost)
 	console_router.HandleFunc("/api/machine/remove", h.ConsoleRemoveMachineAPI).Methods(http.MethodPost)
+	console_router.HandleFunc("/api/routes/{id}/approve", h.CAPIApproveRoute).Methods(http.MethodPost)
+	console_router.HandleFunc("/api/routes/{id}/reject", h.CAPIRejectRoute).Methods(http.MethodPost)
+	console_router.HandleFunc("/api/route-groups", h.CAPIPostRouteGroups).Methods(http.MethodPost)
 	console_router.HandleFunc("/api/netsetting/updatekeyexpiry", h.ConsoleUpdateKeyExpiryAPI).Methods(http.MethodPost)
+	console_router.HandleFunc("/api/netsetting/updatedeviceapproval", h.ConsoleUpdateDeviceApprovalAPI).Methods(http.MethodPost)
+	console_router.HandleFunc("/api/netsetting/expirynotice", h.CAPIPostExpiryNotice).Methods(http.MethodPost)
+	console_router.HandleFunc("/api/machines/{id}/renew", h.CAPIRenewMachine).Methods(http.MethodPost)
 	console_router.HandleFunc("/api/keys", h.CAPIPostKeys).Methods(http.MethodPost)
+	console_router.HandleFunc("/api/workload-identities", h.CAPIPostWorkloadIdentities).Methods(http.MethodPost)
+	console_router.HandleFunc("/api/acls", h.CAPIPostACLPolicy).Methods(http.MethodPost)
+	console_router.HandleFunc("/api/acls/validate", h.CAPIValidateACLPolicy).Methods(http.MethodPost)
+	console_router.HandleFunc("/api/acls/rollback", h.CAPIRollbackACLPolicy).Methods(http.MethodPost)
 	console_router.HandleFunc("/api/acls/tags", h.CAPIPostTags).Methods(http.MethodPost)
 	console_router.HandleFunc("/api/dns", h.CAPIPostDNS).Methods(http.MethodPost)
 	console_router.HandleFunc("/api/tcd", h.CAPIPostTCD).Methods(http.MethodPost)
@@ -378,6 +425,7 @@ func (h *Mirage) initRouter(router *mux.Router) {
 
 	// DELETE(删除类)API
 	console_router.PathPrefix("/api/keys/").HandlerFunc(h.CAPIDelKeys).Methods(http.MethodDelete)
+	console_router.HandleFunc("/api/workload-identities/{id}", h.CAPIDelWorkloadIdentities).Methods(http.MethodDelete)
 	console_router.PathPrefix("/api/acls/tags/").HandlerFunc(h.CAPIDelTags).Methods(http.MethodDelete)
 	console_router.PathPrefix("/api/derp/{id}").HandlerFunc(h.CAPIDelNaviNode).Methods(http.MethodDelete)
 
@@ -417,11 +465,18 @@ func (h *Mirage) Serve(ctrlChn chan CtrlMsg) error {
 	defer ticker.Stop()
 	longTicker := time.NewTicker(time.Millisecond * updateInterval * 6)
 	defer longTicker.Stop()
+	noticeTicker := time.NewTicker(expiryNoticeInterval)
+	defer noticeTicker.Stop()
+	naviOutboxTicker := time.NewTicker(naviOutboxInterval)
+	defer naviOutboxTicker.Stop()
 
 	go h.expireEphemeralNodes(ticker)  //updateInterval)
 	go h.expireExpiredMachines(ticker) //updateInterval)
 	go h.failoverSubnetRoutes(ticker)  //updateInterval)
 	go h.refreshNaviStatusPoller(longTicker)
+	go h.notifyExpiringMachines(noticeTicker)
+	go h.refreshPostureStates(longTicker)
+	go h.deliverNaviOutbox(naviOutboxTicker)
 
 	// Prepare group for running listeners
 	errorGroup := new(errgroup.Group)
@@ -504,11 +559,15 @@ func (h *Mirage) Serve(ctrlChn chan CtrlMsg) error {
 					}
 				*/
 				log.Info().Msg("Mirage stopped")
+				CloseLogSinks()
 				cancel()
 				return
 			case "update-config":
 				log.Info().Msg("Received update-config message, updating config")
 				h.cfg = msg.SysCfg
+				if err := InitLogSinks(h.cfg); err != nil {
+					log.Error().Caller().Err(err).Msg("Some log sinks could not be initialized")
+				}
 			case "set-last-update":
 				log.Info().Msg("Received set-last-update message, updating last update time")
 				h.setLastStateChangeToNow()
@@ -614,12 +673,8 @@ func (h *Mirage) setLastStateChangeToNow() {
 			Msg("failed to fetch all users, failing to update last changed state.")
 	}
 
-	for _, user := range users {
-		if h.lastStateChange == nil {
-			h.lastStateChange = xsync.NewMapOf[time.Time]()
-		}
-		h.lastStateChange.Store(user.StableID, now)
-	}
+	h.storeLastStateChange(now, users)
+	h.publishStateChange()
 }
 
 func (h *Mirage) setOrgLastStateChangeToNow(orgId ...int64) {
@@ -639,49 +694,62 @@ func (h *Mirage) setOrgLastStateChangeToNow(orgId ...int64) {
 			Msg("failed to fetch organization users, failing to update last changed state.")
 	}
 
-	for _, user := range users {
-		if h.lastStateChange == nil {
-			h.lastStateChange = xsync.NewMapOf[time.Time]()
-		}
-		h.lastStateChange.Store(user.StableID, now)
+	h.storeLastStateChange(now, users)
+	if len(orgId) > 0 {
+		h.publishStateChange(orgId...)
 	}
 }
 
-func (h *Mirage) getLastStateChange(users ...User) time.Time {
-	times := []time.Time{}
-
-	// getLastStateChange takes a list of users as a "filter", if no users
-	// are past, then use the entier list of users and look for the last update
-	if len(users) > 0 {
-		for _, user := range users {
-			if lastChange, ok := h.lastStateChange.Load(user.StableID); ok {
-				times = append(times, lastChange)
-			}
-		}
-	} else {
-		h.lastStateChange.Range(func(key string, value time.Time) bool {
-			times = append(times, value)
+func (h *Mirage) storeLastStateChange(now time.Time, users []User) {
+	ids := make([]string, len(users))
+	for i, user := range users {
+		ids[i] = user.StableID
+	}
+	if err := h.cluster.StoreStateChange(now, ids...); err != nil {
+		log.Error().
+			Caller().
+			Err(err).
+			Msg("failed to store last changed state.")
+	}
+}
 
-			return true
-		})
+// publishStateChange 通知全部副本组织发生了状态变化，未指定组织时通知全部组织
+func (h *Mirage) publishStateChange(orgIDs ...int64) {
+	if err := h.cluster.Publish(clusterTopicStateChange, encodeOrgIDs(orgIDs)); err != nil {
+		log.Error().
+			Caller().
+			Err(err).
+			Msg("failed to publish state change, notifying local streams only.")
+		h.handleClusterStateChange(encodeOrgIDs(orgIDs))
 	}
+}
 
-	sort.Slice(times, func(i, j int) bool {
-		return times[i].After(times[j])
-	})
+// handleClusterStateChange 将副本间的状态变化通知转给本副本的长连接
+func (h *Mirage) handleClusterStateChange(payload string) {
+	orgIDs, all := decodeOrgIDs(payload)
+	if all {
+		h.stateNotifier.publishAll()
 
-	if len(times) == 0 {
-		return time.Now().UTC()
-	} else {
-		return times[0]
+		return
 	}
+	h.stateNotifier.publish(orgIDs...)
 }
 
-func (h *Mirage) getOrgLastStateChange(orgId int64) time.Time {
-	times := []time.Time{}
-
+func (h *Mirage) getLastStateChange(users ...User) time.Time {
+	ids := make([]string, len(users))
+	for i, user := range users {
+		ids[i] = user.StableID
+	}
 	// getLastStateChange takes a list of users as a "filter", if no users
 	// are past, then use the entier list of users and look for the last update
+	if lastChange, ok := h.cluster.LoadStateChange(ids...); ok {
+		return lastChange
+	}
+
+	return time.Now().UTC()
+}
+
+func (h *Mirage) getOrgLastStateChange(orgId int64) time.Time {
 	users, err := h.ListOrgUsers(orgId)
 	if err != nil {
 		log.Error().
@@ -689,28 +757,11 @@ func (h *Mirage) getOrgLastStateChange(orgId int64) time.Time {
 			Err(err).
 			Msg("failed to fetch organization users, failing to get last changed state.")
 	}
-	for _, user := range users {
-		if lastChange, ok := h.lastStateChange.Load(user.StableID); ok {
-			if len(times) != 0 {
-				if times[0].Before(lastChange) {
-					times[0] = lastChange
-				}
-			} else {
-				times = append(times, lastChange)
-			}
-		}
-	}
-
-	if len(times) == 0 {
+	if len(users) == 0 {
 		return time.Now().UTC()
 	}
-	/*
-		sort.Slice(times, func(i, j int) bool {
-			return times[i].After(times[j])
-		})
-	*/
 
-	return times[0]
+	return h.getLastStateChange(users...)
 }
 
 func stdoutHandler(
@@ -0,0 +1,410 @@
+package controller
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const auditExportBatchSize = 500
+
+// 审计事件的操作者类型
+const (
+	AuditActorUser        = "user"
+	AuditActorAPIKey      = "apikey"
+	AuditActorOAuthClient = "oauth"
+	AuditActorSysAdmin    = "sysadmin"
+)
+
+// AuditEvent 记录一次管理操作：谁在何时从哪里对什么做了什么，以及变更前后的内容
+// OrganizationID为0表示与具体租户无关的系统级操作（仅在cockpit中产生）
+type AuditEvent struct {
+	ID             uint64 `gorm:"primary_key"`
+	OrganizationID int64  `gorm:"index"`
+	ActorType      string
+	ActorID        string
+	ActorName      string
+	Action         string `gorm:"index"`
+	TargetType     string
+	TargetID       string
+	Before         string // JSON
+	After          string // JSON
+	SourceIP       string
+	CreatedAt      time.Time `gorm:"index"`
+}
+
+func auditJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+
+	return string(bytes)
+}
+
+func (e *AuditEvent) SetBefore(v interface{}) *AuditEvent {
+	e.Before = auditJSON(v)
+	return e
+}
+
+func (e *AuditEvent) SetAfter(v interface{}) *AuditEvent {
+	e.After = auditJSON(v)
+	return e
+}
+
+var (
+	trustedProxiesOnce sync.Once
+	trustedProxies     []netip.Prefix
+)
+
+// loadTrustedProxies 读取可信反向代理的地址，MIRAGE_TRUSTED_PROXIES为逗号分隔的IP或CIDR
+// 未设置时不采信任何转发请求头
+func loadTrustedProxies() []netip.Prefix {
+	trustedProxiesOnce.Do(func() {
+		for _, field := range strings.Split(os.Getenv("MIRAGE_TRUSTED_PROXIES"), ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				addr, addrErr := netip.ParseAddr(field)
+				if addrErr != nil {
+					log.Error().Err(err).Str("proxy", field).Msg("Ignoring invalid MIRAGE_TRUSTED_PROXIES entry")
+
+					continue
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			trustedProxies = append(trustedProxies, prefix.Masked())
+		}
+	})
+
+	return trustedProxies
+}
+
+func isTrustedProxy(addr netip.Addr, proxies []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, prefix := range proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestSourceIP 返回客户端地址，只有连接来自MIRAGE_TRUSTED_PROXIES中的反向代理时才采信转发请求头
+// 其余情况下请求头可由客户端任意伪造，直接使用连接的对端地址
+func requestSourceIP(r *http.Request) string {
+	return sourceIPBehind(r, loadTrustedProxies())
+}
+
+// sourceIPBehind 从右向左查找X-Forwarded-For中第一个不属于可信代理的地址，
+// 左侧的条目由客户端提供，不可信；没有X-Forwarded-For时使用代理设置的X-Real-IP
+func sourceIPBehind(r *http.Request, proxies []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote, err := netip.ParseAddr(host)
+	if err != nil || !isTrustedProxy(remote, proxies) {
+		return host
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 {
+		if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return realIP.Unmap().String()
+		}
+
+		return host
+	}
+	forwarded = strings.Split(strings.Join(forwarded, ","), ",")
+	source := host
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(forwarded[i])
+		if entry == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			// 无法解析的条目之后均不可信
+			break
+		}
+		source = addr.Unmap().String()
+		if !isTrustedProxy(addr, proxies) {
+			return source
+		}
+	}
+
+	return source
+}
+
+func writeAuditEvent(db *gorm.DB, event *AuditEvent) {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	if err := db.Create(event).Error; err != nil {
+		log.Error().
+			Caller().
+			Err(err).
+			Str("action", event.Action).
+			Str("target", event.TargetID).
+			Msg("Failed to write audit event")
+	}
+}
+
+// newAuditEvent 根据控制台请求的认证方式确定操作者
+func (h *Mirage) newAuditEvent(
+	r *http.Request,
+	user *User,
+	action string,
+	targetType string,
+	targetID string,
+) *AuditEvent {
+	event := &AuditEvent{
+		OrganizationID: user.OrganizationID,
+		ActorType:      AuditActorUser,
+		ActorID:        strconv.FormatInt(user.ID, 10),
+		ActorName:      user.Name,
+		Action:         action,
+		TargetType:     targetType,
+		TargetID:       targetID,
+		SourceIP:       requestSourceIP(r),
+	}
+	if apiKey := apiKeyFromRequest(r); apiKey != nil {
+		event.ActorType = AuditActorAPIKey
+		event.ActorID = apiKey.KeyID
+	}
+	if token := oauthTokenFromRequest(r); token != nil {
+		event.ActorType = AuditActorOAuthClient
+		event.ActorID = token.ClientID
+		event.ActorName = token.ClientID
+	}
+
+	return event
+}
+
+func (h *Mirage) recordAudit(event *AuditEvent) {
+	writeAuditEvent(h.db, event)
+}
+
+// newAuditEvent 记录cockpit系统管理员的操作，orgID为受影响的租户
+func (c *Cockpit) newAuditEvent(
+	r *http.Request,
+	orgID int64,
+	action string,
+	targetType string,
+	targetID string,
+) *AuditEvent {
+	admin := &MirageSuperAdmin{}
+
+	return &AuditEvent{
+		OrganizationID: orgID,
+		ActorType:      AuditActorSysAdmin,
+		ActorID:        admin.WebAuthnName(),
+		ActorName:      admin.WebAuthnDisplayName(),
+		Action:         action,
+		TargetType:     targetType,
+		TargetID:       targetID,
+		SourceIP:       requestSourceIP(r),
+	}
+}
+
+func (c *Cockpit) recordAudit(event *AuditEvent) {
+	writeAuditEvent(c.db, event)
+}
+
+// machineAuditState 设备上可由管理员修改的属性快照
+func (h *Mirage) machineAuditState(machine *Machine) map[string]interface{} {
+	state := map[string]interface{}{
+		"name":        machine.GivenName,
+		"hostname":    machine.Hostname,
+		"autoGenName": machine.AutoGenName,
+		"user":        machine.User.Name,
+		"tags":        append([]string{}, machine.ForcedTags...),
+		"approval":    machine.ApprovalState,
+	}
+	if machine.Expiry != nil {
+		state["expiry"] = *machine.Expiry
+	}
+	if routes, err := h.GetEnabledRoutes(machine); err == nil {
+		state["enabledRoutes"] = routes
+	}
+
+	return state
+}
+
+// naviNodeAuditState 司南节点的配置快照，不含SSH口令及DNS服务商密钥
+func naviNodeAuditState(node *NaviNode) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       node.ID,
+		"regionId": node.NaviRegionID,
+		"hostname": node.HostName,
+		"ipv4":     node.IPv4,
+		"ipv6":     node.IPv6,
+		"noSTUN":   node.NoSTUN,
+		"stunPort": node.STUNPort,
+		"noDERP":   node.NoDERP,
+		"derpPort": node.DERPPort,
+		"sshAddr":  node.SSHAddr,
+		"arch":     node.Arch,
+	}
+}
+
+func tenantAuditState(org *Organization, owner string) map[string]interface{} {
+	state := map[string]interface{}{
+		"name":        org.Name,
+		"provider":    org.Provider,
+		"magicDomain": org.MagicDnsDomain,
+	}
+	if owner != "" {
+		state["owner"] = owner
+	}
+
+	return state
+}
+
+// auditSecretFields 系统配置中需要在审计日志中隐去的字段（按json名称）
+var auditSecretFields = map[string]struct{}{
+	"es_key":        {},
+	"key":           {},
+	"client_secret": {},
+	"private_key":   {},
+	"repo_cred":     {},
+	"headers":       {},
+}
+
+func redactAuditValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, item := range value {
+			if _, ok := auditSecretFields[k]; ok {
+				if item != nil && item != "" {
+					value[k] = "******"
+				}
+				continue
+			}
+			value[k] = redactAuditValue(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactAuditValue(item)
+		}
+	}
+
+	return v
+}
+
+// auditConfigChange 只保留前后不同的顶层字段，并隐去其中的密钥
+func auditConfigChange(before, after interface{}) (map[string]interface{}, map[string]interface{}) {
+	toMap := func(v interface{}) map[string]interface{} {
+		m := map[string]interface{}{}
+		if bytes, err := json.Marshal(v); err == nil {
+			json.Unmarshal(bytes, &m)
+		}
+		return m
+	}
+	beforeMap, afterMap := toMap(before), toMap(after)
+	changedBefore, changedAfter := map[string]interface{}{}, map[string]interface{}{}
+	for k, v := range afterMap {
+		if auditJSON(v) == auditJSON(beforeMap[k]) {
+			continue
+		}
+		changedBefore[k] = redactAuditValue(beforeMap[k])
+		changedAfter[k] = redactAuditValue(v)
+	}
+
+	return changedBefore, changedAfter
+}
+
+// AuditEventFilter 审计日志查询条件，零值字段不参与过滤
+type AuditEventFilter struct {
+	Action     string
+	ActorID    string
+	TargetType string
+	TargetID   string
+	Since      *time.Time
+	Until      *time.Time
+}
+
+func (f AuditEventFilter) apply(db *gorm.DB, orgID int64) *gorm.DB {
+	db = db.Model(&AuditEvent{}).Where("organization_id = ?", orgID).Where(&AuditEvent{
+		ActorID:    f.ActorID,
+		TargetType: f.TargetType,
+		TargetID:   f.TargetID,
+	})
+	if f.Action != "" {
+		// 支持按前缀过滤，如machine.匹配全部设备操作
+		if strings.HasSuffix(f.Action, ".") {
+			db = db.Where("action LIKE ?", f.Action+"%")
+		} else {
+			db = db.Where("action = ?", f.Action)
+		}
+	}
+	if f.Since != nil {
+		db = db.Where("created_at >= ?", *f.Since)
+	}
+	if f.Until != nil {
+		db = db.Where("created_at < ?", *f.Until)
+	}
+
+	return db
+}
+
+// ListAuditEvents 按时间倒序分页返回组织的审计事件及符合条件的总数
+func (h *Mirage) ListAuditEvents(
+	orgID int64,
+	filter AuditEventFilter,
+	offset int,
+	limit int,
+) ([]AuditEvent, int64, error) {
+	var total int64
+	if err := filter.apply(h.db, orgID).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	events := []AuditEvent{}
+	err := filter.apply(h.db, orgID).
+		Order("id desc").
+		Offset(offset).
+		Limit(limit).
+		Find(&events).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return events, total, nil
+}
+
+// ExportAuditEvents 按主键（即时间）顺序分批回调，用于导出大量事件
+func (h *Mirage) ExportAuditEvents(
+	orgID int64,
+	filter AuditEventFilter,
+	fn func(event *AuditEvent) error,
+) error {
+	events := []AuditEvent{}
+
+	return filter.apply(h.db, orgID).
+		FindInBatches(&events, auditExportBatchSize, func(tx *gorm.DB, batch int) error {
+			for i := range events {
+				if err := fn(&events[i]); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}).Error
+}
@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestSourceIPBehindTrustedProxy(t *testing.T) {
+	proxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		realIP    string
+		want      string
+	}{
+		{name: "direct client ignores headers", remote: "203.0.113.7:1234", forwarded: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "proxy without headers", remote: "10.0.0.2:1234", want: "10.0.0.2"},
+		{name: "proxy appends client", remote: "10.0.0.2:1234", forwarded: []string{"203.0.113.7"}, want: "203.0.113.7"},
+		{name: "spoofed left-most entry", remote: "10.0.0.2:1234", forwarded: []string{"198.51.100.1, 203.0.113.7"}, want: "203.0.113.7"},
+		{name: "chained proxies", remote: "10.0.0.2:1234", forwarded: []string{"198.51.100.1, 203.0.113.7, 10.0.0.3"}, want: "203.0.113.7"},
+		{name: "repeated headers", remote: "10.0.0.2:1234", forwarded: []string{"198.51.100.1", "203.0.113.7"}, want: "203.0.113.7"},
+		{name: "malformed entry", remote: "10.0.0.2:1234", forwarded: []string{"not-an-ip"}, want: "10.0.0.2"},
+		{name: "real ip from proxy", remote: "10.0.0.2:1234", realIP: "203.0.113.7", want: "203.0.113.7"},
+		{name: "real ip from client", remote: "203.0.113.7:1234", realIP: "198.51.100.1", want: "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := sourceIPBehind(r, proxies); got != tt.want {
+				t.Errorf("sourceIPBehind() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
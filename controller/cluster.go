@@ -0,0 +1,287 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/puzpuzpuz/xsync/v2"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	ClusterModeMemory   = "memory"
+	ClusterModePostgres = "postgres"
+
+	ErrClusterModeUnsupported = Error("unsupported cluster mode")
+
+	// 副本间广播的消息主题
+	clusterTopicStateChange = "state" // 组织状态变化，内容为逗号分隔的组织ID，*表示全部组织
+	clusterTopicLogin       = "login" // 交互式登录结果，内容为“aCode 结果”
+
+	clusterAllOrgs = "*"
+
+	// 共享缓存的分区
+	cacheBucketACode          = "acode"
+	cacheBucketStateCode      = "state"
+	cacheBucketControlCode    = "control"
+	cacheBucketMachineControl = "machine_control"
+	cacheBucketTCD            = "tcd"
+	cacheBucketTCDOffers      = "tcd_offers"
+	cacheBucketSMSCode        = "sms_code"
+	cacheBucketOAuthToken     = "oauth_token"
+	cacheBucketOAuthRevoked   = "oauth_revoked" // 已注销的OAuth客户端，保留一个令牌有效期
+)
+
+// ClusterState 控制服务器的运行时状态，包括登录流程中的各类缓存、用户的最后状态变化时间
+// 以及副本间的变化通知
+// 单实例部署使用进程内实现；多个控制服务器副本部署在负载均衡之后时，
+// 使用共享存储实现，同一网络的客户端无论连到哪个副本都能看到一致的状态
+type ClusterState interface {
+	// CacheGet 读取缓存，返回值与过期时间，永不过期时过期时间为零值
+	CacheGet(bucket, key string) ([]byte, time.Time, bool)
+	// CacheSet 写入缓存，ttl不为正数时永不过期
+	CacheSet(bucket, key string, value []byte, ttl time.Duration) error
+	CacheDelete(bucket, key string) error
+
+	// StoreStateChange 记录用户的最后状态变化时间
+	StoreStateChange(at time.Time, userStableIDs ...string) error
+	// LoadStateChange 返回指定用户中最晚的状态变化时间，未指定用户时在全部用户中查找
+	LoadStateChange(userStableIDs ...string) (time.Time, bool)
+
+	// Publish 向全部副本（包括自身）广播消息
+	Publish(topic, payload string) error
+	// Subscribe 注册主题的消息处理函数，处理函数不应阻塞
+	Subscribe(topic string, handler func(payload string))
+}
+
+// newClusterState 按环境变量创建集群状态的实现：
+//
+//	MIRAGE_CLUSTER_MODE memory(默认) | postgres
+//
+// postgres模式要求MIRAGE_DB_TYPE=postgres，全部副本连接同一个数据库，
+// 状态保存在数据库中，变化通知通过LISTEN/NOTIFY在副本间传递
+func newClusterState(ctx context.Context, db *gorm.DB) (ClusterState, error) {
+	mode := os.Getenv("MIRAGE_CLUSTER_MODE")
+	switch mode {
+	case "", ClusterModeMemory:
+		return newMemoryClusterState(), nil
+
+	case ClusterModePostgres:
+		dbCfg := LoadDBConfig()
+		if dbCfg.Type != DBTypePostgres {
+			return nil, fmt.Errorf("%w: %s requires MIRAGE_DB_TYPE=%s", ErrClusterModeUnsupported, mode, DBTypePostgres)
+		}
+
+		return newPostgresClusterState(ctx, db, dbCfg.PostgresDSN()), nil
+
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrClusterModeUnsupported, mode)
+	}
+}
+
+// ClusterCache 以JSON编码保存在ClusterState中的类型化缓存
+type ClusterCache[T any] struct {
+	state  ClusterState
+	bucket string
+}
+
+func newClusterCache[T any](state ClusterState, bucket string) *ClusterCache[T] {
+	return &ClusterCache[T]{
+		state:  state,
+		bucket: bucket,
+	}
+}
+
+func (c *ClusterCache[T]) Get(key string) (T, bool) {
+	value, _, ok := c.GetWithExpiration(key)
+
+	return value, ok
+}
+
+func (c *ClusterCache[T]) GetWithExpiration(key string) (T, time.Time, bool) {
+	var value T
+	data, expiration, ok := c.state.CacheGet(c.bucket, key)
+	if !ok {
+		return value, time.Time{}, false
+	}
+	if err := json.Unmarshal(data, &value); err != nil {
+		log.Error().Err(err).Str("bucket", c.bucket).Msg("Cannot decode cached value")
+
+		return value, time.Time{}, false
+	}
+
+	return value, expiration, true
+}
+
+func (c *ClusterCache[T]) Set(key string, value T, ttl time.Duration) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Error().Err(err).Str("bucket", c.bucket).Msg("Cannot encode cached value")
+
+		return
+	}
+	if err = c.state.CacheSet(c.bucket, key, data, ttl); err != nil {
+		log.Error().Err(err).Str("bucket", c.bucket).Msg("Cannot store cached value")
+	}
+}
+
+func (c *ClusterCache[T]) Delete(key string) {
+	if err := c.state.CacheDelete(c.bucket, key); err != nil {
+		log.Error().Err(err).Str("bucket", c.bucket).Msg("Cannot delete cached value")
+	}
+}
+
+// encodeOrgIDs 将组织ID编码为状态变化消息，未指定组织表示全部组织
+func encodeOrgIDs(orgIDs []int64) string {
+	if len(orgIDs) == 0 {
+		return clusterAllOrgs
+	}
+	ids := make([]string, len(orgIDs))
+	for i, id := range orgIDs {
+		ids[i] = strconv.FormatInt(id, 10)
+	}
+
+	return strings.Join(ids, ",")
+}
+
+func decodeOrgIDs(payload string) ([]int64, bool) {
+	if payload == clusterAllOrgs {
+		return nil, true
+	}
+	orgIDs := []int64{}
+	for _, s := range strings.Split(payload, ",") {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			continue
+		}
+		orgIDs = append(orgIDs, id)
+	}
+
+	return orgIDs, false
+}
+
+// memoryClusterState 进程内实现，仅适用于单实例部署
+type memoryClusterState struct {
+	caches      *xsync.MapOf[string, *cache.Cache]
+	stateChange *xsync.MapOf[string, time.Time]
+
+	handlers *clusterHandlers
+}
+
+func newMemoryClusterState() *memoryClusterState {
+	return &memoryClusterState{
+		caches:      xsync.NewMapOf[*cache.Cache](),
+		stateChange: xsync.NewMapOf[time.Time](),
+		handlers:    newClusterHandlers(),
+	}
+}
+
+func (s *memoryClusterState) bucket(name string) *cache.Cache {
+	c, _ := s.caches.LoadOrCompute(name, func() *cache.Cache {
+		return cache.New(0, 10*time.Minute)
+	})
+
+	return c
+}
+
+func (s *memoryClusterState) CacheGet(bucket, key string) ([]byte, time.Time, bool) {
+	value, expiration, ok := s.bucket(bucket).GetWithExpiration(key)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+
+	return value.([]byte), expiration, true
+}
+
+func (s *memoryClusterState) CacheSet(bucket, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = cache.NoExpiration
+	}
+	s.bucket(bucket).Set(key, value, ttl)
+
+	return nil
+}
+
+func (s *memoryClusterState) CacheDelete(bucket, key string) error {
+	s.bucket(bucket).Delete(key)
+
+	return nil
+}
+
+func (s *memoryClusterState) StoreStateChange(at time.Time, userStableIDs ...string) error {
+	for _, id := range userStableIDs {
+		s.stateChange.Store(id, at)
+	}
+
+	return nil
+}
+
+func (s *memoryClusterState) LoadStateChange(userStableIDs ...string) (time.Time, bool) {
+	var latest time.Time
+	found := false
+	observe := func(at time.Time) {
+		if !found || at.After(latest) {
+			latest = at
+			found = true
+		}
+	}
+	if len(userStableIDs) == 0 {
+		s.stateChange.Range(func(_ string, at time.Time) bool {
+			observe(at)
+
+			return true
+		})
+	}
+	for _, id := range userStableIDs {
+		if at, ok := s.stateChange.Load(id); ok {
+			observe(at)
+		}
+	}
+
+	return latest, found
+}
+
+func (s *memoryClusterState) Publish(topic, payload string) error {
+	s.handlers.dispatch(topic, payload)
+
+	return nil
+}
+
+func (s *memoryClusterState) Subscribe(topic string, handler func(payload string)) {
+	s.handlers.add(topic, handler)
+}
+
+// clusterHandlers 按主题分发副本间消息
+type clusterHandlers struct {
+	mu       sync.RWMutex
+	handlers map[string][]func(payload string)
+}
+
+func newClusterHandlers() *clusterHandlers {
+	return &clusterHandlers{
+		handlers: make(map[string][]func(payload string)),
+	}
+}
+
+func (c *clusterHandlers) add(topic string, handler func(payload string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[topic] = append(c.handlers[topic], handler)
+}
+
+func (c *clusterHandlers) dispatch(topic, payload string) {
+	c.mu.RLock()
+	handlers := c.handlers[topic]
+	c.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(payload)
+	}
+}
@@ -0,0 +1,208 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	clusterNotifyChannel = "mirage_cluster"
+
+	clusterCacheCleanupInterval = 10 * time.Minute
+	clusterListenRetryMin       = time.Second
+	clusterListenRetryMax       = 30 * time.Second
+)
+
+// ClusterCacheEntry 共享缓存中的一项
+type ClusterCacheEntry struct {
+	Bucket    string `gorm:"primaryKey"`
+	Key       string `gorm:"primaryKey"`
+	Value     []byte
+	ExpiresAt *time.Time `gorm:"index"`
+}
+
+// ClusterStateChange 用户的最后状态变化时间
+type ClusterStateChange struct {
+	UserStableID string `gorm:"primaryKey"`
+	ChangedAt    time.Time
+}
+
+// postgresClusterState 以PostgreSQL为共享存储的实现
+// 缓存与状态变化时间保存在数据库中，消息通过NOTIFY广播，每个副本各自LISTEN
+type postgresClusterState struct {
+	db       *gorm.DB
+	dsn      string
+	handlers *clusterHandlers
+}
+
+func newPostgresClusterState(ctx context.Context, db *gorm.DB, dsn string) *postgresClusterState {
+	s := &postgresClusterState{
+		db:       db,
+		dsn:      dsn,
+		handlers: newClusterHandlers(),
+	}
+	go s.listen(ctx)
+	go s.cleanup(ctx)
+
+	return s
+}
+
+func (s *postgresClusterState) CacheGet(bucket, key string) ([]byte, time.Time, bool) {
+	entry := ClusterCacheEntry{}
+	err := s.db.
+		Where("bucket = ? AND key = ?", bucket, key).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Take(&entry).Error
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Error().Err(err).Str("bucket", bucket).Msg("Cannot read cluster cache")
+		}
+
+		return nil, time.Time{}, false
+	}
+	if entry.ExpiresAt == nil {
+		return entry.Value, time.Time{}, true
+	}
+
+	return entry.Value, *entry.ExpiresAt, true
+}
+
+func (s *postgresClusterState) CacheSet(bucket, key string, value []byte, ttl time.Duration) error {
+	entry := ClusterCacheEntry{
+		Bucket: bucket,
+		Key:    key,
+		Value:  value,
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		entry.ExpiresAt = &expiresAt
+	}
+
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "bucket"}, {Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "expires_at"}),
+	}).Create(&entry).Error
+}
+
+func (s *postgresClusterState) CacheDelete(bucket, key string) error {
+	return s.db.Where("bucket = ? AND key = ?", bucket, key).Delete(&ClusterCacheEntry{}).Error
+}
+
+func (s *postgresClusterState) StoreStateChange(at time.Time, userStableIDs ...string) error {
+	if len(userStableIDs) == 0 {
+		return nil
+	}
+	changes := make([]ClusterStateChange, len(userStableIDs))
+	for i, id := range userStableIDs {
+		changes[i] = ClusterStateChange{
+			UserStableID: id,
+			ChangedAt:    at,
+		}
+	}
+
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_stable_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"changed_at"}),
+	}).Create(&changes).Error
+}
+
+func (s *postgresClusterState) LoadStateChange(userStableIDs ...string) (time.Time, bool) {
+	tx := s.db.Model(&ClusterStateChange{}).Select("MAX(changed_at)")
+	if len(userStableIDs) > 0 {
+		tx = tx.Where("user_stable_id IN ?", userStableIDs)
+	}
+	var latest sql.NullTime
+	if err := tx.Row().Scan(&latest); err != nil {
+		log.Error().Err(err).Msg("Cannot read last state change")
+
+		return time.Time{}, false
+	}
+
+	return latest.Time, latest.Valid
+}
+
+func (s *postgresClusterState) Publish(topic, payload string) error {
+	return s.db.Exec("SELECT pg_notify(?, ?)", clusterNotifyChannel, topic+"\n"+payload).Error
+}
+
+func (s *postgresClusterState) Subscribe(topic string, handler func(payload string)) {
+	s.handlers.add(topic, handler)
+}
+
+// listen 保持一个独立连接监听副本间消息，连接中断后按退避重连
+// 重连成功后向本副本补发一次全部组织的状态变化，避免断线期间遗漏的变化无法推送
+func (s *postgresClusterState) listen(ctx context.Context) {
+	retry := clusterListenRetryMin
+	reconnected := false
+	for {
+		err := s.listenOnce(ctx, reconnected)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Error().Err(err).Dur("retry", retry).Msg("Cluster notification listener disconnected")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry *= 2
+		if retry > clusterListenRetryMax {
+			retry = clusterListenRetryMax
+		}
+		reconnected = true
+	}
+}
+
+func (s *postgresClusterState) listenOnce(ctx context.Context, reconnected bool) error {
+	conn, err := pgx.Connect(ctx, s.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err = conn.Exec(ctx, "LISTEN "+clusterNotifyChannel); err != nil {
+		return err
+	}
+	log.Info().Str("channel", clusterNotifyChannel).Msg("Listening for cluster notifications")
+	if reconnected {
+		s.handlers.dispatch(clusterTopicStateChange, clusterAllOrgs)
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		topic, payload, ok := strings.Cut(notification.Payload, "\n")
+		if !ok {
+			continue
+		}
+		s.handlers.dispatch(topic, payload)
+	}
+}
+
+// cleanup 定期删除已过期的缓存项
+func (s *postgresClusterState) cleanup(ctx context.Context) {
+	ticker := time.NewTicker(clusterCacheCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.db.Where("expires_at IS NOT NULL AND expires_at <= ?", time.Now()).
+				Delete(&ClusterCacheEntry{}).Error
+			if err != nil {
+				log.Error().Err(err).Msg("Cannot clean up expired cluster cache entries")
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// roundTrip 经由进程内集群状态写入并读回缓存项，与共享存储一样经过JSON编码
+func roundTrip[T any](t *testing.T, bucket string, value T) T {
+	t.Helper()
+	cache := newClusterCache[T](newMemoryClusterState(), bucket)
+	cache.Set("key", value, time.Minute)
+	got, ok := cache.Get("key")
+	if !ok {
+		t.Fatalf("%s: cached value not found", bucket)
+	}
+
+	return got
+}
+
+func TestClusterCacheACacheItem(t *testing.T) {
+	machineKey := key.NewMachine().Public()
+	nodeKey := key.NewNode().Public()
+	item := ACacheItem{
+		stateCode: "state-code",
+		mKey:      machineKey,
+		regReq: tailcfg.RegisterRequest{
+			NodeKey:  nodeKey,
+			Hostinfo: &tailcfg.Hostinfo{Hostname: "laptop"},
+		},
+		uid: -1,
+	}
+
+	got := roundTrip(t, cacheBucketACode, item)
+	if got.stateCode != item.stateCode || got.mKey != item.mKey || got.uid != item.uid {
+		t.Errorf("ACacheItem round trip = %+v, want %+v", got, item)
+	}
+	if got.regReq.NodeKey != nodeKey || got.regReq.Hostinfo == nil || got.regReq.Hostinfo.Hostname != "laptop" {
+		t.Errorf("ACacheItem register request round trip = %+v", got.regReq)
+	}
+}
+
+func TestClusterCacheStateCacheItem(t *testing.T) {
+	item := StateCacheItem{
+		nextURL:     "/admin/machines",
+		provider:    "github",
+		uid:         42,
+		userName:    "alice",
+		userDisName: "Alice",
+		machineKey:  key.NewMachine().Public(),
+	}
+
+	if got := roundTrip(t, cacheBucketStateCode, item); got != item {
+		t.Errorf("StateCacheItem round trip = %+v, want %+v", got, item)
+	}
+}
+
+func TestClusterCacheControlCacheItem(t *testing.T) {
+	item := ControlCacheItem{uid: 42}
+
+	if got := roundTrip(t, cacheBucketControlCode, item); got != item {
+		t.Errorf("ControlCacheItem round trip = %+v, want %+v", got, item)
+	}
+}
+
+func TestClusterCacheMachineControlCodeCacheItem(t *testing.T) {
+	item := MachineControlCodeCacheItem{controlCodes: []string{"code-1", "code-2"}}
+
+	if got := roundTrip(t, cacheBucketMachineControl, item); !reflect.DeepEqual(got, item) {
+		t.Errorf("MachineControlCodeCacheItem round trip = %+v, want %+v", got, item)
+	}
+}
+
+func TestClusterCacheUserReg(t *testing.T) {
+	item := UserReg{Fp: "fp", ReqIP: "203.0.113.7", Name: "alice", SMSCode: "123456"}
+
+	if got := roundTrip(t, cacheBucketSMSCode, item); got != item {
+		t.Errorf("UserReg round trip = %+v, want %+v", got, item)
+	}
+}
+
+func TestClusterCacheOAuthTokenItem(t *testing.T) {
+	item := OAuthTokenItem{
+		ClientID:       "client",
+		OrganizationID: 7,
+		Scopes:         []string{OAuthScopeDevicesRead},
+		Tags:           []string{"tag:ci"},
+	}
+
+	if got := roundTrip(t, cacheBucketOAuthToken, item); !reflect.DeepEqual(got, item) {
+		t.Errorf("OAuthTokenItem round trip = %+v, want %+v", got, item)
+	}
+	if got := roundTrip(t, cacheBucketOAuthRevoked, true); !got {
+		t.Error("OAuth revocation marker round trip = false, want true")
+	}
+}
+
+func TestClusterCacheTCD(t *testing.T) {
+	if got := roundTrip(t, cacheBucketTCD, "example.ts.net"); got != "example.ts.net" {
+		t.Errorf("TCD round trip = %q", got)
+	}
+	offers := []TCDOffer{{TCD: "example.ts.net", Token: "token"}}
+	if got := roundTrip(t, cacheBucketTCDOffers, offers); !reflect.DeepEqual(got, offers) {
+		t.Errorf("TCD offers round trip = %+v, want %+v", got, offers)
+	}
+}
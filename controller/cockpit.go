@@ -185,6 +185,8 @@ func (c *Cockpit) createRouter() *mux.Router {
 
 	cockpit_router.PathPrefix("").Handler(http.StripPrefix("/cockpit", http.FileServer(http.FS(cockpitDir))))
 
+	router.Handle("/metrics", metricsHandler()).Methods(http.MethodGet)
+
 	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		c.ErrMessage(w, r, 404, "你迷失在蜃境中了吗？这里什么都没有")
 	})
@@ -251,6 +253,7 @@ func (c *Cockpit) RevokeAdmin(
 		return
 	}
 	c.superAdmin = nil
+	c.recordAudit(c.newAuditEvent(r, 0, "system.revoke_admin", "sysadmin", ""))
 	c.doAPIResponse(w, "", "ok")
 }
 
@@ -340,6 +343,7 @@ func (c *Cockpit) RegisterAdmin(
 			c.doAPIResponse(w, "保存超管凭证失败", nil)
 			return
 		}
+		c.recordAudit(c.newAuditEvent(r, 0, "system.register_admin", "sysadmin", ""))
 		c.doAPIResponse(w, "", "ok")
 		return
 	} else { // 注册请求
@@ -477,6 +481,7 @@ func (c *Cockpit) DoServiceStart(
 			Msg:    "start",
 			SysCfg: cfg,
 		}
+		c.recordAudit(c.newAuditEvent(r, 0, "system.service_start", "service", ""))
 		c.doAPIResponse(w, "", true)
 		return
 	}
@@ -496,6 +501,7 @@ func (c *Cockpit) DoServiceStop(
 	c.CtrlChn <- CtrlMsg{
 		Msg: "stop",
 	}
+	c.recordAudit(c.newAuditEvent(r, 0, "system.service_stop", "service", ""))
 	c.doAPIResponse(w, "", false)
 }
 
@@ -552,6 +558,10 @@ func (c *Cockpit) SetSettingGeneral(
 		c.doAPIResponse(w, "用户请求state解析失败", nil)
 		return
 	}
+	var auditBefore GeneralCfg
+	if sysCfg := c.GetSysCfg(); sysCfg != nil {
+		auditBefore = sysCfg.toGeneralCfg()
+	}
 	switch reqState {
 	case "set-mipv4":
 		mipv4, ok := reqData["mipv4"].(string)
@@ -717,6 +727,33 @@ func (c *Cockpit) SetSettingGeneral(
 			c.doAPIResponse(w, "更新系统配置失败", nil)
 			return
 		}
+	case "set-log-sinks":
+		sinksData, err := json.Marshal(reqData["LogSinks"])
+		if err != nil {
+			c.doAPIResponse(w, "用户请求LogSinks解析失败", nil)
+			return
+		}
+		logSinks := LogSinkConfigs{}
+		if err = json.Unmarshal(sinksData, &logSinks); err != nil {
+			c.doAPIResponse(w, "用户请求LogSinks解析失败", nil)
+			return
+		}
+		for i := range logSinks {
+			if err = logSinks[i].Validate(); err != nil {
+				c.doAPIResponse(w, "日志目标"+logSinks[i].DisplayName()+"配置错误:"+err.Error(), nil)
+				return
+			}
+		}
+		sysCfg := c.GetSysCfg()
+		if sysCfg == nil {
+			c.doAPIResponse(w, "获取系统配置失败", nil)
+			return
+		}
+		sysCfg.LogSinks = logSinks
+		if err := c.db.Save(sysCfg).Error; err != nil {
+			c.doAPIResponse(w, "更新系统配置失败", nil)
+			return
+		}
 	case "set-wxscanurl":
 		wxScanURL, ok := reqData["WXScanURL"].(string)
 		if !ok {
@@ -745,6 +782,7 @@ func (c *Cockpit) SetSettingGeneral(
 			Sign:     smsCfgInt["sign"].(string),
 			Template: smsCfgInt["template"].(string),
 		}
+		smsCfg.ExpiryTemplate, _ = smsCfgInt["expiry_template"].(string)
 		sysCfg := c.GetSysCfg()
 		if sysCfg == nil {
 			c.doAPIResponse(w, "获取系统配置失败", nil)
@@ -755,6 +793,31 @@ func (c *Cockpit) SetSettingGeneral(
 			c.doAPIResponse(w, "更新系统配置失败", nil)
 			return
 		}
+	case "set-smtp":
+		smtpData, err := json.Marshal(reqData["SMTP"])
+		if err != nil {
+			c.doAPIResponse(w, "用户请求SMTP解析失败", nil)
+			return
+		}
+		smtpCfg := SMTPConfig{}
+		if err = json.Unmarshal(smtpData, &smtpCfg); err != nil {
+			c.doAPIResponse(w, "用户请求SMTP解析失败", nil)
+			return
+		}
+		if err = smtpCfg.Validate(); err != nil {
+			c.doAPIResponse(w, "SMTP配置错误:"+err.Error(), nil)
+			return
+		}
+		sysCfg := c.GetSysCfg()
+		if sysCfg == nil {
+			c.doAPIResponse(w, "获取系统配置失败", nil)
+			return
+		}
+		sysCfg.SMTPConfig = smtpCfg
+		if err := c.db.Save(sysCfg).Error; err != nil {
+			c.doAPIResponse(w, "更新系统配置失败", nil)
+			return
+		}
 	case "set-idaas":
 		idaasCfgInt, ok := reqData["IDaaS"].(map[string]interface{})
 		if !ok {
@@ -865,6 +928,12 @@ func (c *Cockpit) SetSettingGeneral(
 		c.doAPIResponse(w, "用户请求state不存在", nil)
 		return
 	}
+	if sysCfg := c.GetSysCfg(); sysCfg != nil {
+		before, after := auditConfigChange(auditBefore, sysCfg.toGeneralCfg())
+		c.recordAudit(c.newAuditEvent(r, 0, "system.update_setting", "setting", reqState).
+			SetBefore(before).
+			SetAfter(after))
+	}
 
 	if c.serviceState {
 		newCfg, err := c.GetSysCfg().toSrvConfig()
@@ -100,6 +100,8 @@ func (c *Cockpit) CAPIAddDERP(
 			c.doAPIResponse(w, "新建司南档案失败", nil)
 			return
 		}
+		c.recordAudit(c.newAuditEvent(r, 0, "navi.create", "navi", naviNode.ID).
+			SetAfter(naviNodeAuditState(naviNode)))
 		c.CAPIQueryDERP(w, r)
 		return
 	}
@@ -195,6 +197,8 @@ func (c *Cockpit) CAPIAddDERP(
 		c.doAPIResponse(w, "新建司南档案失败", nil)
 		return
 	}
+	c.recordAudit(c.newAuditEvent(r, 0, "navi.create", "navi", naviNode.ID).
+		SetAfter(naviNodeAuditState(naviNode)))
 
 	//TODO: 司南建档成功后在目标机执行部署启动
 	// 停止服务
@@ -375,8 +379,13 @@ func (c *Cockpit) CAPIDelNaviNode(
 		c.doAPIResponse(w, "数据库删除司南节点失败:"+err.Error(), nil)
 		return
 	}
-	delete(c.App.DERPNCs, naviID)
-	delete(c.App.DERPseqnum, naviID)
+	c.recordAudit(c.newAuditEvent(r, 0, "navi.delete", "navi", naviID).
+		SetBefore(naviNodeAuditState(naviNode)))
+	c.App.DERPNCs.Delete(naviID)
+	if err := deleteNaviSync(c.db, naviID); err != nil {
+		log.Error().Caller().Err(err).Msg("Failed to delete Navi sync state")
+	}
+	naviMetrics.forget(naviID)
 	//	c.App.LoadDERPMapFromURL(c.App.cfg.DERPURL)
 
 	c.CtrlChn <- CtrlMsg{
@@ -134,6 +134,13 @@ func (c *Cockpit) CAPIPublishClient(
 		c.doAPIResponse(w, "更新客户端信息失败", nil)
 		return
 	}
+	auditAfter := map[string]string{"version": reqData.Version, "url": reqData.Url}
+	if osType == "linux" {
+		// Linux的version字段为软件源凭证
+		delete(auditAfter, "version")
+	}
+	c.recordAudit(c.newAuditEvent(r, 0, "system.publish_client", "client", osType).
+		SetAfter(auditAfter))
 
 	if osType == "linux" {
 		go c.BuildLinuxClient()
@@ -347,9 +347,12 @@ func (c *Cockpit) CAPIPostTenants(
 			c.doAPIResponse(w, "目标租户删除失败:"+err.Error(), nil)
 			return
 		}
+		c.recordAudit(c.newAuditEvent(r, targetTenant.ID, "tenant.delete", "organization", targetTenant.StableID).
+			SetBefore(tenantAuditState(targetTenant, "")))
 		c.doAPIResponse(w, "", nil)
 		return
 	case "update_tenant":
+		auditBefore := tenantAuditState(targetTenant, "")
 		// 更新租户配置
 		if reqData.NewValue.MagicDomain != "" {
 			targetTenant.MagicDnsDomain = reqData.NewValue.MagicDomain
@@ -379,16 +382,23 @@ func (c *Cockpit) CAPIPostTenants(
 		}
 		for _, user := range users {
 			if user.Role == RoleOwner {
+				auditBefore["owner"] = user.Name
 				if user.ID != newOwner.ID {
 					err = c.TransferOwner(user.ID, newOwner.ID)
 					if err != nil {
 						c.doAPIResponse(w, "目标租户更新失败:更改Owner失败", nil)
 						return
 					}
+					c.recordAudit(c.newAuditEvent(r, targetTenant.ID, "user.transfer_owner", "user", strconv.FormatInt(newOwner.ID, 10)).
+						SetBefore(map[string]int64{"owner": user.ID}).
+						SetAfter(map[string]int64{"owner": newOwner.ID}))
 				}
 				break
 			}
 		}
+		c.recordAudit(c.newAuditEvent(r, targetTenant.ID, "tenant.update", "organization", targetTenant.StableID).
+			SetBefore(auditBefore).
+			SetAfter(tenantAuditState(targetTenant, newOwner.Name)))
 		c.doAPIResponse(w, "", nil)
 		return
 	}
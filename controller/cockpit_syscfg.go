@@ -24,12 +24,14 @@ type SysConfig struct {
 	//	DerpUrl               string   `gorm:"default:'https://controlplane.tailscale.com/derpmap/default'"`
 	RouteAccessDueMachine bool `gorm:"default:false"`
 
-	EsUrl string
-	EsKey string
+	EsUrl    string
+	EsKey    string
+	LogSinks LogSinkConfigs
 
 	WXScanURL string
 
-	SMSConfig SMSConfig
+	SMSConfig  SMSConfig
+	SMTPConfig SMTPConfig
 
 	IdaasConfig ALIConfig
 
@@ -58,13 +60,15 @@ type GeneralCfg struct {
 	//		DERPURL               string `json:"derp_url"`
 	RouteAccessDueMachine bool `json:"route_access_due_machine"`
 
-	ESURL string `json:"es_url"`
-	ESKey string `json:"es_key"`
+	ESURL    string          `json:"es_url"`
+	ESKey    string          `json:"es_key"`
+	LogSinks []LogSinkConfig `json:"log_sinks"`
 
 	WXScanURL string `json:"wxscan_url"`
 
-	SMSConfig   SMSConfig `json:"sms"`
-	IDaaSConfig ALIConfig `json:"idaas"`
+	SMSConfig   SMSConfig  `json:"sms"`
+	SMTPConfig  SMTPConfig `json:"smtp"`
+	IDaaSConfig ALIConfig  `json:"idaas"`
 
 	MicrosoftCfg MicrosoftCfg `json:"microsoft"`
 	GithubCfg    GithubCfg    `json:"github"`
@@ -85,12 +89,14 @@ func (s *SysConfig) toGeneralCfg() GeneralCfg {
 		//		DERPURL:               s.DerpUrl,
 		RouteAccessDueMachine: s.RouteAccessDueMachine,
 
-		ESURL: s.EsUrl,
-		ESKey: s.EsKey,
+		ESURL:    s.EsUrl,
+		ESKey:    s.EsKey,
+		LogSinks: s.LogSinks,
 
 		WXScanURL: s.WXScanURL,
 
 		SMSConfig:    s.SMSConfig,
+		SMTPConfig:   s.SMTPConfig,
 		IDaaSConfig:  s.IdaasConfig,
 		MicrosoftCfg: s.MicrosoftCfg,
 		GithubCfg:    s.GithubCfg,
@@ -139,12 +145,14 @@ func (s *SysConfig) toSrvConfig() (*Config, error) {
 		//		DERPURL:                s.DerpUrl,
 		AllowRouteDueToMachine: s.RouteAccessDueMachine,
 
-		ESURL: s.EsUrl,
-		ESKey: s.EsKey,
+		ESURL:    s.EsUrl,
+		ESKey:    s.EsKey,
+		LogSinks: s.LogSinks,
 
 		wxScanURL: s.WXScanURL,
 
 		SMS:       s.SMSConfig,
+		SMTP:      s.SMTPConfig,
 		IDaaS:     s.IdaasConfig,
 		OIDC:      OidcConfig,
 		DexConfig: dexCfg,
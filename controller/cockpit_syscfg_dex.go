@@ -11,16 +11,10 @@ import (
 	"github.com/dexidp/dex/connector/microsoft"
 	"github.com/dexidp/dex/server"
 	dexStorage "github.com/dexidp/dex/storage"
-	dexSQL "github.com/dexidp/dex/storage/sql"
 )
 
 func (s *SysConfig) toDexConfig() (*server.Config, error) {
-	storageCfg := DexStorage{
-		Type: "sqlite3", //DexDBType,
-		Config: &dexSQL.SQLite3{
-			File: AbsolutePathFromConfigPath(DatabasePath), //DexDBPath),
-		},
-	}
+	storageCfg := LoadDBConfig().DexStorage()
 	msConnCfg := &microsoft.Config{
 		ClientID:     s.MicrosoftCfg.ClientID,
 		ClientSecret: s.MicrosoftCfg.ClientSecret,
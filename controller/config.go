@@ -29,8 +29,9 @@ type Config struct {
 
 	//	DERPURL string //DONE
 
-	ESURL string
-	ESKey string
+	ESURL    string
+	ESKey    string
+	LogSinks []LogSinkConfig
 
 	OIDC OIDCConfig
 
@@ -38,6 +39,7 @@ type Config struct {
 
 	IDaaS ALIConfig
 	SMS   SMSConfig
+	SMTP  SMTPConfig
 
 	DexConfig *server.Config
 	IdpList   []string
@@ -50,6 +52,8 @@ type SMSConfig struct {
 	Key      string `json:"key"`
 	Sign     string `json:"sign"`
 	Template string `json:"template"`
+	// 设备密钥即将过期提醒的短信模板，模板参数为machine、days
+	ExpiryTemplate string `json:"expiry_template"`
 }
 
 func (ac *SMSConfig) Scan(value interface{}) error {
@@ -68,6 +72,32 @@ func (ac SMSConfig) Value() (driver.Value, error) {
 	return string(bytes), err
 }
 
+// SMTPConfig 发送通知邮件使用的SMTP服务器
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"key"`
+	From     string `json:"from"`
+	TLS      bool   `json:"tls"` // 为true时直接建立TLS连接（通常为465端口），否则在服务器支持时使用STARTTLS
+}
+
+func (ac *SMTPConfig) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, ac)
+	case string:
+		return json.Unmarshal([]byte(v), ac)
+	default:
+		return fmt.Errorf("cannot parse SMTP Config: unexpected data type %T", value)
+	}
+}
+
+func (ac SMTPConfig) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(ac)
+	return string(bytes), err
+}
+
 type ALIConfig struct {
 	App       string `json:"app"`
 	ClientID  string `json:"id"`
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"tailscale.com/tailcfg"
 	"tailscale.com/version"
 )
 
@@ -51,6 +52,20 @@ func (h *Mirage) verifyTokenIDandGetUser(
 	writer http.ResponseWriter,
 	req *http.Request,
 ) (*User, error) {
+	if apiKey := apiKeyFromRequest(req); apiKey != nil {
+		user, err := h.GetUserByID(tailcfg.UserID(apiKey.UserID))
+		if err != nil {
+			return nil, fmt.Errorf("提取用户信息失败")
+		}
+		return user, nil
+	}
+	if token := oauthTokenFromRequest(req); token != nil {
+		user, err := h.getOrgOwner(token.OrganizationID)
+		if err != nil {
+			return nil, fmt.Errorf("提取组织管理员信息失败")
+		}
+		return user, nil
+	}
 	controlCodeCookie, err := req.Cookie("miragecontrol")
 	if err == http.ErrNoCookie {
 		return nil, fmt.Errorf("Token不存在")
@@ -60,7 +75,7 @@ func (h *Mirage) verifyTokenIDandGetUser(
 	if !ok || concontrolCodeExpiration.Compare(time.Now()) != 1 {
 		return nil, fmt.Errorf("验证Token失败")
 	}
-	controlCodeItem := controlCodeC.(ControlCacheItem)
+	controlCodeItem := controlCodeC
 	user, err := h.GetUserByID(controlCodeItem.uid)
 	if err != nil {
 		return nil, fmt.Errorf("提取用户信息失败")
@@ -0,0 +1,541 @@
+package controller
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type ACLPolicyData struct {
+	Policy  string `json:"policy"`  //HuJSON格式的策略原文
+	Version string `json:"version"` //策略版本号，同ETag
+}
+
+// 请求报文：{"policy":"{ // HuJSON ... }","version":"<GET时返回的version>"}
+// 版本号亦可通过If-Match请求头传递
+type ACLPolicyREQ struct {
+	Policy  string `json:"policy"`
+	Version string `json:"version"`
+}
+
+type ACLPolicyCheckRes struct {
+	Errors []ACLPolicyError `json:"errors"`
+	Tests  []ACLTestResult  `json:"tests"` //tests断言逐条结果，expected与actual不一致即为失败
+}
+
+func (res *ACLPolicyCheckRes) failed() bool {
+	if len(res.Errors) > 0 {
+		return true
+	}
+	for _, result := range res.Tests {
+		if !result.Passed() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 接受/admin/api/acls的Get请求，用于查询组织ACL策略
+func (h *Mirage) CAPIGetACLPolicy(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	org, err := h.GetOrgnaizationByID(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "用户组织信息获取失败", nil)
+		return
+	}
+	policyText, err := org.GetACLPolicyText()
+	if err != nil {
+		h.doAPIResponse(w, "ACL策略读取失败:"+err.Error(), nil)
+		return
+	}
+	version := aclPolicyVersion(policyText)
+	w.Header().Set("ETag", `"`+version+`"`)
+	h.doAPIResponse(w, "", ACLPolicyData{
+		Policy:  string(policyText),
+		Version: version,
+	})
+}
+
+// 接受/admin/api/acls/validate的Post请求，仅校验ACL策略不保存
+func (h *Mirage) CAPIValidateACLPolicy(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	reqData := ACLPolicyREQ{}
+	err = json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil {
+		h.doAPIResponse(w, "用户请求解析失败:"+err.Error(), nil)
+		return
+	}
+	org, err := h.GetOrgnaizationByID(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "用户组织信息获取失败", nil)
+		return
+	}
+	_, checkRes := h.checkACLPolicyOfOrg(org, user, []byte(reqData.Policy))
+	if checkRes.failed() {
+		h.doAPIErrorResponse(w, "ACL策略校验失败", checkRes)
+		return
+	}
+	h.doAPIResponse(w, "", checkRes)
+}
+
+// 接受/admin/api/acls的Post请求，用于保存组织ACL策略
+func (h *Mirage) CAPIPostACLPolicy(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	reqData := ACLPolicyREQ{}
+	err = json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil {
+		h.doAPIResponse(w, "用户请求解析失败:"+err.Error(), nil)
+		return
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		reqData.Version = strings.Trim(ifMatch, `"`)
+	}
+	if reqData.Version == "" {
+		h.doAPIResponse(w, "缺少ACL策略版本号", nil)
+		return
+	}
+	org, err := h.GetOrgnaizationByID(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "用户组织信息获取失败", nil)
+		return
+	}
+
+	policy, checkRes := h.checkACLPolicyOfOrg(org, user, []byte(reqData.Policy))
+	if checkRes.failed() {
+		h.doAPIErrorResponse(w, "ACL策略校验失败", checkRes)
+		return
+	}
+
+	err = h.UpdateACLPolicyTextOfOrg(org, user, policy, reqData.Policy, reqData.Version, ACLPolicyRevisionSave, 0)
+	if err != nil {
+		if errors.Is(err, ErrACLPolicyVersionMismatch) {
+			h.doAPIResponse(w, "ACL策略已被他人修改，请刷新后重试", nil)
+			return
+		}
+		h.doAPIResponse(w, "保存ACL策略失败:"+err.Error(), nil)
+		return
+	}
+	_, err = h.UpdateACLRulesOfOrg(org, user)
+	if err != nil {
+		h.doAPIResponse(w, "更新ACL规则失败:"+err.Error(), nil)
+		return
+	}
+	h.setOrgLastStateChangeToNow(org.ID)
+
+	version := aclPolicyVersion([]byte(reqData.Policy))
+	// 策略全文由ACL历史版本保存，审计日志只记录版本号
+	h.recordAudit(h.newAuditEvent(r, user, "acl.update", "organization", org.StableID).
+		SetBefore(map[string]string{"version": reqData.Version}).
+		SetAfter(map[string]string{"version": version}))
+	w.Header().Set("ETag", `"`+version+`"`)
+	h.doAPIResponse(w, "", ACLPolicyData{
+		Policy:  reqData.Policy,
+		Version: version,
+	})
+}
+
+// checkACLPolicyOfOrg 解析并试运行策略，同时执行策略中的tests断言
+func (h *Mirage) checkACLPolicyOfOrg(
+	org *Organization,
+	user *User,
+	policyText []byte,
+) (*ACLPolicy, *ACLPolicyCheckRes) {
+	checkRes := &ACLPolicyCheckRes{
+		Errors: []ACLPolicyError{},
+		Tests:  []ACLTestResult{},
+	}
+	policy, ast, policyErrs := ParseACLPolicyHuJSON(policyText)
+	if len(policyErrs) > 0 {
+		checkRes.Errors = policyErrs
+		return nil, checkRes
+	}
+	policyErrs, testResults := h.dryRunACLPolicyOfOrg(org, user, policy, ast, policyText)
+	if len(policyErrs) > 0 {
+		checkRes.Errors = policyErrs
+		return nil, checkRes
+	}
+	if testResults != nil {
+		checkRes.Tests = testResults
+	}
+
+	return policy, checkRes
+}
+
+// testACLPolicyOfOrg 对结构化接口（如标签管理）修改后、尚未保存的组织策略执行tests断言
+// 策略编译错误同样计为失败，返回nil表示全部通过
+func (h *Mirage) testACLPolicyOfOrg(org *Organization, user *User) *ACLPolicyCheckRes {
+	policyErrs, testResults := h.dryRunACLPolicyOfOrg(org, user, org.AclPolicy, nil, nil)
+	checkRes := &ACLPolicyCheckRes{
+		Errors: []ACLPolicyError{},
+		Tests:  []ACLTestResult{},
+	}
+	if len(policyErrs) > 0 {
+		checkRes.Errors = policyErrs
+	}
+	if testResults != nil {
+		checkRes.Tests = testResults
+	}
+	if !checkRes.failed() {
+		return nil
+	}
+
+	return checkRes
+}
+
+type ACLPolicyRevisionItem struct {
+	Id           uint64 `json:"id"`
+	Created      string `json:"created"`
+	Creator      string `json:"creator"`
+	Action       string `json:"action"` //"initial","save","tags","rollback"
+	RollbackFrom uint64 `json:"rollbackFrom,omitempty"`
+	Version      string `json:"version"`
+	Policy       string `json:"policy,omitempty"`
+}
+
+func convACLPolicyRevision(revision ACLPolicyRevision) ACLPolicyRevisionItem {
+	return ACLPolicyRevisionItem{
+		Id:           revision.ID,
+		Created:      Time2SHString(revision.CreatedAt),
+		Creator:      revision.UserName,
+		Action:       revision.Action,
+		RollbackFrom: revision.RollbackFrom,
+		Version:      revision.Version,
+		Policy:       revision.PolicyText,
+	}
+}
+
+// 接受/admin/api/acls/revisions的Get请求，用于查询ACL策略历史版本列表
+func (h *Mirage) CAPIGetACLPolicyRevisions(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	revisions, err := h.ListACLPolicyRevisions(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "查询ACL策略历史失败", nil)
+		return
+	}
+	resData := make([]ACLPolicyRevisionItem, 0, len(revisions))
+	for _, revision := range revisions {
+		resData = append(resData, convACLPolicyRevision(revision))
+	}
+	h.doAPIResponse(w, "", resData)
+}
+
+// 接受/admin/api/acls/revisions/{id}的Get请求，用于查询某一历史版本的策略原文
+func (h *Mirage) CAPIGetACLPolicyRevision(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	revisionID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		h.doAPIResponse(w, "历史版本ID解析失败", nil)
+		return
+	}
+	revision, err := h.GetACLPolicyRevision(user.OrganizationID, revisionID)
+	if err != nil {
+		h.doAPIResponse(w, "该历史版本不存在", nil)
+		return
+	}
+	h.doAPIResponse(w, "", convACLPolicyRevision(*revision))
+}
+
+type ACLPolicyDiffData struct {
+	From  uint64              `json:"from"`
+	To    uint64              `json:"to"`
+	Lines []ACLPolicyDiffLine `json:"lines"`
+}
+
+// 接受/admin/api/acls/diff?from={id}&to={id}的Get请求，用于比较两个版本的策略
+// id为0或缺省时表示当前生效的策略
+func (h *Mirage) CAPIGetACLPolicyDiff(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	org, err := h.GetOrgnaizationByID(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "用户组织信息获取失败", nil)
+		return
+	}
+	loadText := func(idStr string) (uint64, string, error) {
+		if idStr == "" || idStr == "0" {
+			policyText, err := org.GetACLPolicyText()
+			return 0, string(policyText), err
+		}
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			return 0, "", err
+		}
+		revision, err := h.GetACLPolicyRevision(org.ID, id)
+		if err != nil {
+			return 0, "", err
+		}
+		return id, revision.PolicyText, nil
+	}
+	fromID, fromText, err := loadText(r.URL.Query().Get("from"))
+	if err != nil {
+		h.doAPIResponse(w, "读取起始版本失败:"+err.Error(), nil)
+		return
+	}
+	toID, toText, err := loadText(r.URL.Query().Get("to"))
+	if err != nil {
+		h.doAPIResponse(w, "读取目标版本失败:"+err.Error(), nil)
+		return
+	}
+	h.doAPIResponse(w, "", ACLPolicyDiffData{
+		From:  fromID,
+		To:    toID,
+		Lines: diffACLPolicyText(fromText, toText),
+	})
+}
+
+// 请求报文：{"id":<历史版本ID>,"version":"<当前策略版本号>"}
+type ACLPolicyRollbackREQ struct {
+	ID      uint64 `json:"id"`
+	Version string `json:"version"`
+}
+
+// 接受/admin/api/acls/rollback的Post请求，用于将ACL策略回滚至某一历史版本
+func (h *Mirage) CAPIRollbackACLPolicy(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	reqData := ACLPolicyRollbackREQ{}
+	err = json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil {
+		h.doAPIResponse(w, "用户请求解析失败:"+err.Error(), nil)
+		return
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		reqData.Version = strings.Trim(ifMatch, `"`)
+	}
+	if reqData.Version == "" {
+		h.doAPIResponse(w, "缺少ACL策略版本号", nil)
+		return
+	}
+	org, err := h.GetOrgnaizationByID(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "用户组织信息获取失败", nil)
+		return
+	}
+	revision, err := h.GetACLPolicyRevision(org.ID, reqData.ID)
+	if err != nil {
+		h.doAPIResponse(w, "该历史版本不存在", nil)
+		return
+	}
+
+	// 历史策略所引用的用户、标签等可能已不存在，回滚前同样需要校验
+	policy, checkRes := h.checkACLPolicyOfOrg(org, user, []byte(revision.PolicyText))
+	if checkRes.failed() {
+		h.doAPIErrorResponse(w, "历史版本ACL策略校验失败", checkRes)
+		return
+	}
+	err = h.UpdateACLPolicyTextOfOrg(org, user, policy, revision.PolicyText, reqData.Version, ACLPolicyRevisionRollback, revision.ID)
+	if err != nil {
+		if errors.Is(err, ErrACLPolicyVersionMismatch) {
+			h.doAPIResponse(w, "ACL策略已被他人修改，请刷新后重试", nil)
+			return
+		}
+		h.doAPIResponse(w, "回滚ACL策略失败:"+err.Error(), nil)
+		return
+	}
+	_, err = h.UpdateACLRulesOfOrg(org, user)
+	if err != nil {
+		h.doAPIResponse(w, "更新ACL规则失败:"+err.Error(), nil)
+		return
+	}
+	h.setOrgLastStateChangeToNow(org.ID)
+
+	version := aclPolicyVersion([]byte(revision.PolicyText))
+	h.recordAudit(h.newAuditEvent(r, user, "acl.rollback", "organization", org.StableID).
+		SetBefore(map[string]string{"version": reqData.Version}).
+		SetAfter(map[string]interface{}{"version": version, "revision": revision.ID}))
+	w.Header().Set("ETag", `"`+version+`"`)
+	h.doAPIResponse(w, "", ACLPolicyData{
+		Policy:  revision.PolicyText,
+		Version: version,
+	})
+}
+
+type ACLAccessData struct {
+	Src     string           `json:"src"`
+	Dst     string           `json:"dst"`
+	Port    uint16           `json:"port"` //0表示不限端口
+	Allowed bool             `json:"allowed"`
+	Grants  []ACLAccessGrant `json:"grants"`
+}
+
+// 接受/admin/api/acls/access?src=&dst=&port=的Get请求，用于查询src能否访问dst(:port)
+// src/dst可以是设备ID、设备名或IP地址，dst为子网内IP时会沿启用的子网路由查找
+func (h *Mirage) CAPIGetACLAccess(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	org, err := h.GetOrgnaizationByID(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "用户组织信息获取失败", nil)
+		return
+	}
+	machines, err := h.ListMachinesByOrgID(org.ID)
+	if err != nil {
+		h.doAPIResponse(w, "查询组织设备失败", nil)
+		return
+	}
+	query := r.URL.Query()
+	resData := ACLAccessData{
+		Src:    query.Get("src"),
+		Dst:    query.Get("dst"),
+		Grants: []ACLAccessGrant{},
+	}
+	if portStr := query.Get("port"); portStr != "" {
+		port, err := strconv.ParseUint(portStr, Base10, BitSize16)
+		if err != nil {
+			h.doAPIResponse(w, "端口解析失败", nil)
+			return
+		}
+		resData.Port = uint16(port)
+	}
+
+	var srcAddrs []netip.Addr
+	if srcMachine := findOrgMachine(machines, resData.Src); srcMachine != nil {
+		srcAddrs = srcMachine.IPAddresses
+	} else if addr, err := netip.ParseAddr(resData.Src); err == nil {
+		srcAddrs = []netip.Addr{addr}
+	} else {
+		h.doAPIResponse(w, "未找到源设备", nil)
+		return
+	}
+
+	var targets []aclAccessTarget
+	ruleUser := user
+	if dstMachine := findOrgMachine(machines, resData.Dst); dstMachine != nil {
+		targets = h.machineAccessTargets(dstMachine, false)
+		ruleUser = &dstMachine.User
+	} else if addr, err := netip.ParseAddr(resData.Dst); err == nil {
+		targets = h.addrAccessTargets(machines, addr)
+	} else {
+		h.doAPIResponse(w, "未找到目标设备", nil)
+		return
+	}
+
+	entries, err := h.compileACLEntriesOfOrg(org, machines, ruleUser)
+	if err != nil {
+		h.doAPIResponse(w, "编译ACL规则失败:"+err.Error(), nil)
+		return
+	}
+	resData.Grants = explainACLAccess(entries, srcAddrs, targets, resData.Port)
+	resData.Allowed = len(resData.Grants) > 0
+	h.doAPIResponse(w, "", resData)
+}
+
+type ACLAccessPeer struct {
+	Id        string           `json:"id"`
+	Name      string           `json:"name"`
+	User      string           `json:"user"`
+	Addresses []string         `json:"addresses"`
+	Grants    []ACLAccessGrant `json:"grants"`
+}
+
+// 接受/admin/api/acls/access/peers?machine=的Get请求，用于查询哪些设备可以访问该设备（含其子网路由）及端口
+func (h *Mirage) CAPIGetACLAccessPeers(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	org, err := h.GetOrgnaizationByID(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "用户组织信息获取失败", nil)
+		return
+	}
+	machines, err := h.ListMachinesByOrgID(org.ID)
+	if err != nil {
+		h.doAPIResponse(w, "查询组织设备失败", nil)
+		return
+	}
+	target := findOrgMachine(machines, r.URL.Query().Get("machine"))
+	if target == nil {
+		h.doAPIResponse(w, "未找到目标设备", nil)
+		return
+	}
+	entries, err := h.compileACLEntriesOfOrg(org, machines, &target.User)
+	if err != nil {
+		h.doAPIResponse(w, "编译ACL规则失败:"+err.Error(), nil)
+		return
+	}
+	targets := h.machineAccessTargets(target, true)
+
+	resData := []ACLAccessPeer{}
+	for _, peer := range machines {
+		if peer.ID == target.ID {
+			continue
+		}
+		grants := explainACLAccess(entries, peer.IPAddresses, targets, 0)
+		if len(grants) == 0 {
+			continue
+		}
+		resData = append(resData, ACLAccessPeer{
+			Id:        strconv.FormatInt(peer.ID, 10),
+			Name:      peer.GivenName,
+			User:      peer.User.Name,
+			Addresses: peer.IPAddresses.ToStringSlice(),
+			Grants:    grants,
+		})
+	}
+	h.doAPIResponse(w, "", resData)
+}
@@ -0,0 +1,174 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	auditDefaultPageSize = 50
+	auditMaxPageSize     = 500
+)
+
+type AuditEventItem struct {
+	ID         uint64          `json:"id"`
+	Time       string          `json:"time"`
+	Timestamp  int64           `json:"timestamp"`
+	ActorType  string          `json:"actorType"`
+	ActorID    string          `json:"actorId"`
+	ActorName  string          `json:"actorName"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"targetType"`
+	TargetID   string          `json:"targetId"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	SourceIP   string          `json:"sourceIp"`
+}
+
+type AuditEventsData struct {
+	Total    int64            `json:"total"`
+	Page     int              `json:"page"`
+	PageSize int              `json:"pageSize"`
+	Events   []AuditEventItem `json:"events"`
+}
+
+func newAuditEventItem(event *AuditEvent) AuditEventItem {
+	item := AuditEventItem{
+		ID:         event.ID,
+		Time:       Time2SHString(event.CreatedAt),
+		Timestamp:  event.CreatedAt.Unix(),
+		ActorType:  event.ActorType,
+		ActorID:    event.ActorID,
+		ActorName:  event.ActorName,
+		Action:     event.Action,
+		TargetType: event.TargetType,
+		TargetID:   event.TargetID,
+		SourceIP:   event.SourceIP,
+	}
+	if event.Before != "" {
+		item.Before = json.RawMessage(event.Before)
+	}
+	if event.After != "" {
+		item.After = json.RawMessage(event.After)
+	}
+
+	return item
+}
+
+// parseAuditTime 接受RFC3339格式或Unix时间戳（秒）
+func parseAuditTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		t := time.Unix(sec, 0)
+		return &t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func parseAuditEventFilter(query url.Values) (AuditEventFilter, error) {
+	filter := AuditEventFilter{
+		Action:     query.Get("action"),
+		ActorID:    query.Get("actor"),
+		TargetType: query.Get("targetType"),
+		TargetID:   query.Get("target"),
+	}
+	var err error
+	if filter.Since, err = parseAuditTime(query.Get("since")); err != nil {
+		return filter, err
+	}
+	if filter.Until, err = parseAuditTime(query.Get("until")); err != nil {
+		return filter, err
+	}
+
+	return filter, nil
+}
+
+// 接受/admin/api/audit的Get请求，分页查询审计日志
+// 查询参数：action(以.结尾时按前缀匹配) actor targetType target since until page pageSize
+func (h *Mirage) CAPIGetAuditEvents(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	query := r.URL.Query()
+	filter, err := parseAuditEventFilter(query)
+	if err != nil {
+		h.doAPIResponse(w, "时间参数解析失败:"+err.Error(), nil)
+		return
+	}
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(query.Get("pageSize"))
+	if err != nil || pageSize < 1 {
+		pageSize = auditDefaultPageSize
+	}
+	if pageSize > auditMaxPageSize {
+		pageSize = auditMaxPageSize
+	}
+
+	events, total, err := h.ListAuditEvents(user.OrganizationID, filter, (page-1)*pageSize, pageSize)
+	if err != nil {
+		h.doAPIResponse(w, "查询审计日志失败", nil)
+		return
+	}
+	resData := AuditEventsData{
+		Total:    total,
+		Page:     page,
+		PageSize: pageSize,
+		Events:   make([]AuditEventItem, 0, len(events)),
+	}
+	for i := range events {
+		resData.Events = append(resData.Events, newAuditEventItem(&events[i]))
+	}
+	h.doAPIResponse(w, "", resData)
+}
+
+// 接受/admin/api/audit/export的Get请求，以JSON Lines格式导出审计日志，过滤参数同上
+func (h *Mirage) CAPIExportAuditEvents(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	filter, err := parseAuditEventFilter(r.URL.Query())
+	if err != nil {
+		h.doAPIResponse(w, "时间参数解析失败:"+err.Error(), nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"audit-"+time.Now().Format("20060102150405")+".jsonl\"")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	err = h.ExportAuditEvents(user.OrganizationID, filter, func(event *AuditEvent) error {
+		return encoder.Encode(newAuditEventItem(event))
+	})
+	if err != nil {
+		log.Error().
+			Caller().
+			Err(err).
+			Int64("org_id", user.OrganizationID).
+			Msg("Failed to export audit events")
+	}
+}
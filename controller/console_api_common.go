@@ -36,6 +36,21 @@ func (h *Mirage) doAPIResponse(writer http.ResponseWriter, msg string, data inte
 	} else {
 		res.Status = "error-" + msg
 	}
+	h.writeAPIResponse(writer, res)
+}
+
+// API调用失败且需要附带详细信息时的响应发报（例如ACL策略的逐行校验错误）
+// @msg 响应状态：拼接为error-{msg}
+// @data 错误详情：key值为data的json对象
+func (h *Mirage) doAPIErrorResponse(writer http.ResponseWriter, msg string, data interface{}) {
+	res := APIResponse{
+		Status: "error-" + msg,
+		Data:   data,
+	}
+	h.writeAPIResponse(writer, res)
+}
+
+func (h *Mirage) writeAPIResponse(writer http.ResponseWriter, res APIResponse) {
 	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
 	writer.WriteHeader(http.StatusOK)
 	err := json.NewEncoder(writer).Encode(&res)
@@ -3,9 +3,12 @@ package controller
 import (
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
 	"time"
+
+	"tailscale.com/tailcfg"
 )
 
 type DNSData struct {
@@ -17,6 +20,10 @@ type DNSData struct {
 	MagicDNS          bool                `json:"magicDNS"`          //是否启用幻域
 	HasNextDNS        bool                `json:"hasNextDNS"`        // TODO:未实现
 	MagicDNSDomains   []string            `json:"magicDNSDomains"`   //幻域域列表
+	ExtraRecords      DNSRecords          `json:"extraRecords"`      //幻域下的自定义记录
+	RouteFallbacks    map[string][]string `json:"routeFallbacks"`    //分离DNS各域名在routes之后依次尝试的域名服务器
+	SearchDomains     []string            `json:"searchDomains"`     //搜索域，与幻域无关
+	ResolverOptions   DNSResolverOptions  `json:"resolverOptions"`   //域名服务器附加选项(DoH/DoT引导地址、出口节点下使用)
 }
 
 // 接受/admin/api/dns的Get请求，用于查询DNS
@@ -29,43 +36,43 @@ func (h *Mirage) CAPIGetDNS(
 		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
 		return
 	}
-	userDNSCfg, userBaseDomain := user.GetDNSConfig(h.cfg.IPPrefixes)
+	h.doAPIResponse(w, "", h.getDNSData(user))
+}
+
+// getDNSData 将用户所在组织的DNS配置转换为控制台展示格式
+func (h *Mirage) getDNSData(user *User) DNSData {
+	org := &user.Organization
 	dnsData := DNSData{
 		Domains:           make([]string, 0),
 		Resolvers:         make([]string, 0),
 		FallbackResolvers: make([]string, 0),
 		Routes:            make(map[string][]string, 0),
-		MagicDNS:          userDNSCfg.Proxied,
-	}
-	for _, domain := range userDNSCfg.Domains {
-		if strings.HasSuffix(domain, "in-addr.arpa") || strings.HasSuffix(domain, "ip6.arpa") {
-			continue
+		RouteFallbacks:    make(map[string][]string, 0),
+		MagicDNS:          org.EnableMagic,
+		MagicDNSDomains:   []string{org.MagicDnsDomain},
+		ExtraRecords:      make(DNSRecords, 0, len(org.ExtraRecords)),
+		SearchDomains:     make([]string, 0, len(org.SearchDomains)),
+		ResolverOptions:   make(DNSResolverOptions, len(org.ResolverOpts)),
+	}
+	if org.OverrideLocal {
+		dnsData.Resolvers = append(dnsData.Resolvers, org.Nameservers...)
+	} else {
+		dnsData.FallbackResolvers = append(dnsData.FallbackResolvers, org.Nameservers...)
+	}
+	for _, splitDNS := range org.SplitDns {
+		dnsData.Domains = append(dnsData.Domains, splitDNS.Domain)
+		dnsData.Routes[splitDNS.Domain] = append(make([]string, 0, len(splitDNS.NS)), splitDNS.NS...)
+		if len(splitDNS.Fallback) > 0 {
+			dnsData.RouteFallbacks[splitDNS.Domain] = append(make([]string, 0, len(splitDNS.Fallback)), splitDNS.Fallback...)
 		}
-		dnsData.Domains = append(dnsData.Domains, domain)
 	}
-	if len(userDNSCfg.Resolvers) > 0 {
-		for _, ns := range userDNSCfg.Resolvers {
-			dnsData.Resolvers = append(dnsData.Resolvers, ns.Addr)
-		}
-	} else if len(userDNSCfg.FallbackResolvers) > 0 {
-		for _, ns := range userDNSCfg.FallbackResolvers {
-			dnsData.FallbackResolvers = append(dnsData.FallbackResolvers, ns.Addr)
-		}
-	}
-	dnsData.MagicDNSDomains = make([]string, 0)
-	dnsData.MagicDNSDomains = append(dnsData.MagicDNSDomains, userBaseDomain)
-	if len(userDNSCfg.Routes) > 0 {
-		for domain, nsl := range userDNSCfg.Routes {
-			if strings.HasSuffix(domain, "in-addr.arpa") || strings.HasSuffix(domain, "ip6.arpa") {
-				continue
-			}
-			dnsData.Routes[domain] = make([]string, 0)
-			for _, ns := range nsl {
-				dnsData.Routes[domain] = append(dnsData.Routes[domain], ns.Addr)
-			}
-		}
+	dnsData.ExtraRecords = append(dnsData.ExtraRecords, org.ExtraRecords...)
+	dnsData.SearchDomains = append(dnsData.SearchDomains, org.SearchDomains...)
+	for addr, option := range org.ResolverOpts {
+		dnsData.ResolverOptions[addr] = option
 	}
-	h.doAPIResponse(w, "", dnsData)
+
+	return dnsData
 }
 
 // 请求报文：同DNSData查询报文
@@ -85,12 +92,27 @@ func (h *Mirage) CAPIPostDNS(
 		return
 	}
 	reqData := DNSData{}
-	json.NewDecoder(r.Body).Decode(&reqData)
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		h.doAPIResponse(w, "用户请求解析失败:"+err.Error(), nil)
+		return
+	}
+	auditBefore := h.getDNSData(user)
 	err = h.UpdateDNSConfig(user, reqData)
-	if err != nil {
+	if errors.Is(err, ErrDNSConfigInvalid) {
+		h.doAPIResponse(w, "DNS设置校验失败:"+err.Error(), nil)
+		return
+	} else if errors.Is(err, ErrDNSRecordInvalid) {
+		h.doAPIResponse(w, "自定义DNS记录校验失败:"+err.Error(), nil)
+		return
+	} else if err != nil {
 		h.doAPIResponse(w, "更新用户DNS设置失败", nil)
 		return
 	}
+	if updatedUser, err := h.GetUserByID(tailcfg.UserID(user.ID)); err == nil {
+		h.recordAudit(h.newAuditEvent(r, user, "dns.update", "organization", user.Organization.StableID).
+			SetBefore(auditBefore).
+			SetAfter(h.getDNSData(updatedUser)))
+	}
 	h.setOrgLastStateChangeToNow(user.OrganizationID)
 	h.CAPIGetDNS(w, r)
 
@@ -114,7 +136,7 @@ func (h *Mirage) CAPIDelDNS(
 	}
 	toDelKeys := make([]PreAuthKey, 0)
 	for _, key := range allKeys {
-		if key.Key[:12] == targetKeyID {
+		if key.KeyID == targetKeyID {
 			toDelKeys = append(toDelKeys, key)
 		}
 	}
@@ -152,8 +174,8 @@ func (h *Mirage) CAPIGetTCDOffers(
 		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
 		return
 	}
-	if oldTCDOffers, ok := h.tcdCache.Get(user.Organization.StableID); ok {
-		for _, tcd := range oldTCDOffers.([]TCDOffer) {
+	if oldTCDOffers, ok := h.tcdOfferCache.Get(user.Organization.StableID); ok {
+		for _, tcd := range oldTCDOffers {
 			h.tcdCache.Delete(tcd.TCD)
 		}
 	}
@@ -177,7 +199,7 @@ func (h *Mirage) CAPIGetTCDOffers(
 		})
 		count--
 	}
-	h.tcdCache.Set(user.Organization.StableID, newTCDOffers.TCDs, 24*time.Hour)
+	h.tcdOfferCache.Set(user.Organization.StableID, newTCDOffers.TCDs, 24*time.Hour)
 	h.doAPIResponse(w, "", newTCDOffers)
 }
 
@@ -208,8 +230,11 @@ func (h *Mirage) CAPIPostTCD(
 		h.doAPIResponse(w, "更新蜃境网域名称失败", nil)
 		return
 	}
-	if oldTCDOffers, ok := h.tcdCache.Get(user.Organization.StableID); ok {
-		for _, tcd := range oldTCDOffers.([]TCDOffer) {
+	h.recordAudit(h.newAuditEvent(r, user, "dns.update_tcd", "organization", user.Organization.StableID).
+		SetBefore(map[string]string{"tcd": user.Organization.MagicDnsDomain}).
+		SetAfter(map[string]string{"tcd": reqData.TCD}))
+	if oldTCDOffers, ok := h.tcdOfferCache.Get(user.Organization.StableID); ok {
+		for _, tcd := range oldTCDOffers {
 			h.tcdCache.Delete(tcd.TCD)
 		}
 	}
@@ -0,0 +1,206 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// 响应中隐去的webhook签名密钥，提交该值表示保留原密钥
+const redactedWebhookKey = "******"
+
+type ExpiringMachineItem struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Hostname   string `json:"hostname"`
+	User       string `json:"user"`
+	Online     bool   `json:"online"`
+	Expires    string `json:"expires"`
+	ExpiryDesc string `json:"expirydesc"`
+	Notified   []int  `json:"notified"` // 当前过期时间下已发送提醒的阈值（天）
+	CanRenew   bool   `json:"canRenew"` // 当前用户是否可以为该设备续期
+}
+
+// 接受/admin/api/netsetting/expirynotice的Get请求，查询组织的密钥过期提醒策略
+func (h *Mirage) CAPIGetExpiryNotice(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	policy := user.Organization.ExpiryNotice
+	if policy.WebhookKey != "" {
+		policy.WebhookKey = redactedWebhookKey
+	}
+	if len(policy.Days) == 0 {
+		policy.Days = defaultExpiryNoticeDays
+	}
+	h.doAPIResponse(w, "", policy)
+}
+
+// 接受/admin/api/netsetting/expirynotice的Post请求，更新组织的密钥过期提醒策略
+func (h *Mirage) CAPIPostExpiryNotice(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	if user.Role != RoleOwner {
+		h.doAPIResponse(w, "用户没有该权限", nil)
+		return
+	}
+	policy := ExpiryNoticePolicy{}
+	if err = json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		h.doAPIResponse(w, "用户请求解析失败:"+err.Error(), nil)
+		return
+	}
+	oldPolicy := user.Organization.ExpiryNotice
+	if policy.WebhookKey == redactedWebhookKey {
+		policy.WebhookKey = oldPolicy.WebhookKey
+	}
+	if err = policy.Validate(); err != nil {
+		h.doAPIResponse(w, "过期提醒设置错误:"+err.Error(), nil)
+		return
+	}
+	if err = h.UpdateOrgExpiryNotice(user.OrganizationID, policy); err != nil {
+		h.doAPIResponse(w, "更新过期提醒设置失败", nil)
+		return
+	}
+	auditState := func(p ExpiryNoticePolicy) ExpiryNoticePolicy {
+		if p.WebhookKey != "" {
+			p.WebhookKey = redactedWebhookKey
+		}
+		return p
+	}
+	h.recordAudit(h.newAuditEvent(r, user, "org.update_expiry_notice", "organization", user.Organization.StableID).
+		SetBefore(auditState(oldPolicy)).
+		SetAfter(auditState(policy)))
+	h.doAPIResponse(w, "", auditState(policy))
+}
+
+// 接受/admin/api/machines/expiring的Get请求，查询组织内即将过期的设备，按过期时间升序
+// 可选参数days：查询多少天内过期，默认为过期提醒策略中最早的阈值
+func (h *Mirage) CAPIGetExpiringMachines(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	days := user.Organization.ExpiryNotice.maxDays()
+	if daysStr := r.URL.Query().Get("days"); daysStr != "" {
+		days, err = strconv.Atoi(daysStr)
+		if err != nil || days < 1 || days > maxExpiryNoticeDays {
+			h.doAPIResponse(w, "查询天数参数错误", nil)
+			return
+		}
+	}
+	machines, err := h.ListMachinesByOrgID(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "查询用户节点列表失败", nil)
+		return
+	}
+
+	now := time.Now()
+	until := now.Add(time.Duration(days) * 24 * time.Hour)
+	expiring := make([]Machine, 0)
+	for _, machine := range machines {
+		if machine.Expiry == nil || machine.Expiry.IsZero() ||
+			!machine.Expiry.After(now) || machine.Expiry.After(until) {
+			continue
+		}
+		expiring = append(expiring, machine)
+	}
+	sort.Slice(expiring, func(i, j int) bool {
+		return expiring[i].Expiry.Before(*expiring[j].Expiry)
+	})
+
+	items := make([]ExpiringMachineItem, 0, len(expiring))
+	for pos := range expiring {
+		machine := &expiring[pos]
+		items = append(items, ExpiringMachineItem{
+			Id:         strconv.FormatInt(machine.ID, 10),
+			Name:       machine.GivenName,
+			Hostname:   machine.Hostname,
+			User:       machine.User.Name,
+			Online:     machine.isOnline(),
+			Expires:    Time2SHString(*machine.Expiry),
+			ExpiryDesc: convExpiryToStr(time.Until(*machine.Expiry)),
+			Notified:   h.ListMachineExpiryNotifications(machine),
+			CanRenew:   user.Role == RoleOwner || machine.UserID == user.ID,
+		})
+	}
+	h.doAPIResponse(w, "", struct {
+		Days     int                   `json:"days"`
+		Machines []ExpiringMachineItem `json:"machines"`
+	}{
+		Days:     days,
+		Machines: items,
+	})
+}
+
+// 接受/admin/api/machines/:id/renew的Post请求，将设备密钥过期时间延长为从现在起一个组织密钥有效期
+// 只能为尚未过期的密钥续期，设备所属用户可以为自己的设备续期，管理员可以为组织内任意设备续期
+func (h *Mirage) CAPIRenewMachine(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	machineID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		h.doAPIResponse(w, "设备ID解析失败", nil)
+		return
+	}
+	machine, err := h.GetMachineByID(machineID)
+	if err != nil || machine.User.OrganizationID != user.OrganizationID {
+		h.doAPIResponse(w, "组织内无此设备", nil)
+		return
+	}
+	if user.Role != RoleOwner && machine.UserID != user.ID {
+		h.doAPIResponse(w, "用户没有该权限", nil)
+		return
+	}
+	if machine.Expiry == nil || machine.Expiry.IsZero() {
+		h.doAPIResponse(w, "该设备密钥永不过期，无需续期", nil)
+		return
+	}
+	if !machine.isApproved() {
+		h.doAPIResponse(w, "该设备尚未通过审批", nil)
+		return
+	}
+	// 已过期（包括被管理员强制过期）的设备必须重新登录认证，不能通过续期恢复
+	if machine.isExpired() {
+		h.doAPIResponse(w, "该设备密钥已过期，请在设备上重新登录", nil)
+		return
+	}
+
+	auditBefore := h.machineAuditState(machine)
+	expiryDuration := time.Hour * 24 * time.Duration(user.Organization.ExpiryDuration)
+	if err = h.RefreshMachine(machine, time.Now().Add(expiryDuration)); err != nil {
+		h.doAPIResponse(w, "设备密钥续期失败", nil)
+		return
+	}
+	h.recordAudit(h.newAuditEvent(r, user, "machine.renew_expiry", "machine", strconv.FormatInt(machine.ID, 10)).
+		SetBefore(auditBefore).
+		SetAfter(h.machineAuditState(machine)))
+	h.doAPIResponse(w, "", machineData{
+		NeverExpires: false,
+		Expires:      convExpiryToStr(expiryDuration),
+	})
+}
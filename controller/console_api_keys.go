@@ -10,15 +10,26 @@ import (
 
 type KeysData struct {
 	AuthKeys            []Key                `json:"authKeys"`
-	InvalidAuthKeys     []InvalidKey         `json:"invalidAuthKeys"`     // 未实现
-	ApiKeys             []Key                `json:"apiKeys"`             //未实现
-	InvalidApiKeys      []InvalidKey         `json:"invalidApiKeys"`      //未实现
-	OauthClients        []OauthClient        `json:"oauthClients"`        //未实现
-	InvalidOauthClients []InvalidOauthClient `json:"invalidOauthClients"` //未实现
+	InvalidAuthKeys     []InvalidKey         `json:"invalidAuthKeys"` // 未实现
+	ApiKeys             []Key                `json:"apiKeys"`
+	InvalidApiKeys      []InvalidKey         `json:"invalidApiKeys"`
+	OauthClients        []OauthClient        `json:"oauthClients"`
+	InvalidOauthClients []InvalidOauthClient `json:"invalidOauthClients"`
 }
 
-type InvalidOauthClient struct{} //未实现
-type OauthClient struct{}        //未实现
+type InvalidOauthClient struct {
+	ClientData OauthClient `json:"clientData"`
+	Revoked    string      `json:"revoked"`
+}
+type OauthClient struct {
+	Id          string   `json:"id"`
+	Created     string   `json:"created"`
+	Creator     string   `json:"creator"`
+	Scopes      []string `json:"scopes"`
+	Tags        []string `json:"tags"`
+	Description string   `json:"description"`
+	LastUsed    string   `json:"lastUsed"`
+}
 
 type InvalidKey struct {
 	KeyData Key    `json:"keyData"`
@@ -35,14 +46,29 @@ type Key struct {
 	Apikey  ApiKeyTypes  `json:"apikey"`
 }
 type AuthKeyTypes struct {
-	Reusable      bool     `json:"reusable"`
-	Ephemeral     bool     `json:"ephemeral"`
-	Preauthorized bool     `json:"preauthorized"` //未实现，建议true
-	ForAdminPanel bool     `json:"forAdminPanel"` //未实现，未知含义，建议false
-	Tags          []string `json:"tags"`
+	Reusable        bool         `json:"reusable"`
+	Ephemeral       bool         `json:"ephemeral"`
+	Preauthorized   bool         `json:"preauthorized"` // 组织开启设备审批时，使用该密钥注册的设备无需审批
+	ForAdminPanel   bool         `json:"forAdminPanel"` //未实现，未知含义，建议false
+	Tags            []string     `json:"tags"`
+	Description     string       `json:"description"`
+	MaxUses         int          `json:"maxUses"` // 0为不限
+	UseCount        int          `json:"useCount"`
+	SourceCIDRs     []string     `json:"sourceCIDRs"`
+	GivenNamePrefix string       `json:"givenNamePrefix"`
+	KeyExpiryDays   int          `json:"keyExpiryDays"` // 0为使用客户端请求的有效期
+	Uses            []AuthKeyUse `json:"uses"`          // 最近的使用记录
+}
+type AuthKeyUse struct {
+	Time     string `json:"time"`
+	Machine  string `json:"machine"`
+	SourceIP string `json:"sourceIp"`
 }
 type ApiKeyTypes struct {
-	Api string `json:"api"` //"control"
+	Api         string `json:"api"`   //"control"
+	Scope       string `json:"scope"` //"read","write","admin"
+	Description string `json:"description"`
+	LastUsed    string `json:"lastUsed"`
 }
 
 type GenKeyData struct {
@@ -68,6 +94,15 @@ func (h *Mirage) CAPIGetKeys(
 		h.doAPIResponse(w, "授权密钥查询失败", nil)
 		return
 	}
+	keyIDs := make([]uint64, 0, len(authKeys))
+	for _, key := range authKeys {
+		keyIDs = append(keyIDs, key.ID)
+	}
+	keyUses, err := h.ListPreAuthKeyUses(keyIDs, preAuthKeyUsesListLimit)
+	if err != nil {
+		h.doAPIResponse(w, "授权密钥使用记录查询失败", nil)
+		return
+	}
 	resData := KeysData{}
 	resData.AuthKeys = make([]Key, 0)
 	for _, key := range authKeys {
@@ -75,22 +110,109 @@ func (h *Mirage) CAPIGetKeys(
 		for _, tag := range key.ACLTags {
 			aclTags = append(aclTags, tag)
 		}
+		uses := make([]AuthKeyUse, 0, len(keyUses[key.ID]))
+		for _, use := range keyUses[key.ID] {
+			uses = append(uses, AuthKeyUse{
+				Time:     Time2SHString(use.CreatedAt),
+				Machine:  use.MachineName,
+				SourceIP: use.SourceIP,
+			})
+		}
 		tmpAuthKey := Key{
-			Id:      key.Key[:12], //key.ID,
+			Id:      key.KeyID,
 			Created: Time2SHString(*key.CreatedAt),
 			Creator: key.User.Name,
 			Expiry:  Time2SHString(*key.Expiration),
 			Type:    "authkey",
 			Authkey: AuthKeyTypes{
-				Reusable:      key.Reusable,
-				Ephemeral:     key.Ephemeral,
-				Preauthorized: true,  //TODO
-				ForAdminPanel: false, //TODO
-				Tags:          aclTags,
+				Reusable:        key.Reusable,
+				Ephemeral:       key.Ephemeral,
+				Preauthorized:   key.PreApproved,
+				ForAdminPanel:   false, //TODO
+				Tags:            aclTags,
+				Description:     key.Description,
+				MaxUses:         key.MaxUses,
+				UseCount:        key.UseCount,
+				SourceCIDRs:     append([]string{}, key.SourceCIDRs...),
+				GivenNamePrefix: key.GivenNamePrefix,
+				KeyExpiryDays:   key.KeyExpiryDays,
+				Uses:            uses,
 			},
 		}
 		resData.AuthKeys = append(resData.AuthKeys, tmpAuthKey)
 	}
+	// OAuth客户端只能查看授权密钥
+	if oauthTokenFromRequest(r) != nil {
+		h.doAPIResponse(w, "", resData)
+		return
+	}
+
+	apiKeys, err := h.ListAPIKeys(user.ID)
+	if err != nil {
+		h.doAPIResponse(w, "API密钥查询失败", nil)
+		return
+	}
+	resData.ApiKeys = make([]Key, 0)
+	resData.InvalidApiKeys = make([]InvalidKey, 0)
+	for _, key := range apiKeys {
+		tmpAPIKey := Key{
+			Id:      key.KeyID,
+			Created: Time2SHString(*key.CreatedAt),
+			Creator: key.User.Name,
+			Type:    "apikey",
+			Apikey: ApiKeyTypes{
+				Api:         "control",
+				Scope:       key.Scope,
+				Description: key.Description,
+			},
+		}
+		if key.Expiration != nil {
+			tmpAPIKey.Expiry = Time2SHString(*key.Expiration)
+		}
+		if key.LastUsedAt != nil {
+			tmpAPIKey.Apikey.LastUsed = Time2SHString(*key.LastUsedAt)
+		}
+		if key.IsValid() {
+			resData.ApiKeys = append(resData.ApiKeys, tmpAPIKey)
+			continue
+		}
+		invalidKey := InvalidKey{
+			KeyData: tmpAPIKey,
+		}
+		if key.RevokedAt != nil {
+			invalidKey.Revoked = Time2SHString(*key.RevokedAt)
+		}
+		resData.InvalidApiKeys = append(resData.InvalidApiKeys, invalidKey)
+	}
+
+	clients, err := h.ListOAuthClients(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "OAuth客户端查询失败", nil)
+		return
+	}
+	resData.OauthClients = make([]OauthClient, 0)
+	resData.InvalidOauthClients = make([]InvalidOauthClient, 0)
+	for _, client := range clients {
+		tmpClient := OauthClient{
+			Id:          client.ClientID,
+			Created:     Time2SHString(*client.CreatedAt),
+			Creator:     client.Creator.Name,
+			Scopes:      client.Scopes,
+			Tags:        client.Tags,
+			Description: client.Description,
+		}
+		if client.LastUsedAt != nil {
+			tmpClient.LastUsed = Time2SHString(*client.LastUsedAt)
+		}
+		if client.RevokedAt == nil {
+			resData.OauthClients = append(resData.OauthClients, tmpClient)
+			continue
+		}
+		resData.InvalidOauthClients = append(resData.InvalidOauthClients, InvalidOauthClient{
+			ClientData: tmpClient,
+			Revoked:    Time2SHString(*client.RevokedAt),
+		})
+	}
 	h.doAPIResponse(w, "", resData)
 }
 
@@ -99,9 +221,11 @@ type GenKeyREQ struct {
 	KeyData REQKeyData `json:"keyData"`
 }
 type REQKeyData struct {
-	Type          string       `json:"type"` //"authkey"
+	Type          string       `json:"type"` //"authkey","apikey","oauthclient"
 	ExpirySeconds uint64       `json:"expirySeconds"`
 	Authkey       AuthKeyTypes `json:"authkey"`
+	Apikey        ApiKeyTypes  `json:"apikey"`
+	OauthClient   OauthClient  `json:"oauthclient"`
 }
 
 // 接受/admin/api/keys的Post请求，用于创建AuthKey
@@ -121,22 +245,108 @@ func (h *Mirage) CAPIPostKeys(
 	}
 	reqData := GenKeyREQ{}
 	json.NewDecoder(r.Body).Decode(&reqData)
+	oauthToken := oauthTokenFromRequest(r)
+	if oauthToken != nil && reqData.KeyData.Type != "authkey" {
+		h.doAPIResponse(w, "访问令牌权限不足", nil)
+		return
+	}
 	switch reqData.KeyData.Type {
 	case "authkey":
 		keyCfg := reqData.KeyData.Authkey
+		// OAuth客户端创建的授权密钥必须带有该客户端允许的标签
+		if oauthToken != nil && !oauthToken.AllowsTags(keyCfg.Tags) {
+			h.doAPIResponse(w, "授权密钥标签不在OAuth客户端允许范围内", nil)
+			return
+		}
 		keyExpiration := time.Now().Add(time.Duration(reqData.KeyData.ExpirySeconds) * time.Second)
-		genedAuthKey, err := h.CreatePreAuthKey(user, keyCfg.Reusable, keyCfg.Ephemeral, &keyExpiration, keyCfg.Tags)
+		genedAuthKey, fullKey, err := h.CreatePreAuthKey(user, keyCfg.Reusable, keyCfg.Ephemeral, &keyExpiration, keyCfg.Tags, &PreAuthKeyOptions{
+			Description:     keyCfg.Description,
+			MaxUses:         keyCfg.MaxUses,
+			SourceCIDRs:     keyCfg.SourceCIDRs,
+			GivenNamePrefix: keyCfg.GivenNamePrefix,
+			KeyExpiryDays:   keyCfg.KeyExpiryDays,
+			PreApproved:     keyCfg.Preauthorized,
+		})
 		if err != nil {
-			h.doAPIResponse(w, "授权密钥创建失败", nil)
+			h.doAPIResponse(w, "授权密钥创建失败:"+err.Error(), nil)
 			return
 		}
 		resData := GenKeyData{
-			Id:      genedAuthKey.Key[:12], //genedAuthKey.ID,
-			FullKey: genedAuthKey.Key,
+			Id:      genedAuthKey.KeyID,
+			FullKey: fullKey,
 			Created: Time2SHString(*genedAuthKey.CreatedAt),
 			Expiry:  Time2SHString(*genedAuthKey.Expiration),
 		}
+		h.recordAudit(h.newAuditEvent(r, user, "key.create_authkey", "authkey", resData.Id).
+			SetAfter(map[string]interface{}{
+				"reusable":        genedAuthKey.Reusable,
+				"ephemeral":       genedAuthKey.Ephemeral,
+				"tags":            genedAuthKey.ACLTags,
+				"expiration":      genedAuthKey.Expiration,
+				"description":     genedAuthKey.Description,
+				"maxUses":         genedAuthKey.MaxUses,
+				"sourceCIDRs":     genedAuthKey.SourceCIDRs,
+				"givenNamePrefix": genedAuthKey.GivenNamePrefix,
+				"keyExpiryDays":   genedAuthKey.KeyExpiryDays,
+				"preApproved":     genedAuthKey.PreApproved,
+			}))
+		h.doAPIResponse(w, "", resData)
+	case "apikey":
+		keyCfg := reqData.KeyData.Apikey
+		if keyCfg.Scope == "" {
+			keyCfg.Scope = APIKeyScopeRead
+		}
+		// 通过API密钥创建的新密钥不能超出自身权限
+		if apiKey := apiKeyFromRequest(r); apiKey != nil && !apiKey.Allows(keyCfg.Scope) {
+			h.doAPIResponse(w, "API密钥权限不足", nil)
+			return
+		}
+		var keyExpiration *time.Time
+		if reqData.KeyData.ExpirySeconds > 0 {
+			expiration := time.Now().Add(time.Duration(reqData.KeyData.ExpirySeconds) * time.Second)
+			keyExpiration = &expiration
+		}
+		genedAPIKey, fullKey, err := h.CreateAPIKey(user, keyCfg.Scope, keyCfg.Description, keyExpiration)
+		if err != nil {
+			h.doAPIResponse(w, "API密钥创建失败:"+err.Error(), nil)
+			return
+		}
+		resData := GenKeyData{
+			Id:      genedAPIKey.KeyID,
+			FullKey: fullKey,
+			Created: Time2SHString(*genedAPIKey.CreatedAt),
+		}
+		if genedAPIKey.Expiration != nil {
+			resData.Expiry = Time2SHString(*genedAPIKey.Expiration)
+		}
+		h.recordAudit(h.newAuditEvent(r, user, "key.create_apikey", "apikey", genedAPIKey.KeyID).
+			SetAfter(map[string]interface{}{
+				"scope":       genedAPIKey.Scope,
+				"description": genedAPIKey.Description,
+				"expiration":  genedAPIKey.Expiration,
+			}))
+		h.doAPIResponse(w, "", resData)
+	case "oauthclient":
+		clientCfg := reqData.KeyData.OauthClient
+		client, secret, err := h.CreateOAuthClient(user, clientCfg.Scopes, clientCfg.Tags, clientCfg.Description)
+		if err != nil {
+			h.doAPIResponse(w, "OAuth客户端创建失败:"+err.Error(), nil)
+			return
+		}
+		resData := GenKeyData{
+			Id:      client.ClientID,
+			FullKey: secret,
+			Created: Time2SHString(*client.CreatedAt),
+		}
+		h.recordAudit(h.newAuditEvent(r, user, "key.create_oauthclient", "oauthclient", client.ClientID).
+			SetAfter(map[string]interface{}{
+				"scopes":      client.Scopes,
+				"tags":        client.Tags,
+				"description": client.Description,
+			}))
 		h.doAPIResponse(w, "", resData)
+	default:
+		h.doAPIResponse(w, "未知的密钥类型", nil)
 	}
 }
 
@@ -151,6 +361,38 @@ func (h *Mirage) CAPIDelKeys(
 		return
 	}
 	targetKeyID := strings.TrimPrefix(r.URL.Path, "/admin/api/keys/")
+	if strings.HasPrefix(targetKeyID, oauthClientIDPrefix) {
+		h.revokeOAuthClient(w, r, user, targetKeyID)
+		return
+	}
+	apiKeys, err := h.ListAPIKeys(user.ID)
+	if err != nil {
+		h.doAPIResponse(w, "查询用户密钥信息失败", nil)
+		return
+	}
+	if oauthTokenFromRequest(r) != nil {
+		apiKeys = nil
+	}
+	for _, key := range apiKeys {
+		if key.KeyID != targetKeyID {
+			continue
+		}
+		if key.RevokedAt != nil {
+			h.doAPIResponse(w, "该密钥已被注销", nil)
+			return
+		}
+		if err := h.RevokeAPIKey(&key); err != nil {
+			h.doAPIResponse(w, "执行密钥注销失败", nil)
+			return
+		}
+		h.recordAudit(h.newAuditEvent(r, user, "key.revoke_apikey", "apikey", targetKeyID).
+			SetBefore(map[string]interface{}{
+				"scope":       key.Scope,
+				"description": key.Description,
+			}))
+		h.doAPIResponse(w, "", targetKeyID)
+		return
+	}
 	allKeys, err := h.ListPreAuthKeys(user.ID)
 	if err != nil {
 		h.doAPIResponse(w, "查询用户密钥信息失败", nil)
@@ -158,7 +400,7 @@ func (h *Mirage) CAPIDelKeys(
 	}
 	toDelKeys := make([]PreAuthKey, 0)
 	for _, key := range allKeys {
-		if key.Key[:12] == targetKeyID {
+		if key.KeyID == targetKeyID {
 			toDelKeys = append(toDelKeys, key)
 		}
 	}
@@ -174,5 +416,53 @@ func (h *Mirage) CAPIDelKeys(
 		h.doAPIResponse(w, "执行密钥删除失败", nil)
 		return
 	}
+	h.recordAudit(h.newAuditEvent(r, user, "key.delete_authkey", "authkey", targetKeyID).
+		SetBefore(map[string]interface{}{
+			"reusable":    toDelKeys[0].Reusable,
+			"ephemeral":   toDelKeys[0].Ephemeral,
+			"tags":        toDelKeys[0].ACLTags,
+			"expiration":  toDelKeys[0].Expiration,
+			"description": toDelKeys[0].Description,
+			"useCount":    toDelKeys[0].UseCount,
+		}))
 	h.doAPIResponse(w, "", targetKeyID)
 }
+
+func (h *Mirage) revokeOAuthClient(
+	w http.ResponseWriter,
+	r *http.Request,
+	user *User,
+	clientID string,
+) {
+	if oauthTokenFromRequest(r) != nil {
+		h.doAPIResponse(w, "访问令牌权限不足", nil)
+		return
+	}
+	clients, err := h.ListOAuthClients(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "查询OAuth客户端信息失败", nil)
+		return
+	}
+	for _, client := range clients {
+		if client.ClientID != clientID {
+			continue
+		}
+		if client.RevokedAt != nil {
+			h.doAPIResponse(w, "该OAuth客户端已被注销", nil)
+			return
+		}
+		if err := h.RevokeOAuthClient(&client); err != nil {
+			h.doAPIResponse(w, "执行OAuth客户端注销失败", nil)
+			return
+		}
+		h.recordAudit(h.newAuditEvent(r, user, "key.revoke_oauthclient", "oauthclient", clientID).
+			SetBefore(map[string]interface{}{
+				"scopes":      client.Scopes,
+				"tags":        client.Tags,
+				"description": client.Description,
+			}))
+		h.doAPIResponse(w, "", clientID)
+		return
+	}
+	h.doAPIResponse(w, "该OAuth客户端不存在", nil)
+}
@@ -89,6 +89,25 @@ type machineItem struct {
 
 	Endpoints         []string `json:"endpoints"`
 	AutomaticNameMode bool     `json:"automaticNameMode"`
+
+	SubnetRoutes []machineSubnetRoute `json:"subnetRoutes"`
+
+	PostureCompliant  bool     `json:"postureCompliant"`
+	PostureViolations []string `json:"postureViolations"` // 不满足defaultSrcPosture的原因
+
+	ApprovalState string `json:"approvalState"` // pending、approved、rejected，开启设备审批前注册的设备为approved
+	ApprovalBy    string `json:"approvalBy"`
+	ApprovalAt    string `json:"approvalAt"`
+}
+
+// 设备通告的子网路由及该子网当前的主路由设备
+type machineSubnetRoute struct {
+	Prefix      string `json:"prefix"`
+	Enabled     bool   `json:"enabled"`
+	IsPrimary   bool   `json:"isPrimary"`
+	Priority    int    `json:"priority"`
+	PrimaryID   string `json:"primaryId"`
+	PrimaryName string `json:"primaryName"`
 }
 
 func IsUpdateAvailable(cur, latest string) bool {
@@ -121,6 +140,12 @@ func (h *Mirage) ConsoleMachinesAPI(
 		return
 	}
 
+	primaryRoutes, err := h.getOrgPrimaryRoutes(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "查询子网主路由失败", nil)
+		return
+	}
+
 	mlist := make([]machineItem, 0)
 	for _, machine := range OrgMachines {
 		tz, _ := time.LoadLocation("Asia/Shanghai")
@@ -146,6 +171,16 @@ func (h *Mirage) ConsoleMachinesAPI(
 			Endpoints:         machine.Endpoints,
 			AutomaticNameMode: machine.AutoGenName,
 		}
+		tmpMachine.PostureViolations = machine.User.Organization.AclPolicy.postureViolations(&machine, time.Now())
+		tmpMachine.PostureCompliant = len(tmpMachine.PostureViolations) == 0
+		tmpMachine.ApprovalState = MachineApprovalApproved
+		if machine.ApprovalState != "" {
+			tmpMachine.ApprovalState = machine.ApprovalState
+			tmpMachine.ApprovalBy = machine.ApprovalBy
+		}
+		if machine.ApprovalAt != nil {
+			tmpMachine.ApprovalAt = Time2SHString(*machine.ApprovalAt)
+		}
 
 		switch machine.HostInfo.OS {
 		case "linux":
@@ -205,6 +240,17 @@ func (h *Mirage) ConsoleMachinesAPI(
 					} else {
 						tmpMachine.ExtraIPs = append(tmpMachine.ExtraIPs, routeV)
 					}
+					subnetRoute := machineSubnetRoute{
+						Prefix:    routeV,
+						Enabled:   route.Enabled,
+						IsPrimary: route.IsPrimary,
+						Priority:  route.Priority,
+					}
+					if primary, ok := primaryRoutes[netip.Prefix(route.Prefix)]; ok {
+						subnetRoute.PrimaryID = strconv.FormatInt(primary.MachineID, 10)
+						subnetRoute.PrimaryName = primary.Machine.GivenName
+					}
+					tmpMachine.SubnetRoutes = append(tmpMachine.SubnetRoutes, subnetRoute)
 				}
 			}
 		}
@@ -355,6 +401,10 @@ func (h *Mirage) ConsoleMachinesUpdateAPI(
 		h.doAPIResponse(writer, "查询用户设备失败", nil)
 		return
 	}
+	if toUpdateMachine.User.OrganizationID != user.OrganizationID {
+		h.doAPIResponse(writer, "组织内无此设备", nil)
+		return
+	}
 	/*
 		if toUpdateMachine.User.ID != user.ID {
 			h.doAPIResponse(writer, "用户没有该权限", nil)
@@ -366,6 +416,12 @@ func (h *Mirage) ConsoleMachinesUpdateAPI(
 		h.doAPIResponse(writer, "用户请求state解析失败", nil)
 		return
 	}
+	auditBefore := h.machineAuditState(toUpdateMachine)
+	recordAudit := func(action string) {
+		h.recordAudit(h.newAuditEvent(req, user, action, "machine", reqMID).
+			SetBefore(auditBefore).
+			SetAfter(h.machineAuditState(toUpdateMachine)))
+	}
 
 	switch reqState {
 	case "set-expires": //切换密钥永不过期设置
@@ -373,6 +429,7 @@ func (h *Mirage) ConsoleMachinesUpdateAPI(
 		if err != nil {
 			h.doAPIResponse(writer, msg, nil)
 		} else {
+			recordAudit("machine.set_expires")
 			resData := machineData{
 				NeverExpires: *toUpdateMachine.Expiry == time.Time{},
 				Expires:      msg,
@@ -385,6 +442,7 @@ func (h *Mirage) ConsoleMachinesUpdateAPI(
 		if err != nil {
 			h.doAPIResponse(writer, msg, nil)
 		} else {
+			recordAudit("machine.rename")
 			resData := machineData{
 				AutomaticNameMode: toUpdateMachine.AutoGenName,
 				Name:              toUpdateMachine.GivenName,
@@ -408,6 +466,7 @@ func (h *Mirage) ConsoleMachinesUpdateAPI(
 			h.doAPIResponse(writer, msg, nil)
 			return
 		} else {
+			recordAudit("machine.set_routes")
 			resData := machineData{
 				AutomaticNameMode: toUpdateMachine.AutoGenName,
 				Name:              toUpdateMachine.GivenName,
@@ -457,6 +516,7 @@ func (h *Mirage) ConsoleMachinesUpdateAPI(
 		if err != nil {
 			h.doAPIResponse(writer, msg, nil)
 		} else {
+			recordAudit("machine.set_tags")
 			invalidTags := []string{}
 			allowedTags := []string{}
 			org, err := h.GetOrgnaizationByID(user.OrganizationID)
@@ -482,6 +542,36 @@ func (h *Mirage) ConsoleMachinesUpdateAPI(
 			}
 			h.doAPIResponse(writer, "", resData)
 		}
+	case "approve-device", "reject-device": //批准或拒绝待审批的新设备
+		approve := reqState == "approve-device"
+		if user.Role != RoleOwner {
+			h.doAPIResponse(writer, "用户没有该权限", nil)
+			return
+		}
+		if toUpdateMachine.ApprovalState != MachineApprovalPending {
+			h.doAPIResponse(writer, "该设备不在待审批状态", nil)
+			return
+		}
+		err := h.SetMachineApproval(toUpdateMachine, approve, user.Name)
+		if err != nil {
+			h.doAPIResponse(writer, "设置设备审批状态失败", nil)
+			return
+		}
+		if approve {
+			recordAudit("machine.approve")
+		} else {
+			recordAudit("machine.reject")
+			h.NotifyNaviOrgNodesChange(user.OrganizationID, "", toUpdateMachine.NodeKey)
+		}
+		h.doAPIResponse(writer, "", struct {
+			ApprovalState string `json:"approvalState"`
+			ApprovalBy    string `json:"approvalBy"`
+			ApprovalAt    string `json:"approvalAt"`
+		}{
+			ApprovalState: toUpdateMachine.ApprovalState,
+			ApprovalBy:    toUpdateMachine.ApprovalBy,
+			ApprovalAt:    Time2SHString(*toUpdateMachine.ApprovalAt),
+		})
 	}
 }
 
@@ -510,12 +600,15 @@ func (h *Mirage) ConsoleRemoveMachineAPI(
 	wantRemoveID := reqData["mid"]
 	for _, machine := range UserMachines {
 		if strconv.FormatInt(machine.ID, 10) == wantRemoveID {
+			auditBefore := h.machineAuditState(&machine)
 			err = h.HardDeleteMachine(&machine)
 			if err != nil {
 				h.doAPIResponse(writer, "用户设备删除失败:"+err.Error(), nil)
 				return
 			}
 			h.NotifyNaviOrgNodesChange(user.OrganizationID, "", machine.NodeKey)
+			h.recordAudit(h.newAuditEvent(req, user, "machine.delete", "machine", wantRemoveID).
+				SetBefore(auditBefore))
 
 			h.doAPIResponse(writer, "", nil)
 			return
@@ -577,7 +670,8 @@ func (h *Mirage) setMachineSubnet(machine *Machine, ExitNodeEnable bool, allowed
 			if err != nil {
 				return "设置设备出口节点状态失败", err
 			}
-		} else {
+		} else if !containsStr(allowedIPs, netip.Prefix(r.Prefix).String()) {
+			// 保持启用的子网不先禁用，避免主路由在组内来回切换
 			err = h.DisableRoute(uint64(r.ID))
 			if err != nil {
 				return "设置设备出口节点状态失败", err
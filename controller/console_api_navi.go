@@ -49,6 +49,7 @@ func (m *Mirage) CAPIQueryDERP(
 						Latency: latency,
 					}
 					naviNodes[index].Arch = "common"
+					naviNodes[index].Sync = nil
 				} else if naviNodes[index].NaviKey != "" && naviNodes[index].Arch == "external" {
 					naviNodes[index].Arch = "unknown"
 				}
@@ -145,6 +146,8 @@ func (m *Mirage) CAPIAddDERP(
 			m.doAPIResponse(w, "新建司南档案失败", nil)
 			return
 		}
+		m.recordAudit(m.newAuditEvent(r, user, "navi.create", "navi", naviNode.ID).
+			SetAfter(naviNodeAuditState(naviNode)))
 
 		m.setOrgLastStateChangeToNow(user.OrganizationID)
 
@@ -245,6 +248,8 @@ func (m *Mirage) CAPIAddDERP(
 		m.doAPIResponse(w, "新建司南档案失败", nil)
 		return
 	}
+	m.recordAudit(m.newAuditEvent(r, user, "navi.create", "navi", naviNode.ID).
+		SetAfter(naviNodeAuditState(naviNode)))
 
 	//TODO: 司南建档成功后在目标机执行部署启动
 	// 停止服务
@@ -379,9 +384,14 @@ func (m *Mirage) CAPIDelNaviNode(
 		m.doAPIResponse(w, "数据库删除司南节点失败:"+err.Error(), nil)
 		return
 	}
-	delete(m.DERPNCs, naviID)
-	delete(m.DERPseqnum, naviID)
+	m.DERPNCs.Delete(naviID)
+	if err := deleteNaviSync(m.db, naviID); err != nil {
+		log.Error().Caller().Err(err).Msg("Failed to delete Navi sync state")
+	}
+	naviMetrics.forget(naviID)
 	//	c.App.LoadDERPMapFromURL(c.App.cfg.DERPURL)
+	m.recordAudit(m.newAuditEvent(r, user, "navi.delete", "navi", naviID).
+		SetBefore(naviNodeAuditState(naviNode)))
 
 	m.setOrgLastStateChangeToNow(user.OrganizationID)
 
@@ -421,7 +431,8 @@ func (m *Mirage) CAPISwitchRegionBan(
 		m.doAPIResponse(w, "查询用户所属组织失败", nil)
 		return
 	}
-	if _, ok := org.NaviBanList[regionID]; ok {
+	_, wasBanned := org.NaviBanList[regionID]
+	if wasBanned {
 		delete(org.NaviBanList, regionID)
 	} else {
 		if org.NaviBanList == nil {
@@ -434,6 +445,9 @@ func (m *Mirage) CAPISwitchRegionBan(
 		m.doAPIResponse(w, "数据库更新组织禁用区域信息失败:"+err.Error(), nil)
 		return
 	}
+	m.recordAudit(m.newAuditEvent(r, user, "navi.switch_region_ban", "region", regionIDStr).
+		SetBefore(map[string]bool{"banned": wasBanned}).
+		SetAfter(map[string]bool{"banned": !wasBanned}))
 
 	m.setOrgLastStateChangeToNow(org.ID)
 
@@ -0,0 +1,232 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const routeFailoverEventsLimit = 50
+
+type RouteGroupRouter struct {
+	MachineID    string `json:"machineId"`
+	Name         string `json:"name"`
+	Priority     int    `json:"priority"`
+	Enabled      bool   `json:"enabled"`
+	IsPrimary    bool   `json:"isPrimary"`
+	Online       bool   `json:"online"`
+	HealthySince string `json:"healthySince"`
+}
+
+type RouteGroupItem struct {
+	Prefix          string             `json:"prefix"`
+	Preempt         bool               `json:"preempt"`
+	HoldDownSeconds int                `json:"holdDownSeconds"`
+	PrimaryID       string             `json:"primaryId"`
+	PrimaryName     string             `json:"primaryName"`
+	Routers         []RouteGroupRouter `json:"routers"`
+}
+
+type RouteFailoverEventItem struct {
+	Time   string `json:"time"`
+	Prefix string `json:"prefix"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Reason string `json:"reason"`
+}
+
+type RouteGroupsData struct {
+	Groups []RouteGroupItem         `json:"groups"`
+	Events []RouteFailoverEventItem `json:"events"`
+}
+
+// 请求报文：{"prefix":"10.0.0.0/24","preempt":true,"holdDownSeconds":60,"priorities":{"设备ID":100}}
+type REQRouteGroup struct {
+	Prefix          string         `json:"prefix"`
+	Preempt         bool           `json:"preempt"`
+	HoldDownSeconds int            `json:"holdDownSeconds"`
+	Priorities      map[string]int `json:"priorities"`
+}
+
+// 按子网前缀汇总组织内通告的子网路由（不含出口节点）
+func groupOrgSubnetRoutes(routes []Route) map[netip.Prefix][]*Route {
+	res := make(map[netip.Prefix][]*Route)
+	for pos, route := range routes {
+		if !route.Advertised || route.isExitRoute() {
+			continue
+		}
+		prefix := netip.Prefix(route.Prefix)
+		res[prefix] = append(res[prefix], &routes[pos])
+	}
+	for _, members := range res {
+		sortRouteCandidates(members)
+	}
+
+	return res
+}
+
+func routeGroupAuditState(group *RouteGroup, routes []*Route) map[string]interface{} {
+	priorities := make(map[string]int, len(routes))
+	for _, route := range routes {
+		priorities[strconv.FormatInt(route.MachineID, 10)] = route.Priority
+	}
+
+	return map[string]interface{}{
+		"preempt":         group.preempt(),
+		"holdDownSeconds": int(group.holdDown() / time.Second),
+		"priorities":      priorities,
+	}
+}
+
+// 接受/admin/api/route-groups的Get请求，查询组织内的子网路由组、当前主路由及切换记录
+func (h *Mirage) CAPIGetRouteGroups(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	routes, err := h.listOrgRoutes(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "查询子网路由失败", nil)
+		return
+	}
+	groups, err := h.ListOrgRouteGroups(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "查询路由组策略失败", nil)
+		return
+	}
+	events, err := h.ListRouteFailoverEvents(user.OrganizationID, routeFailoverEventsLimit)
+	if err != nil {
+		h.doAPIResponse(w, "查询主路由切换记录失败", nil)
+		return
+	}
+
+	resData := RouteGroupsData{
+		Groups: make([]RouteGroupItem, 0),
+		Events: make([]RouteFailoverEventItem, 0, len(events)),
+	}
+	for prefix, members := range groupOrgSubnetRoutes(routes) {
+		group := groups[prefix]
+		item := RouteGroupItem{
+			Prefix:          prefix.String(),
+			Preempt:         group.preempt(),
+			HoldDownSeconds: int(group.holdDown() / time.Second),
+			Routers:         make([]RouteGroupRouter, 0, len(members)),
+		}
+		for _, route := range members {
+			router := RouteGroupRouter{
+				MachineID: strconv.FormatInt(route.MachineID, 10),
+				Name:      route.Machine.GivenName,
+				Priority:  route.Priority,
+				Enabled:   route.Enabled,
+				IsPrimary: route.Enabled && route.IsPrimary,
+				Online:    route.Machine.isOnline(),
+			}
+			if route.HealthySince != nil {
+				router.HealthySince = Time2SHString(*route.HealthySince)
+			}
+			if router.IsPrimary {
+				item.PrimaryID = router.MachineID
+				item.PrimaryName = router.Name
+			}
+			item.Routers = append(item.Routers, router)
+		}
+		resData.Groups = append(resData.Groups, item)
+	}
+	sort.Slice(resData.Groups, func(i, j int) bool {
+		return resData.Groups[i].Prefix < resData.Groups[j].Prefix
+	})
+	for _, event := range events {
+		resData.Events = append(resData.Events, RouteFailoverEventItem{
+			Time:   Time2SHString(event.CreatedAt),
+			Prefix: event.Prefix.String(),
+			From:   event.FromMachine,
+			To:     event.ToMachine,
+			Reason: event.Reason,
+		})
+	}
+	h.doAPIResponse(w, "", resData)
+}
+
+// 接受/admin/api/route-groups的Post请求，设置子网路由组的抢占策略、保持时间及成员优先级
+func (h *Mirage) CAPIPostRouteGroups(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	reqData := REQRouteGroup{}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		h.doAPIResponse(w, "用户请求解析失败:"+err.Error(), nil)
+		return
+	}
+	prefix, err := netip.ParsePrefix(reqData.Prefix)
+	if err != nil {
+		h.doAPIResponse(w, "子网路由地址解析失败", nil)
+		return
+	}
+	prefix = prefix.Masked()
+	if prefix == ExitRouteV4 || prefix == ExitRouteV6 {
+		h.doAPIResponse(w, "出口节点不支持路由组设置", nil)
+		return
+	}
+
+	routes, err := h.listOrgRoutes(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "查询子网路由失败", nil)
+		return
+	}
+	members := groupOrgSubnetRoutes(routes)[prefix]
+	if len(members) == 0 {
+		h.doAPIResponse(w, "组织内没有设备通告该子网", nil)
+		return
+	}
+	membersByMachine := make(map[string]*Route, len(members))
+	for _, route := range members {
+		membersByMachine[strconv.FormatInt(route.MachineID, 10)] = route
+	}
+	for machineID := range reqData.Priorities {
+		if _, ok := membersByMachine[machineID]; !ok {
+			h.doAPIResponse(w, "设备"+machineID+"未通告该子网", nil)
+			return
+		}
+	}
+
+	groups, err := h.ListOrgRouteGroups(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "查询路由组策略失败", nil)
+		return
+	}
+	auditBefore := routeGroupAuditState(groups[prefix], members)
+
+	group, err := h.SaveRouteGroup(user.OrganizationID, prefix, reqData.Preempt, reqData.HoldDownSeconds)
+	if err != nil {
+		h.doAPIResponse(w, "保存路由组策略失败:"+err.Error(), nil)
+		return
+	}
+	for machineID, priority := range reqData.Priorities {
+		if err := h.SetRoutePriority(membersByMachine[machineID], priority); err != nil {
+			h.doAPIResponse(w, "设置路由优先级失败", nil)
+			return
+		}
+	}
+	h.recordAudit(h.newAuditEvent(r, user, "route.update_group", "route_group", prefix.String()).
+		SetBefore(auditBefore).
+		SetAfter(routeGroupAuditState(group, members)))
+
+	// 立即按新策略重新选举，不必等待下一次定时检查
+	if err := h.handlePrimarySubnetFailover(); err != nil {
+		h.doAPIResponse(w, "路由组策略已保存，主路由重新选举失败", nil)
+		return
+	}
+	h.CAPIGetRouteGroups(w, r)
+}
@@ -0,0 +1,241 @@
+package controller
+
+import (
+	"net/http"
+	"net/netip"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+type RouteAutoApproverItem struct {
+	Rule  string `json:"rule"`  // autoApprovers中命中的子网，出口节点为exitNode
+	Alias string `json:"alias"` // 命中的用户、组或标签
+}
+
+type RouteItem struct {
+	Id           string                 `json:"id"`
+	MachineId    string                 `json:"machineId"`
+	MachineName  string                 `json:"machineName"`
+	User         string                 `json:"user"`
+	Prefix       string                 `json:"prefix"`
+	IsExitRoute  bool                   `json:"isExitRoute"`
+	Enabled      bool                   `json:"enabled"`
+	IsPrimary    bool                   `json:"isPrimary"`
+	Priority     int                    `json:"priority"`
+	Online       bool                   `json:"online"`
+	AutoApprover *RouteAutoApproverItem `json:"autoApprover"`
+	Created      string                 `json:"created"`
+}
+
+type RoutesData struct {
+	Routes       []RouteItem `json:"routes"`
+	PendingCount int         `json:"pendingCount"`
+}
+
+func (h *Mirage) newRouteItem(policy *ACLPolicy, route *Route) (RouteItem, error) {
+	item := RouteItem{
+		Id:          strconv.FormatUint(route.ID, 10),
+		MachineId:   strconv.FormatInt(route.MachineID, 10),
+		MachineName: route.Machine.GivenName,
+		User:        route.Machine.User.Name,
+		Prefix:      netip.Prefix(route.Prefix).String(),
+		IsExitRoute: route.isExitRoute(),
+		Enabled:     route.Enabled,
+		IsPrimary:   route.Enabled && route.IsPrimary,
+		Priority:    route.Priority,
+		Online:      route.Machine.isOnline(),
+		Created:     Time2SHString(route.CreatedAt),
+	}
+	rule, alias, err := h.getRouteAutoApprover(policy, route)
+	if err != nil {
+		return item, err
+	}
+	if rule != "" {
+		item.AutoApprover = &RouteAutoApproverItem{
+			Rule:  rule,
+			Alias: alias,
+		}
+	}
+
+	return item, nil
+}
+
+// 接受/admin/api/routes的Get请求，查询组织内设备通告的全部路由
+// 可选参数state：pending（待审批）、enabled（已启用）、primary（主路由），为空时返回全部
+func (h *Mirage) CAPIGetRoutes(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	state := r.URL.Query().Get("state")
+	switch state {
+	case "", "pending", "enabled", "primary":
+	default:
+		h.doAPIResponse(w, "路由状态参数错误", nil)
+		return
+	}
+	org, err := h.GetOrgnaizationByID(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "查询组织信息失败", nil)
+		return
+	}
+	routes, err := h.listOrgRoutes(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "查询子网路由失败", nil)
+		return
+	}
+
+	resData := RoutesData{
+		Routes: make([]RouteItem, 0),
+	}
+	for pos := range routes {
+		route := &routes[pos]
+		if !route.Advertised {
+			continue
+		}
+		if !route.Enabled {
+			resData.PendingCount++
+		}
+		switch state {
+		case "pending":
+			if route.Enabled {
+				continue
+			}
+		case "enabled":
+			if !route.Enabled {
+				continue
+			}
+		case "primary":
+			if !route.Enabled || !route.IsPrimary {
+				continue
+			}
+		}
+		item, err := h.newRouteItem(org.AclPolicy, route)
+		if err != nil {
+			log.Error().Err(err).Str("route", route.String()).Msg("Failed to resolve autoApprovers for route")
+			h.doAPIResponse(w, "autoApprovers规则解析失败", nil)
+			return
+		}
+		resData.Routes = append(resData.Routes, item)
+	}
+	h.doAPIResponse(w, "", resData)
+}
+
+// 接受/admin/api/routes/:id/approve的Post请求，批准设备通告的路由
+func (h *Mirage) CAPIApproveRoute(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	h.setRouteApproval(w, r, true)
+}
+
+// 接受/admin/api/routes/:id/reject的Post请求，拒绝（禁用）设备通告的路由
+func (h *Mirage) CAPIRejectRoute(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	h.setRouteApproval(w, r, false)
+}
+
+func (h *Mirage) setRouteApproval(
+	w http.ResponseWriter,
+	r *http.Request,
+	approve bool,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	routeID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		h.doAPIResponse(w, "路由ID解析失败", nil)
+		return
+	}
+	route, err := h.GetOrgRoute(user.OrganizationID, routeID)
+	if err != nil {
+		h.doAPIResponse(w, "组织内无此路由", nil)
+		return
+	}
+	if !route.Advertised {
+		h.doAPIResponse(w, "该路由未被设备通告", nil)
+		return
+	}
+	auditState := func(route *Route) map[string]interface{} {
+		return map[string]interface{}{
+			"machine": route.Machine.GivenName,
+			"prefix":  netip.Prefix(route.Prefix).String(),
+			"enabled": route.Enabled,
+		}
+	}
+	auditBefore := auditState(route)
+
+	action := "route.approve"
+	if approve {
+		// 出口节点的IPv4与IPv6路由由EnableRoute一并启用
+		err = h.EnableRoute(route.ID)
+	} else {
+		action = "route.reject"
+		err = h.rejectRoute(route)
+	}
+	if err != nil {
+		h.doAPIResponse(w, "设置路由状态失败", nil)
+		return
+	}
+
+	route, err = h.GetOrgRoute(user.OrganizationID, routeID)
+	if err != nil {
+		h.doAPIResponse(w, "查询子网路由失败", nil)
+		return
+	}
+	h.recordAudit(h.newAuditEvent(r, user, action, "route", strconv.FormatUint(routeID, 10)).
+		SetBefore(auditBefore).
+		SetAfter(auditState(route)))
+
+	org, err := h.GetOrgnaizationByID(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "查询组织信息失败", nil)
+		return
+	}
+	item, err := h.newRouteItem(org.AclPolicy, route)
+	if err != nil {
+		h.doAPIResponse(w, "autoApprovers规则解析失败", nil)
+		return
+	}
+	h.doAPIResponse(w, "", item)
+}
+
+// rejectRoute 禁用路由，出口节点需同时禁用IPv4与IPv6路由
+func (h *Mirage) rejectRoute(route *Route) error {
+	if !route.isExitRoute() {
+		err := h.DisableRoute(route.ID)
+		if err != nil {
+			return err
+		}
+		h.setOrgLastStateChangeToNow(route.Machine.User.OrganizationID)
+
+		return nil
+	}
+
+	machineRoutes, err := h.GetMachineRoutes(&route.Machine)
+	if err != nil {
+		return err
+	}
+	for _, r := range machineRoutes {
+		if !r.isExitRoute() {
+			continue
+		}
+		if err := h.DisableRoute(r.ID); err != nil {
+			return err
+		}
+	}
+	h.setOrgLastStateChangeToNow(route.Machine.User.OrganizationID)
+
+	return nil
+}
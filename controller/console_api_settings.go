@@ -32,7 +32,7 @@ func (h *Mirage) getNetSettingAPI(
 		ServicesCollection: false, //未实现
 		HttpsEnabled:       false, //未实现
 		Provider:           user.Organization.Provider,
-		MachineAuthNeeded:  false, //未实现
+		MachineAuthNeeded:  user.Organization.DeviceApproval,
 		MaxKeyDurationDays: 180,
 		NetworkLockEnabled: false, //未实现
 	}
@@ -63,10 +63,51 @@ func (h *Mirage) ConsoleUpdateKeyExpiryAPI(
 		h.doAPIResponse(writer, "从请求获取新值失败:"+err.Error(), nil)
 		return
 	}
+	oldExpiryDuration := user.Organization.ExpiryDuration
 	err = h.UpdateUserKeyExpiry(user, uint(newExpiryDuration))
 	if err != nil {
 		h.doAPIResponse(writer, "更新密钥过期时长失败:"+err.Error(), nil)
 		return
 	}
+	h.recordAudit(h.newAuditEvent(req, user, "org.update_key_expiry", "organization", user.Organization.StableID).
+		SetBefore(map[string]uint{"maxKeyDurationDays": oldExpiryDuration}).
+		SetAfter(map[string]uint{"maxKeyDurationDays": uint(newExpiryDuration)}))
 	h.doAPIResponse(writer, "", uint(newExpiryDuration))
 }
+
+// 开启或关闭新设备审批，开启后新注册的设备需管理员批准才能接入网络
+func (h *Mirage) ConsoleUpdateDeviceApprovalAPI(
+	writer http.ResponseWriter,
+	req *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(writer, req)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(writer, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	if user.Role != RoleOwner {
+		h.doAPIResponse(writer, "用户没有该权限", nil)
+		return
+	}
+	reqData := make(map[string]bool)
+	err = json.NewDecoder(req.Body).Decode(&reqData)
+	if err != nil {
+		h.doAPIResponse(writer, "用户请求解析失败:"+err.Error(), nil)
+		return
+	}
+	enabled, ok := reqData["machineAuthNeeded"]
+	if !ok {
+		h.doAPIResponse(writer, "从请求获取新值失败", nil)
+		return
+	}
+	oldEnabled := user.Organization.DeviceApproval
+	err = h.UpdateOrgDeviceApproval(user.OrganizationID, enabled)
+	if err != nil {
+		h.doAPIResponse(writer, "更新设备审批设置失败:"+err.Error(), nil)
+		return
+	}
+	h.recordAudit(h.newAuditEvent(req, user, "org.update_device_approval", "organization", user.Organization.StableID).
+		SetBefore(map[string]bool{"machineAuthNeeded": oldEnabled}).
+		SetAfter(map[string]bool{"machineAuthNeeded": enabled}))
+	h.doAPIResponse(writer, "", enabled)
+}
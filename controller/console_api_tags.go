@@ -82,9 +82,13 @@ func (h *Mirage) CAPIPostTags(
 			acl.TagOwners = make(map[string][]string)
 		}
 		acl.TagOwners["tag:"+reqData.TagName] = reqData.Owners
+		if checkRes := h.testACLPolicyOfOrg(org, user); checkRes != nil {
+			h.doAPIErrorResponse(w, "ACL策略校验或tests断言失败", checkRes)
+			return
+		}
 		//aclPath := AbsolutePathFromConfigPath(ACLPath)
 		//err = h.SaveACLPolicy(aclPath)
-		err = h.SaveACLPolicyOfOrg(org)
+		err = h.SaveACLPolicyOfOrg(org, user)
 		if err != nil {
 			//delete(acl.TagOwners, "tag:"+reqData.TagName)
 			h.doAPIResponse(w, "保存ACL策略失败:"+err.Error(), nil)
@@ -103,6 +107,8 @@ func (h *Mirage) CAPIPostTags(
 			TagName: reqData.TagName,
 			Owners:  reqData.Owners,
 		}
+		h.recordAudit(h.newAuditEvent(r, user, "acl.create_tag", "tag", "tag:"+reqData.TagName).
+			SetAfter(map[string][]string{"owners": reqData.Owners}))
 		h.doAPIResponse(w, "", resData)
 	}
 }
@@ -122,13 +128,17 @@ func (h *Mirage) CAPIDelTags(
 		h.doAPIResponse(w, "用户组织信息获取失败", nil)
 	}
 	targetTagName := strings.TrimPrefix(r.URL.Path, "/admin/api/acls/tags/")
-	_, ok := org.AclPolicy.TagOwners["tag:"+targetTagName]
+	owners, ok := org.AclPolicy.TagOwners["tag:"+targetTagName]
 	if !ok {
 		h.doAPIResponse(w, "该标签不存在", nil)
 		return
 	}
 	delete(org.AclPolicy.TagOwners, "tag:"+targetTagName)
-	err = h.SaveACLPolicyOfOrg(org)
+	if checkRes := h.testACLPolicyOfOrg(org, user); checkRes != nil {
+		h.doAPIErrorResponse(w, "ACL策略校验或tests断言失败", checkRes)
+		return
+	}
+	err = h.SaveACLPolicyOfOrg(org, user)
 	if err != nil {
 		h.doAPIResponse(w, "保存ACL策略失败:"+err.Error(), nil)
 		return
@@ -149,5 +159,7 @@ func (h *Mirage) CAPIDelTags(
 			return
 		}
 	*/
+	h.recordAudit(h.newAuditEvent(r, user, "acl.delete_tag", "tag", "tag:"+targetTagName).
+		SetBefore(map[string][]string{"owners": owners}))
 	h.doAPIResponse(w, "", targetTagName)
 }
@@ -139,6 +139,9 @@ func (h *Mirage) CAPIPostUsers(
 			h.doAPIResponse(w, "修改用户角色失败:"+err.Error(), nil)
 			return
 		}
+		h.recordAudit(h.newAuditEvent(r, user, "user.transfer_owner", "user", reqData.UserID).
+			SetBefore(map[string]int64{"owner": user.ID}).
+			SetAfter(map[string]int64{"owner": targetUID}))
 		h.doAPIResponse(w, "", nil)
 	case "delete_user":
 		targetUID, err := strconv.ParseInt(reqData.UserID, 10, 64)
@@ -176,6 +179,13 @@ func (h *Mirage) CAPIPostUsers(
 			h.doAPIResponse(w, "目标用户删除失败:"+err.Error(), nil)
 			return
 		}
+		h.recordAudit(h.newAuditEvent(r, user, "user.delete", "user", reqData.UserID).
+			SetBefore(map[string]interface{}{
+				"name":        targetUser.Name,
+				"displayName": targetUser.Display_Name,
+				"role":        RoleStr[targetUser.Role],
+				"machines":    len(mlist),
+			}))
 		h.doAPIResponse(w, "", nil)
 	}
 }
@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type WorkloadIdentityItem struct {
+	Id          string             `json:"id"`
+	Created     string             `json:"created"`
+	Creator     string             `json:"creator"`
+	Description string             `json:"description"`
+	Issuer      string             `json:"issuer"`
+	Audience    string             `json:"audience"`
+	ClaimRules  WorkloadClaimRules `json:"claimRules"`
+	Tags        []string           `json:"tags"`
+	LastUsed    string             `json:"lastUsed"`
+	Revoked     string             `json:"revoked"`
+}
+
+type WorkloadIdentitiesData struct {
+	Trusts        []WorkloadIdentityItem `json:"trusts"`
+	RevokedTrusts []WorkloadIdentityItem `json:"revokedTrusts"`
+}
+
+// 请求报文：{"issuer":"https://token.actions.githubusercontent.com","audience":"","claimRules":{"repository":"myorg/*"},"tags":["tag:ci"],"description":"CI"}
+type REQWorkloadIdentity struct {
+	Issuer      string             `json:"issuer"`
+	Audience    string             `json:"audience"` // 为空时自动生成
+	ClaimRules  WorkloadClaimRules `json:"claimRules"`
+	Tags        []string           `json:"tags"`
+	Description string             `json:"description"`
+}
+
+func newWorkloadIdentityItem(trust *WorkloadIdentityTrust) WorkloadIdentityItem {
+	item := WorkloadIdentityItem{
+		Id:          trust.TrustID,
+		Created:     Time2SHString(*trust.CreatedAt),
+		Creator:     trust.Creator.Name,
+		Description: trust.Description,
+		Issuer:      trust.Issuer,
+		Audience:    trust.Audience,
+		ClaimRules:  trust.ClaimRules,
+		Tags:        trust.Tags,
+	}
+	if trust.LastUsedAt != nil {
+		item.LastUsed = Time2SHString(*trust.LastUsedAt)
+	}
+	if trust.RevokedAt != nil {
+		item.Revoked = Time2SHString(*trust.RevokedAt)
+	}
+
+	return item
+}
+
+// 接受/admin/api/workload-identities的Get请求，查询组织信任的工作负载身份签发方
+func (h *Mirage) CAPIGetWorkloadIdentities(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	trusts, err := h.ListWorkloadIdentityTrusts(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "工作负载身份信任查询失败", nil)
+		return
+	}
+	resData := WorkloadIdentitiesData{
+		Trusts:        make([]WorkloadIdentityItem, 0),
+		RevokedTrusts: make([]WorkloadIdentityItem, 0),
+	}
+	for i := range trusts {
+		item := newWorkloadIdentityItem(&trusts[i])
+		if trusts[i].RevokedAt == nil {
+			resData.Trusts = append(resData.Trusts, item)
+		} else {
+			resData.RevokedTrusts = append(resData.RevokedTrusts, item)
+		}
+	}
+	h.doAPIResponse(w, "", resData)
+}
+
+// 接受/admin/api/workload-identities的Post请求，新建工作负载身份信任
+func (h *Mirage) CAPIPostWorkloadIdentities(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	reqData := REQWorkloadIdentity{}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		h.doAPIResponse(w, "用户请求解析失败:"+err.Error(), nil)
+		return
+	}
+	trust, err := h.CreateWorkloadIdentityTrust(
+		user,
+		reqData.Issuer,
+		reqData.Audience,
+		reqData.ClaimRules,
+		reqData.Tags,
+		reqData.Description,
+	)
+	if err != nil {
+		h.doAPIResponse(w, "工作负载身份信任创建失败:"+err.Error(), nil)
+		return
+	}
+	h.recordAudit(h.newAuditEvent(r, user, "key.create_workload_identity", "workload_identity", trust.TrustID).
+		SetAfter(map[string]interface{}{
+			"issuer":      trust.Issuer,
+			"audience":    trust.Audience,
+			"claimRules":  trust.ClaimRules,
+			"tags":        trust.Tags,
+			"description": trust.Description,
+		}))
+	h.doAPIResponse(w, "", newWorkloadIdentityItem(trust))
+}
+
+// 注销工作负载身份信任执行DELETE方法api/workload-identities/:Id，已注册的设备不受影响
+func (h *Mirage) CAPIDelWorkloadIdentities(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	user, err := h.verifyTokenIDandGetUser(w, r)
+	if err != nil || user.CheckEmpty() {
+		h.doAPIResponse(w, "用户信息核对失败:"+err.Error(), nil)
+		return
+	}
+	trustID := mux.Vars(r)["id"]
+	trusts, err := h.ListWorkloadIdentityTrusts(user.OrganizationID)
+	if err != nil {
+		h.doAPIResponse(w, "工作负载身份信任查询失败", nil)
+		return
+	}
+	for _, trust := range trusts {
+		if trust.TrustID != trustID {
+			continue
+		}
+		if trust.RevokedAt != nil {
+			h.doAPIResponse(w, "该信任已被注销", nil)
+			return
+		}
+		if err := h.RevokeWorkloadIdentityTrust(&trust); err != nil {
+			h.doAPIResponse(w, "执行信任注销失败", nil)
+			return
+		}
+		h.recordAudit(h.newAuditEvent(r, user, "key.revoke_workload_identity", "workload_identity", trustID).
+			SetBefore(map[string]interface{}{
+				"issuer":     trust.Issuer,
+				"audience":   trust.Audience,
+				"claimRules": trust.ClaimRules,
+				"tags":       trust.Tags,
+			}))
+		h.doAPIResponse(w, "", trustID)
+		return
+	}
+	h.doAPIResponse(w, "该信任不存在", nil)
+}
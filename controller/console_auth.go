@@ -49,14 +49,14 @@ func (h *Mirage) doLogin(w http.ResponseWriter, r *http.Request) {
 	if strings.HasPrefix(nextURL, "/a/") {
 		aCode := strings.TrimPrefix(nextURL, "/a/")
 		aCodeC, ok := h.aCodeCache.Get(aCode)
-		if ok && aCodeC.(ACacheItem).uid == -1 {
-			stateCode = aCodeC.(ACacheItem).stateCode
+		if ok && aCodeC.uid == -1 {
+			stateCode = aCodeC.stateCode
 			stateCodeC, ok := h.stateCodeCache.Get(stateCode)
-			if ok && stateCodeC.(StateCacheItem).uid != -1 {
+			if ok && stateCodeC.uid != -1 {
 				h.ErrMessage(w, r, 400, "授权流程已进行")
 				return
 			}
-			stateCodeItem = stateCodeC.(StateCacheItem)
+			stateCodeItem = stateCodeC
 			stateCodeItem.provider = provider
 		}
 	}
@@ -200,7 +200,7 @@ func (h *Mirage) ConsoleAuth(next http.Handler) http.Handler {
 			http.Redirect(w, r, "/login?"+r.URL.RawQuery, http.StatusFound)
 			return
 		}
-		controlCodeItem := controlCodeC.(ControlCacheItem)
+		controlCodeItem := controlCodeC
 		user, err := h.GetUserByID(controlCodeItem.uid)
 		if err != nil {
 			log.Debug().
@@ -229,6 +229,15 @@ type APICheckRes struct {
 // API鉴权中间件
 func (h *Mirage) APIAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, AuthPrefix) {
+			token := strings.TrimSpace(strings.TrimPrefix(authHeader, AuthPrefix))
+			if strings.HasPrefix(token, oauthAccessTokenPrefix) {
+				h.oauthTokenAuth(next, w, r, token)
+				return
+			}
+			h.apiKeyAuth(next, w, r, token)
+			return
+		}
 		controlCodeCookie, err := r.Cookie("miragecontrol")
 		if err == http.ErrNoCookie {
 			log.Warn().Msg("未能从Cookie读取到OIDC Token！")
@@ -254,7 +263,7 @@ func (h *Mirage) APIAuth(next http.Handler) http.Handler {
 			json.NewEncoder(w).Encode(&renderData)
 			return
 		}
-		controlCodeItem := controlCodeC.(ControlCacheItem)
+		controlCodeItem := controlCodeC
 		user, err := h.GetUserByID(controlCodeItem.uid)
 		if err != nil {
 			log.Debug().
@@ -284,6 +293,79 @@ func (h *Mirage) APIAuth(next http.Handler) http.Handler {
 	})
 }
 
+// 使用API密钥（Authorization: Bearer）访问控制台API
+func (h *Mirage) apiKeyAuth(next http.Handler, w http.ResponseWriter, r *http.Request, fullKey string) {
+	renderData := APICheckRes{
+		NeedReauth: true,
+	}
+	status := http.StatusUnauthorized
+
+	apiKey, err := h.checkAPIKey(fullKey)
+	if err == nil {
+		var user *User
+		user, err = h.GetUserByID(tailcfg.UserID(apiKey.UserID))
+		switch {
+		case err != nil:
+			renderData.Reason = "用户查询失败"
+		case user.Role != RoleOwner:
+			renderData.Reason = "无相应权限"
+		case !apiKey.Allows(apiKeyScopeForRequest(r)):
+			renderData.Reason = "API密钥权限不足"
+			status = http.StatusForbidden
+		default:
+			next.ServeHTTP(w, withAPIKey(r, apiKey))
+			return
+		}
+	} else {
+		renderData.Reason = "API密钥校验失败"
+	}
+	log.Debug().
+		Caller().
+		Err(err).
+		Str("path", r.URL.Path).
+		Msg(renderData.Reason)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&renderData)
+}
+
+// 使用OAuth客户端签发的访问令牌（Authorization: Bearer）访问控制台API
+func (h *Mirage) oauthTokenAuth(next http.Handler, w http.ResponseWriter, r *http.Request, accessToken string) {
+	renderData := APICheckRes{
+		NeedReauth: true,
+	}
+	status := http.StatusUnauthorized
+
+	token, err := h.checkOAuthToken(accessToken)
+	if err == nil {
+		scope := oauthScopeForRequest(r)
+		if scope != "" && token.HasScope(scope) {
+			log.Info().
+				Str("client_id", token.ClientID).
+				Int64("org_id", token.OrganizationID).
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Msg("OAuth client API access")
+			next.ServeHTTP(w, withOAuthToken(r, token))
+			return
+		}
+		renderData.Reason = "访问令牌权限不足"
+		status = http.StatusForbidden
+	} else {
+		renderData.Reason = "访问令牌校验失败"
+	}
+	log.Debug().
+		Caller().
+		Err(err).
+		Str("path", r.URL.Path).
+		Msg(renderData.Reason)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&renderData)
+}
+
 func (h *Mirage) deviceRegPortal(
 	w http.ResponseWriter,
 	r *http.Request,
@@ -302,7 +384,7 @@ func (h *Mirage) deviceRegPortal(
 		h.ErrMessage(w, r, 400, "未知的鉴别码")
 		return
 	}
-	aCodeItem := aC.(ACacheItem)
+	aCodeItem := aC
 
 	// 无论哪种情形，当前没有control都应该跳转到login页面
 	controlCodeCookie, controlCodeErr := r.Cookie("miragecontrol")
@@ -328,7 +410,7 @@ func (h *Mirage) deviceRegPortal(
 		}
 	}
 	// 按TS官方做法似乎超过5分钟的control不能用于机器授权，跳转重新获取
-	controlCodeItem := controlCodeC.(ControlCacheItem)
+	controlCodeItem := controlCodeC
 	if time.Now().AddDate(0, 1, 0).Sub(controlCodeExpiration) > time.Minute*5 {
 		newQuery := r.URL.Query()
 		newQuery.Add("next_url", "/a/"+aCode)
@@ -395,7 +477,7 @@ func (h *Mirage) deviceReg(
 		h.ErrMessage(w, r, 400, "未知的鉴别码")
 		return
 	}
-	aCodeItem := aC.(ACacheItem)
+	aCodeItem := aC
 	// 无论哪种情形，当前没有control都应该跳转到login页面
 	controlCodeCookie, controlCodeErr := r.Cookie("miragecontrol")
 	if controlCodeErr == http.ErrNoCookie {
@@ -415,7 +497,7 @@ func (h *Mirage) deviceReg(
 		return
 	}
 	// 按TS官方做法似乎超过5分钟的control不能用于机器授权，跳转重新获取
-	controlCodeItem := controlCodeC.(ControlCacheItem)
+	controlCodeItem := controlCodeC
 	if time.Now().AddDate(0, 1, 0).Sub(controlCodeExpiration) > time.Minute*5 {
 		newQuery := r.URL.Query()
 		newQuery.Add("next_url", "/a/"+aCode)
@@ -452,7 +534,7 @@ func (h *Mirage) deviceReg(
 		return
 	}
 
-	h.longPollChanPool[aCode] <- "ok" // longpoll的救赎
+	h.signalLogin(aCode, "ok") // longpoll的救赎
 
 	Hostname := machine.GivenName
 	Netname := machine.User.Organization.Name
@@ -478,7 +560,7 @@ func (h *Mirage) oauthResponse(
 		h.ErrMessage(w, r, 409, "未知的state参数")
 		return
 	}
-	qStateItem := qStateC.(StateCacheItem)
+	qStateItem := qStateC
 	// 对于任何已经之前经过认证的stateCode都往目标URL跳转，由目标URL校验是否放行
 	if qStateItem.uid != -1 {
 		http.Redirect(w, r, qStateItem.nextURL, http.StatusFound)
@@ -639,7 +721,7 @@ func (h *Mirage) finishOauthResponse(
 		h.ErrMessage(w, r, 409, "未知的state参数")
 		return
 	}
-	stateItem := stateC.(StateCacheItem)
+	stateItem := stateC
 	// 对于任何已经之前经过认证的stateCode都往目标URL跳转，由目标URL校验是否放行
 	if stateItem.uid != -1 {
 		http.Redirect(w, r, stateItem.nextURL, http.StatusFound)
@@ -671,7 +753,7 @@ func (h *Mirage) finishOauthResponse(
 			}
 			machineControlCodeExpiration = time.Now().AddDate(0, 1, 0)
 		}
-		machineControlItem := machineControlCodes.(MachineControlCodeCacheItem)
+		machineControlItem := machineControlCodes
 		machineControlItem.controlCodes = append(machineControlItem.controlCodes, controlCode)
 		h.machineControlCodeCache.Set(machineKey.String(), machineControlItem, time.Until(machineControlCodeExpiration))
 	}
@@ -707,6 +789,61 @@ type MachineControlCodeCacheItem struct {
 	controlCodes []string
 }
 
+// 缓存项可能保存在副本共享的存储中，以下为其JSON编码
+
+type stateCacheItemJSON struct {
+	NextURL     string            `json:"nextURL"`
+	Provider    string            `json:"provider"`
+	UID         tailcfg.UserID    `json:"uid"`
+	UserName    string            `json:"userName"`
+	UserDisName string            `json:"userDisName"`
+	MachineKey  key.MachinePublic `json:"machineKey"`
+}
+
+func (item StateCacheItem) MarshalJSON() ([]byte, error) {
+	return json.Marshal(stateCacheItemJSON{
+		NextURL:     item.nextURL,
+		Provider:    item.provider,
+		UID:         item.uid,
+		UserName:    item.userName,
+		UserDisName: item.userDisName,
+		MachineKey:  item.machineKey,
+	})
+}
+
+func (item *StateCacheItem) UnmarshalJSON(data []byte) error {
+	v := stateCacheItemJSON{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*item = StateCacheItem{
+		nextURL:     v.NextURL,
+		provider:    v.Provider,
+		uid:         v.UID,
+		userName:    v.UserName,
+		userDisName: v.UserDisName,
+		machineKey:  v.MachineKey,
+	}
+
+	return nil
+}
+
+func (item ControlCacheItem) MarshalJSON() ([]byte, error) {
+	return json.Marshal(item.uid)
+}
+
+func (item *ControlCacheItem) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &item.uid)
+}
+
+func (item MachineControlCodeCacheItem) MarshalJSON() ([]byte, error) {
+	return json.Marshal(item.controlCodes)
+}
+
+func (item *MachineControlCodeCacheItem) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &item.controlCodes)
+}
+
 //go:embed templates/connectDevice.html
 var connectDeviceTemplate string
 
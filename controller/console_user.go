@@ -19,7 +19,7 @@ import (
 
 type UserReg struct {
 	Fp      string
-	reqIP   string
+	ReqIP   string
 	Name    string
 	SMSCode string
 }
@@ -107,7 +107,7 @@ func (h *Mirage) RegisterUserAPI(
 		}
 
 		newUserReg := UserReg{
-			reqIP:   reqAddr,
+			ReqIP:   reqAddr,
 			Name:    name,
 			SMSCode: newVerifyCode,
 		}
@@ -172,11 +172,10 @@ func (h *Mirage) RegisterUserAPI(
 	} else {
 		// 校验验证码流程
 		log.Info().Msg("用户返回校验码为: " + verifyCode)
-		if userRegInterface, ok := h.smsCodeCache.Get(mobile); ok {
-			regCacheInfo := userRegInterface.(UserReg)
-			if regCacheInfo.SMSCode == verifyCode /*&& regCacheInfo.reqIP == reqAddr*/ && regCacheInfo.Name == name {
+		if regCacheInfo, ok := h.smsCodeCache.Get(mobile); ok {
+			if regCacheInfo.SMSCode == verifyCode /*&& regCacheInfo.ReqIP == reqAddr*/ && regCacheInfo.Name == name {
 
-				if regCacheInfo.reqIP != reqAddr {
+				if regCacheInfo.ReqIP != reqAddr {
 					resMsg := "创建用户失败： IP与获取验证码时不同！"
 					h.doAPIResponse(writer, resMsg, nil)
 				} else {
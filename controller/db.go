@@ -8,8 +8,6 @@ import (
 	"net/netip"
 	"time"
 
-	//"gorm.io/driver/sqlite"
-	"github.com/glebarez/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"tailscale.com/tailcfg"
@@ -29,87 +27,58 @@ func (dp *DataPool) DB() *gorm.DB {
 }
 
 func (dp *DataPool) InitCockpitDB() error {
-	err := dp.db.AutoMigrate(&SysAdmin{})
-	if err != nil {
-		return err
-	}
-
-	err = dp.db.AutoMigrate(&SysConfig{})
-	if err != nil {
-		return err
-	}
-
-	err = dp.db.AutoMigrate(&NaviRegion{})
-	if err != nil {
-		return err
-	}
-	err = dp.db.AutoMigrate(&NaviNode{})
-	if err != nil {
-		return err
-	}
-
-	return err
+	return dp.migrateSchema(schemaScopeCockpit)
 }
 
 func (dp *DataPool) InitMirageDB() error {
-	err := dp.db.AutoMigrate(&User{})
-	if err != nil {
-		return err
-	}
+	return dp.migrateSchema(schemaScopeMirage)
+}
 
-	err = dp.db.AutoMigrate(&Route{})
+func (dp *DataPool) OpenDB() error {
+	log := logger.Default.LogMode(logger.Silent)
+
+	dbCfg := LoadDBConfig()
+	dialector, err := dbCfg.Dialector()
 	if err != nil {
 		return err
 	}
 
-	err = dp.db.AutoMigrate(&Machine{})
+	db, err := gorm.Open(
+		dialector,
+		&gorm.Config{
+			DisableForeignKeyConstraintWhenMigrating: true,
+			Logger:                                   log,
+		},
+	)
 	if err != nil {
 		return err
 	}
-
-	err = dp.db.AutoMigrate(&PreAuthKey{})
-	if err != nil {
+	if err = registerDBMetrics(db); err != nil {
 		return err
 	}
 
-	/*
-		err = dp.db.AutoMigrate(&PreAuthKeyACLTag{})
-		if err != nil {
-			return err
-		}
-	*/
-	err = dp.db.AutoMigrate(&Organization{})
+	sqlDB, err := db.DB()
 	if err != nil {
 		return err
 	}
 
-	return err
-}
-
-func (dp *DataPool) OpenDB() error {
-	log := logger.Default.LogMode(logger.Silent)
+	switch dbCfg.Type {
+	case DBTypePostgres:
+		sqlDB.SetMaxIdleConns(dbCfg.MaxIdleConns)
+		sqlDB.SetMaxOpenConns(dbCfg.MaxOpenConns)
+		sqlDB.SetConnMaxIdleTime(time.Hour)
 
-	db, err := gorm.Open(
-		sqlite.Open(AbsolutePathFromConfigPath(DatabasePath)+"?_synchronous=1&_journal_mode=WAL"),
-		&gorm.Config{
-			DisableForeignKeyConstraintWhenMigrating: true,
-			Logger:                                   log,
-		},
-	)
-
-	db.Exec("PRAGMA foreign_keys=ON")
-
-	// The pure Go SQLite library does not handle locking in
-	// the same way as the C based one and we cant use the gorm
-	// connection pool as of 2022/02/23.
-	sqlDB, _ := db.DB()
-	sqlDB.SetMaxIdleConns(1)
-	sqlDB.SetMaxOpenConns(1)
-	sqlDB.SetConnMaxIdleTime(time.Hour)
+	default:
+		db.Exec("PRAGMA foreign_keys=ON")
 
-	if err != nil {
-		return err
+		// The pure Go SQLite library does not handle locking in
+		// the same way as the C based one and we cant use the gorm
+		// connection pool as of 2022/02/23.
+		sqlDB.SetMaxIdleConns(1)
+		sqlDB.SetMaxOpenConns(1)
+		sqlDB.SetConnMaxIdleTime(time.Hour)
 	}
+
 	dp.db = db
 
 	return nil
@@ -161,6 +130,9 @@ func (i IPPrefix) String() string {
 
 func (i *IPPrefix) Scan(destination interface{}) error {
 	switch value := destination.(type) {
+	case []byte:
+		return i.Scan(string(value))
+
 	case string:
 		prefix, err := netip.ParsePrefix(value)
 		if err != nil {
@@ -229,8 +201,9 @@ func (i StringList) Value() (driver.Value, error) {
 type SplitDNS []SplitDNSItem
 
 type SplitDNSItem struct {
-	Domain string   `json:"domain"`
-	NS     []string `json:"ns"`
+	Domain   string   `json:"domain"`
+	NS       []string `json:"ns"`
+	Fallback []string `json:"fallback,omitempty"` // 在NS之后依次尝试的域名服务器
 }
 
 func (i *SplitDNS) Scan(destination interface{}) error {
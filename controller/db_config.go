@@ -0,0 +1,156 @@
+package controller
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+
+	dexSQL "github.com/dexidp/dex/storage/sql"
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+const (
+	DBTypeSqlite   = "sqlite"
+	DBTypePostgres = "postgres"
+
+	defaultPostgresPort         = 5432
+	defaultPostgresMaxOpenConns = 32
+	defaultPostgresMaxIdleConns = 8
+
+	ErrUnsupportedDBType = Error("unsupported database type")
+)
+
+// DBConfig 描述DataPool所使用的存储后端
+// 默认使用配置目录下的SQLite文件，设置MIRAGE_DB_TYPE=postgres后改用PostgreSQL
+type DBConfig struct {
+	Type string
+
+	// PostgreSQL
+	Host     string
+	Port     int
+	Name     string
+	User     string
+	Password string
+	SSLMode  string
+
+	MaxOpenConns int
+	MaxIdleConns int
+}
+
+// LoadDBConfig 从环境变量读取数据库配置
+//
+//	MIRAGE_DB_TYPE           sqlite(默认) | postgres
+//	MIRAGE_DB_HOST           PostgreSQL地址，默认localhost
+//	MIRAGE_DB_PORT           PostgreSQL端口，默认5432
+//	MIRAGE_DB_NAME           数据库名，默认mirage
+//	MIRAGE_DB_USER           用户名
+//	MIRAGE_DB_PASSWORD       密码
+//	MIRAGE_DB_SSLMODE        disable(默认) | require | verify-ca | verify-full
+//	MIRAGE_DB_MAX_OPEN_CONNS 连接池最大连接数
+//	MIRAGE_DB_MAX_IDLE_CONNS 连接池最大空闲连接数
+func LoadDBConfig() DBConfig {
+	cfg := DBConfig{
+		Type:         DBTypeSqlite,
+		Host:         "localhost",
+		Port:         defaultPostgresPort,
+		Name:         "mirage",
+		SSLMode:      "disable",
+		MaxOpenConns: defaultPostgresMaxOpenConns,
+		MaxIdleConns: defaultPostgresMaxIdleConns,
+	}
+
+	if v, ok := os.LookupEnv("MIRAGE_DB_TYPE"); ok && v != "" {
+		cfg.Type = v
+	}
+	if cfg.Type == "sqlite3" {
+		cfg.Type = DBTypeSqlite
+	}
+	if cfg.Type == "postgresql" || cfg.Type == "pgsql" {
+		cfg.Type = DBTypePostgres
+	}
+	if v, ok := os.LookupEnv("MIRAGE_DB_HOST"); ok && v != "" {
+		cfg.Host = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("MIRAGE_DB_PORT")); err == nil && v > 0 {
+		cfg.Port = v
+	}
+	if v, ok := os.LookupEnv("MIRAGE_DB_NAME"); ok && v != "" {
+		cfg.Name = v
+	}
+	cfg.User = os.Getenv("MIRAGE_DB_USER")
+	cfg.Password = os.Getenv("MIRAGE_DB_PASSWORD")
+	if v, ok := os.LookupEnv("MIRAGE_DB_SSLMODE"); ok && v != "" {
+		cfg.SSLMode = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("MIRAGE_DB_MAX_OPEN_CONNS")); err == nil && v > 0 {
+		cfg.MaxOpenConns = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("MIRAGE_DB_MAX_IDLE_CONNS")); err == nil && v > 0 {
+		cfg.MaxIdleConns = v
+	}
+
+	return cfg
+}
+
+// PostgresDSN 生成pgx可识别的连接串
+func (c DBConfig) PostgresDSN() string {
+	dsn := url.URL{
+		Scheme: "postgres",
+		Host:   fmt.Sprintf("%s:%d", c.Host, c.Port),
+		Path:   "/" + c.Name,
+	}
+	if c.User != "" {
+		if c.Password != "" {
+			dsn.User = url.UserPassword(c.User, c.Password)
+		} else {
+			dsn.User = url.User(c.User)
+		}
+	}
+	query := url.Values{}
+	query.Set("sslmode", c.SSLMode)
+	dsn.RawQuery = query.Encode()
+
+	return dsn.String()
+}
+
+func (c DBConfig) Dialector() (gorm.Dialector, error) {
+	switch c.Type {
+	case DBTypeSqlite:
+		return sqlite.Open(AbsolutePathFromConfigPath(DatabasePath) + "?_synchronous=1&_journal_mode=WAL"), nil
+	case DBTypePostgres:
+		return postgres.Open(c.PostgresDSN()), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedDBType, c.Type)
+	}
+}
+
+// DexStorage Dex与Mirage共用同一个数据库
+func (c DBConfig) DexStorage() DexStorage {
+	if c.Type == DBTypePostgres {
+		return DexStorage{
+			Type: "postgres",
+			Config: &dexSQL.Postgres{
+				NetworkDB: dexSQL.NetworkDB{
+					Database: c.Name,
+					User:     c.User,
+					Password: c.Password,
+					Host:     c.Host,
+					Port:     uint16(c.Port),
+				},
+				SSL: dexSQL.SSL{
+					Mode: c.SSLMode,
+				},
+			},
+		}
+	}
+
+	return DexStorage{
+		Type: "sqlite3", //DexDBType,
+		Config: &dexSQL.SQLite3{
+			File: AbsolutePathFromConfigPath(DatabasePath), //DexDBPath),
+		},
+	}
+}
@@ -0,0 +1,259 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	ErrSchemaTooNew = Error("database schema is newer than this binary")
+
+	schemaScopeCockpit = "cockpit"
+	schemaScopeMirage  = "mirage"
+)
+
+// SchemaVersion 记录每个已执行的迁移步骤，某个scope的当前版本为其最大的Version
+type SchemaVersion struct {
+	ID        uint64 `gorm:"primary_key"`
+	Scope     string `gorm:"uniqueIndex:idx_schema_scope_version;not null"`
+	Version   int    `gorm:"uniqueIndex:idx_schema_scope_version;not null"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (SchemaVersion) TableName() string {
+	return "schema_version"
+}
+
+// schemaMigration 是一个编号的升级步骤，每一步在独立事务中执行
+// 步骤一经发布不得修改或重新编号，新的变更只能追加在列表末尾
+// 步骤只能迁移db_migrations_schema.go中该版本的冻结结构，不得引用运行时模型
+// 重命名列、回填数据等无法由AutoMigrate完成的变更直接在Up中使用tx.Migrator()和tx.Exec实现
+type schemaMigration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+func autoMigrateStep(models ...interface{}) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		return tx.AutoMigrate(models...)
+	}
+}
+
+var cockpitMigrations = []schemaMigration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up:      autoMigrateStep(&schemaV1SysAdmin{}, &schemaV1SysConfig{}, &schemaV1NaviRegion{}, &schemaV1NaviNode{}),
+	},
+	{
+		Version: 2,
+		Name:    "log_sinks",
+		Up:      autoMigrateStep(&schemaV2SysConfig{}),
+	},
+	{
+		Version: 3,
+		Name:    "smtp_config",
+		Up:      autoMigrateStep(&schemaV3SysConfig{}),
+	},
+	{
+		Version: 4,
+		Name:    "navi_outbox",
+		Up:      autoMigrateStep(&schemaV4NaviOutboxEntry{}, &schemaV4NaviSyncState{}),
+	},
+}
+
+var mirageMigrations = []schemaMigration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up: autoMigrateStep(
+			&schemaV1User{}, &schemaV1Route{}, &schemaV1Machine{}, &schemaV1PreAuthKey{}, &schemaV1Organization{}),
+	},
+	{
+		Version: 2,
+		Name:    "acl_policy_revisions",
+		Up:      autoMigrateStep(&schemaV2Organization{}, &schemaV2ACLPolicyRevision{}),
+	},
+	{
+		Version: 3,
+		Name:    "api_keys",
+		Up:      autoMigrateStep(&schemaV3APIKey{}),
+	},
+	{
+		Version: 4,
+		Name:    "oauth_clients",
+		Up:      autoMigrateStep(&schemaV4OAuthClient{}),
+	},
+	{
+		Version: 5,
+		Name:    "audit_events",
+		Up:      autoMigrateStep(&schemaV5AuditEvent{}),
+	},
+	{
+		Version: 6,
+		Name:    "preauth_key_limits",
+		Up:      autoMigrateStep(&schemaV6PreAuthKey{}, &schemaV6PreAuthKeyUse{}),
+	},
+	{
+		Version: 7,
+		Name:    "hash_preauth_keys",
+		Up:      hashLegacyPreAuthKeys,
+	},
+	{
+		Version: 8,
+		Name:    "workload_identity_trusts",
+		Up:      autoMigrateStep(&schemaV8WorkloadIdentityTrust{}),
+	},
+	{
+		Version: 9,
+		Name:    "route_groups",
+		Up:      autoMigrateStep(&schemaV9Route{}, &schemaV9RouteGroup{}, &schemaV9RouteFailoverEvent{}),
+	},
+	{
+		Version: 10,
+		Name:    "org_dns_extra_records",
+		Up:      autoMigrateStep(&schemaV10Organization{}),
+	},
+	{
+		Version: 11,
+		Name:    "org_dns_resolver_options",
+		Up:      autoMigrateStep(&schemaV11Organization{}),
+	},
+	{
+		Version: 12,
+		Name:    "device_approval",
+		Up:      autoMigrateStep(&schemaV12Organization{}, &schemaV12Machine{}, &schemaV12PreAuthKey{}),
+	},
+	{
+		Version: 13,
+		Name:    "expiry_notifications",
+		Up:      autoMigrateStep(&schemaV13Organization{}, &schemaV13ExpiryNotification{}),
+	},
+	{
+		Version: 14,
+		Name:    "cluster_state",
+		Up:      autoMigrateStep(&schemaV14ClusterCacheEntry{}, &schemaV14ClusterStateChange{}),
+	},
+}
+
+var schemaMigrations = map[string][]schemaMigration{
+	schemaScopeCockpit: cockpitMigrations,
+	schemaScopeMirage:  mirageMigrations,
+}
+
+func latestSchemaVersion(steps []schemaMigration) int {
+	if len(steps) == 0 {
+		return 0
+	}
+
+	return steps[len(steps)-1].Version
+}
+
+func (dp *DataPool) schemaVersion(scope string) (int, error) {
+	var version int
+	err := dp.db.Model(&SchemaVersion{}).
+		Where(&SchemaVersion{Scope: scope}).
+		Select("COALESCE(MAX(version), 0)").
+		Scan(&version).Error
+
+	return version, err
+}
+
+// checkSchemaVersions 拒绝在由更新版本程序迁移过的数据库上启动
+func (dp *DataPool) checkSchemaVersions() error {
+	if err := dp.db.AutoMigrate(&SchemaVersion{}); err != nil {
+		return err
+	}
+
+	for scope, steps := range schemaMigrations {
+		current, err := dp.schemaVersion(scope)
+		if err != nil {
+			return err
+		}
+		if latest := latestSchemaVersion(steps); current > latest {
+			return fmt.Errorf("%w: %s schema is at version %d, binary supports up to %d",
+				ErrSchemaTooNew, scope, current, latest)
+		}
+	}
+
+	return nil
+}
+
+// migrateSchema 依次执行scope中尚未应用的步骤
+func (dp *DataPool) migrateSchema(scope string) error {
+	if err := dp.checkSchemaVersions(); err != nil {
+		return err
+	}
+
+	steps := schemaMigrations[scope]
+	current, err := dp.schemaVersion(scope)
+	if err != nil {
+		return err
+	}
+	if current == latestSchemaVersion(steps) {
+		return nil
+	}
+
+	// 引入版本表之前的数据库版本为0，但已有数据，同样需要备份
+	if current > 0 || dp.db.Migrator().HasTable(&SysConfig{}) {
+		if err := dp.backupDB(scope, current); err != nil {
+			return err
+		}
+	}
+
+	for _, step := range steps {
+		if step.Version <= current {
+			continue
+		}
+
+		err := dp.db.Transaction(func(tx *gorm.DB) error {
+			if err := step.Up(tx); err != nil {
+				return err
+			}
+
+			return tx.Create(&SchemaVersion{
+				Scope:     scope,
+				Version:   step.Version,
+				Name:      step.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migrate %s schema to version %d (%s): %w", scope, step.Version, step.Name, err)
+		}
+
+		log.Info().
+			Str("scope", scope).
+			Int("version", step.Version).
+			Str("name", step.Name).
+			Msg("Applied schema migration")
+	}
+
+	return nil
+}
+
+// backupDB 在升级已有的SQLite数据库前保存一份快照，PostgreSQL依赖每一步的事务
+func (dp *DataPool) backupDB(scope string, version int) error {
+	if dp.db.Dialector.Name() != DBTypeSqlite {
+		return nil
+	}
+
+	backupPath := fmt.Sprintf("%s.%s-v%d-%s.bak",
+		AbsolutePathFromConfigPath(DatabasePath), scope, version, time.Now().Format("20060102150405"))
+	if _, err := os.Stat(backupPath); err == nil {
+		return nil
+	}
+
+	if err := dp.db.Exec("VACUUM INTO ?", backupPath).Error; err != nil {
+		return fmt.Errorf("backup database before migration: %w", err)
+	}
+	log.Info().Str("path", backupPath).Msg("Database backed up before schema migration")
+
+	return nil
+}
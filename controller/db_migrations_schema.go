@@ -0,0 +1,536 @@
+package controller
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 本文件保存每个迁移步骤使用的冻结表结构，与运行时模型相互独立
+// 模型结构后续演进不会改变已发布版本号所描述的表结构
+// 新建表的步骤使用完整快照，为已有表加列的步骤只列出本版本新增的列
+// 关联字段不产生列（迁移时不创建外键约束），快照中省略
+
+// cockpit v1 baseline
+
+type schemaV1SysAdmin struct {
+	gorm.Model
+	AdminCredential AdminCredential `gorm:"not null"`
+}
+
+func (schemaV1SysAdmin) TableName() string {
+	return "sys_admins"
+}
+
+type schemaV1SysConfig struct {
+	gorm.Model
+
+	ServerURL             string
+	ServerKey             string
+	Addr                  string   `gorm:"default:':8080'"`
+	Mip4                  IPPrefix `gorm:"default:'100.64.0.0/10'"`
+	Mip6                  IPPrefix `gorm:"default:'fd7a:115c:a1e0::/48'"`
+	Basedomain            string   `gorm:"default:'mira.net'"`
+	RouteAccessDueMachine bool     `gorm:"default:false"`
+
+	EsUrl string
+	EsKey string
+
+	WXScanURL string
+
+	SMSConfig SMSConfig
+
+	IdaasConfig ALIConfig
+
+	DexSecret string
+
+	MicrosoftCfg MicrosoftCfg
+	GithubCfg    GithubCfg
+	GoogleCfg    GoogleCfg
+	AppleCfg     AppleCfg
+
+	NaviDeployPub string
+	NaviDeployKey string
+	ClientVersion ClientVersionInfo
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (schemaV1SysConfig) TableName() string {
+	return "sys_configs"
+}
+
+type schemaV1NaviRegion struct {
+	ID         int    `gorm:"primary_key;unique;not null"`
+	OrgID      int64  `gorm:";not null"`
+	RegionCode string `gorm:"not null"`
+	RegionName string `gorm:"not null"`
+}
+
+func (schemaV1NaviRegion) TableName() string {
+	return "navi_regions"
+}
+
+type schemaV1NaviNode struct {
+	ID           string `gorm:"primary_key;unique;not null"`
+	NaviKey      string
+	NaviRegionID int `gorm:"not null"`
+	HostName     string
+	IPv4         string
+	IPv6         string
+	NoSTUN       bool
+	STUNPort     int
+	NoDERP       bool
+	DERPPort     int
+	SSHAddr      string
+	SSHPwd       string
+	DNSProvider  string
+	DNSID        string
+	DNSKey       string
+	Arch         string
+	Statics      NaviStatus
+}
+
+func (schemaV1NaviNode) TableName() string {
+	return "navi_nodes"
+}
+
+// cockpit v2 log_sinks
+
+type schemaV2SysConfig struct {
+	LogSinks LogSinkConfigs
+}
+
+func (schemaV2SysConfig) TableName() string {
+	return "sys_configs"
+}
+
+// cockpit v3 smtp_config
+
+type schemaV3SysConfig struct {
+	SMTPConfig SMTPConfig
+}
+
+func (schemaV3SysConfig) TableName() string {
+	return "sys_configs"
+}
+
+// cockpit v4 navi_outbox
+
+type schemaV4NaviOutboxEntry struct {
+	ID            uint64 `gorm:"primaryKey"`
+	NaviID        string `gorm:"index;not null"`
+	SeqNum        int
+	AddNode       string
+	RemoveNode    string
+	FullSync      bool
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+}
+
+func (schemaV4NaviOutboxEntry) TableName() string {
+	return "navi_outbox_entries"
+}
+
+type schemaV4NaviSyncState struct {
+	NaviID         string `gorm:"primaryKey"`
+	State          string
+	NextSeq        int
+	AckedSeq       int
+	Pending        int
+	LastAckAt      *time.Time
+	LastFullSyncAt *time.Time
+	LastError      string
+	PushFullSync   bool
+	LeaseOwner     string
+	LeaseUntil     *time.Time
+	UpdatedAt      time.Time
+}
+
+func (schemaV4NaviSyncState) TableName() string {
+	return "navi_sync_states"
+}
+
+// mirage v1 baseline
+
+type schemaV1User struct {
+	ID             int64  `gorm:"primary_key;unique;not null"`
+	StableID       string `gorm:"unique"`
+	Name           string `gorm:"uniqueIndex:idx_user_org_id"`
+	OrganizationID int64  `gorm:"uniqueIndex:idx_user_org_id"`
+	Display_Name   string
+	Role           int64
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+func (schemaV1User) TableName() string {
+	return "users"
+}
+
+type schemaV1Route struct {
+	ID         uint64 `gorm:"primaryKey"`
+	MachineID  int64
+	Prefix     IPPrefix
+	Advertised bool
+	Enabled    bool
+	IsPrimary  bool
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (schemaV1Route) TableName() string {
+	return "routes"
+}
+
+type schemaV1Machine struct {
+	ID                   int64  `gorm:"primary_key;unique;not null"`
+	MachineKey           string `gorm:"type:varchar(64);"`
+	NodeKey              string
+	DiscoKey             string
+	IPAddresses          MachineAddresses
+	Hostname             string
+	GivenName            string `gorm:"type:varchar(63)"`
+	AutoGenName          bool   `gorm:"default:true"`
+	UserID               int64
+	RegisterMethod       string
+	ForcedTags           StringList
+	AuthKeyID            uint
+	LastSeen             *time.Time
+	LastSuccessfulUpdate *time.Time
+	Expiry               *time.Time
+	HostInfo             HostInfo
+	Endpoints            StringList
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+}
+
+func (schemaV1Machine) TableName() string {
+	return "machines"
+}
+
+type schemaV1PreAuthKey struct {
+	ID         uint64 `gorm:"primary_key"`
+	Key        string
+	UserID     int64
+	Reusable   bool
+	Ephemeral  bool `gorm:"default:false"`
+	Used       bool `gorm:"default:false"`
+	ACLTags    StringList
+	CreatedAt  *time.Time
+	Expiration *time.Time
+}
+
+func (schemaV1PreAuthKey) TableName() string {
+	return "pre_auth_keys"
+}
+
+type schemaV1Organization struct {
+	ID             int64  `gorm:"primary_key;unique;not null"`
+	StableID       string `gorm:"unique"`
+	Name           string `gorm:"uniqueIndex:idx_name_provider"`
+	Provider       string `gorm:"uniqueIndex:idx_name_provider"`
+	ExpiryDuration uint   `gorm:"default:180"`
+	EnableMagic    bool   `gorm:"default:false"`
+	MagicDnsDomain string
+	OverrideLocal  bool `gorm:"default:false"`
+	Nameservers    StringList
+	SplitDns       SplitDNS
+	AclPolicy      *ACLPolicy
+	NaviBanList    NaviBanList
+	NaviDeployKey  string
+	NaviDeployPub  string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+func (schemaV1Organization) TableName() string {
+	return "organizations"
+}
+
+// mirage v2 acl_policy_revisions
+
+type schemaV2Organization struct {
+	AclPolicyText string
+}
+
+func (schemaV2Organization) TableName() string {
+	return "organizations"
+}
+
+type schemaV2ACLPolicyRevision struct {
+	ID             uint64 `gorm:"primary_key"`
+	OrganizationID int64  `gorm:"index"`
+	UserID         int64
+	UserName       string
+	Action         string
+	RollbackFrom   uint64
+	Version        string
+	PolicyText     string
+	CreatedAt      time.Time
+}
+
+func (schemaV2ACLPolicyRevision) TableName() string {
+	return "acl_policy_revisions"
+}
+
+// mirage v3 api_keys
+
+type schemaV3APIKey struct {
+	ID          uint64 `gorm:"primary_key"`
+	KeyID       string `gorm:"uniqueIndex"`
+	Salt        string
+	Hash        string
+	UserID      int64 `gorm:"index"`
+	Scope       string
+	Description string
+	CreatedAt   *time.Time
+	Expiration  *time.Time
+	LastUsedAt  *time.Time
+	RevokedAt   *time.Time
+}
+
+func (schemaV3APIKey) TableName() string {
+	return "api_keys"
+}
+
+// mirage v4 oauth_clients
+
+type schemaV4OAuthClient struct {
+	ID             uint64 `gorm:"primary_key"`
+	ClientID       string `gorm:"uniqueIndex"`
+	Salt           string
+	Hash           string
+	OrganizationID int64 `gorm:"index"`
+	CreatorID      int64
+	Scopes         StringList
+	Tags           StringList
+	Description    string
+	CreatedAt      *time.Time
+	LastUsedAt     *time.Time
+	RevokedAt      *time.Time
+}
+
+func (schemaV4OAuthClient) TableName() string {
+	return "o_auth_clients"
+}
+
+// mirage v5 audit_events
+
+type schemaV5AuditEvent struct {
+	ID             uint64 `gorm:"primary_key"`
+	OrganizationID int64  `gorm:"index"`
+	ActorType      string
+	ActorID        string
+	ActorName      string
+	Action         string `gorm:"index"`
+	TargetType     string
+	TargetID       string
+	Before         string
+	After          string
+	SourceIP       string
+	CreatedAt      time.Time `gorm:"index"`
+}
+
+func (schemaV5AuditEvent) TableName() string {
+	return "audit_events"
+}
+
+// mirage v6 preauth_key_limits
+
+type schemaV6PreAuthKey struct {
+	Description     string
+	MaxUses         int `gorm:"default:0"`
+	UseCount        int `gorm:"default:0"`
+	SourceCIDRs     StringList
+	GivenNamePrefix string
+}
+
+func (schemaV6PreAuthKey) TableName() string {
+	return "pre_auth_keys"
+}
+
+type schemaV6PreAuthKeyUse struct {
+	ID           uint64 `gorm:"primary_key"`
+	PreAuthKeyID uint64 `gorm:"index"`
+	MachineID    int64
+	MachineName  string
+	SourceIP     string
+	CreatedAt    time.Time
+}
+
+func (schemaV6PreAuthKeyUse) TableName() string {
+	return "pre_auth_key_uses"
+}
+
+// mirage v7 hash_preauth_keys
+
+type schemaV7PreAuthKey struct {
+	KeyID string `gorm:"index"`
+	Salt  string
+	Hash  string
+}
+
+func (schemaV7PreAuthKey) TableName() string {
+	return "pre_auth_keys"
+}
+
+// mirage v8 workload_identity_trusts
+
+type schemaV8WorkloadIdentityTrust struct {
+	ID             uint64 `gorm:"primary_key"`
+	TrustID        string `gorm:"uniqueIndex"`
+	OrganizationID int64  `gorm:"index;uniqueIndex:idx_workload_org_issuer_audience,where:revoked_at IS NULL"`
+	CreatorID      int64
+	Description    string
+	Issuer         string `gorm:"uniqueIndex:idx_workload_org_issuer_audience"`
+	Audience       string `gorm:"uniqueIndex:idx_workload_org_issuer_audience"`
+	ClaimRules     WorkloadClaimRules
+	Tags           StringList
+	CreatedAt      *time.Time
+	LastUsedAt     *time.Time
+	RevokedAt      *time.Time
+}
+
+func (schemaV8WorkloadIdentityTrust) TableName() string {
+	return "workload_identity_trusts"
+}
+
+// mirage v9 route_groups
+
+type schemaV9Route struct {
+	Priority     int
+	HealthySince *time.Time
+}
+
+func (schemaV9Route) TableName() string {
+	return "routes"
+}
+
+type schemaV9RouteGroup struct {
+	ID              uint64   `gorm:"primaryKey"`
+	OrganizationID  int64    `gorm:"uniqueIndex:idx_route_group_org_prefix;not null"`
+	Prefix          IPPrefix `gorm:"uniqueIndex:idx_route_group_org_prefix;not null"`
+	Preempt         bool
+	HoldDownSeconds int
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+func (schemaV9RouteGroup) TableName() string {
+	return "route_groups"
+}
+
+type schemaV9RouteFailoverEvent struct {
+	ID             uint64   `gorm:"primaryKey"`
+	OrganizationID int64    `gorm:"index"`
+	Prefix         IPPrefix `gorm:"index"`
+	FromMachineID  int64
+	FromMachine    string
+	ToMachineID    int64
+	ToMachine      string
+	Reason         string
+	CreatedAt      time.Time `gorm:"index"`
+}
+
+func (schemaV9RouteFailoverEvent) TableName() string {
+	return "route_failover_events"
+}
+
+// mirage v10 org_dns_extra_records
+
+type schemaV10Organization struct {
+	ExtraRecords DNSRecords
+}
+
+func (schemaV10Organization) TableName() string {
+	return "organizations"
+}
+
+// mirage v11 org_dns_resolver_options
+
+type schemaV11Organization struct {
+	SearchDomains StringList
+	ResolverOpts  DNSResolverOptions
+}
+
+func (schemaV11Organization) TableName() string {
+	return "organizations"
+}
+
+// mirage v12 device_approval
+
+type schemaV12Organization struct {
+	DeviceApproval bool `gorm:"default:false"`
+}
+
+func (schemaV12Organization) TableName() string {
+	return "organizations"
+}
+
+type schemaV12Machine struct {
+	ApprovalState string
+	ApprovalBy    string
+	ApprovalAt    *time.Time
+}
+
+func (schemaV12Machine) TableName() string {
+	return "machines"
+}
+
+type schemaV12PreAuthKey struct {
+	KeyExpiryDays int  `gorm:"default:0"`
+	PreApproved   bool `gorm:"default:false"`
+}
+
+func (schemaV12PreAuthKey) TableName() string {
+	return "pre_auth_keys"
+}
+
+// mirage v13 expiry_notifications
+
+type schemaV13Organization struct {
+	ExpiryNotice ExpiryNoticePolicy
+}
+
+func (schemaV13Organization) TableName() string {
+	return "organizations"
+}
+
+type schemaV13ExpiryNotification struct {
+	ID        uint64 `gorm:"primaryKey"`
+	MachineID int64  `gorm:"uniqueIndex:idx_expiry_notification;not null"`
+	Expiry    int64  `gorm:"uniqueIndex:idx_expiry_notification;not null"`
+	Days      int    `gorm:"uniqueIndex:idx_expiry_notification;not null"`
+	Channels  StringList
+	CreatedAt time.Time
+}
+
+func (schemaV13ExpiryNotification) TableName() string {
+	return "expiry_notifications"
+}
+
+// mirage v14 cluster_state
+
+type schemaV14ClusterCacheEntry struct {
+	Bucket    string `gorm:"primaryKey"`
+	Key       string `gorm:"primaryKey"`
+	Value     []byte
+	ExpiresAt *time.Time `gorm:"index"`
+}
+
+func (schemaV14ClusterCacheEntry) TableName() string {
+	return "cluster_cache_entries"
+}
+
+type schemaV14ClusterStateChange struct {
+	UserStableID string `gorm:"primaryKey"`
+	ChangedAt    time.Time
+}
+
+func (schemaV14ClusterStateChange) TableName() string {
+	return "cluster_state_changes"
+}
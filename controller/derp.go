@@ -44,6 +44,8 @@ type NaviNode struct {
 
 	Arch    string     `json:"Arch"` //所在环境架构，x86_64或aarch64
 	Statics NaviStatus `json:"Statics"`
+
+	Sync *NaviSyncState `gorm:"foreignKey:NaviID;references:ID" json:"Sync,omitempty"` //可信节点列表同步状态，非受控司南为空
 }
 
 func (c *Cockpit) toDERPRegion(nr NaviRegion) (tailcfg.DERPRegion, error) {
@@ -122,7 +124,7 @@ func (c *Cockpit) UpdateNaviRegion(naviRegion *NaviRegion) *NaviRegion {
 
 func (c *Cockpit) ListNaviNodes(regionID int) []NaviNode {
 	naviNodes := []NaviNode{}
-	if err := c.db.Preload("NaviRegion").Where("navi_region_id = ?", regionID).Find(&naviNodes).Error; err != nil {
+	if err := c.db.Preload("NaviRegion").Preload("Sync").Where("navi_region_id = ?", regionID).Find(&naviNodes).Error; err != nil {
 		return nil
 	}
 	return naviNodes
@@ -309,7 +311,7 @@ func (m *Mirage) UpdateNaviRegion(naviRegion *NaviRegion) *NaviRegion {
 
 func (m *Mirage) ListNaviNodes(regionID int) []NaviNode {
 	naviNodes := []NaviNode{}
-	if err := m.db.Preload("NaviRegion").Where("navi_region_id = ?", regionID).Find(&naviNodes).Error; err != nil {
+	if err := m.db.Preload("NaviRegion").Preload("Sync").Where("navi_region_id = ?", regionID).Find(&naviNodes).Error; err != nil {
 		return nil
 	}
 	return naviNodes
@@ -0,0 +1,182 @@
+package controller
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/dnsname"
+)
+
+const (
+	ErrDNSRecordInvalid = Error("invalid dns record")
+
+	DNSRecordTypeA     = "A"
+	DNSRecordTypeAAAA  = "AAAA"
+	DNSRecordTypeCNAME = "CNAME"
+)
+
+// DNSRecordItem 组织在幻域下自定义的DNS记录
+type DNSRecordItem struct {
+	Name  string `json:"name"`  // 幻域下的相对名称，如grafana对应grafana.<MagicDnsDomain>
+	Type  string `json:"type"`  // A、AAAA或CNAME
+	Value string `json:"value"` // A/AAAA为IP地址，CNAME为组织内的设备名
+}
+
+type DNSRecords []DNSRecordItem
+
+func (i *DNSRecords) Scan(destination interface{}) error {
+	switch value := destination.(type) {
+	case []byte:
+		return json.Unmarshal(value, i)
+
+	case string:
+		return json.Unmarshal([]byte(value), i)
+
+	default:
+		return fmt.Errorf("%w: unexpected data type %T", ErrDNSRecordInvalid, destination)
+	}
+}
+
+// Value return json value, implement driver.Valuer interface.
+func (i DNSRecords) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(i)
+
+	return string(bytes), err
+}
+
+// trimMagicDomain 去掉末尾的点及幻域后缀，统一为幻域下的相对名称
+func trimMagicDomain(name, magicDomain string) string {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	if magicDomain != "" {
+		name = strings.TrimSuffix(name, "."+strings.ToLower(magicDomain))
+	}
+
+	return name
+}
+
+// normalizeOrgDNSRecords 校验并规范化组织的自定义DNS记录
+// 记录名不能与组织内设备名冲突，CNAME只能指向组织内已有的设备
+func (h *Mirage) normalizeOrgDNSRecords(org *Organization, records DNSRecords) (DNSRecords, error) {
+	res := make(DNSRecords, 0, len(records))
+	types := make(map[string]string, len(records))
+	for _, record := range records {
+		record.Type = strings.ToUpper(strings.TrimSpace(record.Type))
+		record.Name = trimMagicDomain(record.Name, org.MagicDnsDomain)
+		record.Value = strings.TrimSpace(record.Value)
+		if record.Name == "" {
+			return nil, fmt.Errorf("%w: empty name", ErrDNSRecordInvalid)
+		}
+		for _, label := range strings.Split(record.Name, ".") {
+			if err := dnsname.ValidLabel(label); err != nil {
+				return nil, fmt.Errorf("%w: %s: %s", ErrDNSRecordInvalid, record.Name, err.Error())
+			}
+		}
+		if machine, err := h.GetOrgMachineByGivenName(record.Name, org.ID); err == nil && machine.ID != 0 {
+			return nil, fmt.Errorf("%w: %s conflicts with a machine name", ErrDNSRecordInvalid, record.Name)
+		}
+
+		switch record.Type {
+		case DNSRecordTypeA, DNSRecordTypeAAAA:
+			addr, err := netip.ParseAddr(record.Value)
+			if err != nil || addr.Is4() != (record.Type == DNSRecordTypeA) {
+				return nil, fmt.Errorf("%w: %s: %s is not a valid %s value", ErrDNSRecordInvalid, record.Name, record.Value, record.Type)
+			}
+			record.Value = addr.String()
+		case DNSRecordTypeCNAME:
+			record.Value = trimMagicDomain(record.Value, org.MagicDnsDomain)
+			machine, err := h.GetOrgMachineByGivenName(record.Value, org.ID)
+			if err != nil || machine.ID == 0 {
+				return nil, fmt.Errorf("%w: %s: CNAME target %s is not a machine of the organization", ErrDNSRecordInvalid, record.Name, record.Value)
+			}
+		default:
+			return nil, fmt.Errorf("%w: %s: unsupported type %q", ErrDNSRecordInvalid, record.Name, record.Type)
+		}
+
+		// 同名记录可以同时有A和AAAA，但CNAME必须独占该名称
+		if prev, ok := types[record.Name]; ok {
+			if prev == record.Type || prev == DNSRecordTypeCNAME || record.Type == DNSRecordTypeCNAME {
+				return nil, fmt.Errorf("%w: %s: duplicate record", ErrDNSRecordInvalid, record.Name)
+			}
+		}
+		types[record.Name] = record.Type
+		res = append(res, record)
+	}
+
+	return res, nil
+}
+
+// getOrgExtraDNSRecords 将组织的自定义记录转换为下发给客户端的ExtraRecords
+// 客户端只支持A/AAAA，CNAME在此展开为目标设备的地址
+// machines为生成该网络映射时已加载的本机及对等设备，目标不在其中的CNAME不下发
+func (h *Mirage) getOrgExtraDNSRecords(org *Organization, machines Machines) []tailcfg.DNSRecord {
+	if !org.EnableMagic || len(org.ExtraRecords) == 0 {
+		return nil
+	}
+
+	byName := make(map[string]*Machine, len(machines))
+	for i := range machines {
+		byName[strings.ToLower(machines[i].GivenName)] = &machines[i]
+	}
+
+	records := make([]tailcfg.DNSRecord, 0, len(org.ExtraRecords))
+	for _, record := range org.ExtraRecords {
+		fqdn := record.Name + "." + org.MagicDnsDomain
+		switch record.Type {
+		case DNSRecordTypeA, DNSRecordTypeAAAA:
+			records = append(records, tailcfg.DNSRecord{
+				Name:  fqdn,
+				Value: record.Value,
+			})
+		case DNSRecordTypeCNAME:
+			machine, ok := byName[record.Value]
+			if !ok {
+				continue
+			}
+			for _, addr := range machine.IPAddresses {
+				records = append(records, tailcfg.DNSRecord{
+					Name:  fqdn,
+					Value: addr.String(),
+				})
+			}
+		}
+	}
+
+	return records
+}
+
+// retargetOrgCNAMERecords 在设备改名后让指向旧名称的CNAME跟随到新名称，
+// newName为空（设备被删除）时移除这些记录
+func (h *Mirage) retargetOrgCNAMERecords(orgID int64, oldName, newName string) error {
+	org := Organization{}
+	if err := h.db.Select("id", "extra_records").First(&org, orgID).Error; err != nil {
+		return err
+	}
+
+	changed := false
+	records := make(DNSRecords, 0, len(org.ExtraRecords))
+	for _, record := range org.ExtraRecords {
+		if record.Type == DNSRecordTypeCNAME && strings.EqualFold(record.Value, oldName) {
+			changed = true
+			if newName == "" {
+				log.Info().
+					Str("record", record.Name).
+					Str("target", oldName).
+					Msg("Removed CNAME record pointing to deleted machine")
+
+				continue
+			}
+			record.Value = strings.ToLower(newName)
+		}
+		records = append(records, record)
+	}
+	if !changed {
+		return nil
+	}
+
+	return h.db.Model(&Organization{ID: orgID}).Update("extra_records", records).Error
+}
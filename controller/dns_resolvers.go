@@ -0,0 +1,186 @@
+package controller
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+const (
+	ErrDNSConfigInvalid = Error("invalid dns config")
+
+	dohResolverPrefix = "https://"
+	dotResolverPrefix = "tls://"
+)
+
+// DNSResolverOption 域名服务器的附加选项，以域名服务器地址为键保存在组织上
+type DNSResolverOption struct {
+	// BootstrapResolution DoH/DoT服务器主机名的引导IP，避免客户端先用系统DNS解析服务器本身
+	BootstrapResolution []string `json:"bootstrapResolution,omitempty"`
+	// UseWithExitNode 客户端使用出口节点时仍使用该域名服务器
+	UseWithExitNode bool `json:"useWithExitNode,omitempty"`
+}
+
+type DNSResolverOptions map[string]DNSResolverOption
+
+func (i *DNSResolverOptions) Scan(destination interface{}) error {
+	switch value := destination.(type) {
+	case []byte:
+		return json.Unmarshal(value, i)
+
+	case string:
+		return json.Unmarshal([]byte(value), i)
+
+	default:
+		return fmt.Errorf("%w: unexpected data type %T", ErrDNSConfigInvalid, destination)
+	}
+}
+
+// Value return json value, implement driver.Valuer interface.
+func (i DNSResolverOptions) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(i)
+
+	return string(bytes), err
+}
+
+func isEncryptedResolver(addr string) bool {
+	return strings.HasPrefix(addr, dohResolverPrefix) || strings.HasPrefix(addr, dotResolverPrefix)
+}
+
+// validateResolverAddr 域名服务器可以是IP、IP:端口、https://开头的DoH地址或tls://开头的DoT地址
+func validateResolverAddr(addr string) error {
+	switch {
+	case strings.HasPrefix(addr, dohResolverPrefix):
+		u, err := url.Parse(addr)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("%w: invalid DNS-over-HTTPS resolver %q", ErrDNSConfigInvalid, addr)
+		}
+	case strings.HasPrefix(addr, dotResolverPrefix):
+		u, err := url.Parse(addr)
+		if err != nil || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return fmt.Errorf("%w: invalid DNS-over-TLS resolver %q", ErrDNSConfigInvalid, addr)
+		}
+	default:
+		if _, err := netip.ParseAddr(addr); err == nil {
+			return nil
+		}
+		if _, err := netip.ParseAddrPort(addr); err == nil {
+			return nil
+		}
+
+		return fmt.Errorf("%w: invalid resolver %q", ErrDNSConfigInvalid, addr)
+	}
+
+	return nil
+}
+
+func validateDNSDomain(domain string) error {
+	if _, err := dnsname.ToFQDN(domain); err != nil || domain == "" {
+		return fmt.Errorf("%w: invalid domain %q", ErrDNSConfigInvalid, domain)
+	}
+
+	return nil
+}
+
+// validateDNSData 校验控制台提交的DNS设置，错误均包装ErrDNSConfigInvalid
+func validateDNSData(data *DNSData) error {
+	if len(data.Resolvers) > 0 && len(data.FallbackResolvers) > 0 {
+		return fmt.Errorf("%w: resolvers and fallbackResolvers are mutually exclusive", ErrDNSConfigInvalid)
+	}
+
+	usedResolvers := map[string]bool{}
+	checkResolvers := func(addrs []string) error {
+		for _, addr := range addrs {
+			if err := validateResolverAddr(addr); err != nil {
+				return err
+			}
+			usedResolvers[addr] = true
+		}
+
+		return nil
+	}
+	if err := checkResolvers(data.Resolvers); err != nil {
+		return err
+	}
+	if err := checkResolvers(data.FallbackResolvers); err != nil {
+		return err
+	}
+
+	for _, domain := range data.Domains {
+		if err := validateDNSDomain(domain); err != nil {
+			return err
+		}
+		if len(data.Routes[domain]) == 0 {
+			return fmt.Errorf("%w: split domain %q has no resolver", ErrDNSConfigInvalid, domain)
+		}
+		if err := checkResolvers(data.Routes[domain]); err != nil {
+			return err
+		}
+		if err := checkResolvers(data.RouteFallbacks[domain]); err != nil {
+			return err
+		}
+	}
+	for domain := range data.Routes {
+		if !containsStr(data.Domains, domain) {
+			return fmt.Errorf("%w: split domain %q is not listed in domains", ErrDNSConfigInvalid, domain)
+		}
+	}
+	for domain := range data.RouteFallbacks {
+		if !containsStr(data.Domains, domain) {
+			return fmt.Errorf("%w: split domain %q is not listed in domains", ErrDNSConfigInvalid, domain)
+		}
+	}
+
+	for _, domain := range data.SearchDomains {
+		if err := validateDNSDomain(domain); err != nil {
+			return err
+		}
+	}
+
+	for addr, option := range data.ResolverOptions {
+		if !usedResolvers[addr] {
+			return fmt.Errorf("%w: options given for unused resolver %q", ErrDNSConfigInvalid, addr)
+		}
+		if len(option.BootstrapResolution) > 0 && !isEncryptedResolver(addr) {
+			return fmt.Errorf("%w: bootstrap addresses are only supported for DoH/DoT resolver %q", ErrDNSConfigInvalid, addr)
+		}
+		for _, bootstrap := range option.BootstrapResolution {
+			if _, err := netip.ParseAddr(bootstrap); err != nil {
+				return fmt.Errorf("%w: invalid bootstrap address %q of resolver %q", ErrDNSConfigInvalid, bootstrap, addr)
+			}
+		}
+	}
+
+	return nil
+}
+
+// dnsResolver 将组织保存的域名服务器地址及其选项转换为下发给客户端的dnstype.Resolver
+func (o *Organization) dnsResolver(addr string) *dnstype.Resolver {
+	resolver := &dnstype.Resolver{
+		Addr: addr,
+	}
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		resolver.Addr = ap.String()
+	} else if ip, err := netip.ParseAddr(addr); err == nil {
+		resolver.Addr = ip.String()
+	}
+
+	option, ok := o.ResolverOpts[addr]
+	if !ok {
+		return resolver
+	}
+	for _, bootstrap := range option.BootstrapResolution {
+		if ip, err := netip.ParseAddr(bootstrap); err == nil {
+			resolver.BootstrapResolution = append(resolver.BootstrapResolution, ip)
+		}
+	}
+	resolver.UseWithExitNode = option.UseWithExitNode
+
+	return resolver
+}
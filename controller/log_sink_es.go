@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+const defaultESLogIndex = "mirage-server"
+
+// esLogSink 使用Bulk API批量写入Elasticsearch
+type esLogSink struct {
+	client *elasticsearch.Client
+	index  string
+}
+
+func newESLogSink(cfg *LogSinkConfig) (LogSink, error) {
+	client, err := elasticsearch.NewClient(elasticsearch.Config{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+		Addresses: []string{cfg.URL},
+		APIKey:    cfg.Key,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	index := cfg.Index
+	if index == "" {
+		index = defaultESLogIndex
+	}
+
+	return &esLogSink{
+		client: client,
+		index:  index,
+	}, nil
+}
+
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+func (s *esLogSink) Send(ctx context.Context, entries []logEntry) error {
+	body := bytes.Buffer{}
+	for _, entry := range entries {
+		body.WriteString(`{"index":{}}` + "\n")
+		body.Write(bytes.TrimRight(entry.Data, "\n"))
+		body.WriteByte('\n')
+	}
+
+	req := esapi.BulkRequest{
+		Index: s.index,
+		Body:  &body,
+	}
+	res, err := req.Do(ctx, s.client)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		err = fmt.Errorf("elasticsearch bulk request failed: %s", res.Status())
+		if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+			return permanentSinkError{err}
+		}
+		return err
+	}
+
+	// 单条文档被拒绝（如映射冲突）时重试没有意义，只报告第一条原因
+	bulkRes := esBulkResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&bulkRes); err == nil && bulkRes.Errors {
+		for _, item := range bulkRes.Items {
+			for _, result := range item {
+				if result.Status >= http.StatusBadRequest {
+					return permanentSinkError{fmt.Errorf("elasticsearch rejected document: %s: %s",
+						result.Error.Type, result.Error.Reason)}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *esLogSink) Close() error {
+	return nil
+}
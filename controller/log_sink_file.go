@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	defaultFileLogMaxSizeMB  = 100
+	defaultFileLogMaxBackups = 5
+)
+
+// fileLogSink 将日志以JSON Lines写入本地文件，超过大小上限时轮转为path.1、path.2……
+type fileLogSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+
+	// 上一次Send写入中断的日志及已写入的字节数，重试时从此处续写，避免重复写入已落盘的部分
+	// 整条写入的日志由partialSinkError告知调用方，不会再次传入
+	resumeSeq    uint64
+	resumeOffset int
+}
+
+func newFileLogSink(cfg *LogSinkConfig) (LogSink, error) {
+	maxSizeMB := cfg.MaxSizeMB
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultFileLogMaxSizeMB
+	}
+	maxBackups := cfg.MaxBackups
+	if maxBackups <= 0 {
+		maxBackups = defaultFileLogMaxBackups
+	}
+	sink := &fileLogSink{
+		path:       AbsolutePathFromConfigPath(cfg.Path),
+		maxSize:    int64(maxSizeMB) << 20,
+		maxBackups: maxBackups,
+	}
+	if err := os.MkdirAll(filepath.Dir(sink.path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+
+	return sink, nil
+}
+
+func (s *fileLogSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+
+	return nil
+}
+
+func (s *fileLogSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+func (s *fileLogSink) Send(_ context.Context, entries []logEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	offset := 0
+	if s.resumeOffset > 0 {
+		if entries[0].Seq == s.resumeSeq {
+			offset = s.resumeOffset
+		} else {
+			// 被放弃的日志留下了半行，先补上换行以免与后续日志粘连
+			n, err := s.file.Write([]byte{'\n'})
+			s.size += int64(n)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	s.resumeSeq, s.resumeOffset = 0, 0
+
+	for i := range entries {
+		data := entries[i].Data[offset:]
+		if offset == 0 && s.size > 0 && s.size+int64(len(data)) > s.maxSize {
+			if err := s.rotate(); err != nil {
+				s.file = nil
+				return partialSinkError{sent: i, err: err}
+			}
+		}
+		n, err := s.file.Write(data)
+		s.size += int64(n)
+		if err != nil {
+			if offset+n > 0 {
+				s.resumeSeq, s.resumeOffset = entries[i].Seq, offset+n
+			}
+			return partialSinkError{sent: i, err: err}
+		}
+		offset = 0
+	}
+
+	return nil
+}
+
+func (s *fileLogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	httpSinkFormatJSON = "json"
+	httpSinkFormatLoki = "loki"
+
+	httpLogSinkTimeout = 10 * time.Second
+)
+
+// httpLogSink 将一批日志POST到任意HTTP端点
+// json格式的请求体为日志对象数组；loki格式按Loki push API以级别分流
+type httpLogSink struct {
+	client  *http.Client
+	url     string
+	key     string
+	format  string
+	labels  map[string]string
+	headers map[string]string
+}
+
+func newHTTPLogSink(cfg *LogSinkConfig) LogSink {
+	format := cfg.Format
+	if format == "" {
+		format = httpSinkFormatJSON
+	}
+	labels := map[string]string{"job": "mirage"}
+	for k, v := range cfg.Labels {
+		labels[k] = v
+	}
+
+	return &httpLogSink{
+		client:  &http.Client{Timeout: httpLogSinkTimeout},
+		url:     cfg.URL,
+		key:     cfg.Key,
+		format:  format,
+		labels:  labels,
+		headers: cfg.Headers,
+	}
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type lokiPushRequest struct {
+	Streams []lokiStream `json:"streams"`
+}
+
+func (s *httpLogSink) lokiBody(entries []logEntry) ([]byte, error) {
+	streams := map[zerolog.Level]*lokiStream{}
+	order := []zerolog.Level{}
+	for _, entry := range entries {
+		stream, ok := streams[entry.Level]
+		if !ok {
+			labels := make(map[string]string, len(s.labels)+1)
+			for k, v := range s.labels {
+				labels[k] = v
+			}
+			if entry.Level != zerolog.NoLevel {
+				labels["level"] = entry.Level.String()
+			}
+			stream = &lokiStream{Stream: labels}
+			streams[entry.Level] = stream
+			order = append(order, entry.Level)
+		}
+		stream.Values = append(stream.Values, [2]string{
+			strconv.FormatInt(entry.Time.UnixNano(), 10),
+			strings.TrimRight(string(entry.Data), "\n"),
+		})
+	}
+
+	req := lokiPushRequest{}
+	for _, level := range order {
+		req.Streams = append(req.Streams, *streams[level])
+	}
+
+	return json.Marshal(req)
+}
+
+func (s *httpLogSink) jsonBody(entries []logEntry) []byte {
+	body := bytes.Buffer{}
+	body.WriteByte('[')
+	for i, entry := range entries {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		body.Write(bytes.TrimRight(entry.Data, "\n"))
+	}
+	body.WriteByte(']')
+
+	return body.Bytes()
+}
+
+func (s *httpLogSink) Send(ctx context.Context, entries []logEntry) error {
+	var body []byte
+	if s.format == httpSinkFormatLoki {
+		var err error
+		if body, err = s.lokiBody(entries); err != nil {
+			return permanentSinkError{err}
+		}
+	} else {
+		body = s.jsonBody(entries)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentSinkError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.key != "" {
+		// 未带认证方案时按Bearer令牌处理
+		if strings.Contains(s.key, " ") {
+			req.Header.Set("Authorization", s.key)
+		} else {
+			req.Header.Set("Authorization", AuthPrefix+s.key)
+		}
+	}
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+
+	if res.StatusCode >= http.StatusBadRequest {
+		err = fmt.Errorf("http log push failed: %s", res.Status)
+		// 除限流外的4xx说明请求本身有误，重试不会成功
+		if res.StatusCode < http.StatusInternalServerError && res.StatusCode != http.StatusTooManyRequests {
+			return permanentSinkError{err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *httpLogSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,59 @@
+//go:build !windows && !plan9
+
+package controller
+
+import (
+	"context"
+	"log/syslog"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+const defaultSyslogTag = "mirage"
+
+// syslogLogSink 将日志写入本机或远端syslog，按日志级别映射优先级
+type syslogLogSink struct {
+	writer *syslog.Writer
+}
+
+func newSyslogLogSink(cfg *LogSinkConfig) (LogSink, error) {
+	tag := cfg.Tag
+	if tag == "" {
+		tag = defaultSyslogTag
+	}
+	writer, err := syslog.Dial(cfg.Network, cfg.Address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogLogSink{writer: writer}, nil
+}
+
+func (s *syslogLogSink) Send(_ context.Context, entries []logEntry) error {
+	for i, entry := range entries {
+		msg := strings.TrimRight(string(entry.Data), "\n")
+		var err error
+		switch entry.Level {
+		case zerolog.PanicLevel, zerolog.FatalLevel:
+			err = s.writer.Crit(msg)
+		case zerolog.ErrorLevel:
+			err = s.writer.Err(msg)
+		case zerolog.WarnLevel:
+			err = s.writer.Warning(msg)
+		case zerolog.DebugLevel, zerolog.TraceLevel:
+			err = s.writer.Debug(msg)
+		default:
+			err = s.writer.Info(msg)
+		}
+		if err != nil {
+			return partialSinkError{sent: i, err: err}
+		}
+	}
+
+	return nil
+}
+
+func (s *syslogLogSink) Close() error {
+	return s.writer.Close()
+}
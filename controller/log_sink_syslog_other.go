@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package controller
+
+import "fmt"
+
+func newSyslogLogSink(cfg *LogSinkConfig) (LogSink, error) {
+	return nil, fmt.Errorf("%w: syslog is not supported on this platform", ErrLogSinkConfigInvalid)
+}
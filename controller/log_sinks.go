@@ -0,0 +1,465 @@
+package controller
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ErrLogSinkTypeInvalid   = Error("unknown log sink type")
+	ErrLogSinkLevelInvalid  = Error("invalid log sink level")
+	ErrLogSinkConfigInvalid = Error("invalid log sink config")
+
+	LogSinkElasticsearch = "elasticsearch"
+	LogSinkFile          = "file"
+	LogSinkSyslog        = "syslog"
+	LogSinkHTTP          = "http"
+
+	defaultLogSinkLevel         = "info"
+	defaultLogSinkBufferSize    = 4096
+	defaultLogSinkBatchSize     = 100
+	defaultLogSinkFlushInterval = time.Second
+	defaultLogSinkMaxRetries    = 3
+	defaultLogSinkRetryBackoff  = time.Second
+	maxLogSinkRetryBackoff      = time.Minute
+	logSinkCloseTimeout         = 5 * time.Second
+	logSinkDropReportInterval   = time.Minute
+)
+
+// LogSinkConfig 是一个日志投递目标的配置，未设置的数值项使用默认值
+type LogSinkConfig struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Level   string `json:"level"`   // 只投递不低于该级别的日志，默认info
+	Enabled bool   `json:"enabled"` // 仅启用的目标会被创建
+
+	URL     string            `json:"url"`     // elasticsearch/http
+	Key     string            `json:"key"`     // elasticsearch的APIKey，http的Authorization
+	Index   string            `json:"index"`   // elasticsearch索引名，默认mirage-server
+	Format  string            `json:"format"`  // http推送格式：json或loki
+	Labels  map[string]string `json:"labels"`  // loki stream标签
+	Headers map[string]string `json:"headers"` // http附加请求头
+
+	Path       string `json:"path"`        // file：日志文件路径
+	MaxSizeMB  int    `json:"max_size_mb"` // file：单个文件大小上限
+	MaxBackups int    `json:"max_backups"` // file：保留的历史文件数
+
+	Network string `json:"network"` // syslog：udp/tcp，为空时使用本机syslog
+	Address string `json:"address"` // syslog：远端地址
+	Tag     string `json:"tag"`     // syslog：标识，默认mirage
+
+	BufferSize    int `json:"buffer_size"`    // 待投递队列长度，满时丢弃新日志
+	BatchSize     int `json:"batch_size"`     // 每批最多投递的日志条数
+	FlushInterval int `json:"flush_interval"` // 未满一批时的最长等待秒数
+	MaxRetries    int `json:"max_retries"`    // 单批投递失败后的重试次数
+	RetryBackoff  int `json:"retry_backoff"`  // 首次重试等待秒数，之后指数增长
+}
+
+func (cfg *LogSinkConfig) DisplayName() string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+
+	return cfg.Type
+}
+
+// Validate 检查配置并补齐默认值
+func (cfg *LogSinkConfig) Validate() error {
+	if cfg.Level == "" {
+		cfg.Level = defaultLogSinkLevel
+	}
+	if _, err := zerolog.ParseLevel(cfg.Level); err != nil {
+		return fmt.Errorf("%w: %s", ErrLogSinkLevelInvalid, cfg.Level)
+	}
+
+	switch cfg.Type {
+	case LogSinkElasticsearch:
+		if cfg.URL == "" {
+			return fmt.Errorf("%w: elasticsearch sink requires url", ErrLogSinkConfigInvalid)
+		}
+	case LogSinkHTTP:
+		if cfg.URL == "" {
+			return fmt.Errorf("%w: http sink requires url", ErrLogSinkConfigInvalid)
+		}
+		if cfg.Format != "" && cfg.Format != httpSinkFormatJSON && cfg.Format != httpSinkFormatLoki {
+			return fmt.Errorf("%w: unknown http format %s", ErrLogSinkConfigInvalid, cfg.Format)
+		}
+	case LogSinkFile:
+		if cfg.Path == "" {
+			return fmt.Errorf("%w: file sink requires path", ErrLogSinkConfigInvalid)
+		}
+	case LogSinkSyslog:
+		if (cfg.Network == "") != (cfg.Address == "") {
+			return fmt.Errorf("%w: syslog network and address must be set together", ErrLogSinkConfigInvalid)
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrLogSinkTypeInvalid, cfg.Type)
+	}
+
+	if cfg.BufferSize < 0 || cfg.BatchSize < 0 || cfg.FlushInterval < 0 ||
+		cfg.MaxRetries < 0 || cfg.RetryBackoff < 0 {
+		return fmt.Errorf("%w: negative value", ErrLogSinkConfigInvalid)
+	}
+
+	return nil
+}
+
+type LogSinkConfigs []LogSinkConfig
+
+func (cfgs *LogSinkConfigs) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, cfgs)
+	case string:
+		return json.Unmarshal([]byte(v), cfgs)
+	default:
+		return fmt.Errorf("cannot parse log sink config: unexpected data type %T", value)
+	}
+}
+
+func (cfgs LogSinkConfigs) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(cfgs)
+	return string(bytes), err
+}
+
+// logEntry 是一条已序列化的JSON日志，Seq在同一投递目标内从1开始递增
+type logEntry struct {
+	Seq   uint64
+	Level zerolog.Level
+	Time  time.Time
+	Data  []byte
+}
+
+// LogSink 是日志投递后端，Send应将一批日志整体投递，
+// 返回错误时整批按重试策略重发，返回permanentSinkError时放弃该批；
+// 逐条投递的后端在部分日志已送达时返回partialSinkError，重试只发送剩余的日志
+type LogSink interface {
+	Send(ctx context.Context, entries []logEntry) error
+	Close() error
+}
+
+// permanentSinkError 表示重试无意义的错误（如认证失败、请求被拒绝）
+type permanentSinkError struct {
+	err error
+}
+
+func (e permanentSinkError) Error() string { return e.err.Error() }
+func (e permanentSinkError) Unwrap() error { return e.err }
+
+// partialSinkError 表示一批日志中前sent条已送达
+type partialSinkError struct {
+	sent int
+	err  error
+}
+
+func (e partialSinkError) Error() string { return e.err.Error() }
+func (e partialSinkError) Unwrap() error { return e.err }
+
+func newLogSink(cfg *LogSinkConfig) (LogSink, error) {
+	switch cfg.Type {
+	case LogSinkElasticsearch:
+		return newESLogSink(cfg)
+	case LogSinkFile:
+		return newFileLogSink(cfg)
+	case LogSinkSyslog:
+		return newSyslogLogSink(cfg)
+	case LogSinkHTTP:
+		return newHTTPLogSink(cfg), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrLogSinkTypeInvalid, cfg.Type)
+	}
+}
+
+// bufferedSinkWriter 作为zerolog的LevelWriter，将日志放入队列由后台协程按批投递
+// 写入从不阻塞调用方：队列满时直接丢弃并计数，避免下游故障拖慢控制器
+type bufferedSinkWriter struct {
+	name          string
+	sink          LogSink
+	level         zerolog.Level
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+	retryBackoff  time.Duration
+
+	queue   chan logEntry
+	done    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	closed  atomic.Bool
+	dropped atomic.Uint64
+	seq     atomic.Uint64
+	mu      sync.RWMutex
+}
+
+func newBufferedSinkWriter(cfg *LogSinkConfig, sink LogSink) *bufferedSinkWriter {
+	level, _ := zerolog.ParseLevel(cfg.Level)
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &bufferedSinkWriter{
+		name:          cfg.DisplayName(),
+		sink:          sink,
+		level:         level,
+		batchSize:     cfg.BatchSize,
+		flushInterval: time.Duration(cfg.FlushInterval) * time.Second,
+		maxRetries:    cfg.MaxRetries,
+		retryBackoff:  time.Duration(cfg.RetryBackoff) * time.Second,
+		done:          make(chan struct{}),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+	bufferSize := cfg.BufferSize
+	if bufferSize == 0 {
+		bufferSize = defaultLogSinkBufferSize
+	}
+	if w.batchSize == 0 {
+		w.batchSize = defaultLogSinkBatchSize
+	}
+	if w.flushInterval == 0 {
+		w.flushInterval = defaultLogSinkFlushInterval
+	}
+	if w.maxRetries == 0 {
+		w.maxRetries = defaultLogSinkMaxRetries
+	}
+	if w.retryBackoff == 0 {
+		w.retryBackoff = defaultLogSinkRetryBackoff
+	}
+	w.queue = make(chan logEntry, bufferSize)
+
+	go w.run()
+
+	return w
+}
+
+func (w *bufferedSinkWriter) Write(p []byte) (int, error) {
+	return w.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (w *bufferedSinkWriter) WriteLevel(l zerolog.Level, p []byte) (int, error) {
+	if l != zerolog.NoLevel && l < w.level {
+		return len(p), nil
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed.Load() {
+		return len(p), nil
+	}
+
+	// zerolog会复用p的底层缓冲区，入队前必须复制
+	data := make([]byte, len(p))
+	copy(data, p)
+	select {
+	case w.queue <- logEntry{Seq: w.seq.Add(1), Level: l, Time: time.Now(), Data: data}:
+	default:
+		w.dropped.Add(1)
+	}
+
+	return len(p), nil
+}
+
+func (w *bufferedSinkWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+	reportTicker := time.NewTicker(logSinkDropReportInterval)
+	defer reportTicker.Stop()
+
+	batch := make([]logEntry, 0, w.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		w.deliver(batch)
+		batch = make([]logEntry, 0, w.batchSize)
+	}
+
+	for {
+		select {
+		case entry, ok := <-w.queue:
+			if !ok {
+				flush()
+				w.reportDropped()
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) >= w.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-reportTicker.C:
+			w.reportDropped()
+		}
+	}
+}
+
+// deliver 按指数退避重试投递一批日志，已送达的部分不再重发，关闭时不再等待退避
+func (w *bufferedSinkWriter) deliver(batch []logEntry) {
+	backoff := w.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := w.sink.Send(w.ctx, batch)
+		if err == nil {
+			return
+		}
+		var partial partialSinkError
+		if errors.As(err, &partial) && partial.sent > 0 {
+			batch = batch[partial.sent:]
+		}
+
+		var permanent permanentSinkError
+		if errors.As(err, &permanent) || attempt >= w.maxRetries {
+			w.dropped.Add(uint64(len(batch)))
+			// 不能经由log.Logger输出，否则失败日志会再次进入本队列
+			fmt.Fprintf(os.Stderr, "log sink %s: dropped %d entries: %v\n", w.name, len(batch), err)
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-w.ctx.Done():
+		}
+		backoff *= 2
+		if backoff > maxLogSinkRetryBackoff {
+			backoff = maxLogSinkRetryBackoff
+		}
+	}
+}
+
+func (w *bufferedSinkWriter) reportDropped() {
+	if dropped := w.dropped.Swap(0); dropped > 0 {
+		fmt.Fprintf(os.Stderr, "log sink %s: %d entries dropped\n", w.name, dropped)
+	}
+}
+
+// Close 停止接收日志并在超时前尽量投递队列中剩余的日志
+func (w *bufferedSinkWriter) Close() error {
+	w.mu.Lock()
+	if w.closed.Swap(true) {
+		w.mu.Unlock()
+		return nil
+	}
+	close(w.queue)
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+	case <-time.After(logSinkCloseTimeout):
+		w.cancel()
+		<-w.done
+	}
+	w.cancel()
+
+	return w.sink.Close()
+}
+
+var (
+	logSinksMu     sync.Mutex
+	activeLogSinks []*bufferedSinkWriter
+)
+
+// logSinkConfigs 合并显式配置的日志目标与旧版的EsUrl/EsKey配置
+func (cfg *Config) logSinkConfigs() []LogSinkConfig {
+	sinks := []LogSinkConfig{}
+	hasES := false
+	for _, sink := range cfg.LogSinks {
+		if !sink.Enabled {
+			continue
+		}
+		if sink.Type == LogSinkElasticsearch {
+			hasES = true
+		}
+		sinks = append(sinks, sink)
+	}
+	if !hasES && cfg.ESURL != "" {
+		sinks = append(sinks, LogSinkConfig{
+			Type:    LogSinkElasticsearch,
+			Name:    "es",
+			Level:   zerolog.LevelInfoValue,
+			Enabled: true,
+			URL:     cfg.ESURL,
+			Key:     cfg.ESKey,
+		})
+	}
+
+	return sinks
+}
+
+// InitLogSinks 按配置重建日志投递目标，已有的目标会先被关闭
+// 单个目标创建失败不影响其他目标，错误汇总后返回
+func InitLogSinks(cfg *Config) error {
+	logSinksMu.Lock()
+	defer logSinksMu.Unlock()
+
+	writers := []*bufferedSinkWriter{}
+	var errs []error
+	for _, sinkCfg := range cfg.logSinkConfigs() {
+		sinkCfg := sinkCfg
+		if err := sinkCfg.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("log sink %s: %w", sinkCfg.DisplayName(), err))
+			continue
+		}
+		sink, err := newLogSink(&sinkCfg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("log sink %s: %w", sinkCfg.DisplayName(), err))
+			continue
+		}
+		writers = append(writers, newBufferedSinkWriter(&sinkCfg, sink))
+	}
+
+	previous := activeLogSinks
+	activeLogSinks = writers
+	setLogWriters(writers)
+	closeLogSinkWriters(previous)
+
+	for _, w := range writers {
+		log.Info().Str("sink", w.name).Str("level", w.level.String()).Msg("Log sink enabled")
+	}
+	for _, err := range errs {
+		log.Error().Err(err).Msg("Failed to create log sink")
+	}
+
+	return errors.Join(errs...)
+}
+
+// CloseLogSinks 恢复为仅输出到标准输出，并投递各目标中剩余的日志
+func CloseLogSinks() {
+	logSinksMu.Lock()
+	defer logSinksMu.Unlock()
+
+	previous := activeLogSinks
+	activeLogSinks = nil
+	setLogWriters(nil)
+	closeLogSinkWriters(previous)
+}
+
+func setLogWriters(sinks []*bufferedSinkWriter) {
+	writers := []io.Writer{os.Stdout}
+	for _, sink := range sinks {
+		writers = append(writers, sink)
+	}
+
+	log.Logger = zerolog.New(zerolog.MultiLevelWriter(writers...)).
+		With().
+		Timestamp().
+		Logger().
+		Level(zerolog.DebugLevel)
+}
+
+func closeLogSinkWriters(writers []*bufferedSinkWriter) {
+	for _, w := range writers {
+		if err := w.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "log sink %s: close: %v\n", w.name, err)
+		}
+	}
+}
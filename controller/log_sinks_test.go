@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// flakySink 每次Send只送达前accept条，之后返回partialSinkError
+type flakySink struct {
+	accept    int
+	delivered []uint64
+}
+
+func (s *flakySink) Send(_ context.Context, entries []logEntry) error {
+	for i, entry := range entries {
+		if i == s.accept {
+			return partialSinkError{sent: i, err: errors.New("connection reset")}
+		}
+		s.delivered = append(s.delivered, entry.Seq)
+	}
+
+	return nil
+}
+
+func (s *flakySink) Close() error { return nil }
+
+func TestLogSinkPartialBatchNotResent(t *testing.T) {
+	sink := &flakySink{accept: 2}
+	w := &bufferedSinkWriter{
+		name:       "flaky",
+		sink:       sink,
+		maxRetries: 5,
+		ctx:        context.Background(),
+	}
+	batch := make([]logEntry, 5)
+	for i := range batch {
+		batch[i] = logEntry{Seq: uint64(i + 1), Data: []byte("{}\n")}
+	}
+
+	w.deliver(batch)
+
+	want := []uint64{1, 2, 3, 4, 5}
+	if len(sink.delivered) != len(want) {
+		t.Fatalf("delivered %v, want %v", sink.delivered, want)
+	}
+	for i := range want {
+		if sink.delivered[i] != want[i] {
+			t.Fatalf("delivered %v, want %v", sink.delivered, want)
+		}
+	}
+	if dropped := w.dropped.Load(); dropped != 0 {
+		t.Errorf("dropped %d entries, want 0", dropped)
+	}
+}
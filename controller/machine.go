@@ -38,6 +38,12 @@ const (
 	maxHostnameLength = 255
 )
 
+const (
+	MachineApprovalPending  = "pending"
+	MachineApprovalApproved = "approved"
+	MachineApprovalRejected = "rejected"
+)
+
 // Machine is a Mirage client.
 type Machine struct {
 	ID          int64  `gorm:"primary_key;unique;not null"`
@@ -76,6 +82,11 @@ type Machine struct {
 	HostInfo  HostInfo
 	Endpoints StringList
 
+	// 设备审批状态，空值视为已批准（开启设备审批前注册的设备）
+	ApprovalState string
+	ApprovalBy    string // 作出审批决定的管理员或预批准的来源
+	ApprovalAt    *time.Time
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
@@ -110,6 +121,9 @@ func (ma MachineAddresses) ToStringSlice() []string {
 
 func (ma *MachineAddresses) Scan(destination interface{}) error {
 	switch value := destination.(type) {
+	case []byte:
+		return ma.Scan(string(value))
+
 	case string:
 		addresses := strings.Split(value, ",")
 		*ma = (*ma)[:0]
@@ -165,9 +179,26 @@ func (machine *Machine) isOnline() bool {
 	return machine.LastSeen.After(time.Now().Add(-keepAliveInterval))
 }
 
+// isApproved returns if the machine may join the tailnet. Machines registered
+// before device approval was enabled have no approval state and are approved.
+func (machine *Machine) isApproved() bool {
+	return machine.ApprovalState == "" || machine.ApprovalState == MachineApprovalApproved
+}
+
+// preApprove marks a machine that is admitted without manual approval.
+func (machine *Machine) preApprove(by string) {
+	now := time.Now().UTC()
+	machine.ApprovalState = MachineApprovalApproved
+	machine.ApprovalBy = by
+	machine.ApprovalAt = &now
+}
+
 // isEphemeral returns if the machine is registered as an Ephemeral node.
 // https://tailscale.com/kb/1111/ephemeral-nodes/
 func (machine *Machine) isEphemeral() bool {
+	if machine.RegisterMethod == RegisterMethodWorkloadIdentity {
+		return true
+	}
 	return machine.AuthKey != nil && machine.AuthKey.Ephemeral
 }
 
@@ -198,6 +229,7 @@ func getFilteredByACLPeers(
 	rules []tailcfg.FilterRule,
 	enableSelf bool,
 	machine *Machine,
+	policy *ACLPolicy,
 ) (Machines, []tailcfg.NodeID) {
 	log.Trace().
 		Str("machine", machine.Hostname).
@@ -205,6 +237,18 @@ func getFilteredByACLPeers(
 
 	peers := make(map[int64]Machine)
 	var invalidNodeIDs []tailcfg.NodeID
+
+	// Machines failing the defaultSrcPosture of the policy are cut off from the
+	// tailnet in both directions.
+	now := time.Now()
+	if violations := policy.postureViolations(machine, now); len(violations) > 0 {
+		log.Debug().
+			Str("machine", machine.Hostname).
+			Strs("violations", violations).
+			Msg("Machine is not posture compliant, hiding all peers")
+
+		return Machines{}, invalidNodeIDs
+	}
 	// Aclfilter peers here. We are itering through machines in all users and search through the computed aclRules
 	// for match between rule SrcIPs and DstPorts. If the rule is a match we allow the machine to be viewable.
 	machineIPs := machine.IPAddresses.ToStringSlice()
@@ -213,6 +257,10 @@ func getFilteredByACLPeers(
 		if peer.ID == machine.ID {
 			continue
 		}
+		if len(policy.postureViolations(&peer, now)) > 0 {
+			invalidNodeIDs = append(invalidNodeIDs, tailcfg.NodeID(peer.ID))
+			continue
+		}
 		// 处理self情况:如果启用了self且没有tag,直接加入peer列表
 		if enableSelf && peer.UserID == machine.UserID && len(peer.ForcedTags) == 0 && len(machine.ForcedTags) == 0 {
 			peers[peer.ID] = peer
@@ -325,7 +373,7 @@ func (h *Mirage) getPeers(machine *Machine, enableSelf bool) (Machines, []tailcf
 
 			return Machines{}, []tailcfg.NodeID{}, err
 		}
-		peers, invalidNodeIDs = getFilteredByACLPeers(machines, org.AclRules, enableSelf, machine)
+		peers, invalidNodeIDs = getFilteredByACLPeers(machines, org.AclRules, enableSelf, machine, org.AclPolicy)
 	} else {
 		peers, err = h.ListPeers(machine)
 		if err != nil {
@@ -351,13 +399,18 @@ func (h *Mirage) getPeers(machine *Machine, enableSelf bool) (Machines, []tailcf
 func (h *Mirage) getValidPeers(machine *Machine, enableSelf bool) (Machines, []tailcfg.NodeID, error) {
 	validPeers := make(Machines, 0)
 
+	// machines waiting for (or refused) approval neither see nor are seen by others
+	if !machine.isApproved() {
+		return validPeers, []tailcfg.NodeID{}, nil
+	}
+
 	peers, nodeIDs, err := h.getPeers(machine, enableSelf)
 	if err != nil {
 		return Machines{}, []tailcfg.NodeID{}, err
 	}
 
 	for _, peer := range peers {
-		if !peer.isExpired() {
+		if !peer.isExpired() && peer.isApproved() {
 			validPeers = append(validPeers, peer)
 		}
 	}
@@ -692,6 +745,34 @@ func (h *Mirage) ExpireMachine(machine *Machine) error {
 	return nil
 }
 
+// SetMachineApproval records the approval decision of an admin on the machine.
+// Rejected machines are expired so that the client is logged out.
+func (h *Mirage) SetMachineApproval(machine *Machine, approve bool, by string) error {
+	now := time.Now().UTC()
+	machine.ApprovalState = MachineApprovalRejected
+	if approve {
+		machine.ApprovalState = MachineApprovalApproved
+	}
+	machine.ApprovalBy = by
+	machine.ApprovalAt = &now
+
+	err := h.db.Model(machine).Updates(map[string]interface{}{
+		"approval_state": machine.ApprovalState,
+		"approval_by":    machine.ApprovalBy,
+		"approval_at":    machine.ApprovalAt,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to save machine approval in the database: %w", err)
+	}
+
+	if !approve {
+		return h.ExpireMachine(machine)
+	}
+	h.setOrgLastStateChangeToNow(machine.User.OrganizationID)
+
+	return nil
+}
+
 // setAutoGenName can set whether a machine should use hostname as its given name
 // (will generated if there's already same hostname node). will return new givenname when success.
 func (h *Mirage) setAutoGenName(machine *Machine, newName string) (string, error) {
@@ -699,11 +780,14 @@ func (h *Mirage) setAutoGenName(machine *Machine, newName string) (string, error
 	if newName == "" {
 		isAutoGen = true
 	}
+	// 只记录自动生成名称时的旧名，手动改名由RenameMachine处理CNAME记录
+	oldName := ""
 	if !(machine.AutoGenName && machine.GivenName == newName) {
 		if isAutoGen {
 			if machine.AutoGenName {
 				return machine.GivenName, nil
 			}
+			oldName = machine.GivenName
 			machine.GivenName = h.GenMachineName(machine.Hostname, machine.UserID, machine.User.OrganizationID, machine.MachineKey)
 		} else {
 			_, err := h.GetOrgMachineByGivenName(newName, machine.User.OrganizationID)
@@ -724,6 +808,11 @@ func (h *Mirage) setAutoGenName(machine *Machine, newName string) (string, error
 	if err := h.db.Save(machine).Error; err != nil {
 		return "", fmt.Errorf("failed to save setAutoGen machine in the database: %w", err)
 	}
+	if oldName != "" && oldName != machine.GivenName {
+		if err := h.retargetOrgCNAMERecords(machine.User.OrganizationID, oldName, machine.GivenName); err != nil {
+			return "", fmt.Errorf("failed to update CNAME records of renamed machine: %w", err)
+		}
+	}
 
 	return machine.GivenName, nil
 }
@@ -744,6 +833,7 @@ func (h *Mirage) RenameMachine(machine *Machine, newName string) error {
 
 		return err
 	}
+	oldName := machine.GivenName
 	machine.GivenName = newName
 
 	h.setOrgLastStateChangeToNow(machine.User.OrganizationID)
@@ -751,6 +841,9 @@ func (h *Mirage) RenameMachine(machine *Machine, newName string) error {
 	if err := h.db.Save(machine).Error; err != nil {
 		return fmt.Errorf("failed to rename machine in the database: %w", err)
 	}
+	if err := h.retargetOrgCNAMERecords(machine.User.OrganizationID, oldName, newName); err != nil {
+		return fmt.Errorf("failed to update CNAME records of renamed machine: %w", err)
+	}
 
 	return nil
 }
@@ -817,6 +910,14 @@ func (h *Mirage) HardDeleteMachine(machine *Machine) error {
 	if err := h.db.Unscoped().Delete(&machine).Error; err != nil {
 		return err
 	}
+	if err := h.retargetOrgCNAMERecords(machine.User.OrganizationID, machine.GivenName, ""); err != nil {
+		log.Error().
+			Caller().
+			Str("machine", machine.GivenName).
+			Err(err).
+			Msg("Failed to remove CNAME records of deleted machine")
+	}
+	h.postureStates.Delete(machine.ID)
 
 	h.setOrgLastStateChangeToNow(machine.User.OrganizationID)
 	return nil
@@ -1031,7 +1132,7 @@ func (h *Mirage) toNode(
 		LastSeen:          machine.LastSeen,
 		Online:            &online,
 		KeepAlive:         true,
-		MachineAuthorized: !machine.isExpired(),
+		MachineAuthorized: !machine.isExpired() && machine.isApproved(),
 
 		Capabilities: []string{
 			tailcfg.CapabilityFileSharing,
@@ -1111,10 +1212,23 @@ func (h *Mirage) RegisterMachine(machine Machine,
 			Str("node_key", machine.NodeKey).
 			Str("user", machine.User.Name).
 			Msg("Machine authorized again")
+		observeRegistration(machine.RegisterMethod)
 
 		return &machine, nil
 	}
 
+	// New machines of organizations requiring device approval wait for an admin,
+	// unless the caller already pre-approved them.
+	if machine.ApprovalState == "" {
+		user, err := h.GetUserByID(tailcfg.UserID(machine.UserID))
+		if err != nil {
+			return nil, err
+		}
+		if user.Organization.DeviceApproval {
+			machine.ApprovalState = MachineApprovalPending
+		}
+	}
+
 	h.ipAllocationMutex.Lock()
 	defer h.ipAllocationMutex.Unlock()
 
@@ -1139,6 +1253,7 @@ func (h *Mirage) RegisterMachine(machine Machine,
 		Str("machine", machine.Hostname).
 		Str("ip", strings.Join(ips.ToStringSlice(), ",")).
 		Msg("Machine registered with the database")
+	observeRegistration(machine.RegisterMethod)
 
 	return &machine, nil
 }
@@ -1253,9 +1368,10 @@ func (h *Mirage) enableRoutes(machine *Machine, routeStrs ...string) error {
 			route.Enabled = true
 
 			// Mark already as primary if there is only this node offering this subnet
-			// (and is not an exit route)
+			// (and is not an exit route). Re-enabling keeps an existing primary in place,
+			// any further election is left to handlePrimarySubnetFailover.
 			if !route.isExitRoute() {
-				route.IsPrimary = h.isUniquePrefix(route)
+				route.IsPrimary = route.IsPrimary || h.isUniquePrefix(route)
 			}
 
 			err = h.db.Save(&route).Error
@@ -1312,22 +1428,12 @@ func (h *Mirage) EnableAutoApprovedRoutes(machine *Machine) error {
 		}
 
 		for _, approvedAlias := range routeApprovers {
-			if approvedAlias == machine.User.Name {
+			approved, err := h.isRouteApprover(machine, machine.User.Organization.AclPolicy, approvedAlias)
+			if err != nil {
+				return err
+			}
+			if approved {
 				approvedRoutes = append(approvedRoutes, advertisedRoute)
-			} else {
-				approvedIps, err := h.expandAlias(false, []Machine{*machine}, machine.UserID, *(machine.User.Organization.AclPolicy), approvedAlias, h.cfg.OIDC.StripEmaildomain)
-				if err != nil {
-					log.Err(err).
-						Str("alias", approvedAlias).
-						Msg("Failed to expand alias when processing autoApprovers policy")
-
-					return err
-				}
-
-				// approvedIPs should contain all of machine's IPs if it matches the rule, so check for first
-				if contains(approvedIps, machine.IPAddresses[0].String()) {
-					approvedRoutes = append(approvedRoutes, advertisedRoute)
-				}
 			}
 		}
 	}
@@ -1348,11 +1454,57 @@ func (h *Mirage) EnableAutoApprovedRoutes(machine *Machine) error {
 	return nil
 }
 
-func machinesByID(machines Machines) map[int64]Machine {
-	byID := make(map[int64]Machine)
-	for _, machine := range machines {
-		byID[machine.ID] = machine
+// isRouteApprover returns if the machine is matched by the given autoApprovers alias.
+func (h *Mirage) isRouteApprover(machine *Machine, policy *ACLPolicy, alias string) (bool, error) {
+	if alias == machine.User.Name {
+		return true, nil
+	}
+	if len(machine.IPAddresses) == 0 {
+		return false, nil
+	}
+
+	approvedIps, err := h.expandAlias(false, []Machine{*machine}, machine.UserID, *policy, alias, h.cfg.OIDC.StripEmaildomain)
+	if err != nil {
+		log.Err(err).
+			Str("alias", alias).
+			Msg("Failed to expand alias when processing autoApprovers policy")
+
+		return false, err
+	}
+
+	// approvedIPs should contain all of machine's IPs if it matches the rule, so check for first
+	return contains(approvedIps, machine.IPAddresses[0].String()), nil
+}
+
+// getRouteAutoApprover returns the autoApprovers rule and alias that would approve the route,
+// both empty if no rule matches. The route must have its Machine and Machine.User loaded.
+func (h *Mirage) getRouteAutoApprover(policy *ACLPolicy, route *Route) (string, string, error) {
+	if policy == nil {
+		return "", "", nil
+	}
+
+	rules, err := policy.AutoApprovers.GetRouteApproverRules(netip.Prefix(route.Prefix))
+	if err != nil {
+		return "", "", err
+	}
+
+	rulePrefixes := make([]string, 0, len(rules))
+	for rulePrefix := range rules {
+		rulePrefixes = append(rulePrefixes, rulePrefix)
+	}
+	sort.Strings(rulePrefixes)
+
+	for _, rulePrefix := range rulePrefixes {
+		for _, alias := range rules[rulePrefix] {
+			approved, err := h.isRouteApprover(&route.Machine, policy, alias)
+			if err != nil {
+				return "", "", err
+			}
+			if approved {
+				return rulePrefix, alias, nil
+			}
+		}
 	}
 
-	return byID
+	return "", "", nil
 }
@@ -0,0 +1,279 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	metricsNamespace = "mirage"
+
+	dbMetricsStartKey = "mirage:metrics_start"
+)
+
+var (
+	pollStreamsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "poll_streams",
+		Help:      "Number of connected map poll streams per organization.",
+	}, []string{"org"})
+
+	mapResponseBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "map_response_bytes",
+		Help:      "Size of encoded map responses sent to machines.",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 10),
+	})
+
+	mapResponseDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "map_response_generation_seconds",
+		Help:      "Time spent generating map responses.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	registrationsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "machine_registrations_total",
+		Help:      "Number of machine registrations by register method.",
+	}, []string{"method"})
+
+	routeFailoverCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "route_failovers_total",
+		Help:      "Number of primary subnet route switches by reason.",
+	}, []string{"reason"})
+
+	aclCompileDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "acl_compile_seconds",
+		Help:      "Time spent compiling the ACL and SSH rules of an organization.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "db_query_seconds",
+		Help:      "Latency of database operations by operation type.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"op"})
+
+	naviMetrics = newNaviCollector()
+)
+
+func init() {
+	prometheus.MustRegister(naviMetrics)
+}
+
+// metricsHandler 返回/metrics的处理函数
+// 请求须携带Authorization: Bearer <MIRAGE_METRICS_TOKEN>，
+// 只有显式设置MIRAGE_METRICS_ANONYMOUS=true时才允许匿名抓取，两者都未设置时拒绝所有请求
+func metricsHandler() http.Handler {
+	handler := promhttp.Handler()
+	token := os.Getenv("MIRAGE_METRICS_TOKEN")
+	if token == "" {
+		if anonymous, _ := strconv.ParseBool(os.Getenv("MIRAGE_METRICS_ANONYMOUS")); anonymous {
+			log.Warn().Msg("Metrics endpoint allows anonymous scraping (MIRAGE_METRICS_ANONYMOUS)")
+			return handler
+		}
+		log.Warn().Msg("Metrics endpoint disabled: set MIRAGE_METRICS_TOKEN, or MIRAGE_METRICS_ANONYMOUS=true to allow anonymous scraping")
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Metrics endpoint is not configured", http.StatusForbidden)
+		})
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// trackPollStream 记录组织的长连接数，返回的函数在连接结束时调用
+func trackPollStream(orgID int64) func() {
+	gauge := pollStreamsGauge.WithLabelValues(strconv.FormatInt(orgID, 10))
+	gauge.Inc()
+
+	return gauge.Dec
+}
+
+func observeSince(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
+
+func observeRegistration(method string) {
+	if method == "" {
+		method = "unknown"
+	}
+	registrationsCounter.WithLabelValues(method).Inc()
+}
+
+// registerDBMetrics 通过gorm回调统计各类数据库操作的耗时
+func registerDBMetrics(db *gorm.DB) error {
+	before := func(tx *gorm.DB) {
+		tx.InstanceSet(dbMetricsStartKey, time.Now())
+	}
+	after := func(op string) func(*gorm.DB) {
+		observer := dbQueryDuration.WithLabelValues(op)
+
+		return func(tx *gorm.DB) {
+			if start, ok := tx.InstanceGet(dbMetricsStartKey); ok {
+				observer.Observe(time.Since(start.(time.Time)).Seconds())
+			}
+		}
+	}
+
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().Before("gorm:create").Register("metrics:before_create", before),
+		cb.Create().After("gorm:create").Register("metrics:after_create", after("create")),
+		cb.Query().Before("gorm:query").Register("metrics:before_query", before),
+		cb.Query().After("gorm:query").Register("metrics:after_query", after("query")),
+		cb.Update().Before("gorm:update").Register("metrics:before_update", before),
+		cb.Update().After("gorm:update").Register("metrics:after_update", after("update")),
+		cb.Delete().Before("gorm:delete").Register("metrics:before_delete", before),
+		cb.Delete().After("gorm:delete").Register("metrics:after_delete", after("delete")),
+		cb.Row().Before("gorm:row").Register("metrics:before_row", before),
+		cb.Row().After("gorm:row").Register("metrics:after_row", after("row")),
+		cb.Raw().Before("gorm:raw").Register("metrics:before_raw", before),
+		cb.Raw().After("gorm:raw").Register("metrics:after_raw", after("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// naviCollector 导出updateNaviStatus最近一次采集到的司南状态
+// 司南自身的计数器按counter导出，不可达的司南只导出up=0
+type naviCollector struct {
+	mu     sync.RWMutex
+	status map[string]naviMetricsEntry
+
+	up          *prometheus.Desc
+	latency     *prometheus.Desc
+	certExpiry  *prometheus.Desc
+	uptime      *prometheus.Desc
+	accepts     *prometheus.Desc
+	bytes       *prometheus.Desc
+	packets     *prometheus.Desc
+	dropped     *prometheus.Desc
+	forwarded   *prometheus.Desc
+	homeMoves   *prometheus.Desc
+	clients     *prometheus.Desc
+	connections *prometheus.Desc
+}
+
+type naviMetricsEntry struct {
+	region string
+	status NaviStatus
+}
+
+func newNaviCollector() *naviCollector {
+	labels := []string{"navi", "region"}
+	desc := func(name, help string, extra ...string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "navi", name), help, append(labels, extra...), nil)
+	}
+
+	return &naviCollector{
+		status: make(map[string]naviMetricsEntry),
+
+		up:          desc("up", "Whether the last status check of the Navi node succeeded."),
+		latency:     desc("latency_seconds", "Latency of the last status check of the Navi node."),
+		certExpiry:  desc("cert_expiry_timestamp_seconds", "Expiry time of the Navi node TLS certificate."),
+		uptime:      desc("uptime_seconds", "Uptime reported by the Navi node."),
+		accepts:     desc("accepts_total", "DERP connections accepted by the Navi node."),
+		bytes:       desc("bytes_total", "DERP bytes handled by the Navi node.", "direction"),
+		packets:     desc("packets_total", "DERP packets handled by the Navi node.", "direction"),
+		dropped:     desc("packets_dropped_total", "DERP packets dropped by the Navi node."),
+		forwarded:   desc("packets_forwarded_total", "DERP packets forwarded between Navi nodes.", "direction"),
+		homeMoves:   desc("home_moves_total", "Clients moving their home DERP to or from the Navi node.", "direction"),
+		clients:     desc("clients", "DERP clients connected to the Navi node.", "scope"),
+		connections: desc("connections", "Current DERP connections of the Navi node."),
+	}
+}
+
+// update 记录司南的最新状态
+func (c *naviCollector) update(navi *NaviNode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status[navi.ID] = naviMetricsEntry{
+		region: strconv.Itoa(navi.NaviRegionID),
+		status: navi.Statics,
+	}
+}
+
+// forget 删除已移除司南的指标
+func (c *naviCollector) forget(naviID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.status, naviID)
+}
+
+func (c *naviCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c *naviCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for id, entry := range c.status {
+		emit := func(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, extra ...string) {
+			metric, err := prometheus.NewConstMetric(desc, valueType, value, append([]string{id, entry.region}, extra...)...)
+			if err != nil {
+				log.Error().Err(err).Str("navi", id).Msg("Cannot build navi metric")
+
+				return
+			}
+			ch <- metric
+		}
+
+		status := &entry.status
+		if status.Latency < 0 {
+			emit(c.up, prometheus.GaugeValue, 0)
+
+			continue
+		}
+		emit(c.up, prometheus.GaugeValue, 1)
+		emit(c.latency, prometheus.GaugeValue, float64(status.Latency)/1000)
+		if !status.CertExpiresAt.IsZero() {
+			emit(c.certExpiry, prometheus.GaugeValue, float64(status.CertExpiresAt.Unix()))
+		}
+		// 非受控司南只做连通性检查，没有DERP计数
+		if status.Derp.Version == "" && status.CounterUptimeSec == 0 {
+			continue
+		}
+		derp := &status.Derp
+		emit(c.uptime, prometheus.GaugeValue, float64(status.CounterUptimeSec))
+		emit(c.accepts, prometheus.CounterValue, float64(derp.Accepts))
+		emit(c.bytes, prometheus.CounterValue, float64(derp.BytesReceived), "in")
+		emit(c.bytes, prometheus.CounterValue, float64(derp.BytesSent), "out")
+		emit(c.packets, prometheus.CounterValue, float64(derp.PacketsReceived), "in")
+		emit(c.packets, prometheus.CounterValue, float64(derp.PacketsSent), "out")
+		emit(c.dropped, prometheus.CounterValue, float64(derp.PacketsDropped))
+		emit(c.forwarded, prometheus.CounterValue, float64(derp.PacketsForwarded_in), "in")
+		emit(c.forwarded, prometheus.CounterValue, float64(derp.PacketsForwarded_out), "out")
+		emit(c.homeMoves, prometheus.CounterValue, float64(derp.HomeMovesIn), "in")
+		emit(c.homeMoves, prometheus.CounterValue, float64(derp.HomeMovesOut), "out")
+		emit(c.clients, prometheus.GaugeValue, float64(derp.GaugeClientsLocal), "local")
+		emit(c.clients, prometheus.GaugeValue, float64(derp.GaugeClientsTotal), "total")
+		emit(c.connections, prometheus.GaugeValue, float64(derp.GaugeCurrentConnections))
+	}
+}
@@ -0,0 +1,419 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"time"
+
+	"github.com/puzpuzpuz/xsync/v2"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	NaviSyncStateSynced    = "synced"
+	NaviSyncStatePending   = "pending"
+	NaviSyncStateOutOfSync = "out_of_sync"
+
+	naviOutboxInterval     = 5 * time.Second
+	naviOutboxLease        = time.Minute
+	naviSendTimeout        = 10 * time.Second // 单条变更的发送超时，须远小于租约时长
+	naviOutboxBatch        = 100
+	naviOutboxMaxBackoff   = 5 * time.Minute
+	naviOutOfSyncAttempts  = 5
+	naviReconcileInterval  = 30 * time.Minute
+	naviOutboxErrorMaxSize = 200
+)
+
+// NaviOutboxEntry 待发送给司南的可信节点变更
+// 每个司南的变更按SeqNum顺序逐条发送，司南返回200视为确认，确认后删除；
+// 发送失败时按退避重试，前一条未确认时不会发送后一条
+// FullSync为真时发送全量可信节点列表，列表在发送时生成，排在它之前的变更已无意义会被删除；
+// 只有声明支持全量推送的司南才会收到，其余司南只能通过重新拉取列表完成纠偏
+type NaviOutboxEntry struct {
+	ID            uint64 `gorm:"primaryKey"`
+	NaviID        string `gorm:"index;not null"`
+	SeqNum        int
+	AddNode       string
+	RemoveNode    string
+	FullSync      bool
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+}
+
+// NaviSyncState 司南可信节点列表的同步状态，在司南列表中展示
+type NaviSyncState struct {
+	NaviID         string     `gorm:"primaryKey" json:"-"`
+	State          string     `json:"State"`          // synced | pending | out_of_sync
+	NextSeq        int        `json:"-"`              // 最近分配的序列号
+	AckedSeq       int        `json:"AckedSeq"`       // 司南最近确认的序列号
+	Pending        int        `json:"Pending"`        // 待发送的变更数
+	LastAckAt      *time.Time `json:"LastAckAt"`      // 最近一次确认时间
+	LastFullSyncAt *time.Time `json:"LastFullSyncAt"` // 最近一次全量同步时间
+	LastError      string     `json:"LastError"`
+	PushFullSync   bool       `json:"PushFullSync"` // 司南最近一次注册或拉取列表时声明支持全量推送
+	LeaseOwner     string     `json:"-"`            // 正在投递的控制服务器副本
+	LeaseUntil     *time.Time `json:"-"`
+	UpdatedAt      time.Time  `json:"UpdatedAt"`
+}
+
+// newInstanceID 生成本控制服务器副本的标识，用于投递司南变更时的租约
+func newInstanceID() string {
+	hostname, _ := os.Hostname()
+	randomBlob := make([]byte, 4)
+	rand.Read(randomBlob)
+
+	return hostname + "-" + hex.EncodeToString(randomBlob)
+}
+
+func ensureNaviSyncState(tx *gorm.DB, naviID string) error {
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&NaviSyncState{
+		NaviID: naviID,
+		State:  NaviSyncStateSynced,
+	}).Error
+}
+
+// nextNaviSeq 分配司南的下一个序列号，须在事务中调用，更新会锁住该司南的状态行直到事务结束
+func nextNaviSeq(tx *gorm.DB, naviID string) (int, error) {
+	if err := ensureNaviSyncState(tx, naviID); err != nil {
+		return 0, err
+	}
+	err := tx.Model(&NaviSyncState{}).
+		Where("navi_id = ?", naviID).
+		UpdateColumn("next_seq", gorm.Expr("next_seq + 1")).Error
+	if err != nil {
+		return 0, err
+	}
+	state := NaviSyncState{}
+	if err = tx.Take(&state, "navi_id = ?", naviID).Error; err != nil {
+		return 0, err
+	}
+
+	return state.NextSeq, nil
+}
+
+// enqueueNodesChange 将可信节点变更加入司南的发送队列
+func (m *Mirage) enqueueNodesChange(naviID, addNode, removeNode string) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		seqNum, err := nextNaviSeq(tx, naviID)
+		if err != nil {
+			return err
+		}
+		if err = tx.Create(&NaviOutboxEntry{
+			NaviID:        naviID,
+			SeqNum:        seqNum,
+			AddNode:       addNode,
+			RemoveNode:    removeNode,
+			NextAttemptAt: time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&NaviSyncState{}).Where("navi_id = ?", naviID).Updates(map[string]interface{}{
+			"pending": gorm.Expr("pending + 1"),
+			"state": gorm.Expr("CASE WHEN state = ? THEN ? ELSE state END",
+				NaviSyncStateSynced, NaviSyncStatePending),
+		}).Error
+	})
+}
+
+// enqueueNaviFullSync 丢弃司南队列中尚未发送的变更，改为发送一次全量同步
+func (m *Mirage) enqueueNaviFullSync(naviID string) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		seqNum, err := nextNaviSeq(tx, naviID)
+		if err != nil {
+			return err
+		}
+		if err = tx.Where("navi_id = ?", naviID).Delete(&NaviOutboxEntry{}).Error; err != nil {
+			return err
+		}
+		if err = tx.Create(&NaviOutboxEntry{
+			NaviID:        naviID,
+			SeqNum:        seqNum,
+			FullSync:      true,
+			NextAttemptAt: time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&NaviSyncState{}).Where("navi_id = ?", naviID).Update("pending", 1).Error
+	})
+}
+
+// resetNaviOutbox 在司南拉取全量可信节点列表前调用：丢弃待发送的变更并将序列号置零
+// 须在生成列表之前调用，之后产生的变更会以新的序列号继续发送，重复的增删对司南没有影响
+// pushFullSync记录司南本次是否声明支持全量推送，决定之后的纠偏方式
+func (m *Mirage) resetNaviOutbox(naviID string, pushFullSync bool) error {
+	now := time.Now()
+
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := ensureNaviSyncState(tx, naviID); err != nil {
+			return err
+		}
+		if err := tx.Where("navi_id = ?", naviID).Delete(&NaviOutboxEntry{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&NaviSyncState{}).Where("navi_id = ?", naviID).Updates(map[string]interface{}{
+			"state":             NaviSyncStateSynced,
+			"next_seq":          0,
+			"acked_seq":         0,
+			"pending":           0,
+			"last_full_sync_at": &now,
+			"last_error":        "",
+			"push_full_sync":    pushFullSync,
+		}).Error
+	})
+}
+
+// deleteNaviSync 删除已移除司南的发送队列与同步状态
+func deleteNaviSync(db *gorm.DB, naviID string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("navi_id = ?", naviID).Delete(&NaviOutboxEntry{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("navi_id = ?", naviID).Delete(&NaviSyncState{}).Error
+	})
+}
+
+// kickNaviOutbox 唤醒投递协程立即发送
+func (m *Mirage) kickNaviOutbox() {
+	select {
+	case m.naviOutboxKick <- struct{}{}:
+	default:
+	}
+}
+
+// deliverNaviOutbox 定期或被唤醒时投递全部司南的待发送变更，并对支持全量推送的司南定期发起全量同步以纠正偏差
+// 各司南分别在独立的协程中投递，无响应的司南不会拖慢其他司南；同一司南在本副本上同时只有一个协程投递
+func (m *Mirage) deliverNaviOutbox(ticker *time.Ticker) {
+	delivering := xsync.NewMapOf[struct{}]()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.naviOutboxKick:
+		}
+		nrs := m.ListNaviRegions()
+		for _, nr := range nrs {
+			nns := m.ListNaviNodes(nr.ID)
+			for index := range nns {
+				navi := nns[index]
+				if navi.NaviKey == "" {
+					continue
+				}
+				if _, loaded := delivering.LoadOrStore(navi.ID, struct{}{}); loaded {
+					continue
+				}
+				go func() {
+					defer delivering.Delete(navi.ID)
+					m.deliverNaviOutboxOf(&navi)
+				}()
+			}
+		}
+	}
+}
+
+// acquireNaviLease 多副本部署时同一司南同时只由一个副本投递，以保证发送顺序
+func (m *Mirage) acquireNaviLease(naviID string) bool {
+	if err := ensureNaviSyncState(m.db, naviID); err != nil {
+		log.Error().Caller().Err(err).Str("navi", naviID).Msg("Cannot create navi sync state")
+
+		return false
+	}
+	now := time.Now()
+	until := now.Add(naviOutboxLease)
+	res := m.db.Model(&NaviSyncState{}).
+		Where("navi_id = ?", naviID).
+		Where("lease_owner = ? OR lease_until IS NULL OR lease_until < ?", m.instanceID, now).
+		UpdateColumns(map[string]interface{}{
+			"lease_owner": m.instanceID,
+			"lease_until": &until,
+		})
+	if res.Error != nil {
+		log.Error().Caller().Err(res.Error).Str("navi", naviID).Msg("Cannot acquire navi outbox lease")
+
+		return false
+	}
+
+	return res.RowsAffected == 1
+}
+
+// renewNaviLease 在发送每条变更前续租，租约已过期（可能已被其他副本取得）时返回false，本轮投递须停止
+func (m *Mirage) renewNaviLease(naviID string) bool {
+	now := time.Now()
+	until := now.Add(naviOutboxLease)
+	res := m.db.Model(&NaviSyncState{}).
+		Where("navi_id = ? AND lease_owner = ? AND lease_until >= ?", naviID, m.instanceID, now).
+		UpdateColumn("lease_until", &until)
+	if res.Error != nil {
+		log.Error().Caller().Err(res.Error).Str("navi", naviID).Msg("Cannot renew navi outbox lease")
+
+		return false
+	}
+
+	return res.RowsAffected == 1
+}
+
+func (m *Mirage) releaseNaviLease(naviID string) {
+	err := m.db.Model(&NaviSyncState{}).
+		Where("navi_id = ? AND lease_owner = ?", naviID, m.instanceID).
+		UpdateColumns(map[string]interface{}{
+			"lease_owner": "",
+			"lease_until": nil,
+		}).Error
+	if err != nil {
+		log.Error().Caller().Err(err).Str("navi", naviID).Msg("Cannot release navi outbox lease")
+	}
+}
+
+func (m *Mirage) deliverNaviOutboxOf(navi *NaviNode) {
+	if !m.acquireNaviLease(navi.ID) {
+		return
+	}
+	defer m.releaseNaviLease(navi.ID)
+
+	state := NaviSyncState{}
+	if err := m.db.Take(&state, "navi_id = ?", navi.ID).Error; err != nil {
+		log.Error().Caller().Err(err).Str("navi", navi.ID).Msg("Cannot load navi sync state")
+
+		return
+	}
+	// 旧版司南会忽略全量推送的字段并对空的增删返回200，不能据此判定已同步
+	if state.PushFullSync &&
+		(state.LastFullSyncAt == nil || time.Since(*state.LastFullSyncAt) > naviReconcileInterval) {
+		var fullSyncs int64
+		m.db.Model(&NaviOutboxEntry{}).Where("navi_id = ? AND full_sync = ?", navi.ID, true).Count(&fullSyncs)
+		if fullSyncs == 0 {
+			if err := m.enqueueNaviFullSync(navi.ID); err != nil {
+				log.Error().Caller().Err(err).Str("navi", navi.ID).Msg("Cannot enqueue navi full sync")
+			}
+		}
+	}
+
+	entries := []NaviOutboxEntry{}
+	err := m.db.Where("navi_id = ?", navi.ID).Order("seq_num").Limit(naviOutboxBatch).Find(&entries).Error
+	if err != nil {
+		log.Error().Caller().Err(err).Str("navi", navi.ID).Msg("Cannot load navi outbox")
+
+		return
+	}
+	for index := range entries {
+		entry := &entries[index]
+		if entry.NextAttemptAt.After(time.Now()) {
+			break
+		}
+		if !m.renewNaviLease(navi.ID) {
+			log.Warn().Str("navi", navi.ID).Msg("Navi outbox lease lost, stopping delivery")
+
+			break
+		}
+		if err = m.sendNodesChange(navi, entry); err != nil {
+			m.naviOutboxFailed(navi, entry, err)
+
+			break
+		}
+		m.naviOutboxAcked(navi, entry)
+	}
+}
+
+// naviPushFullSync 司南最近一次注册或拉取列表时是否声明支持全量推送
+func (m *Mirage) naviPushFullSync(naviID string) bool {
+	state := NaviSyncState{}
+	if err := m.db.Take(&state, "navi_id = ?", naviID).Error; err != nil {
+		log.Error().Caller().Err(err).Str("navi", naviID).Msg("Cannot load navi sync state")
+
+		return false
+	}
+
+	return state.PushFullSync
+}
+
+func (m *Mirage) naviOutboxAcked(navi *NaviNode, entry *NaviOutboxEntry) {
+	now := time.Now()
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Delete(&NaviOutboxEntry{}, entry.ID)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			// 发送期间队列被全量同步或司南拉取列表重置，状态已由重置方更新
+			return nil
+		}
+		var pending int64
+		if err := tx.Model(&NaviOutboxEntry{}).Where("navi_id = ?", navi.ID).Count(&pending).Error; err != nil {
+			return err
+		}
+		updates := map[string]interface{}{
+			"acked_seq":   entry.SeqNum,
+			"pending":     pending,
+			"last_ack_at": &now,
+			"last_error":  "",
+		}
+		if entry.FullSync {
+			updates["last_full_sync_at"] = &now
+		}
+		if pending == 0 {
+			updates["state"] = NaviSyncStateSynced
+		} else if entry.FullSync {
+			updates["state"] = NaviSyncStatePending
+		}
+
+		return tx.Model(&NaviSyncState{}).Where("navi_id = ?", navi.ID).Updates(updates).Error
+	})
+	if err != nil {
+		log.Error().Caller().Err(err).Str("navi", navi.ID).Msg("Cannot record navi outbox ack")
+	}
+}
+
+// naviOutboxFailed 记录发送失败并安排重试，连续失败达到上限时判定司南已失去同步
+// 支持全量推送的司南改为全量同步，其余司南继续按序重试，直到送达或司南重新拉取列表
+func (m *Mirage) naviOutboxFailed(navi *NaviNode, entry *NaviOutboxEntry, sendErr error) {
+	log.Warn().
+		Err(sendErr).
+		Str("navi", navi.ID).
+		Int("seq", entry.SeqNum).
+		Int("attempts", entry.Attempts+1).
+		Msg("Cannot send nodes change to navi, will retry")
+
+	lastError := sendErr.Error()
+	if len(lastError) > naviOutboxErrorMaxSize {
+		lastError = lastError[:naviOutboxErrorMaxSize]
+	}
+	backoff := time.Second << entry.Attempts
+	if backoff <= 0 || backoff > naviOutboxMaxBackoff {
+		backoff = naviOutboxMaxBackoff
+	}
+	attempts := entry.Attempts + 1
+	err := m.db.Model(&NaviOutboxEntry{}).Where("id = ?", entry.ID).Updates(map[string]interface{}{
+		"attempts":        attempts,
+		"next_attempt_at": time.Now().Add(backoff),
+		"last_error":      lastError,
+	}).Error
+	if err != nil {
+		log.Error().Caller().Err(err).Str("navi", navi.ID).Msg("Cannot record navi outbox failure")
+	}
+
+	state := NaviSyncStatePending
+	if attempts >= naviOutOfSyncAttempts {
+		state = NaviSyncStateOutOfSync
+		if !entry.FullSync && m.naviPushFullSync(navi.ID) {
+			if err = m.enqueueNaviFullSync(navi.ID); err != nil {
+				log.Error().Caller().Err(err).Str("navi", navi.ID).Msg("Cannot enqueue navi full sync")
+			}
+		}
+	}
+	err = m.db.Model(&NaviSyncState{}).Where("navi_id = ?", navi.ID).Updates(map[string]interface{}{
+		"state":      state,
+		"last_error": lastError,
+	}).Error
+	if err != nil {
+		log.Error().Caller().Err(err).Str("navi", navi.ID).Msg("Cannot update navi sync state")
+	}
+}
@@ -38,6 +38,7 @@ type noiseServer struct {
 	conn           *controlbase.Conn
 	machineKey     key.MachinePublic
 	nodeKey        key.NodePublic
+	clientIP       string // 升级请求的来源地址，Noise内层请求只能看到承载连接
 
 	// EarlyNoise-related stuff
 	challenge       key.ChallengePrivate
@@ -69,6 +70,7 @@ func (h *Mirage) NoiseUpgradeHandler(
 	noiseServer := noiseServer{
 		mirage:    h,
 		challenge: key.NewChallenge(),
+		clientIP:  requestSourceIP(req),
 	}
 
 	noiseConn, err := controlhttp.AcceptHTTP(
@@ -0,0 +1,330 @@
+package controller
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ErrExpiryNoticeInvalid = Error("invalid expiry notice policy")
+
+	NotifyChannelEmail   = "email"
+	NotifyChannelWebhook = "webhook"
+	NotifyChannelSMS     = "sms"
+
+	expiryNoticeInterval = 10 * time.Minute
+	expiryNoticeTimeout  = 30 * time.Second
+	maxExpiryNoticeDays  = 90
+)
+
+var defaultExpiryNoticeDays = []int{7, 1}
+
+// ExpiryNoticePolicy 组织的设备密钥过期提醒策略
+type ExpiryNoticePolicy struct {
+	Enabled     bool     `json:"enabled"`
+	Days        []int    `json:"days"`        // 在过期前N天提醒，为空时使用7天与1天
+	NotifyOwner bool     `json:"notifyOwner"` // 同时提醒设备所属用户（用户名为邮箱或手机号时）
+	Emails      []string `json:"emails"`      // 额外接收邮件提醒的地址
+	Phones      []string `json:"phones"`      // 额外接收短信提醒的手机号
+	WebhookURL  string   `json:"webhookUrl"`  // 只允许https公网地址
+	WebhookKey  string   `json:"webhookKey"`  // 不为空时以HMAC-SHA256对请求体签名
+}
+
+func (p *ExpiryNoticePolicy) Scan(destination interface{}) error {
+	switch value := destination.(type) {
+	case []byte:
+		return json.Unmarshal(value, p)
+
+	case string:
+		return json.Unmarshal([]byte(value), p)
+
+	default:
+		return fmt.Errorf("%w: unexpected data type %T", ErrExpiryNoticeInvalid, destination)
+	}
+}
+
+// Value return json value, implement driver.Valuer interface.
+func (p ExpiryNoticePolicy) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(p)
+
+	return string(bytes), err
+}
+
+// Validate 校验并规范化提醒策略，阈值去重后从大到小排列
+func (p *ExpiryNoticePolicy) Validate() error {
+	seen := map[int]bool{}
+	days := make([]int, 0, len(p.Days))
+	for _, d := range p.Days {
+		if d < 1 || d > maxExpiryNoticeDays {
+			return fmt.Errorf("%w: days must be between 1 and %d", ErrExpiryNoticeInvalid, maxExpiryNoticeDays)
+		}
+		if !seen[d] {
+			seen[d] = true
+			days = append(days, d)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(days)))
+	p.Days = days
+
+	for _, addr := range p.Emails {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return fmt.Errorf("%w: invalid email %q", ErrExpiryNoticeInvalid, addr)
+		}
+	}
+	for _, phone := range p.Phones {
+		if !isMobileNumber(phone) {
+			return fmt.Errorf("%w: invalid phone %q", ErrExpiryNoticeInvalid, phone)
+		}
+	}
+	if p.WebhookURL != "" {
+		if err := validateWebhookURL(p.WebhookURL); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *ExpiryNoticePolicy) days() []int {
+	if len(p.Days) == 0 {
+		return defaultExpiryNoticeDays
+	}
+
+	return p.Days
+}
+
+// maxDays 返回最早的提醒阈值，控制台以此作为“即将过期”的默认范围
+func (p *ExpiryNoticePolicy) maxDays() int {
+	res := 0
+	for _, d := range p.days() {
+		if d > res {
+			res = d
+		}
+	}
+
+	return res
+}
+
+// dueThreshold 返回设备当前所处的最小提醒阈值，永不过期或已过期的设备不需要提醒
+func (p *ExpiryNoticePolicy) dueThreshold(machine *Machine, now time.Time) (int, bool) {
+	if machine.Expiry == nil || machine.Expiry.IsZero() || !machine.Expiry.After(now) {
+		return 0, false
+	}
+	left := machine.Expiry.Sub(now)
+	due := 0
+	for _, d := range p.days() {
+		if left <= time.Duration(d)*24*time.Hour && (due == 0 || d < due) {
+			due = d
+		}
+	}
+
+	return due, due > 0
+}
+
+func isMobileNumber(s string) bool {
+	if len(s) != 11 || s[0] != '1' {
+		return false
+	}
+	_, err := strconv.ParseUint(s, 10, 64)
+
+	return err == nil
+}
+
+// ExpiryNotice 一条设备密钥即将过期的提醒
+type ExpiryNotice struct {
+	Organization string    `json:"organization"`
+	MachineID    string    `json:"machineId"`
+	Machine      string    `json:"machine"`
+	Hostname     string    `json:"hostname"`
+	User         string    `json:"user"`
+	Expiry       time.Time `json:"expiry"`
+	Days         int       `json:"days"` // 触发本次提醒的阈值
+	RenewURL     string    `json:"renewUrl"`
+}
+
+func (n *ExpiryNotice) subject() string {
+	return fmt.Sprintf("设备%s的密钥将在%d天内过期", n.Machine, n.Days)
+}
+
+func (n *ExpiryNotice) text() string {
+	return fmt.Sprintf("您好，\n\n%s中用户%s的设备%s（主机名%s）的密钥将于%s过期，过期后该设备将无法接入网络。\n"+
+		"请在过期前登录控制台续期：%s\n",
+		n.Organization, n.User, n.Machine, n.Hostname, Time2SHString(n.Expiry), n.RenewURL)
+}
+
+// ExpiryNotifier 过期提醒的投递渠道
+type ExpiryNotifier interface {
+	Channel() string
+	Notify(ctx context.Context, notice *ExpiryNotice) error
+}
+
+// ExpiryNotification 记录已发送的提醒，同一设备的同一过期时间在每个阈值只提醒一次
+// 设备续期后过期时间改变，会重新按阈值提醒
+type ExpiryNotification struct {
+	ID        uint64     `gorm:"primaryKey"`
+	MachineID int64      `gorm:"uniqueIndex:idx_expiry_notification;not null"`
+	Expiry    int64      `gorm:"uniqueIndex:idx_expiry_notification;not null"` // 提醒时设备的过期时间（Unix秒）
+	Days      int        `gorm:"uniqueIndex:idx_expiry_notification;not null"`
+	Channels  StringList // 投递成功的渠道
+	CreatedAt time.Time
+}
+
+// expiryNotifiers 按组织策略与系统配置组装本次提醒可用的投递渠道
+func (h *Mirage) expiryNotifiers(org *Organization, owner *User) []ExpiryNotifier {
+	policy := &org.ExpiryNotice
+	emails := append([]string{}, policy.Emails...)
+	phones := append([]string{}, policy.Phones...)
+	if policy.NotifyOwner && owner != nil {
+		if addr, err := mail.ParseAddress(owner.Name); err == nil && addr.Address == owner.Name {
+			emails = append(emails, owner.Name)
+		} else if isMobileNumber(owner.Name) {
+			phones = append(phones, owner.Name)
+		}
+	}
+
+	notifiers := []ExpiryNotifier{}
+	if len(emails) > 0 && h.cfg.SMTP.Host != "" {
+		notifiers = append(notifiers, newSMTPNotifier(h.cfg.SMTP, emails))
+	}
+	if len(phones) > 0 && h.cfg.SMS.ExpiryTemplate != "" {
+		notifiers = append(notifiers, newSMSNotifier(h.cfg.SMS, phones))
+	}
+	if policy.WebhookURL != "" {
+		notifiers = append(notifiers, newWebhookNotifier(policy.WebhookURL, policy.WebhookKey))
+	}
+
+	return notifiers
+}
+
+// notifyExpiringMachines warns about machines whose key is about to expire.
+func (h *Mirage) notifyExpiringMachines(ticker *time.Ticker) {
+	for range ticker.C {
+		h.notifyExpiringMachinesWorker()
+	}
+}
+
+func (h *Mirage) notifyExpiringMachinesWorker() {
+	orgs, err := h.ListOrgnaizations()
+	if err != nil {
+		log.Error().Err(err).Msg("Error listing organizations")
+
+		return
+	}
+	now := time.Now()
+	for pos := range orgs {
+		org := &orgs[pos]
+		if !org.ExpiryNotice.Enabled {
+			continue
+		}
+		machines, err := h.ListMachinesByOrgID(org.ID)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("organization", org.Name).
+				Msg("Error listing machines in organization")
+
+			continue
+		}
+		for index := range machines {
+			machine := &machines[index]
+			days, ok := org.ExpiryNotice.dueThreshold(machine, now)
+			if !ok || h.expiryNoticeSent(machine, days) {
+				continue
+			}
+			h.sendExpiryNotice(org, machine, days)
+		}
+	}
+}
+
+func (h *Mirage) expiryNoticeSent(machine *Machine, days int) bool {
+	var count int64
+	h.db.Model(&ExpiryNotification{}).Where(&ExpiryNotification{
+		MachineID: machine.ID,
+		Expiry:    machine.Expiry.Unix(),
+		Days:      days,
+	}).Count(&count)
+
+	return count > 0
+}
+
+// sendExpiryNotice 向全部渠道投递提醒，至少一个渠道成功时记为已提醒，全部失败则在下一轮重试
+func (h *Mirage) sendExpiryNotice(org *Organization, machine *Machine, days int) {
+	notifiers := h.expiryNotifiers(org, &machine.User)
+	if len(notifiers) == 0 {
+		log.Debug().
+			Str("organization", org.Name).
+			Str("machine", machine.GivenName).
+			Msg("No notification channel available for expiring machine")
+
+		return
+	}
+
+	notice := &ExpiryNotice{
+		Organization: org.Name,
+		MachineID:    strconv.FormatInt(machine.ID, 10),
+		Machine:      machine.GivenName,
+		Hostname:     machine.Hostname,
+		User:         machine.User.Name,
+		Expiry:       *machine.Expiry,
+		Days:         days,
+		RenewURL:     "https://" + h.cfg.ServerURL + "/admin/machines",
+	}
+	channels := StringList{}
+	for _, notifier := range notifiers {
+		ctx, cancel := context.WithTimeout(h.ctx, expiryNoticeTimeout)
+		err := notifier.Notify(ctx, notice)
+		cancel()
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("channel", notifier.Channel()).
+				Str("machine", machine.GivenName).
+				Msg("Failed to send machine expiry notice")
+
+			continue
+		}
+		channels = append(channels, notifier.Channel())
+	}
+	if len(channels) == 0 {
+		return
+	}
+
+	err := h.db.Create(&ExpiryNotification{
+		MachineID: machine.ID,
+		Expiry:    machine.Expiry.Unix(),
+		Days:      days,
+		Channels:  channels,
+	}).Error
+	if err != nil {
+		log.Error().Err(err).Str("machine", machine.GivenName).Msg("Failed to record machine expiry notice")
+
+		return
+	}
+	log.Info().
+		Str("machine", machine.GivenName).
+		Int("days", days).
+		Strs("channels", channels).
+		Msg("Machine expiry notice sent")
+}
+
+// ListMachineExpiryNotifications 返回设备当前过期时间下已发送提醒的阈值
+func (h *Mirage) ListMachineExpiryNotifications(machine *Machine) []int {
+	if machine.Expiry == nil || machine.Expiry.IsZero() {
+		return []int{}
+	}
+	days := []int{}
+	h.db.Model(&ExpiryNotification{}).
+		Where(&ExpiryNotification{MachineID: machine.ID, Expiry: machine.Expiry.Unix()}).
+		Order("days DESC").
+		Pluck("days", &days)
+
+	return days
+}
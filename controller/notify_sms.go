@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	openapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	dysmsapi20170525 "github.com/alibabacloud-go/dysmsapi-20170525/v3/client"
+	util "github.com/alibabacloud-go/tea-utils/v2/service"
+	"github.com/alibabacloud-go/tea/tea"
+)
+
+// smsNotifier 通过阿里云短信服务发送提醒，使用SMSConfig中的ExpiryTemplate
+type smsNotifier struct {
+	cfg    SMSConfig
+	phones []string
+}
+
+func newSMSNotifier(cfg SMSConfig, phones []string) ExpiryNotifier {
+	return &smsNotifier{
+		cfg:    cfg,
+		phones: phones,
+	}
+}
+
+func (n *smsNotifier) Channel() string {
+	return NotifyChannelSMS
+}
+
+func (n *smsNotifier) Notify(ctx context.Context, notice *ExpiryNotice) (err error) {
+	client, err := dysmsapi20170525.NewClient(&openapi.Config{
+		AccessKeyId:     &n.cfg.ID,
+		AccessKeySecret: &n.cfg.Key,
+		Endpoint:        tea.String("dysmsapi.aliyuncs.com"),
+	})
+	if err != nil {
+		return err
+	}
+	param, err := json.Marshal(map[string]string{
+		"machine": notice.Machine,
+		"days":    strconv.Itoa(notice.Days),
+	})
+	if err != nil {
+		return err
+	}
+
+	// SDK以panic报告部分错误，统一转换为返回值
+	defer func() {
+		if r := tea.Recover(recover()); r != nil {
+			err = r
+		}
+	}()
+	res, err := client.SendSmsWithOptions(&dysmsapi20170525.SendSmsRequest{
+		PhoneNumbers:  tea.String(strings.Join(n.phones, ",")),
+		SignName:      &n.cfg.Sign,
+		TemplateCode:  &n.cfg.ExpiryTemplate,
+		TemplateParam: tea.String(string(param)),
+	}, &util.RuntimeOptions{})
+	if err != nil {
+		return err
+	}
+	if res.Body != nil && tea.StringValue(res.Body.Code) != "OK" {
+		return fmt.Errorf("sms send failed: %s %s", tea.StringValue(res.Body.Code), tea.StringValue(res.Body.Message))
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSMTPPort    = 587
+	defaultSMTPTLSPort = 465
+)
+
+// Validate 检查SMTP配置并补齐默认端口，Host为空表示不启用邮件通知
+func (cfg *SMTPConfig) Validate() error {
+	if cfg.Host == "" {
+		return nil
+	}
+	if _, err := mail.ParseAddress(cfg.From); err != nil {
+		return fmt.Errorf("invalid from address %q", cfg.From)
+	}
+	if cfg.Port == 0 {
+		cfg.Port = defaultSMTPPort
+		if cfg.TLS {
+			cfg.Port = defaultSMTPTLSPort
+		}
+	}
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return fmt.Errorf("invalid port %d", cfg.Port)
+	}
+
+	return nil
+}
+
+// smtpNotifier 通过SMTP发送提醒邮件
+type smtpNotifier struct {
+	cfg SMTPConfig
+	to  []string
+}
+
+func newSMTPNotifier(cfg SMTPConfig, to []string) ExpiryNotifier {
+	return &smtpNotifier{
+		cfg: cfg,
+		to:  to,
+	}
+}
+
+func (n *smtpNotifier) Channel() string {
+	return NotifyChannelEmail
+}
+
+func (n *smtpNotifier) message(notice *ExpiryNotice) []byte {
+	msg := bytes.Buffer{}
+	fmt.Fprintf(&msg, "From: %s\r\n", n.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.BEncoding.Encode("utf-8", notice.subject()))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	body := base64.StdEncoding.EncodeToString([]byte(notice.text()))
+	for len(body) > 76 {
+		msg.WriteString(body[:76] + "\r\n")
+		body = body[76:]
+	}
+	msg.WriteString(body + "\r\n")
+
+	return msg.Bytes()
+}
+
+func (n *smtpNotifier) Notify(ctx context.Context, notice *ExpiryNotice) error {
+	addr := net.JoinHostPort(n.cfg.Host, strconv.Itoa(n.cfg.Port))
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	var err error
+	if n.cfg.TLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: n.cfg.Host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, n.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if !n.cfg.TLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err = client.StartTLS(&tls.Config{ServerName: n.cfg.Host}); err != nil {
+				return err
+			}
+		}
+	}
+	if n.cfg.Username != "" {
+		if err = client.Auth(smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, n.cfg.Host)); err != nil {
+			return err
+		}
+	}
+	from, err := mail.ParseAddress(n.cfg.From)
+	if err != nil {
+		return err
+	}
+	if err = client.Mail(from.Address); err != nil {
+		return err
+	}
+	// 策略中的地址可以带显示名（Name <addr>），信封只能使用其中的邮箱地址
+	for _, to := range n.to {
+		rcpt, err := mail.ParseAddress(to)
+		if err != nil {
+			return err
+		}
+		if err = client.Rcpt(rcpt.Address); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(n.message(notice)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
@@ -0,0 +1,339 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestExpiryNoticeDueThreshold(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	in := func(d time.Duration) *time.Time {
+		expiry := now.Add(d)
+		return &expiry
+	}
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name   string
+		days   []int
+		expiry *time.Time
+		want   int
+		wantOK bool
+	}{
+		{name: "never expires", expiry: nil},
+		{name: "already expired", expiry: in(-time.Minute)},
+		{name: "outside every threshold", expiry: in(10 * day)},
+		{name: "inside default 7 days", expiry: in(6 * day), want: 7, wantOK: true},
+		{name: "exactly at threshold", expiry: in(7 * day), want: 7, wantOK: true},
+		{name: "inside default 1 day picks smallest", expiry: in(12 * time.Hour), want: 1, wantOK: true},
+		{name: "custom thresholds", days: []int{30, 14}, expiry: in(20 * day), want: 30, wantOK: true},
+		{name: "custom thresholds smallest", days: []int{30, 14}, expiry: in(3 * day), want: 14, wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := ExpiryNoticePolicy{Enabled: true, Days: tt.days}
+			got, ok := policy.dueThreshold(&Machine{Expiry: tt.expiry}, now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("dueThreshold() = %d, %v, want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestWebhookNotifierSignature(t *testing.T) {
+	var (
+		gotBody      []byte
+		gotSignature string
+		gotTimestamp string
+	)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotBody, _ = io.ReadAll(r.Body)
+		gotSignature = r.Header.Get(webhookSignatureHeader)
+		gotTimestamp = r.Header.Get(webhookTimestampHeader)
+	}))
+	defer srv.Close()
+
+	// 测试服务器监听在环回地址上，绕过newWebhookHTTPClient的地址限制
+	notifier := &webhookNotifier{client: srv.Client(), url: srv.URL, key: "s3cret"}
+	notice := &ExpiryNotice{Machine: "laptop", Days: 7, Expiry: time.Now().Add(time.Hour)}
+	if err := notifier.Notify(context.Background(), notice); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+
+	if gotTimestamp == "" {
+		t.Fatal("timestamp header not set")
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(gotTimestamp + "."))
+	mac.Write(gotBody)
+	if want := hex.EncodeToString(mac.Sum(nil)); gotSignature != want {
+		t.Errorf("signature = %q, want %q", gotSignature, want)
+	}
+
+	payload := webhookPayload{}
+	if err := json.Unmarshal(gotBody, &payload); err != nil {
+		t.Fatalf("unmarshal payload: %v", err)
+	}
+	if payload.Event != webhookEventMachineExpiring || payload.Data.Machine != "laptop" || payload.Data.Days != 7 {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+
+	notifier.key = ""
+	if err := notifier.Notify(context.Background(), notice); err != nil {
+		t.Fatalf("Notify() without key error = %v", err)
+	}
+	if gotSignature != "" || gotTimestamp != "" {
+		t.Errorf("unsigned webhook sent signature %q timestamp %q", gotSignature, gotTimestamp)
+	}
+}
+
+func TestWebhookRejectsInternalTargets(t *testing.T) {
+	for _, rawURL := range []string{
+		"http://93.184.216.34/hook",
+		"https://127.0.0.1/hook",
+		"https://[::1]/hook",
+		"https://10.1.2.3/hook",
+		"https://192.168.1.1/hook",
+		"https://169.254.169.254/latest/meta-data",
+		"https://100.64.0.1/hook",
+		"https://[fd7a:115c:a1e0::1]/hook",
+		"https://localhost/hook",
+	} {
+		if err := validateWebhookURL(rawURL); err == nil {
+			t.Errorf("validateWebhookURL(%q) accepted an internal or non-https target", rawURL)
+		}
+	}
+	if err := validateWebhookURL("https://93.184.216.34/hook"); err != nil {
+		t.Errorf("validateWebhookURL() rejected a public https target: %v", err)
+	}
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("webhook reached a loopback server")
+	}))
+	defer srv.Close()
+	notifier := newWebhookNotifier(srv.URL, "").(*webhookNotifier)
+	err := notifier.Notify(context.Background(), &ExpiryNotice{})
+	if !errors.Is(err, ErrWebhookTargetForbidden) {
+		t.Errorf("Notify() to loopback error = %v, want %v", err, ErrWebhookTargetForbidden)
+	}
+}
+
+// fakeSMTPServer 只实现投递一封邮件所需的最少命令，记录收到的邮件正文
+type fakeSMTPServer struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	messages []string
+	rcpts    []string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &fakeSMTPServer{listener: listener}
+	go srv.serve()
+	t.Cleanup(func() { listener.Close() })
+
+	return srv
+}
+
+func (s *fakeSMTPServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.messages)
+}
+
+func (s *fakeSMTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		io.WriteString(conn, line+"\r\n")
+	}
+
+	reply("220 fake ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 fake")
+		case strings.HasPrefix(cmd, "MAIL"):
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT"):
+			s.mu.Lock()
+			s.rcpts = append(s.rcpts, strings.TrimSpace(line))
+			s.mu.Unlock()
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 end with <CRLF>.<CRLF>")
+			data := strings.Builder{}
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, data.String())
+			s.mu.Unlock()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPNotifierRecipientAddress(t *testing.T) {
+	smtpServer := newFakeSMTPServer(t)
+	cfg := SMTPConfig{Host: "127.0.0.1", Port: smtpServer.port(), From: "Mirage <mirage@example.com>"}
+	notifier := newSMTPNotifier(cfg, []string{"Ops Team <ops@example.com>", "dev@example.com"})
+	notice := &ExpiryNotice{Machine: "laptop", Days: 7, Expiry: time.Now().Add(time.Hour)}
+	if err := notifier.Notify(context.Background(), notice); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+
+	smtpServer.mu.Lock()
+	defer smtpServer.mu.Unlock()
+	want := []string{"RCPT TO:<ops@example.com>", "RCPT TO:<dev@example.com>"}
+	if strings.Join(smtpServer.rcpts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("recipients = %q, want %q", smtpServer.rcpts, want)
+	}
+	if len(smtpServer.messages) != 1 || !strings.Contains(smtpServer.messages[0], "To: Ops Team <ops@example.com>, dev@example.com") {
+		t.Errorf("message To header not kept in display form: %q", smtpServer.messages)
+	}
+}
+
+func newExpiryNoticeTestMirage(t *testing.T, smtpPort int) *Mirage {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{
+		DisableForeignKeyConstraintWhenMigrating: true,
+		Logger:                                   logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	// 内存数据库只存在于单个连接中
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	err = db.AutoMigrate(&Organization{}, &User{}, &Machine{}, &PreAuthKey{}, &ExpiryNotification{})
+	if err != nil {
+		t.Fatalf("migrate db: %v", err)
+	}
+
+	return &Mirage{
+		db:  db,
+		ctx: context.Background(),
+		cfg: &Config{
+			ServerURL: "mirage.example.com",
+			SMTP: SMTPConfig{
+				Host: "127.0.0.1",
+				Port: smtpPort,
+				From: "mirage@example.com",
+			},
+		},
+	}
+}
+
+func TestExpiryNoticeSentOncePerThreshold(t *testing.T) {
+	smtpServer := newFakeSMTPServer(t)
+	h := newExpiryNoticeTestMirage(t, smtpServer.port())
+
+	org := Organization{
+		ID:       1,
+		Name:     "example",
+		Provider: "test",
+		ExpiryNotice: ExpiryNoticePolicy{
+			Enabled: true,
+			Days:    []int{7, 1},
+			Emails:  []string{"ops@example.com"},
+		},
+	}
+	user := User{ID: 2, Name: "alice", OrganizationID: org.ID}
+	expiry := time.Now().Add(5 * 24 * time.Hour).Truncate(time.Second)
+	machine := Machine{ID: 3, GivenName: "laptop", UserID: user.ID, Expiry: &expiry}
+	for _, value := range []interface{}{&org, &user, &machine} {
+		if err := h.db.Create(value).Error; err != nil {
+			t.Fatalf("create %T: %v", value, err)
+		}
+	}
+
+	h.notifyExpiringMachinesWorker()
+	h.notifyExpiringMachinesWorker()
+	if got := smtpServer.count(); got != 1 {
+		t.Fatalf("after two runs inside the 7 day threshold got %d mails, want 1", got)
+	}
+
+	// 进入1天阈值时再提醒一次
+	expiry = time.Now().Add(12 * time.Hour).Truncate(time.Second)
+	if err := h.db.Model(&machine).Update("expiry", expiry).Error; err != nil {
+		t.Fatalf("update expiry: %v", err)
+	}
+	h.notifyExpiringMachinesWorker()
+	h.notifyExpiringMachinesWorker()
+	if got := smtpServer.count(); got != 2 {
+		t.Fatalf("after entering the 1 day threshold got %d mails, want 2", got)
+	}
+
+	// 续期后过期时间改变，重新按阈值提醒
+	expiry = time.Now().Add(6 * 24 * time.Hour).Truncate(time.Second)
+	if err := h.db.Model(&machine).Update("expiry", expiry).Error; err != nil {
+		t.Fatalf("update expiry: %v", err)
+	}
+	h.notifyExpiringMachinesWorker()
+	if got := smtpServer.count(); got != 3 {
+		t.Fatalf("after renewal got %d mails, want 3", got)
+	}
+
+	sent := h.ListMachineExpiryNotifications(&machine)
+	if len(sent) != 1 || sent[0] != 7 {
+		t.Errorf("ListMachineExpiryNotifications() = %v, want [7]", sent)
+	}
+}
@@ -0,0 +1,203 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	webhookEventMachineExpiring = "machine.expiring"
+
+	webhookSignatureHeader = "X-Mirage-Signature"
+	webhookTimestampHeader = "X-Mirage-Timestamp"
+
+	webhookResolveTimeout = 5 * time.Second
+	webhookMaxRedirects   = 3
+
+	ErrWebhookTargetForbidden = Error("webhook target address is not allowed")
+)
+
+// webhookForbiddenPrefixes 除环回、私有与链路本地地址外，同样禁止访问的网段
+var webhookForbiddenPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"), // CGNAT，也是组织内设备的地址段
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// isPublicWebhookAddr 报告webhook能否投递到该地址，
+// 租户配置的地址不能用于访问控制服务器所在的内部网络
+func isPublicWebhookAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range webhookForbiddenPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validateWebhookURL 要求https，并拒绝解析到非公网地址的目标
+// 投递时仍会在建立连接前再次检查，防止DNS重绑定
+func validateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return fmt.Errorf("%w: webhook url must be https: %q", ErrExpiryNoticeInvalid, rawURL)
+	}
+	host := u.Hostname()
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !isPublicWebhookAddr(addr) {
+			return fmt.Errorf("%w: %s", ErrWebhookTargetForbidden, host)
+		}
+
+		return nil
+	}
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return fmt.Errorf("%w: %s", ErrWebhookTargetForbidden, host)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("%w: cannot resolve webhook host %s", ErrExpiryNoticeInvalid, host)
+	}
+	for _, addr := range addrs {
+		if !isPublicWebhookAddr(addr) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrWebhookTargetForbidden, host, addr)
+		}
+	}
+
+	return nil
+}
+
+// webhookDialControl 在连接建立前检查实际拨号的地址
+func webhookDialControl(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !isPublicWebhookAddr(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrWebhookTargetForbidden, addrPort.Addr())
+	}
+
+	return nil
+}
+
+// newWebhookHTTPClient 返回投递提醒的客户端
+func newWebhookHTTPClient() *http.Client {
+	return newPublicHTTPClient(expiryNoticeTimeout)
+}
+
+// newPublicHTTPClient 返回只能访问公网https地址的客户端，不使用环境变量中的代理
+// 用于访问租户配置的地址，如提醒的Webhook与工作负载身份的签发方
+func newPublicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: webhookDialControl,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= webhookMaxRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("%w: redirect to %s", ErrWebhookTargetForbidden, req.URL.Redacted())
+			}
+
+			return nil
+		},
+	}
+}
+
+// webhookNotifier 以JSON向组织配置的地址POST提醒
+// 配置了密钥时，签名为HMAC-SHA256(key, timestamp + "." + body)的十六进制值
+type webhookNotifier struct {
+	client *http.Client
+	url    string
+	key    string
+}
+
+type webhookPayload struct {
+	Event string        `json:"event"`
+	Data  *ExpiryNotice `json:"data"`
+}
+
+func newWebhookNotifier(url, key string) ExpiryNotifier {
+	return &webhookNotifier{
+		client: newWebhookHTTPClient(),
+		url:    url,
+		key:    key,
+	}
+}
+
+func (n *webhookNotifier) Channel() string {
+	return NotifyChannelWebhook
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, notice *ExpiryNotice) error {
+	// 旧版本保存的策略可能仍是http地址
+	if u, err := url.Parse(n.url); err != nil || u.Scheme != "https" {
+		return fmt.Errorf("%w: webhook url must be https", ErrWebhookTargetForbidden)
+	}
+
+	body, err := json.Marshal(webhookPayload{
+		Event: webhookEventMachineExpiring,
+		Data:  notice,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.key != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(n.key))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+
+	if res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook failed: %s", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,364 @@
+package controller
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"tailscale.com/tailcfg"
+)
+
+const (
+	ErrOAuthClientNotFound     = Error("OAuth client not found")
+	ErrOAuthClientRevoked      = Error("OAuth client revoked")
+	ErrOAuthClientInvalid      = Error("OAuth client credentials invalid")
+	ErrOAuthClientScopeInvalid = Error("OAuth client scope invalid")
+	ErrOAuthClientTagInvalid   = Error("OAuth client tag invalid")
+	ErrOAuthTokenInvalid       = Error("OAuth access token invalid")
+	ErrOrgOwnerNotFound        = Error("organization owner not found")
+
+	oauthClientIDPrefix     = "mscli-"
+	oauthClientSecretPrefix = "mssec-"
+	oauthAccessTokenPrefix  = "mstok-"
+	oauthClientIDLength     = 12
+	oauthSecretLength       = 32
+
+	oauthTokenExpiration = time.Hour
+
+	oauthClientContextKey = contextKey("oauthClient")
+)
+
+// OAuth客户端可申请的权限范围
+const (
+	OAuthScopeDevicesRead  = "devices:read"
+	OAuthScopeDevicesWrite = "devices:write"
+	OAuthScopeDNS          = "dns"
+	OAuthScopeACL          = "acl"
+	OAuthScopeKeys         = "keys"
+)
+
+var OAuthScopes = []string{
+	OAuthScopeDevicesRead,
+	OAuthScopeDevicesWrite,
+	OAuthScopeDNS,
+	OAuthScopeACL,
+	OAuthScopeKeys,
+}
+
+// OAuthClient 是组织级的client-credentials客户端，用于机器对机器的自动化
+// 客户端不代表具体用户，通过其获取的令牌以组织管理员身份执行被授权的操作
+type OAuthClient struct {
+	ID             uint64 `gorm:"primary_key"`
+	ClientID       string `gorm:"uniqueIndex"`
+	Salt           string
+	Hash           string
+	OrganizationID int64 `gorm:"index"`
+	CreatorID      int64
+	Creator        User
+	Scopes         StringList
+	Tags           StringList // 通过该客户端创建的授权密钥只能使用这些标签
+	Description    string
+
+	CreatedAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+// OAuthTokenItem 是一个已签发的访问令牌
+type OAuthTokenItem struct {
+	ClientID       string
+	OrganizationID int64
+	Scopes         []string
+	Tags           []string
+}
+
+func (t *OAuthTokenItem) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || (scope == OAuthScopeDevicesRead && s == OAuthScopeDevicesWrite) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsTags 判断令牌是否可以创建带有这些标签的授权密钥，令牌创建的密钥必须带标签
+func (t *OAuthTokenItem) AllowsTags(tags []string) bool {
+	if len(tags) == 0 {
+		return false
+	}
+	for _, tag := range tags {
+		if !containsStr(t.Tags, tag) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func validateOAuthScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return ErrOAuthClientScopeInvalid
+	}
+	for _, scope := range scopes {
+		if !containsStr(OAuthScopes, scope) {
+			return ErrOAuthClientScopeInvalid
+		}
+	}
+
+	return nil
+}
+
+// CreateOAuthClient 创建OAuth客户端，返回的client secret只在此时可见
+func (h *Mirage) CreateOAuthClient(
+	creator *User,
+	scopes []string,
+	tags []string,
+	description string,
+) (*OAuthClient, string, error) {
+	if err := validateOAuthScopes(scopes); err != nil {
+		return nil, "", err
+	}
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, "tag:") {
+			return nil, "", ErrOAuthClientTagInvalid
+		}
+	}
+
+	clientID, err := randomHex(oauthClientIDLength / 2)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(oauthSecretLength)
+	if err != nil {
+		return nil, "", err
+	}
+	salt, err := randomHex(apiKeySaltLength)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now().UTC()
+	client := OAuthClient{
+		ClientID:       oauthClientIDPrefix + clientID,
+		Salt:           salt,
+		Hash:           hashAPIKeySecret(salt, secret),
+		OrganizationID: creator.OrganizationID,
+		CreatorID:      creator.ID,
+		Creator:        *creator,
+		Scopes:         scopes,
+		Tags:           tags,
+		Description:    description,
+		CreatedAt:      &now,
+	}
+	if err := h.db.Omit("Creator").Create(&client).Error; err != nil {
+		return nil, "", err
+	}
+
+	return &client, oauthClientSecretPrefix + secret, nil
+}
+
+// ListOAuthClients returns all OAuth clients (including revoked ones) of an organization.
+func (h *Mirage) ListOAuthClients(orgID int64) ([]OAuthClient, error) {
+	clients := []OAuthClient{}
+	err := h.db.Preload("Creator").Where(&OAuthClient{OrganizationID: orgID}).Find(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+// RevokeOAuthClient 注销客户端并使其已签发的令牌立即失效
+func (h *Mirage) RevokeOAuthClient(client *OAuthClient) error {
+	now := time.Now().UTC()
+	client.RevokedAt = &now
+	if err := h.db.Model(client).Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+
+	// 令牌保存在副本共享的缓存中无法按客户端枚举，记录注销标记直到已签发的令牌全部过期
+	h.oauthRevokedCache.Set(client.ClientID, true, oauthTokenExpiration)
+
+	return nil
+}
+
+func (h *Mirage) checkOAuthClient(clientID, clientSecret string) (*OAuthClient, error) {
+	client := OAuthClient{}
+	if err := h.db.Where(&OAuthClient{ClientID: clientID}).Take(&client).Error; err != nil {
+		return nil, ErrOAuthClientNotFound
+	}
+	secret, ok := strings.CutPrefix(clientSecret, oauthClientSecretPrefix)
+	if !ok {
+		return nil, ErrOAuthClientInvalid
+	}
+	hash := hashAPIKeySecret(client.Salt, secret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(client.Hash)) != 1 {
+		return nil, ErrOAuthClientInvalid
+	}
+	if client.RevokedAt != nil {
+		return nil, ErrOAuthClientRevoked
+	}
+
+	now := time.Now().UTC()
+	h.db.Model(&client).Update("last_used_at", now)
+	client.LastUsedAt = &now
+
+	return &client, nil
+}
+
+func (h *Mirage) checkOAuthToken(token string) (*OAuthTokenItem, error) {
+	tokenItem, ok := h.oauthTokenCache.Get(token)
+	if !ok {
+		return nil, ErrOAuthTokenInvalid
+	}
+	if _, revoked := h.oauthRevokedCache.Get(tokenItem.ClientID); revoked {
+		return nil, ErrOAuthTokenInvalid
+	}
+
+	return &tokenItem, nil
+}
+
+// getOrgOwner OAuth令牌以组织管理员的身份执行操作
+func (h *Mirage) getOrgOwner(orgID int64) (*User, error) {
+	users, err := h.ListOrgUsers(orgID)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if user.Role == RoleOwner {
+			return h.GetUserByID(tailcfg.UserID(user.ID))
+		}
+	}
+
+	return nil, ErrOrgOwnerNotFound
+}
+
+type oauthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+type oauthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func writeOAuthResponse(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// OAuthTokenHandler 实现OAuth2 client-credentials授权（RFC 6749 4.4）
+// 客户端凭证可以通过HTTP Basic或表单参数client_id/client_secret提交
+func (h *Mirage) OAuthTokenHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthResponse(w, http.StatusBadRequest, oauthErrorResponse{Error: "invalid_request"})
+		return
+	}
+	if r.PostForm.Get("grant_type") != "client_credentials" {
+		writeOAuthResponse(w, http.StatusBadRequest, oauthErrorResponse{Error: "unsupported_grant_type"})
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	client, err := h.checkOAuthClient(clientID, clientSecret)
+	if err != nil {
+		log.Info().
+			Caller().
+			Err(err).
+			Str("client_id", clientID).
+			Msg("OAuth client authentication failed")
+		writeOAuthResponse(w, http.StatusUnauthorized, oauthErrorResponse{Error: "invalid_client"})
+		return
+	}
+
+	scopes := []string(client.Scopes)
+	if requested := strings.Fields(r.PostForm.Get("scope")); len(requested) > 0 {
+		for _, scope := range requested {
+			if !containsStr(client.Scopes, scope) {
+				writeOAuthResponse(w, http.StatusBadRequest, oauthErrorResponse{
+					Error:            "invalid_scope",
+					ErrorDescription: scope,
+				})
+				return
+			}
+		}
+		scopes = requested
+	}
+
+	token, err := randomHex(oauthSecretLength)
+	if err != nil {
+		writeOAuthResponse(w, http.StatusInternalServerError, oauthErrorResponse{Error: "server_error"})
+		return
+	}
+	token = oauthAccessTokenPrefix + token
+	h.oauthTokenCache.Set(token, OAuthTokenItem{
+		ClientID:       client.ClientID,
+		OrganizationID: client.OrganizationID,
+		Scopes:         scopes,
+		Tags:           client.Tags,
+	}, oauthTokenExpiration)
+
+	log.Info().
+		Str("client_id", client.ClientID).
+		Int64("org_id", client.OrganizationID).
+		Strs("scopes", scopes).
+		Msg("OAuth access token issued")
+
+	writeOAuthResponse(w, http.StatusOK, oauthTokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(oauthTokenExpiration.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	})
+}
+
+// oauthScopeForRequest 返回访问该控制台API所需的权限范围，空字符串表示OAuth令牌不可访问
+func oauthScopeForRequest(r *http.Request) string {
+	path := strings.TrimPrefix(r.URL.Path, "/admin/api/")
+	resource, _, _ := strings.Cut(path, "/")
+	isRead := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+	switch resource {
+	case "machines", "machine", "machine-debug", "routes", "route-groups":
+		if isRead {
+			return OAuthScopeDevicesRead
+		}
+		return OAuthScopeDevicesWrite
+	case "dns":
+		return OAuthScopeDNS
+	case "acls":
+		return OAuthScopeACL
+	case "keys":
+		return OAuthScopeKeys
+	default:
+		return ""
+	}
+}
+
+func withOAuthToken(r *http.Request, token *OAuthTokenItem) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), oauthClientContextKey, token))
+}
+
+// oauthTokenFromRequest 返回经由OAuth访问令牌认证的客户端信息，其他认证方式返回nil
+func oauthTokenFromRequest(r *http.Request) *OAuthTokenItem {
+	token, _ := r.Context().Value(oauthClientContextKey).(*OAuthTokenItem)
+
+	return token
+}
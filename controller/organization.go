@@ -5,12 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
 	"strings"
 	"time"
 
 	"github.com/bwmarrin/snowflake"
 	"github.com/rs/zerolog/log"
 	"github.com/sethvargo/go-diceware/diceware"
+	"github.com/tailscale/hujson"
 	"gorm.io/gorm"
 	"tailscale.com/tailcfg"
 )
@@ -31,12 +33,18 @@ type Organization struct {
 	Name           string `gorm:"uniqueIndex:idx_name_provider"`
 	Provider       string `gorm:"uniqueIndex:idx_name_provider"`
 	ExpiryDuration uint   `gorm:"default:180"`
+	DeviceApproval bool   `gorm:"default:false"` // 新注册设备需管理员审批后才能接入
 	EnableMagic    bool   `gorm:"default:false"`
 	MagicDnsDomain string
 	OverrideLocal  bool `gorm:"default:false"`
 	Nameservers    StringList
 	SplitDns       SplitDNS
+	ExtraRecords   DNSRecords
+	SearchDomains  StringList
+	ResolverOpts   DNSResolverOptions
+	ExpiryNotice   ExpiryNoticePolicy
 	AclPolicy      *ACLPolicy
+	AclPolicyText  string               // AclPolicy的HuJSON原文（保留注释），为空时由AclPolicy生成
 	AclRules       []tailcfg.FilterRule `gorm:"-"`
 	SshPolicy      *tailcfg.SSHPolicy   `gorm:"-"`
 	NaviBanList    NaviBanList
@@ -65,6 +73,94 @@ func (nbl *NaviBanList) Scan(value interface{}) error {
 	}
 }
 
+// GetACLPolicyText returns the HuJSON source of the organization's ACL policy.
+func (o *Organization) GetACLPolicyText() ([]byte, error) {
+	if o.AclPolicyText != "" {
+		return []byte(o.AclPolicyText), nil
+	}
+	if o.AclPolicy == nil {
+		return nil, errEmptyPolicy
+	}
+	policyJSON, err := json.Marshal(o.AclPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	return hujson.Format(policyJSON)
+}
+
+// syncACLPolicyText patches the sections of AclPolicyText that differ from
+// AclPolicy, so edits made through the structured APIs (e.g. tags) keep the
+// comments of the untouched sections.
+func (o *Organization) syncACLPolicyText() error {
+	if o.AclPolicyText == "" || o.AclPolicy == nil {
+		return nil
+	}
+	ast, err := hujson.Parse([]byte(o.AclPolicyText))
+	if err != nil {
+		return err
+	}
+	standard := ast.Clone()
+	standard.Standardize()
+	// 经ACLPolicy转换一轮，避免hosts等字段书写形式不同造成误判
+	var oldPolicy ACLPolicy
+	if err := json.Unmarshal(standard.Pack(), &oldPolicy); err != nil {
+		return err
+	}
+	oldJSON, err := json.Marshal(oldPolicy)
+	if err != nil {
+		return err
+	}
+	oldSections := map[string]interface{}{}
+	if err := json.Unmarshal(oldJSON, &oldSections); err != nil {
+		return err
+	}
+
+	policyJSON, err := json.Marshal(o.AclPolicy)
+	if err != nil {
+		return err
+	}
+	newSections := map[string]json.RawMessage{}
+	if err := json.Unmarshal(policyJSON, &newSections); err != nil {
+		return err
+	}
+
+	type patchOp struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+	patch := []patchOp{}
+	for name, raw := range newSections {
+		var newValue interface{}
+		if err := json.Unmarshal(raw, &newValue); err != nil {
+			return err
+		}
+		if oldValue, ok := oldSections[name]; ok && reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		patch = append(patch, patchOp{
+			Op:    "add",
+			Path:  aclPolicyPointer(name),
+			Value: raw,
+		})
+	}
+	if len(patch) == 0 {
+		return nil
+	}
+	patchJSON, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	if err := ast.Patch(patchJSON); err != nil {
+		return err
+	}
+	ast.Format()
+	o.AclPolicyText = string(ast.Pack())
+
+	return nil
+}
+
 func (o *Organization) BeforeCreate(tx *gorm.DB) error {
 	if o.ID == 0 {
 		flakeID, err := snowflake.NewNode(1)
@@ -271,6 +367,16 @@ func (m *Mirage) DestroyOrgnaization(orgName, provider string, force bool) (int,
 	return before, after, nil
 }
 
+// UpdateOrgDeviceApproval 开启或关闭组织的设备审批，只影响之后新注册的设备
+func (m *Mirage) UpdateOrgDeviceApproval(orgID int64, enabled bool) error {
+	return m.db.Model(&Organization{ID: orgID}).Update("device_approval", enabled).Error
+}
+
+// UpdateOrgExpiryNotice 更新组织的设备密钥过期提醒策略
+func (m *Mirage) UpdateOrgExpiryNotice(orgID int64, policy ExpiryNoticePolicy) error {
+	return m.db.Model(&Organization{ID: orgID}).Update("expiry_notice", policy).Error
+}
+
 func (m *Mirage) UpdateOrgExpiry(user *User, newDuration uint) error {
 	err := m.db.Select("expiry_duration").Updates(&Organization{
 		ID:             user.OrganizationID,
@@ -280,6 +386,18 @@ func (m *Mirage) UpdateOrgExpiry(user *User, newDuration uint) error {
 }
 
 func (m *Mirage) UpdateOrgDNSConfig(org *Organization, newDNSCfg DNSData) error {
+	if err := validateDNSData(&newDNSCfg); err != nil {
+		return err
+	}
+	// 未携带extraRecords字段的请求保留原有记录
+	extraRecords := org.ExtraRecords
+	if newDNSCfg.ExtraRecords != nil {
+		var err error
+		extraRecords, err = m.normalizeOrgDNSRecords(org, newDNSCfg.ExtraRecords)
+		if err != nil {
+			return err
+		}
+	}
 
 	org.EnableMagic = newDNSCfg.MagicDNS
 	org.Nameservers = make([]string, 0)
@@ -294,13 +412,23 @@ func (m *Mirage) UpdateOrgDNSConfig(org *Organization, newDNSCfg DNSData) error
 	for _, domain := range newDNSCfg.Domains {
 		if ns, ok := newDNSCfg.Routes[domain]; ok {
 			newSplitDns = append(newSplitDns, SplitDNSItem{
-				Domain: domain,
-				NS:     ns,
+				Domain:   domain,
+				NS:       ns,
+				Fallback: newDNSCfg.RouteFallbacks[domain],
 			})
 		}
 	}
 
 	org.SplitDns = newSplitDns
-	err := m.db.Select("EnableMagic", "Nameservers", "OverrideLocal", "Nameservers", "OverrideLocal", "SplitDns").Updates(org).Error
+	org.ExtraRecords = extraRecords
+	org.SearchDomains = newDNSCfg.SearchDomains
+	if org.SearchDomains == nil {
+		org.SearchDomains = StringList{}
+	}
+	org.ResolverOpts = newDNSCfg.ResolverOptions
+	if org.ResolverOpts == nil {
+		org.ResolverOpts = DNSResolverOptions{}
+	}
+	err := m.db.Select("EnableMagic", "Nameservers", "OverrideLocal", "SplitDns", "ExtraRecords", "SearchDomains", "ResolverOpts").Updates(org).Error
 	return err
 }
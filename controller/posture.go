@@ -0,0 +1,254 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ErrInvalidPosture = Error("invalid posture")
+
+	PosturePrefix = "posture:"
+)
+
+// PostureRule 设备合规条件，所有已设置的条件都满足时设备才符合该posture
+type PostureRule struct {
+	MinClientVersion   string   `json:"minClientVersion,omitempty"   yaml:"minClientVersion,omitempty"`   // 最低客户端版本，如1.40
+	AllowedOS          []string `json:"allowedOS,omitempty"          yaml:"allowedOS,omitempty"`          // 允许的操作系统，如linux、windows、macOS、iOS、android
+	LastSeenWithinDays int      `json:"lastSeenWithinDays,omitempty" yaml:"lastSeenWithinDays,omitempty"` // 最近N天内在线过
+}
+
+// Postures 以posture:名称为键的合规策略
+type Postures map[string]PostureRule
+
+func (r PostureRule) validate() error {
+	if r.MinClientVersion != "" {
+		if _, err := parseClientVersion(r.MinClientVersion); err != nil {
+			return err
+		}
+	}
+	if r.LastSeenWithinDays < 0 {
+		return fmt.Errorf("%w: lastSeenWithinDays must not be negative", ErrInvalidPosture)
+	}
+	if r.MinClientVersion == "" && len(r.AllowedOS) == 0 && r.LastSeenWithinDays == 0 {
+		return fmt.Errorf("%w: no condition defined", ErrInvalidPosture)
+	}
+
+	return nil
+}
+
+// violations 返回设备不满足的条件描述，为空表示符合
+func (r PostureRule) violations(machine *Machine, now time.Time) []string {
+	res := []string{}
+	if r.MinClientVersion != "" {
+		if compareClientVersion(machine.HostInfo.IPNVersion, r.MinClientVersion) < 0 {
+			res = append(res, fmt.Sprintf("client version %s is older than %s",
+				strings.Split(machine.HostInfo.IPNVersion, "-")[0], r.MinClientVersion))
+		}
+	}
+	if len(r.AllowedOS) > 0 {
+		allowed := false
+		for _, os := range r.AllowedOS {
+			if strings.EqualFold(os, machine.HostInfo.OS) {
+				allowed = true
+
+				break
+			}
+		}
+		if !allowed {
+			res = append(res, fmt.Sprintf("os %q is not allowed", machine.HostInfo.OS))
+		}
+	}
+	if r.LastSeenWithinDays > 0 {
+		if machine.LastSeen == nil ||
+			machine.LastSeen.Before(now.Add(-time.Duration(r.LastSeenWithinDays)*24*time.Hour)) {
+			res = append(res, fmt.Sprintf("not seen in the last %d days", r.LastSeenWithinDays))
+		}
+	}
+
+	return res
+}
+
+// parseClientVersion 解析形如1.40.0-t1234abcd的客户端版本号的数字部分
+func parseClientVersion(version string) ([]int, error) {
+	version = strings.Split(strings.TrimPrefix(strings.TrimSpace(version), "v"), "-")[0]
+	if version == "" {
+		return nil, fmt.Errorf("%w: empty version", ErrInvalidPosture)
+	}
+	parts := strings.Split(version, ".")
+	res := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%w: invalid version %q", ErrInvalidPosture, version)
+		}
+		res[i] = n
+	}
+
+	return res, nil
+}
+
+// compareClientVersion 比较两个客户端版本，无法解析的版本视为最旧
+func compareClientVersion(a, b string) int {
+	av, aErr := parseClientVersion(a)
+	bv, bErr := parseClientVersion(b)
+	switch {
+	case aErr != nil && bErr != nil:
+		return 0
+	case aErr != nil:
+		return -1
+	case bErr != nil:
+		return 1
+	}
+	for i := 0; i < len(av) || i < len(bv); i++ {
+		var x, y int
+		if i < len(av) {
+			x = av[i]
+		}
+		if i < len(bv) {
+			y = bv[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// validatePostures 校验posture定义及defaultSrcPosture的引用
+func (policy *ACLPolicy) validatePostures() error {
+	for name, rule := range policy.Postures {
+		if !strings.HasPrefix(name, PosturePrefix) {
+			return fmt.Errorf("%w: '%s' did not begin with '%s'", ErrInvalidPosture, name, PosturePrefix)
+		}
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	for _, name := range policy.DefaultSrcPosture {
+		if _, ok := policy.Postures[name]; !ok {
+			return fmt.Errorf("%w: %s is not defined", ErrInvalidPosture, name)
+		}
+	}
+
+	return nil
+}
+
+// machineMatchesPosture 判断设备是否符合指定的posture
+func (policy *ACLPolicy) machineMatchesPosture(machine *Machine, name string, now time.Time) (bool, error) {
+	rule, ok := policy.Postures[name]
+	if !ok {
+		return false, fmt.Errorf("%w: %s is not defined", ErrInvalidPosture, name)
+	}
+
+	return len(rule.violations(machine, now)) == 0, nil
+}
+
+// postureViolations 返回设备不满足defaultSrcPosture的原因，为空表示设备合规
+// 不合规的设备不会出现在其他设备的peer列表中，也看不到其他设备
+func (policy *ACLPolicy) postureViolations(machine *Machine, now time.Time) []string {
+	if policy == nil {
+		return nil
+	}
+	var res []string
+	for _, name := range policy.DefaultSrcPosture {
+		rule, ok := policy.Postures[name]
+		if !ok {
+			continue
+		}
+		for _, violation := range rule.violations(machine, now) {
+			res = append(res, name+": "+violation)
+		}
+	}
+
+	return res
+}
+
+// postureState 以字符串记录设备对每个posture的符合情况，用于发现合规状态的变化
+// 符合情况随时间（最近在线）与hostinfo（系统、客户端版本）变化，不伴随其他状态变化
+func (policy *ACLPolicy) postureState(machine *Machine, now time.Time) string {
+	if policy == nil || len(policy.Postures) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(policy.Postures))
+	for name := range policy.Postures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	state := strings.Builder{}
+	for _, name := range names {
+		state.WriteString(name)
+		if len(policy.Postures[name].violations(machine, now)) == 0 {
+			state.WriteString("=1;")
+		} else {
+			state.WriteString("=0;")
+		}
+	}
+
+	return state.String()
+}
+
+// recordMachinePosture 记录设备最近一次的合规状态，与上次记录不同时返回true
+// 本副本首次见到的设备只记录不比较
+func (h *Mirage) recordMachinePosture(policy *ACLPolicy, machine *Machine, now time.Time) bool {
+	state := policy.postureState(machine, now)
+	previous, loaded := h.postureStates.LoadAndStore(machine.ID, state)
+
+	return loaded && previous != state
+}
+
+// refreshPostureStates 定期重新评估设备的合规状态
+func (h *Mirage) refreshPostureStates(ticker *time.Ticker) {
+	for range ticker.C {
+		h.refreshPostureStatesWorker()
+	}
+}
+
+// refreshPostureStatesWorker 合规状态因时间流逝而改变的设备（如超过N天未在线）所在的组织，
+// 通知其设备重新获取网络映射
+func (h *Mirage) refreshPostureStatesWorker() {
+	orgs, err := h.ListOrgnaizations()
+	if err != nil {
+		log.Error().Err(err).Msg("Error listing organizations")
+
+		return
+	}
+	now := time.Now()
+	changedOrgs := []int64{}
+	for _, org := range orgs {
+		if org.AclPolicy == nil || len(org.AclPolicy.Postures) == 0 {
+			continue
+		}
+		machines, err := h.ListMachinesByOrgID(org.ID)
+		if err != nil {
+			log.Error().Err(err).Int64("org", org.ID).Msg("Error listing machines in organization")
+
+			continue
+		}
+		changed := false
+		for index := range machines {
+			if h.recordMachinePosture(org.AclPolicy, &machines[index], now) {
+				log.Info().
+					Str("machine", machines[index].Hostname).
+					Msg("Machine posture changed")
+				changed = true
+			}
+		}
+		if changed {
+			changedOrgs = append(changedOrgs, org.ID)
+		}
+	}
+	if len(changedOrgs) > 0 {
+		h.setOrgLastStateChangeToNow(changedOrgs...)
+	}
+}
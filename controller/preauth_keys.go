@@ -1,10 +1,10 @@
 package controller
 
 import (
-	"crypto/rand"
-	"encoding/hex"
-	"errors"
+	"crypto/subtle"
 	"fmt"
+	"net/netip"
+	"regexp"
 	"strings"
 	"time"
 
@@ -17,12 +17,30 @@ const (
 	ErrSingleUseAuthKeyHasBeenUsed = Error("AuthKey has already been used")
 	ErrUserMismatch                = Error("user mismatch")
 	ErrPreAuthKeyACLTagInvalid     = Error("AuthKey tag is invalid")
+	ErrPreAuthKeyUsageExceeded     = Error("AuthKey has reached its maximum number of uses")
+	ErrPreAuthKeySourceNotAllowed  = Error("AuthKey cannot be used from this address")
+	ErrPreAuthKeySourceCIDRInvalid = Error("AuthKey source CIDR is invalid")
+	ErrPreAuthKeyNamePrefixInvalid = Error("AuthKey given name prefix is invalid")
+	ErrPreAuthKeyOptionInvalid     = Error("AuthKey max uses and key expiry must not be negative")
+
+	// 授权密钥形如mskey-auth-<KeyID>-<secret>，数据库中只保存KeyID与加盐哈希
+	preAuthKeyPrefix       = "mskey-auth-"
+	preAuthKeyIDLength     = 12
+	preAuthKeySecretLength = 32
+
+	// 每个密钥在控制台中展示的最近使用记录条数
+	preAuthKeyUsesListLimit = 50
 )
 
+// 设备名前缀只能由小写字母、数字和连字符组成，以便与主机名拼接后仍是合法的DNS标签
+var givenNamePrefixRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
 // PreAuthKey describes a pre-authorization key usable in a particular user.
 type PreAuthKey struct {
 	ID        uint64 `gorm:"primary_key"`
-	Key       string
+	KeyID     string `gorm:"index"` // 明文前缀，用于查找与展示
+	Salt      string
+	Hash      string
 	UserID    int64
 	User      User
 	Reusable  bool
@@ -30,10 +48,54 @@ type PreAuthKey struct {
 	Used      bool `gorm:"default:false"`
 	ACLTags   StringList
 
+	Description     string
+	MaxUses         int        `gorm:"default:0"` // 0表示不限次数（仅对可重用密钥有意义）
+	UseCount        int        `gorm:"default:0"`
+	SourceCIDRs     StringList // 非空时只允许从这些网段注册
+	GivenNamePrefix string     // 新注册设备名为前缀加主机名
+	KeyExpiryDays   int        `gorm:"default:0"`     // 大于0时以此覆盖设备密钥有效期
+	PreApproved     bool       `gorm:"default:false"` // 组织开启设备审批时，使用该密钥注册的设备无需审批
+
 	CreatedAt  *time.Time
 	Expiration *time.Time
 }
 
+// PreAuthKeyOptions 创建授权密钥时的可选属性
+type PreAuthKeyOptions struct {
+	Description     string
+	MaxUses         int
+	SourceCIDRs     []string
+	GivenNamePrefix string
+	KeyExpiryDays   int
+	PreApproved     bool
+}
+
+// PreAuthKeyUse 记录授权密钥的每一次使用
+type PreAuthKeyUse struct {
+	ID           uint64 `gorm:"primary_key"`
+	PreAuthKeyID uint64 `gorm:"index"`
+	MachineID    int64
+	MachineName  string
+	SourceIP     string
+	CreatedAt    time.Time
+}
+
+func (opts *PreAuthKeyOptions) validate() error {
+	if opts.MaxUses < 0 || opts.KeyExpiryDays < 0 {
+		return ErrPreAuthKeyOptionInvalid
+	}
+	for _, cidr := range opts.SourceCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("%w: '%s'", ErrPreAuthKeySourceCIDRInvalid, cidr)
+		}
+	}
+	if opts.GivenNamePrefix != "" && !givenNamePrefixRegex.MatchString(opts.GivenNamePrefix) {
+		return fmt.Errorf("%w: '%s'", ErrPreAuthKeyNamePrefixInvalid, opts.GivenNamePrefix)
+	}
+
+	return nil
+}
+
 /*
 // PreAuthKeyACLTag describes an autmatic tag applied to a node when registered with the associated PreAuthKey.
 type PreAuthKeyACLTag struct {
@@ -43,35 +105,60 @@ type PreAuthKeyACLTag struct {
 }
 */
 
-// CreatePreAuthKey creates a new PreAuthKey in a user, and returns it.
+// CreatePreAuthKey creates a new PreAuthKey in a user, and returns it
+// together with the full key, which is not stored and cannot be shown again.
 func (h *Mirage) CreatePreAuthKey(
 	user *User,
 	reusable bool,
 	ephemeral bool,
 	expiration *time.Time,
 	aclTags []string,
-) (*PreAuthKey, error) {
+	opts *PreAuthKeyOptions,
+) (*PreAuthKey, string, error) {
 
 	for _, tag := range aclTags {
 		if !strings.HasPrefix(tag, "tag:") {
-			return nil, fmt.Errorf("%w: '%s' did not begin with 'tag:'", ErrPreAuthKeyACLTagInvalid, tag)
+			return nil, "", fmt.Errorf("%w: '%s' did not begin with 'tag:'", ErrPreAuthKeyACLTagInvalid, tag)
 		}
 	}
+	if opts == nil {
+		opts = &PreAuthKeyOptions{}
+	}
+	if err := opts.validate(); err != nil {
+		return nil, "", err
+	}
 
 	now := time.Now().UTC()
-	kstr, err := h.generateKey()
+	keyID, err := randomHex(preAuthKeyIDLength / 2)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	secret, err := randomHex(preAuthKeySecretLength)
+	if err != nil {
+		return nil, "", err
+	}
+	salt, err := randomHex(apiKeySaltLength)
+	if err != nil {
+		return nil, "", err
 	}
 
 	key := PreAuthKey{
-		Key:        kstr,
+		KeyID:      keyID,
+		Salt:       salt,
+		Hash:       hashAPIKeySecret(salt, secret),
 		UserID:     user.ID,
 		User:       *user,
 		Reusable:   reusable,
 		Ephemeral:  ephemeral,
 		CreatedAt:  &now,
 		Expiration: expiration,
+
+		Description:     opts.Description,
+		MaxUses:         opts.MaxUses,
+		SourceCIDRs:     StringList(opts.SourceCIDRs),
+		GivenNamePrefix: opts.GivenNamePrefix,
+		KeyExpiryDays:   opts.KeyExpiryDays,
+		PreApproved:     opts.PreApproved,
 	}
 
 	err = h.db.Transaction(func(db *gorm.DB) error {
@@ -95,10 +182,10 @@ func (h *Mirage) CreatePreAuthKey(
 	})
 
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return &key, nil
+	return &key, preAuthKeyPrefix + keyID + "-" + secret, nil
 }
 
 // ListPreAuthKeys returns the list of PreAuthKeys for a user.
@@ -132,6 +219,9 @@ func (h *Mirage) DestroyPreAuthKey(pak PreAuthKey) error {
 		if result := db.Unscoped().Delete(pak); result.Error != nil {
 			return result.Error
 		}
+		if err := db.Where(&PreAuthKeyUse{PreAuthKeyID: pak.ID}).Delete(&PreAuthKeyUse{}).Error; err != nil {
+			return err
+		}
 
 		return nil
 	})
@@ -146,24 +236,141 @@ func (h *Mirage) ExpirePreAuthKey(k *PreAuthKey) error {
 	return nil
 }
 
-// UsePreAuthKey marks a PreAuthKey as used.
+// UsePreAuthKey marks a PreAuthKey as used and consumes one of its uses.
+// 计数通过条件更新完成，并发注册时一次性密钥只能成功一次，可重用密钥不会超过MaxUses
 func (h *Mirage) UsePreAuthKey(k *PreAuthKey) error {
+	result := h.db.Model(&PreAuthKey{}).
+		Where("id = ? AND (max_uses = 0 OR use_count < max_uses)", k.ID).
+		Where("reusable = ? OR used = ?", true, false).
+		Updates(map[string]interface{}{
+			"used":      true,
+			"use_count": gorm.Expr("use_count + 1"),
+		})
+	if result.Error != nil {
+		return fmt.Errorf("failed to update key used status in the database: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrPreAuthKeyUsageExceeded
+	}
 	k.Used = true
-	if err := h.db.Save(k).Error; err != nil {
-		return fmt.Errorf("failed to update key used status in the database: %w", err)
+	k.UseCount++
+
+	return nil
+}
+
+// ReleasePreAuthKeyUse 在设备注册失败时归还UsePreAuthKey占用的一次使用次数
+func (h *Mirage) ReleasePreAuthKeyUse(k *PreAuthKey) error {
+	result := h.db.Model(&PreAuthKey{}).
+		Where("id = ? AND use_count > 0", k.ID).
+		Updates(map[string]interface{}{
+			"used":      gorm.Expr("use_count > 1"),
+			"use_count": gorm.Expr("use_count - 1"),
+		})
+	if result.Error != nil {
+		return fmt.Errorf("failed to release key use in the database: %w", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		k.UseCount--
+		k.Used = k.UseCount > 0
+	}
+
+	return nil
+}
+
+// RecordPreAuthKeyUse 在设备注册成功后记录本次使用
+func (h *Mirage) RecordPreAuthKeyUse(k *PreAuthKey, machine *Machine, sourceIP string) error {
+	use := PreAuthKeyUse{
+		PreAuthKeyID: k.ID,
+		MachineID:    machine.ID,
+		MachineName:  machine.GivenName,
+		SourceIP:     sourceIP,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := h.db.Create(&use).Error; err != nil {
+		return fmt.Errorf("failed to record key use in the database: %w", err)
 	}
 
 	return nil
 }
 
+// ListPreAuthKeyUses 返回各密钥最近的使用记录，按时间倒序
+func (h *Mirage) ListPreAuthKeyUses(keyIDs []uint64, limit int) (map[uint64][]PreAuthKeyUse, error) {
+	uses := map[uint64][]PreAuthKeyUse{}
+	if len(keyIDs) == 0 {
+		return uses, nil
+	}
+	records := []PreAuthKeyUse{}
+	if err := h.db.Where("pre_auth_key_id IN ?", keyIDs).Order("id desc").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if len(uses[record.PreAuthKeyID]) < limit {
+			uses[record.PreAuthKeyID] = append(uses[record.PreAuthKeyID], record)
+		}
+	}
+
+	return uses, nil
+}
+
+// AllowsSource 检查注册请求的来源地址是否在密钥允许的网段内
+func (key *PreAuthKey) AllowsSource(sourceIP string) bool {
+	if len(key.SourceCIDRs) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(sourceIP)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, cidr := range key.SourceCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitPreAuthKey 拆分出用于查找的KeyID与参与哈希的secret
+// 旧版密钥是48位十六进制串，迁移时以前12位为KeyID、整串为secret保存
+func splitPreAuthKey(k string) (string, string, bool) {
+	if rest, ok := strings.CutPrefix(k, preAuthKeyPrefix); ok {
+		keyID, secret, ok := strings.Cut(rest, "-")
+		if !ok || len(keyID) != preAuthKeyIDLength || secret == "" {
+			return "", "", false
+		}
+		return keyID, secret, true
+	}
+	if len(k) <= preAuthKeyIDLength {
+		return "", "", false
+	}
+
+	return k[:preAuthKeyIDLength], k, true
+}
+
 // checkKeyValidity does the heavy lifting for validation of the PreAuthKey coming from a node
 // If returns no error and a PreAuthKey, it can be used.
 func (h *Mirage) checkKeyValidity(k string) (*PreAuthKey, error) {
-	pak := PreAuthKey{}
-	if result := h.db.Preload("User").First(&pak, "key = ?", k); errors.Is(
-		result.Error,
-		gorm.ErrRecordNotFound,
-	) {
+	keyID, secret, ok := splitPreAuthKey(k)
+	if !ok {
+		return nil, ErrPreAuthKeyNotFound
+	}
+	// 旧版密钥的前缀可能重复，需逐个比对哈希
+	candidates := []PreAuthKey{}
+	if err := h.db.Preload("User").Where(&PreAuthKey{KeyID: keyID}).Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+	var pak PreAuthKey
+	found := false
+	for _, candidate := range candidates {
+		hash := hashAPIKeySecret(candidate.Salt, secret)
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(candidate.Hash)) == 1 {
+			pak = candidate
+			found = true
+		}
+	}
+	if !found {
 		return nil, ErrPreAuthKeyNotFound
 	}
 
@@ -171,6 +378,10 @@ func (h *Mirage) checkKeyValidity(k string) (*PreAuthKey, error) {
 		return nil, ErrPreAuthKeyExpired
 	}
 
+	if pak.MaxUses > 0 && pak.UseCount >= pak.MaxUses {
+		return nil, ErrPreAuthKeyUsageExceeded
+	}
+
 	if pak.Reusable { // cgao6: 依据TS逻辑，自熄并不影响是否可重用|| pak.Ephemeral { // we don't need to check if has been used before
 		return &pak, nil
 	}
@@ -187,18 +398,54 @@ func (h *Mirage) checkKeyValidity(k string) (*PreAuthKey, error) {
 	return &pak, nil
 }
 
-func (h *Mirage) generateKey() (string, error) {
-	size := 24
-	bytes := make([]byte, size)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
-	}
-
-	return hex.EncodeToString(bytes), nil
-}
-
 func (key *PreAuthKey) GetAclTags() []string {
 	aclTags := make([]string, len(key.ACLTags))
 	copy(aclTags, key.ACLTags)
 	return aclTags
 }
+
+// legacyPreAuthKey 对应旧版明文保存密钥的列，仅在迁移中使用
+type legacyPreAuthKey struct {
+	ID  uint64
+	Key string
+}
+
+func (legacyPreAuthKey) TableName() string {
+	return "pre_auth_keys"
+}
+
+// hashLegacyPreAuthKeys 将旧版明文密钥转为KeyID与加盐哈希，并删除明文列
+// 已下发的旧密钥在迁移后仍可使用，控制台展示的ID保持不变
+func hashLegacyPreAuthKeys(tx *gorm.DB) error {
+	if err := tx.AutoMigrate(&schemaV7PreAuthKey{}); err != nil {
+		return err
+	}
+	if !tx.Migrator().HasColumn(&legacyPreAuthKey{}, "key") {
+		return nil
+	}
+
+	legacyKeys := []legacyPreAuthKey{}
+	if err := tx.Where("key <> ''").Find(&legacyKeys).Error; err != nil {
+		return err
+	}
+	for _, legacy := range legacyKeys {
+		keyID, secret, ok := splitPreAuthKey(legacy.Key)
+		if !ok {
+			continue
+		}
+		salt, err := randomHex(apiKeySaltLength)
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&legacyPreAuthKey{ID: legacy.ID}).Updates(map[string]interface{}{
+			"key_id": keyID,
+			"salt":   salt,
+			"hash":   hashAPIKeySecret(salt, secret),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Migrator().DropColumn(&legacyPreAuthKey{}, "key")
+}
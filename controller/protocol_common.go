@@ -81,6 +81,7 @@ func (h *Mirage) handleRegisterCommon(
 	req *http.Request,
 	registerRequest tailcfg.RegisterRequest,
 	machineKey key.MachinePublic,
+	clientIP string,
 ) {
 	now := time.Now().UTC()
 	// 这一步目前考虑不使用MachineKey
@@ -105,9 +106,15 @@ func (h *Mirage) handleRegisterCommon(
 	}
 	//cgao6: 因为除去NodeKey一致（正常）和NodeKey一致（请求过期）两种外我们预计同样处理，故后续不用再判断
 
+	// 工作负载身份令牌（JWT）放在授权密钥的位置提交
+	if isWorkloadIdentityToken(registerRequest.Auth.AuthKey) {
+		h.handleWorkloadIdentityCommon(writer, registerRequest, machineKey, clientIP)
+		return
+	}
+
 	//cgao6: 授权密钥注册模式 //TODO: 后续需要对授权密钥注册进行检查
 	if registerRequest.Auth.AuthKey != "" {
-		h.handleAuthKeyCommon(writer, registerRequest, machineKey)
+		h.handleAuthKeyCommon(writer, registerRequest, machineKey, clientIP)
 		return
 	}
 
@@ -124,14 +131,15 @@ func (h *Mirage) handleRegisterCommon(
 				Str("follow_up", registerRequest.Followup).
 				Msg("Machine is waiting for interactive login")
 
-			longPollChan := make(chan string)
-			h.longPollChanPool[aCode] = longPollChan
+			longPollChan := make(chan string, 1)
+			h.longPollChanPool.Store(aCode, longPollChan)
 			select {
 			case <-req.Context().Done():
+				h.longPollChanPool.Delete(aCode)
 				fmt.Println("DEBUG: 客户端断开long poll")
 				return
 			case loginNoticeMsg := <-longPollChan:
-				delete(h.longPollChanPool, aCode)
+				h.longPollChanPool.Delete(aCode)
 				if loginNoticeMsg == "ok" {
 					h.sendLoginSuccess(writer, machineKey)
 				}
@@ -178,7 +186,7 @@ func (h *Mirage) handleRegisterCommon(
 	)
 	// 创建新acode时，将原先机器对应的controlCode全部清除
 	if machineControlCodeC, ok := h.machineControlCodeCache.Get(machineKey.String()); ok {
-		for _, controlCode := range machineControlCodeC.(MachineControlCodeCacheItem).controlCodes {
+		for _, controlCode := range machineControlCodeC.controlCodes {
 			h.controlCodeCache.Delete(controlCode)
 		}
 	}
@@ -193,6 +201,59 @@ type ACacheItem struct {
 	uid       tailcfg.UserID
 }
 
+type aCacheItemJSON struct {
+	StateCode string                  `json:"stateCode"`
+	MKey      key.MachinePublic       `json:"mKey"`
+	RegReq    tailcfg.RegisterRequest `json:"regReq"`
+	UID       tailcfg.UserID          `json:"uid"`
+}
+
+func (item ACacheItem) MarshalJSON() ([]byte, error) {
+	return json.Marshal(aCacheItemJSON{
+		StateCode: item.stateCode,
+		MKey:      item.mKey,
+		RegReq:    item.regReq,
+		UID:       item.uid,
+	})
+}
+
+func (item *ACacheItem) UnmarshalJSON(data []byte) error {
+	v := aCacheItemJSON{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*item = ACacheItem{
+		stateCode: v.StateCode,
+		mKey:      v.MKey,
+		regReq:    v.RegReq,
+		uid:       v.UID,
+	}
+
+	return nil
+}
+
+// signalLogin 通知等待aCode的客户端登录结果，客户端的长连接可能在任意副本上
+func (h *Mirage) signalLogin(aCode, msg string) {
+	if err := h.cluster.Publish(clusterTopicLogin, aCode+" "+msg); err != nil {
+		log.Error().Caller().Err(err).Msg("Failed to publish login notice")
+		h.handleClusterLogin(aCode + " " + msg)
+	}
+}
+
+// handleClusterLogin 将登录结果转给在本副本上等待的客户端
+func (h *Mirage) handleClusterLogin(payload string) {
+	aCode, msg, ok := strings.Cut(payload, " ")
+	if !ok {
+		return
+	}
+	if longPollChan, ok := h.longPollChanPool.Load(aCode); ok {
+		select {
+		case longPollChan <- msg:
+		default:
+		}
+	}
+}
+
 func (h *Mirage) GenACode() string {
 	randomBlob := make([]byte, 6)
 	if _, err := rand.Read(randomBlob); err != nil {
@@ -286,6 +347,7 @@ func (h *Mirage) handleAuthKeyCommon(
 	writer http.ResponseWriter,
 	registerRequest tailcfg.RegisterRequest,
 	machineKey key.MachinePublic,
+	clientIP string,
 ) {
 	log.Debug().
 		Str("func", "handleAuthKeyCommon").
@@ -294,11 +356,19 @@ func (h *Mirage) handleAuthKeyCommon(
 	resp := tailcfg.RegisterResponse{}
 
 	pak, err := h.checkKeyValidity(registerRequest.Auth.AuthKey)
+	if err == nil && !pak.AllowsSource(clientIP) {
+		err = ErrPreAuthKeySourceNotAllowed
+	}
+	if err == nil {
+		// 在注册前占用一次使用次数，避免并发注册超出限制
+		err = h.UsePreAuthKey(pak)
+	}
 	if err != nil {
 		log.Error().
 			Caller().
 			Str("func", "handleAuthKeyCommon").
 			Str("machine", registerRequest.Hostinfo.Hostname).
+			Str("client_ip", clientIP).
 			Err(err).
 			Msg("Failed authentication via AuthKey")
 		resp.MachineAuthorized = false
@@ -340,8 +410,25 @@ func (h *Mirage) handleAuthKeyCommon(
 		Str("machine", registerRequest.Hostinfo.Hostname).
 		Msg("Authentication key was valid, proceeding to acquire IP addresses")
 
+	// 注册失败时归还占用的使用次数，否则单次或限次密钥会被白白消耗
+	releaseKeyUse := func() {
+		if err := h.ReleasePreAuthKeyUse(pak); err != nil {
+			log.Error().
+				Caller().
+				Str("machine", registerRequest.Hostinfo.Hostname).
+				Err(err).
+				Msg("Failed to release pre-auth key use")
+		}
+	}
+
 	nodeKey := NodePublicKeyStripPrefix(registerRequest.NodeKey)
 
+	// 密钥指定了设备密钥有效期时覆盖客户端请求的有效期
+	expiry := registerRequest.Expiry
+	if pak.KeyExpiryDays > 0 {
+		expiry = time.Now().UTC().AddDate(0, 0, pak.KeyExpiryDays)
+	}
+
 	// retrieve machine information if it exist
 	// The error is not important, because if it does not
 	// exist, then this is a new machine and we will move
@@ -358,13 +445,14 @@ func (h *Mirage) handleAuthKeyCommon(
 		machine.NodeKey = nodeKey
 		machine.AuthKeyID = uint(pak.ID)
 		machine.AuthKey = pak
-		err := h.RefreshMachine(machine, registerRequest.Expiry)
+		err := h.RefreshMachine(machine, expiry)
 		if err != nil {
 			log.Error().
 				Caller().
 				Str("machine", machine.Hostname).
 				Err(err).
 				Msg("Failed to refresh machine")
+			releaseKeyUse()
 
 			return
 		}
@@ -388,7 +476,7 @@ func (h *Mirage) handleAuthKeyCommon(
 	} else {
 		now := time.Now().UTC()
 
-		givenName := h.GenMachineName(registerRequest.Hostinfo.Hostname, pak.UserID, pak.User.OrganizationID, MachinePublicKeyStripPrefix(machineKey))
+		givenName := h.GenMachineName(pak.GivenNamePrefix+registerRequest.Hostinfo.Hostname, pak.UserID, pak.User.OrganizationID, MachinePublicKeyStripPrefix(machineKey))
 		if err != nil {
 			log.Error().
 				Caller().
@@ -405,12 +493,15 @@ func (h *Mirage) handleAuthKeyCommon(
 			UserID:         pak.User.ID,
 			MachineKey:     MachinePublicKeyStripPrefix(machineKey),
 			RegisterMethod: RegisterMethodAuthKey,
-			Expiry:         &registerRequest.Expiry,
+			Expiry:         &expiry,
 			NodeKey:        nodeKey,
 			LastSeen:       &now,
 			AuthKeyID:      uint(pak.ID),
 			ForcedTags:     pak.GetAclTags(),
 		}
+		if pak.PreApproved {
+			machineToRegister.preApprove("preauth-key:" + pak.KeyID)
+		}
 
 		machine, err = h.RegisterMachine(
 			machineToRegister,
@@ -420,6 +511,7 @@ func (h *Mirage) handleAuthKeyCommon(
 				Caller().
 				Err(err).
 				Msg("could not register machine")
+			releaseKeyUse()
 			http.Error(writer, "Internal server error", http.StatusInternalServerError)
 
 			return
@@ -427,15 +519,12 @@ func (h *Mirage) handleAuthKeyCommon(
 		h.NotifyNaviOrgNodesChange(machine.User.OrganizationID, nodeKey, "")
 	}
 
-	err = h.UsePreAuthKey(pak)
+	err = h.RecordPreAuthKeyUse(pak, machine, clientIP)
 	if err != nil {
 		log.Error().
 			Caller().
 			Err(err).
-			Msg("Failed to use pre-auth key")
-		http.Error(writer, "Internal server error", http.StatusInternalServerError)
-
-		return
+			Msg("Failed to record pre-auth key use")
 	}
 
 	resp.MachineAuthorized = true
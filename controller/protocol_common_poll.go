@@ -26,10 +26,12 @@ func (h *Mirage) handlePollCommon(
 	machine *Machine,
 	mapRequest tailcfg.MapRequest,
 ) {
+	now := time.Now().UTC()
+	// 合规状态取决于hostinfo与最近在线时间，更新前后各记录一次
+	postureChanged := h.recordMachinePosture(machine.User.Organization.AclPolicy, machine, now)
 	machine.Hostname = mapRequest.Hostinfo.Hostname
 	machine.HostInfo = HostInfo(*mapRequest.Hostinfo)
 	machine.DiscoKey = DiscoPublicKeyStripPrefix(mapRequest.DiscoKey)
-	now := time.Now().UTC()
 
 	err := h.processMachineRoutes(machine)
 	if err != nil {
@@ -89,6 +91,13 @@ func (h *Mirage) handlePollCommon(
 			return
 		}
 	}
+	if h.recordMachinePosture(machine.User.Organization.AclPolicy, machine, now) || postureChanged {
+		log.Info().
+			Str("handler", "PollNetMap").
+			Str("machine", machine.Hostname).
+			Msg("Machine posture changed")
+		h.setOrgLastStateChangeToNow(machine.User.OrganizationID)
+	}
 	var mapResponseState mapResponseStreamState
 	mapResp, err := h.getMapResponseData(mapRequest, machine, &mapResponseState)
 	if err != nil {
@@ -235,6 +244,7 @@ func (h *Mirage) pollNetMapStream(
 ) {
 	h.pollNetMapStreamWG.Add(1)
 	defer h.pollNetMapStreamWG.Done()
+	defer trackPollStream(machine.User.OrganizationID)()
 
 	ctx := context.WithValue(ctxReq, machineNameContextKey, machine.Hostname)
 
@@ -428,6 +438,9 @@ func (h *Mirage) pollNetMapStream(
 					Time("last_successful_update", lastUpdate).
 					Time("last_state_change", h.getOrgLastStateChange(machine.User.OrganizationID)).
 					Msgf("There has been updates since the last successful update to %s", machine.Hostname)
+				// Changes published while the map is being generated must still
+				// count as newer than this update, so take the time beforehand.
+				generatedAt := time.Now().UTC()
 				data, err := h.getMapResponseData(mapRequest, machine, mapResponseState)
 				if err != nil {
 					log.Error().
@@ -492,9 +505,7 @@ func (h *Mirage) pollNetMapStream(
 					return
 				}
 				*/
-				now := time.Now().UTC()
-
-				machine.LastSuccessfulUpdate = &now
+				machine.LastSuccessfulUpdate = &generatedAt
 
 				err = h.TouchMachine(machine)
 				if err != nil {
@@ -575,6 +586,8 @@ func (h *Mirage) pollNetMapStream(
 	}
 }
 
+// scheduledPollWorker sends keep alives on a timer and forwards state changes
+// of the machine's organization to the stream as they are published.
 func (h *Mirage) scheduledPollWorker(
 	ctx context.Context,
 	updateChan chan struct{},
@@ -583,7 +596,9 @@ func (h *Mirage) scheduledPollWorker(
 	machine *Machine,
 ) {
 	keepAliveTicker := time.NewTicker(keepAliveInterval)
-	updateCheckerTicker := time.NewTicker(NodeUpdateCheckInterval)
+	defer keepAliveTicker.Stop()
+	stateChanges, unsubscribe := h.stateNotifier.subscribe(machine.User.OrganizationID)
+	defer unsubscribe()
 
 	defer closeChanWithLog(
 		updateChan,
@@ -622,11 +637,11 @@ func (h *Mirage) scheduledPollWorker(
 				return
 			}
 
-		case <-updateCheckerTicker.C:
+		case <-stateChanges:
 			log.Debug().
 				Str("func", "scheduledPollWorker").
 				Str("machine", machine.Hostname).
-				Msg("Sending update request")
+				Msg("Organization state changed, sending update request")
 			select {
 			case updateChan <- struct{}{}:
 			case <-ctx.Done():
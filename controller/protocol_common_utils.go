@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,12 +16,41 @@ import (
 	"tailscale.com/types/key"
 )
 
+// minDeltaMapVersion is the lowest client capability version for which
+// omitted fields of a streamed MapResponse mean "unchanged". Older clients
+// always get a full map.
+const minDeltaMapVersion tailcfg.CapabilityVersion = 18
+
+// Capability versions that introduced each kind of peer delta. A client below
+// one of them gets the full node in PeersChanged instead of that delta.
+const (
+	peerSeenChangeVersion     tailcfg.CapabilityVersion = 10 // MapResponse.PeerSeenChange
+	onlineChangeVersion       tailcfg.CapabilityVersion = 16 // MapResponse.OnlineChange
+	peerPatchEndpointsVersion tailcfg.CapabilityVersion = 33 // PeersChangedPatch with DERPRegion and Endpoints
+	peerPatchKeysVersion      tailcfg.CapabilityVersion = 36 // PeerChange.Key and PeerChange.DiscoKey
+)
+
 // mapResponseStreamState tracks state associated with a stream of MapResponse messages,
 // which may optionally send only deltas from the previous message.
 type mapResponseStreamState struct {
-	// peersByID is the peers sent in the last stream message,
-	// for comparison in generating deltas in the new message.
-	peersByID map[int64]Machine
+	// version is the capability version the state was built for, a
+	// mismatch with the current request forces a full map.
+	version tailcfg.CapabilityVersion
+	// peers are the peer nodes as last sent in this stream, for comparison
+	// in generating deltas in the new message. nil until the first full map.
+	peers map[tailcfg.NodeID]*tailcfg.Node
+	// sent holds the JSON of the optional top-level fields last sent, so
+	// unchanged ones can be left out of the next message.
+	sent map[string]string
+	// userProfiles holds the JSON of every user profile already sent.
+	userProfiles map[tailcfg.UserID]string
+}
+
+func (s *mapResponseStreamState) reset(version tailcfg.CapabilityVersion) {
+	s.version = version
+	s.peers = nil
+	s.sent = make(map[string]string)
+	s.userProfiles = make(map[tailcfg.UserID]string)
 }
 
 func (h *Mirage) generateMapResponse(
@@ -32,6 +62,7 @@ func (h *Mirage) generateMapResponse(
 		Str("func", "generateMapResponse").
 		Str("machine", mapRequest.Hostinfo.Hostname).
 		Msg("Creating Map response")
+	defer observeSince(mapResponseDuration, time.Now())
 
 	//cgao6: change to use User's DNSConfig
 	node, err := h.toNode(*machine) //h.cfg.BaseDomain, h.cfg.DNSConfig)
@@ -93,6 +124,7 @@ func (h *Mirage) generateMapResponse(
 		*machine,
 		peers,
 	)
+	dnsConfig.ExtraRecords = append(dnsConfig.ExtraRecords, h.getOrgExtraDNSRecords(org, append(Machines{*machine}, peers...))...)
 
 	now := time.Now()
 	//org := &machine.User.Organization
@@ -113,13 +145,9 @@ func (h *Mirage) generateMapResponse(
 		// TODO: Only send if updated
 		DERPMap: derpMap, //cgao6: h.DERPMap,
 
-		// TODO(kradalby): Implement:
-		// https://github.com/tailscale/tailscale/blob/main/tailcfg/tailcfg.go#L1351-L1374
-		// PeersChanged
-		// PeersRemoved
-		// PeersChangedPatch
-		// PeerSeenChange
-		// OnlineChange
+		// Peers or their deltas (PeersChanged, PeersRemoved, PeersChangedPatch,
+		// PeerSeenChange, OnlineChange) are filled in by applyMapResponseDelta,
+		// which also drops the fields below that did not change in this stream.
 
 		// TODO: Only send if updated
 		DNSConfig: dnsConfig,
@@ -150,7 +178,7 @@ func (h *Mirage) generateMapResponse(
 	toNodes := func(machines Machines) ([]*tailcfg.Node, error) {
 		return h.toNodes(machines) //, h.cfg.BaseDomain, h.cfg.DNSConfig)
 	}
-	resp, err = applyMapResponseDelta(resp, streamState, peers, toNodes)
+	resp, err = applyMapResponseDelta(resp, streamState, mapRequest.Version, peers, toNodes)
 	if err != nil {
 		log.Error().
 			Caller().
@@ -191,8 +219,13 @@ func (h *Mirage) getMapResponseData(
 		return nil, err
 	}
 
-	return h.marshalMapResponse(mapResponse, key.MachinePublic{}, mapRequest.Compress)
+	data, err := h.marshalMapResponse(mapResponse, key.MachinePublic{}, mapRequest.Compress)
+	if err != nil {
+		return nil, err
+	}
+	mapResponseBytes.Observe(float64(len(data)))
 
+	return data, nil
 }
 
 func (h *Mirage) getMapKeepAliveResponseData(
@@ -281,60 +314,222 @@ var zstdEncoderPool = &sync.Pool{
 // with fields modified which make use of delta (send on changes).
 //
 // mapResponse the current mapResponse with delta fields not set.
-// streamState optional previous state of mapResponse sent in this stream. Set to nil for a "full update" (no deltas).
+// streamState previous state of mapResponse sent in this stream. A zero state
+// results in a "full update" (no deltas).
+// version the capability version of the client.
 // currentPeers list of peers currently available for the node that this mapResponse is for.
 // toNodes a function to convert the Headscale Machines structure to Tailscale Nodes structure.
 func applyMapResponseDelta(
 	mapResponse tailcfg.MapResponse,
 	streamState *mapResponseStreamState,
+	version tailcfg.CapabilityVersion,
 	currentPeers Machines,
 	toNodes func(Machines) ([]*tailcfg.Node, error)) (tailcfg.MapResponse, error) {
 
-	// Peer delta
-	currentPeersByID := machinesByID(currentPeers)
-
-	if streamState.peersByID == nil {
-		// 1st map, send full nodes
-		nodePeers, err := toNodes(currentPeers)
-		if err != nil {
-			return tailcfg.MapResponse{}, err
-		}
-		mapResponse.Peers = nodePeers
+	nodes, err := toNodes(currentPeers)
+	if err != nil {
+		return tailcfg.MapResponse{}, err
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+	currentPeersByID := make(map[tailcfg.NodeID]*tailcfg.Node, len(nodes))
+	for _, node := range nodes {
+		currentPeersByID[node.ID] = node
+	}
+	previousPeers := streamState.peers
+
+	if previousPeers == nil || streamState.version != version || version < minDeltaMapVersion {
+		// 1st map of the stream or the client capabilities changed, send full nodes
+		streamState.reset(version)
+		mapResponse.Peers = nodes
+		// Peers is omitted when empty, so an emptied peer list has to be
+		// expressed through removals.
+		mapResponse.PeersRemoved = removedPeers(previousPeers, currentPeersByID)
 	} else {
-		// Update PeersChanged with any peers which were removed or changed
-		var peersChanged []Machine
-		for id, peer := range currentPeersByID {
-			previousPeer, hadPrevious := streamState.peersByID[id]
-			if !hadPrevious || previousPeer.LastSuccessfulUpdate.Before(*peer.LastSuccessfulUpdate) {
-				peersChanged = append(peersChanged, peer)
+		for _, node := range nodes {
+			previous, hadPrevious := previousPeers[node.ID]
+			if !hadPrevious {
+				mapResponse.PeersChanged = append(mapResponse.PeersChanged, node)
+
+				continue
 			}
-		}
-		nodesChanged, err := toNodes(peersChanged)
-		if err != nil {
-			return tailcfg.MapResponse{}, err
-		}
-		sort.Slice(nodesChanged, func(i, j int) bool {
-			return nodesChanged[i].ID < nodesChanged[j].ID
-		})
-		mapResponse.PeersChanged = nodesChanged
-
-		// Update PeersRemoved with any peers which are no longer present
-		for id := range streamState.peersByID {
-			if _, has := currentPeersByID[id]; !has {
-				mapResponse.PeersRemoved = append(mapResponse.PeersRemoved, tailcfg.NodeID(id))
+			onlineChanged := node.Online != nil && (previous.Online == nil || *previous.Online != *node.Online)
+			seenChanged := node.LastSeen != nil && (previous.LastSeen == nil || previous.LastSeen.Before(*node.LastSeen))
+			patch, full := peerChangePatch(previous, node, version)
+			if full ||
+				(onlineChanged && version < onlineChangeVersion) ||
+				(seenChanged && version < peerSeenChangeVersion) {
+				mapResponse.PeersChanged = append(mapResponse.PeersChanged, node)
+
+				continue
+			}
+			if patch != nil {
+				mapResponse.PeersChangedPatch = append(mapResponse.PeersChangedPatch, patch)
+			}
+			if onlineChanged {
+				if mapResponse.OnlineChange == nil {
+					mapResponse.OnlineChange = make(map[tailcfg.NodeID]bool)
+				}
+				mapResponse.OnlineChange[node.ID] = *node.Online
+			}
+			if seenChanged {
+				if mapResponse.PeerSeenChange == nil {
+					mapResponse.PeerSeenChange = make(map[tailcfg.NodeID]bool)
+				}
+				mapResponse.PeerSeenChange[node.ID] = true
 			}
 		}
+		mapResponse.PeersRemoved = removedPeers(previousPeers, currentPeersByID)
 	}
 
 	// Update streamState for use in the next message
-	streamState.peersByID = currentPeersByID
-
-	// TODO(kallen): Also Implement the following deltas for even smaller
-	// message sizes:
-	//
-	// PeersChangedPatch
-	// PeerSeenChange
-	// OnlineChange
+	streamState.peers = currentPeersByID
+	streamState.omitUnchangedFields(&mapResponse)
 
 	return mapResponse, nil
 }
+
+func removedPeers(previous, current map[tailcfg.NodeID]*tailcfg.Node) []tailcfg.NodeID {
+	var removed []tailcfg.NodeID
+	for id := range previous {
+		if _, has := current[id]; !has {
+			removed = append(removed, id)
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool {
+		return removed[i] < removed[j]
+	})
+
+	return removed
+}
+
+// peerChangePatch compares a peer as last sent with its current state. It
+// returns full=true when fields that cannot be patched changed, otherwise a
+// PeerChange with the patchable fields that changed, or nil if none did.
+// Online and LastSeen are not part of the patch, they are sent through
+// OnlineChange and PeerSeenChange. A change the client's capability version
+// cannot take as a patch also returns full=true.
+func peerChangePatch(previous, current *tailcfg.Node, version tailcfg.CapabilityVersion) (*tailcfg.PeerChange, bool) {
+	a, b := *previous, *current
+	for _, node := range []*tailcfg.Node{&a, &b} {
+		node.DERP = ""
+		node.Endpoints = nil
+		node.Key = key.NodePublic{}
+		node.DiscoKey = key.DiscoPublic{}
+		node.Online = nil
+		node.LastSeen = nil
+	}
+	if jsonString(a) != jsonString(b) {
+		return nil, true
+	}
+
+	patch := &tailcfg.PeerChange{NodeID: current.ID}
+	changed := false
+	if previous.DERP != current.DERP {
+		// region 0 means "unchanged" in a patch, so a lost DERP needs the full node
+		region := derpRegionOfNode(current)
+		if region == 0 || version < peerPatchEndpointsVersion {
+			return nil, true
+		}
+		patch.DERPRegion = region
+		changed = true
+	}
+	if strings.Join(previous.Endpoints, ",") != strings.Join(current.Endpoints, ",") {
+		if len(current.Endpoints) == 0 || version < peerPatchEndpointsVersion {
+			return nil, true
+		}
+		patch.Endpoints = current.Endpoints
+		changed = true
+	}
+	if (previous.Key != current.Key || previous.DiscoKey != current.DiscoKey) && version < peerPatchKeysVersion {
+		return nil, true
+	}
+	if previous.Key != current.Key {
+		nodeKey := current.Key
+		patch.Key = &nodeKey
+		changed = true
+	}
+	if previous.DiscoKey != current.DiscoKey {
+		discoKey := current.DiscoKey
+		patch.DiscoKey = &discoKey
+		changed = true
+	}
+	if !changed {
+		return nil, false
+	}
+
+	return patch, false
+}
+
+// derpRegionOfNode parses the region out of the legacy "127.3.3.40:<region>" DERP address.
+func derpRegionOfNode(node *tailcfg.Node) int {
+	_, region, ok := strings.Cut(node.DERP, ":")
+	if !ok {
+		return 0
+	}
+	id, err := strconv.Atoi(region)
+	if err != nil {
+		return 0
+	}
+
+	return id
+}
+
+// omitUnchangedFields drops the top-level fields that are identical to the
+// ones last sent in this stream, for which nil means "unchanged" to clients.
+func (s *mapResponseStreamState) omitUnchangedFields(resp *tailcfg.MapResponse) {
+	unchanged := func(name string, v interface{}) bool {
+		encoded := jsonString(v)
+		if s.sent[name] == encoded {
+			return true
+		}
+		s.sent[name] = encoded
+
+		return false
+	}
+
+	if resp.Node != nil && unchanged("node", resp.Node) {
+		resp.Node = nil
+	}
+	if resp.DERPMap != nil && unchanged("derpMap", resp.DERPMap) {
+		resp.DERPMap = nil
+	}
+	if resp.DNSConfig != nil && unchanged("dnsConfig", resp.DNSConfig) {
+		resp.DNSConfig = nil
+	}
+	if resp.SSHPolicy != nil && unchanged("sshPolicy", resp.SSHPolicy) {
+		resp.SSHPolicy = nil
+	}
+	if unchanged("domain", resp.Domain) {
+		resp.Domain = ""
+	}
+	// nil means unchanged, an empty non-nil list blocks everything
+	if resp.PacketFilter == nil {
+		resp.PacketFilter = []tailcfg.FilterRule{}
+	}
+	if unchanged("packetFilter", resp.PacketFilter) {
+		resp.PacketFilter = nil
+	}
+
+	// only new or updated user profiles are sent
+	profiles := []tailcfg.UserProfile{}
+	for _, profile := range resp.UserProfiles {
+		encoded := jsonString(profile)
+		if s.userProfiles[profile.ID] == encoded {
+			continue
+		}
+		s.userProfiles[profile.ID] = encoded
+		profiles = append(profiles, profile)
+	}
+	resp.UserProfiles = profiles
+}
+
+func jsonString(v interface{}) string {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+
+	return string(bytes)
+}
@@ -44,7 +44,7 @@ func (t *noiseServer) NoiseRegistrationHandler(
 		return
 	}
 
-	t.mirage.handleRegisterCommon(writer, req, registerRequest, t.conn.Peer())
+	t.mirage.handleRegisterCommon(writer, req, registerRequest, t.conn.Peer(), t.clientIP)
 }
 
 type NaviRegisterResponse struct {
@@ -78,6 +78,12 @@ func (m *Mirage) handleRegisterNavi(
 		}
 		log.Trace().Msgf("Navi node %s registered", node.ID)
 
+		//清空发送队列并将序列号置零，须在生成可信节点列表之前
+		if err := m.resetNaviOutbox(node.ID, naviSupportsPushFullSync(req)); err != nil {
+			log.Error().Caller().Err(err).Msg("Failed to reset Navi outbox")
+			http.Error(writer, "Internal error", http.StatusInternalServerError)
+			return
+		}
 		trustNodesKeys, err := m.getOrgNodesKey(node.NaviRegion.OrgID)
 		if err != nil {
 			log.Error().Caller().Err(err).Msg("Failed to get trust nodes key")
@@ -111,8 +117,8 @@ func (m *Mirage) handleRegisterNavi(
 				Msg("Failed to get Navi Noise client")
 			return
 		}
-		m.DERPNCs[node.ID] = nc
-		m.DERPseqnum[node.ID] = 0 //初始化Noise client及序列号
+		//初始化Noise client
+		m.DERPNCs.Store(node.ID, nc)
 
 		_, err = writer.Write(respBody)
 		if err != nil {
@@ -170,6 +176,12 @@ func (t *noiseServer) NoiseNaviPollNodesListHandler(
 		return
 	}
 	if node.NaviKey == MachinePublicKeyStripPrefix(t.conn.Peer()) {
+		//清空发送队列并将序列号置零，须在生成可信节点列表之前
+		if err := t.mirage.resetNaviOutbox(node.ID, naviSupportsPushFullSync(req)); err != nil {
+			log.Error().Caller().Err(err).Msg("Failed to reset Navi outbox")
+			http.Error(writer, "Internal error", http.StatusInternalServerError)
+			return
+		}
 		trustNodesKeys, err := t.mirage.getOrgNodesKey(node.NaviRegion.OrgID)
 		if err != nil {
 			log.Error().Caller().Err(err).Msg("Failed to get trust nodes key")
@@ -195,8 +207,6 @@ func (t *noiseServer) NoiseNaviPollNodesListHandler(
 		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
 		writer.WriteHeader(http.StatusOK)
 
-		t.mirage.DERPseqnum[node.ID] = 0 //序列号置零
-
 		_, err = writer.Write(respBody)
 		if err != nil {
 			log.Error().
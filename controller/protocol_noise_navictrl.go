@@ -2,6 +2,7 @@ package controller
 
 import (
 	"bytes"
+	"context"
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
@@ -67,36 +68,93 @@ func decodeNoiseResponse(res *http.Response, v any) error {
 	return json.Unmarshal(msg, v)
 }
 
+// NodesChange 可信节点变更请求，司南按SeqNum顺序处理，返回200表示已确认
+// FullSync为真时TrustNodes为完整的可信节点列表，司南应以其替换本地列表并以SeqNum作为新的起点；
+// 全量推送只发给在naviCapabilityHeader中声明naviCapPushFullSync的司南
 type NodesChange struct {
 	SeqNum     int
 	AddNode    string
 	RemoveNode string
+	TrustNodes []string `json:",omitempty"`
+	FullSync   bool     `json:",omitempty"`
 }
 
-// 发送可信节点变更请求
-func (m *Mirage) sendNodesChange(navi *NaviNode, addNode, removeNode string) error {
-	m.DERPseqnum[navi.ID]++
+const (
+	// naviCapabilityHeader 司南注册及拉取可信节点列表时通过该请求头声明支持的能力，以逗号分隔
+	naviCapabilityHeader = "Navi-Capabilities"
+	// naviCapPushFullSync 司南能够处理NodesChange中的全量推送
+	naviCapPushFullSync = "push-full-sync"
+)
+
+// naviSupportsPushFullSync 检查司南请求是否声明支持全量推送，旧版司南不带该请求头
+func naviSupportsPushFullSync(req *http.Request) bool {
+	for _, value := range req.Header.Values(naviCapabilityHeader) {
+		for _, capability := range strings.Split(value, ",") {
+			if strings.TrimSpace(capability) == naviCapPushFullSync {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// naviNoiseClient 返回到司南的Noise客户端
+// 多副本部署时司南只向其中一个副本注册，其他副本在首次使用时按司南档案建立连接
+func (m *Mirage) naviNoiseClient(navi *NaviNode) (*controlclient.NoiseClient, error) {
+	if nc, ok := m.DERPNCs.Load(navi.ID); ok && nc != nil {
+		return nc, nil
+	}
+	naviKey := key.MachinePublic{}
+	if err := naviKey.UnmarshalText([]byte(MachinePublicKeyEnsurePrefix(navi.NaviKey))); err != nil {
+		return nil, err
+	}
+	nc, err := m.GetNaviNoiseClient(naviKey, navi.HostName, navi.DERPPort)
+	if err != nil {
+		return nil, err
+	}
+	m.DERPNCs.Store(navi.ID, nc)
+
+	return nc, nil
+}
+
+// 发送可信节点变更请求，全量同步的节点列表在发送时生成，超过naviSendTimeout未确认视为失败
+func (m *Mirage) sendNodesChange(navi *NaviNode, entry *NaviOutboxEntry) error {
 	request := NodesChange{
-		SeqNum:     m.DERPseqnum[navi.ID],
-		AddNode:    addNode,
-		RemoveNode: removeNode,
+		SeqNum:     entry.SeqNum,
+		AddNode:    entry.AddNode,
+		RemoveNode: entry.RemoveNode,
+		FullSync:   entry.FullSync,
+	}
+	if entry.FullSync {
+		trustNodes, err := m.getOrgNodesKey(navi.NaviRegion.OrgID)
+		if err != nil {
+			return fmt.Errorf("node change request: %w", err)
+		}
+		request.TrustNodes = trustNodes
 	}
 	url := fmt.Sprintf("https://%s:%d/ctrl/nodes", navi.HostName, navi.DERPPort)
 	bodyData, err := json.Marshal(request)
 	if err != nil {
 		return fmt.Errorf("node change request: %w", err)
 	}
-	req, err := http.NewRequestWithContext(m.ctx, "POST", url, bytes.NewReader(bodyData))
+	ctx, cancel := context.WithTimeout(m.ctx, naviSendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bodyData))
 	if err != nil {
 		return fmt.Errorf("node change request: %w", err)
 	}
-	res, err := m.DERPNCs[navi.ID].Do(req)
+	nc, err := m.naviNoiseClient(navi)
 	if err != nil {
 		return fmt.Errorf("node change request: %w", err)
 	}
+	res, err := nc.Do(req)
+	if err != nil {
+		return fmt.Errorf("node change request: %w", err)
+	}
+	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		msg, _ := io.ReadAll(res.Body)
-		res.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
 		return fmt.Errorf("node change request: http %d: %.200s",
 			res.StatusCode, strings.TrimSpace(string(msg)))
 	}
@@ -104,25 +162,27 @@ func (m *Mirage) sendNodesChange(navi *NaviNode, addNode, removeNode string) err
 }
 
 // 通知租户内（及全局）司南可信节点变更
+// 变更先写入各司南的发送队列，由deliverNaviOutbox按顺序投递并在失败时重试
 func (m *Mirage) NotifyNaviOrgNodesChange(orgID int64, addNode, removeNode string) {
-	//TODO
 	nrs := m.ListNaviRegions()
 	for _, nr := range nrs {
 		if nr.OrgID == orgID || nr.OrgID == 0 {
 			nns := m.ListNaviNodes(nr.ID)
 			for _, nn := range nns {
 				if nn.NaviKey != "" {
-					err := m.sendNodesChange(&nn, addNode, removeNode)
+					err := m.enqueueNodesChange(nn.ID, addNode, removeNode)
 					if err != nil {
 						log.Error().
 							Caller().
 							Err(err).
-							Msg("Cannot send nodes change")
+							Str("navi", nn.ID).
+							Msg("Cannot enqueue nodes change")
 					}
 				}
 			}
 		}
 	}
+	m.kickNaviOutbox()
 }
 
 // 获取租户内节点NodeKey列表
@@ -209,6 +269,7 @@ func (m *Mirage) updateNaviStatus(navi *NaviNode) error {
 			Latency: -1,
 		}
 		m.db.Model(&navi).Update("statics", navi.Statics)
+		naviMetrics.update(navi)
 		return fmt.Errorf("update navi status request: %w", err)
 	}
 
@@ -219,6 +280,7 @@ func (m *Mirage) updateNaviStatus(navi *NaviNode) error {
 			Latency: -1,
 		}
 		m.db.Model(&navi).Update("statics", navi.Statics)
+		naviMetrics.update(navi)
 		return fmt.Errorf("update navi status request: http %d: %.200s",
 			res204.StatusCode, strings.TrimSpace(string(msg)))
 	}
@@ -230,6 +292,7 @@ func (m *Mirage) updateNaviStatus(navi *NaviNode) error {
 			Latency:       latency.Milliseconds(),
 			CertExpiresAt: certExpiresAt,
 		}
+		naviMetrics.update(navi)
 		err = m.db.Model(&navi).Update("statics", navi.Statics).Error
 		return err
 	}
@@ -239,7 +302,11 @@ func (m *Mirage) updateNaviStatus(navi *NaviNode) error {
 	if err != nil {
 		return fmt.Errorf("update navi status request: %w", err)
 	}
-	res, err := m.DERPNCs[navi.ID].Do(req)
+	nc, err := m.naviNoiseClient(navi)
+	if err != nil {
+		return fmt.Errorf("update navi status request: %w", err)
+	}
+	res, err := nc.Do(req)
 	if err != nil {
 		return fmt.Errorf("update navi status request: %w", err)
 	}
@@ -261,6 +328,7 @@ func (m *Mirage) updateNaviStatus(navi *NaviNode) error {
 	navi.Statics.Latency = latency.Milliseconds()
 	navi.Statics.CertExpiresAt = certExpiresAt
 	m.db.Model(&navi).Update("statics", navi.Statics)
+	naviMetrics.update(navi)
 
 	return nil
 }
@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ErrRouteGroupHoldDownInvalid = Error("route group hold-down must be between 0 and 86400 seconds")
+
+	// defaultRouteHoldDown 新上线的子网路由器需持续在线该时长后才可被选为主路由（存在在线主路由时）
+	defaultRouteHoldDown = 30 * time.Second
+	maxRouteHoldDown     = 24 * time.Hour
+
+	RouteFailoverReasonElected = "elected" // 该前缀此前没有主路由
+	RouteFailoverReasonOffline = "offline" // 原主路由离线
+	RouteFailoverReasonPreempt = "preempt" // 更高优先级的路由器恢复后抢占
+)
+
+// RouteGroup 为同一组织内通告相同子网前缀的路由器组配置故障切换策略
+// 组内成员即通告该前缀的全部路由，成员优先级保存在各自的Route.Priority上
+type RouteGroup struct {
+	ID             uint64   `gorm:"primaryKey"`
+	OrganizationID int64    `gorm:"uniqueIndex:idx_route_group_org_prefix;not null"`
+	Prefix         IPPrefix `gorm:"uniqueIndex:idx_route_group_org_prefix;not null"`
+
+	// Preempt 为true时，更高优先级的路由器持续在线超过HoldDown后会夺回主路由
+	Preempt bool
+	// HoldDownSeconds 为0时使用defaultRouteHoldDown
+	HoldDownSeconds int
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (g *RouteGroup) holdDown() time.Duration {
+	if g == nil || g.HoldDownSeconds <= 0 {
+		return defaultRouteHoldDown
+	}
+
+	return time.Duration(g.HoldDownSeconds) * time.Second
+}
+
+func (g *RouteGroup) preempt() bool {
+	return g != nil && g.Preempt
+}
+
+// RouteFailoverEvent 记录子网前缀主路由的每一次切换
+type RouteFailoverEvent struct {
+	ID             uint64   `gorm:"primaryKey"`
+	OrganizationID int64    `gorm:"index"`
+	Prefix         IPPrefix `gorm:"index"`
+	FromMachineID  int64
+	FromMachine    string
+	ToMachineID    int64
+	ToMachine      string
+	Reason         string
+	CreatedAt      time.Time `gorm:"index"`
+}
+
+type routeGroupKey struct {
+	orgID  int64
+	prefix netip.Prefix
+}
+
+func newRouteFailoverEvent(orgID int64, from, to *Route, reason string) *RouteFailoverEvent {
+	event := &RouteFailoverEvent{
+		OrganizationID: orgID,
+		Prefix:         to.Prefix,
+		ToMachineID:    to.MachineID,
+		ToMachine:      to.Machine.GivenName,
+		Reason:         reason,
+	}
+	if from != nil {
+		event.FromMachineID = from.MachineID
+		event.FromMachine = from.Machine.GivenName
+	}
+
+	return event
+}
+
+// listOrgRoutes 返回组织内全部设备的路由
+func (h *Mirage) listOrgRoutes(orgID int64) ([]Route, error) {
+	var routes []Route
+	err := h.db.
+		Preload("Machine").Preload("Machine.User").
+		Where("machine_id IN (?)", h.orgMachineIDs(orgID)).
+		Order("id").
+		Find(&routes).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	return routes, nil
+}
+
+// getOrgPrimaryRoutes 返回组织内每个子网前缀当前的主路由
+func (h *Mirage) getOrgPrimaryRoutes(orgID int64) (map[netip.Prefix]*Route, error) {
+	routes, err := h.listOrgRoutes(orgID)
+	if err != nil {
+		return nil, err
+	}
+	primaries := make(map[netip.Prefix]*Route)
+	for pos, route := range routes {
+		if route.Advertised && route.Enabled && route.IsPrimary && !route.isExitRoute() {
+			primaries[netip.Prefix(route.Prefix)] = &routes[pos]
+		}
+	}
+
+	return primaries, nil
+}
+
+func (h *Mirage) getRouteGroups() (map[routeGroupKey]*RouteGroup, error) {
+	var groups []RouteGroup
+	if err := h.db.Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	res := make(map[routeGroupKey]*RouteGroup, len(groups))
+	for pos, group := range groups {
+		res[routeGroupKey{orgID: group.OrganizationID, prefix: netip.Prefix(group.Prefix)}] = &groups[pos]
+	}
+
+	return res, nil
+}
+
+// ListOrgRouteGroups 返回组织内已保存的路由组策略，以子网前缀为键
+func (h *Mirage) ListOrgRouteGroups(orgID int64) (map[netip.Prefix]*RouteGroup, error) {
+	var groups []RouteGroup
+	if err := h.db.Where("organization_id = ?", orgID).Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	res := make(map[netip.Prefix]*RouteGroup, len(groups))
+	for pos, group := range groups {
+		res[netip.Prefix(group.Prefix)] = &groups[pos]
+	}
+
+	return res, nil
+}
+
+// SaveRouteGroup 新建或更新组织内某子网前缀的故障切换策略
+func (h *Mirage) SaveRouteGroup(orgID int64, prefix netip.Prefix, preempt bool, holdDownSeconds int) (*RouteGroup, error) {
+	if holdDownSeconds < 0 || time.Duration(holdDownSeconds)*time.Second > maxRouteHoldDown {
+		return nil, ErrRouteGroupHoldDownInvalid
+	}
+	group := RouteGroup{
+		OrganizationID:  orgID,
+		Prefix:          IPPrefix(prefix.Masked()),
+		Preempt:         preempt,
+		HoldDownSeconds: holdDownSeconds,
+	}
+	err := h.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "organization_id"}, {Name: "prefix"}},
+		DoUpdates: clause.AssignmentColumns([]string{"preempt", "hold_down_seconds", "updated_at"}),
+	}).Create(&group).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+// SetRoutePriority 设置路由在其路由组中的优先级，数值越大越优先
+func (h *Mirage) SetRoutePriority(route *Route, priority int) error {
+	route.Priority = priority
+
+	return h.db.Model(route).UpdateColumn("priority", priority).Error
+}
+
+// ListRouteFailoverEvents 按时间倒序返回组织内的主路由切换记录，limit<=0时不限制条数
+func (h *Mirage) ListRouteFailoverEvents(orgID int64, limit int) ([]RouteFailoverEvent, error) {
+	var events []RouteFailoverEvent
+	tx := h.db.Where("organization_id = ?", orgID).Order("created_at DESC, id DESC")
+	if limit > 0 {
+		tx = tx.Limit(limit)
+	}
+	if err := tx.Find(&events).Error; err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/netip"
+	"sort"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -29,6 +30,13 @@ type Route struct {
 	Enabled    bool
 	IsPrimary  bool
 
+	// Priority orders the routers advertising the same prefix,
+	// the highest value is preferred as primary.
+	Priority int
+	// HealthySince is when the router was last seen coming online,
+	// used to hold down freshly reconnected routers.
+	HealthySince *time.Time
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
@@ -77,7 +85,28 @@ func (h *Mirage) GetMachineRoutes(m *Machine) ([]Route, error) {
 
 func (h *Mirage) GetRoute(id uint64) (*Route, error) {
 	var route Route
-	err := h.db.Preload("Machine").First(&route, id).Error
+	err := h.db.Preload("Machine").Preload("Machine.User").First(&route, id).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &route, nil
+}
+
+// orgMachineIDs returns a subquery selecting the IDs of all machines in the organization.
+func (h *Mirage) orgMachineIDs(orgID int64) *gorm.DB {
+	userIDs := h.db.Model(&User{}).Select("id").Where("organization_id = ?", orgID)
+
+	return h.db.Model(&Machine{}).Select("id").Where("user_id IN (?)", userIDs)
+}
+
+// GetOrgRoute returns the route only if it belongs to a machine of the organization.
+func (h *Mirage) GetOrgRoute(orgID int64, id uint64) (*Route, error) {
+	var route Route
+	err := h.db.
+		Preload("Machine").Preload("Machine.User").
+		Where("machine_id IN (?)", h.orgMachineIDs(orgID)).
+		First(&route, id).Error
 	if err != nil {
 		return nil, err
 	}
@@ -212,6 +241,38 @@ func (h *Mirage) processMachineRoutes(machine *Machine) error {
 	return nil
 }
 
+// isHealthyFor returns if the router has been continuously online for at least d.
+func (r *Route) isHealthyFor(d time.Duration, now time.Time) bool {
+	return r.Machine.isOnline() && r.HealthySince != nil && now.Sub(*r.HealthySince) >= d
+}
+
+// sortRouteCandidates orders routes by descending priority,
+// ties are broken in favour of the route advertised first.
+func sortRouteCandidates(routes []*Route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].Priority != routes[j].Priority {
+			return routes[i].Priority > routes[j].Priority
+		}
+
+		return routes[i].ID < routes[j].ID
+	})
+}
+
+// updateRouteHealth keeps HealthySince in sync with the online state of the router.
+func (h *Mirage) updateRouteHealth(route *Route, now time.Time) error {
+	online := route.Machine.isOnline()
+	switch {
+	case online && route.HealthySince == nil:
+		route.HealthySince = &now
+	case !online && route.HealthySince != nil:
+		route.HealthySince = nil
+	default:
+		return nil
+	}
+
+	return h.db.Model(route).UpdateColumn("healthy_since", route.HealthySince).Error
+}
+
 func (h *Mirage) handlePrimarySubnetFailover() error {
 	// first, get all the enabled routes
 	var routes []Route
@@ -221,110 +282,181 @@ func (h *Mirage) handlePrimarySubnetFailover() error {
 		Find(&routes).Error
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		log.Error().Err(err).Msg("error getting routes")
+
+		return err
 	}
 
-	routesChangedOrgSet := NewUtilsSet[int64]()
-	for pos, route := range routes {
-		if route.isExitRoute() {
+	routeGroups, err := h.getRouteGroups()
+	if err != nil {
+		log.Error().Err(err).Msg("error getting route groups")
+
+		return err
+	}
+
+	now := time.Now().UTC()
+	members := make(map[routeGroupKey][]*Route)
+	for pos := range routes {
+		route := &routes[pos]
+		if route.isExitRoute() || route.Machine.ID == 0 {
 			continue
 		}
 
-		if !route.IsPrimary {
-			_, err := h.getPrimaryRoute(netip.Prefix(route.Prefix))
-			if h.isUniquePrefix(route) || errors.Is(err, gorm.ErrRecordNotFound) {
-				log.Info().
-					Str("prefix", netip.Prefix(route.Prefix).String()).
-					Str("machine", route.Machine.GivenName).
-					Msg("Setting primary route")
-				routes[pos].IsPrimary = true
-				err := h.db.Save(&routes[pos]).Error
-				if err != nil {
-					log.Error().Err(err).Msg("error marking route as primary")
+		err := h.updateRouteHealth(route, now)
+		if err != nil {
+			log.Error().Err(err).Msg("error updating route health")
 
-					return err
-				}
+			return err
+		}
 
-				routesChangedOrgSet.SetKey(route.Machine.User.OrganizationID)
-				continue
-			}
+		key := routeGroupKey{
+			orgID:  route.Machine.User.OrganizationID,
+			prefix: netip.Prefix(route.Prefix),
 		}
+		members[key] = append(members[key], route)
+	}
 
-		if route.IsPrimary {
-			if route.Machine.isOnline() {
-				continue
-			}
+	routesChangedOrgSet := NewUtilsSet[int64]()
+	for key, group := range members {
+		changed, err := h.electPrimaryRoute(key, routeGroups[key], group, now)
+		if err != nil {
+			return err
+		}
+		if changed {
+			routesChangedOrgSet.SetKey(key.orgID)
+		}
+	}
 
-			// machine offline, find a new primary
-			log.Info().
-				Str("machine", route.Machine.Hostname).
-				Str("prefix", netip.Prefix(route.Prefix).String()).
-				Msgf("machine offline, finding a new primary subnet")
-
-			// find a new primary route
-			var newPrimaryRoutes []Route
-			err := h.db.
-				Preload("Machine").
-				Where("prefix = ? AND machine_id != ? AND advertised = ? AND enabled = ?",
-					route.Prefix,
-					route.MachineID,
-					true, true).
-				Find(&newPrimaryRoutes).Error
-			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-				log.Error().Err(err).Msg("error finding new primary route")
+	changedOrgList := routesChangedOrgSet.GetKeys()
+	if len(changedOrgList) > 0 {
+		h.setOrgLastStateChangeToNow(changedOrgList...)
+	}
 
-				return err
-			}
+	return nil
+}
 
-			var newPrimaryRoute *Route
-			for pos, r := range newPrimaryRoutes {
-				if r.Machine.isOnline() {
-					newPrimaryRoute = &newPrimaryRoutes[pos]
+// electPrimaryRoute makes sure exactly one route of the group is primary.
+//
+// The current primary is kept as long as it is online, unless the group
+// allows preemption and a router with a higher priority has been online
+// for the whole hold-down period. When the primary goes offline, the
+// highest priority router past its hold-down takes over, falling back to
+// any online router so the prefix is never left without a path.
+func (h *Mirage) electPrimaryRoute(
+	key routeGroupKey,
+	group *RouteGroup,
+	routes []*Route,
+	now time.Time,
+) (bool, error) {
+	sortRouteCandidates(routes)
+	holdDown := group.holdDown()
+	changed := false
+
+	var primary *Route
+	for _, route := range routes {
+		if !route.IsPrimary {
+			continue
+		}
+		if primary == nil {
+			primary = route
 
-					break
-				}
-			}
+			continue
+		}
 
-			if newPrimaryRoute == nil {
-				log.Warn().
-					Str("machine", route.Machine.Hostname).
-					Str("prefix", netip.Prefix(route.Prefix).String()).
-					Msgf("no alternative primary route found")
+		// more than one primary for the same prefix, keep the preferred one
+		route.IsPrimary = false
+		err := h.db.Model(route).UpdateColumn("is_primary", false).Error
+		if err != nil {
+			log.Error().Err(err).Msg("error demoting duplicate primary route")
 
-				continue
-			}
+			return false, err
+		}
+		changed = true
+	}
 
-			log.Info().
-				Str("old_machine", route.Machine.Hostname).
-				Str("prefix", netip.Prefix(route.Prefix).String()).
-				Str("new_machine", newPrimaryRoute.Machine.Hostname).
-				Msgf("found new primary route")
+	var healthy, online *Route
+	for _, route := range routes {
+		if !route.Machine.isOnline() {
+			continue
+		}
+		if online == nil {
+			online = route
+		}
+		if route.isHealthyFor(holdDown, now) {
+			healthy = route
 
-			// disable the old primary route
-			routes[pos].IsPrimary = false
-			err = h.db.Save(&routes[pos]).Error
-			if err != nil {
-				log.Error().Err(err).Msg("error disabling old primary route")
+			break
+		}
+	}
 
-				return err
-			}
+	var next *Route
+	var reason string
+	switch {
+	case primary == nil:
+		reason = RouteFailoverReasonElected
+		switch {
+		case healthy != nil:
+			next = healthy
+		case online != nil:
+			next = online
+		default:
+			// nobody is online, still pick one so the route shows up once it connects
+			next = routes[0]
+		}
+	case !primary.Machine.isOnline():
+		reason = RouteFailoverReasonOffline
+		if healthy != nil {
+			next = healthy
+		} else {
+			next = online
+		}
+		if next == nil {
+			log.Warn().
+				Str("machine", primary.Machine.Hostname).
+				Str("prefix", key.prefix.String()).
+				Msgf("no alternative primary route found")
+		}
+	case group.preempt() && healthy != nil && healthy.Priority > primary.Priority:
+		reason = RouteFailoverReasonPreempt
+		next = healthy
+	}
 
-			// enable the new primary route
-			newPrimaryRoute.IsPrimary = true
-			err = h.db.Save(&newPrimaryRoute).Error
-			if err != nil {
-				log.Error().Err(err).Msg("error enabling new primary route")
+	if next == nil || next == primary {
+		return changed, nil
+	}
+
+	logger := log.Info().
+		Str("prefix", key.prefix.String()).
+		Str("new_machine", next.Machine.Hostname).
+		Str("reason", reason)
+	if primary != nil {
+		logger = logger.Str("old_machine", primary.Machine.Hostname)
+	}
+	logger.Msg("switching primary subnet route")
 
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if primary != nil {
+			err := tx.Model(primary).UpdateColumn("is_primary", false).Error
+			if err != nil {
 				return err
 			}
-
-			routesChangedOrgSet.SetKey(route.Machine.User.OrganizationID)
 		}
-	}
+		err := tx.Model(next).UpdateColumn("is_primary", true).Error
+		if err != nil {
+			return err
+		}
 
-	changedOrgList := routesChangedOrgSet.GetKeys()
-	if len(changedOrgList) > 0 {
-		h.setOrgLastStateChangeToNow(changedOrgList...)
+		return tx.Create(newRouteFailoverEvent(key.orgID, primary, next, reason)).Error
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("error switching primary route")
+
+		return changed, err
 	}
+	routeFailoverCounter.WithLabelValues(reason).Inc()
+	if primary != nil {
+		primary.IsPrimary = false
+	}
+	next.IsPrimary = true
 
-	return nil
+	return true, nil
 }
@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultNetMapDebounce = 200 * time.Millisecond
+	defaultNetMapMaxDelay = 2 * time.Second
+)
+
+// stateNotifier 将组织的状态变化推送给订阅了该组织的长连接
+// 短时间内的多次变化会被合并：每次变化后等待debounce再推送，持续变化时最多推迟maxDelay
+// 没有订阅者的组织不产生任何开销
+type stateNotifier struct {
+	debounce time.Duration
+	maxDelay time.Duration
+
+	mu      sync.Mutex
+	nextID  uint64
+	subs    map[int64]map[uint64]chan struct{}
+	pending map[int64]*pendingOrgChange
+}
+
+type pendingOrgChange struct {
+	timer *time.Timer
+	first time.Time
+}
+
+func newStateNotifier(debounce, maxDelay time.Duration) *stateNotifier {
+	if maxDelay < debounce {
+		maxDelay = debounce
+	}
+
+	return &stateNotifier{
+		debounce: debounce,
+		maxDelay: maxDelay,
+		subs:     make(map[int64]map[uint64]chan struct{}),
+		pending:  make(map[int64]*pendingOrgChange),
+	}
+}
+
+// loadStateNotifierConfig 从环境变量读取推送合并参数，取值为Go的时长格式（如200ms、2s）：
+//
+//	MIRAGE_NETMAP_DEBOUNCE  变化后等待多久再推送，0表示立即推送，默认200ms
+//	MIRAGE_NETMAP_MAX_DELAY 持续变化时推送的最长推迟时间，默认2s
+func loadStateNotifierConfig() (time.Duration, time.Duration) {
+	load := func(name string, def time.Duration) time.Duration {
+		v, ok := os.LookupEnv(name)
+		if !ok || v == "" {
+			return def
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Warn().Str("env", name).Str("value", v).Msg("Invalid duration, using default")
+
+			return def
+		}
+
+		return d
+	}
+
+	return load("MIRAGE_NETMAP_DEBOUNCE", defaultNetMapDebounce),
+		load("MIRAGE_NETMAP_MAX_DELAY", defaultNetMapMaxDelay)
+}
+
+// subscribe 订阅组织的状态变化，返回的通道容量为1，未及时处理的多次通知合并为一次
+// 调用方结束时必须调用返回的取消函数
+func (n *stateNotifier) subscribe(orgID int64) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	n.mu.Lock()
+	id := n.nextID
+	n.nextID++
+	if n.subs[orgID] == nil {
+		n.subs[orgID] = make(map[uint64]chan struct{})
+	}
+	n.subs[orgID][id] = ch
+	n.mu.Unlock()
+
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.subs[orgID], id)
+		if len(n.subs[orgID]) == 0 {
+			delete(n.subs, orgID)
+		}
+	}
+}
+
+// publish 通知组织发生了状态变化
+func (n *stateNotifier) publish(orgIDs ...int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, orgID := range orgIDs {
+		n.schedule(orgID)
+	}
+}
+
+// publishAll 通知全部有订阅者的组织
+func (n *stateNotifier) publishAll() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for orgID := range n.subs {
+		n.schedule(orgID)
+	}
+}
+
+// schedule 需持有n.mu
+func (n *stateNotifier) schedule(orgID int64) {
+	if _, ok := n.subs[orgID]; !ok {
+		return
+	}
+	if n.debounce <= 0 {
+		n.fanout(orgID)
+		return
+	}
+
+	now := time.Now()
+	if p, ok := n.pending[orgID]; ok {
+		delay := n.debounce
+		if remain := p.first.Add(n.maxDelay).Sub(now); remain < delay {
+			delay = remain
+		}
+		if delay > 0 {
+			p.timer.Reset(delay)
+		}
+		return
+	}
+
+	p := &pendingOrgChange{first: now}
+	p.timer = time.AfterFunc(n.debounce, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if n.pending[orgID] == p {
+			delete(n.pending, orgID)
+		}
+		n.fanout(orgID)
+	})
+	n.pending[orgID] = p
+}
+
+// fanout 需持有n.mu，通道已有未处理的通知时直接跳过
+func (n *stateNotifier) fanout(orgID int64) {
+	for _, ch := range n.subs[orgID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
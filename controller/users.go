@@ -535,27 +535,20 @@ func (me *User) GetDNSConfig(ipPrefixesCfg []netip.Prefix) (*tailcfg.DNSConfig,
 	resolvers := []*dnstype.Resolver{}
 
 	for _, nameserverStr := range nameserversStr {
-		// Search for explicit DNS-over-HTTPS resolvers
-		if strings.HasPrefix(nameserverStr, "https://") {
-			resolvers = append(resolvers, &dnstype.Resolver{
-				Addr: nameserverStr,
-			})
-			// This nameserver can not be parsed as an IP address
-			continue
-		}
-		// Parse nameserver as a regular IP
-		nameserver, err := netip.ParseAddr(nameserverStr)
-		if err != nil {
-			log.Error().
-				Str("func", "getDNSConfig").
-				Err(err).
-				Msgf("Could not parse nameserver IP: %s", nameserverStr)
-		}
+		// DNS-over-HTTPS/TLS resolvers and ip:port can not be parsed as an IP address
+		if nameserver, err := netip.ParseAddr(nameserverStr); err == nil {
+			nameservers = append(nameservers, nameserver)
+		} else if !isEncryptedResolver(nameserverStr) {
+			if _, err := netip.ParseAddrPort(nameserverStr); err != nil {
+				log.Error().
+					Str("func", "getDNSConfig").
+					Err(err).
+					Msgf("Could not parse nameserver: %s", nameserverStr)
 
-		nameservers = append(nameservers, nameserver)
-		resolvers = append(resolvers, &dnstype.Resolver{
-			Addr: nameserver.String(),
-		})
+				continue
+			}
+		}
+		resolvers = append(resolvers, me.Organization.dnsResolver(nameserverStr))
 	}
 
 	dnsConfig.Nameservers = nameservers
@@ -571,25 +564,31 @@ func (me *User) GetDNSConfig(ipPrefixesCfg []netip.Prefix) (*tailcfg.DNSConfig,
 	domains := []string{}
 	restrictedDNS := me.Organization.SplitDns
 	for _, oneRestrictedDNS := range restrictedDNS {
+		// NS在前，Fallback按顺序追加在后
 		restrictedResolvers := make(
 			[]*dnstype.Resolver,
-			len(oneRestrictedDNS.NS),
+			0,
+			len(oneRestrictedDNS.NS)+len(oneRestrictedDNS.Fallback),
 		)
-		for index, nameserverStr := range oneRestrictedDNS.NS {
-			nameserver, err := netip.ParseAddr(nameserverStr)
-			if err != nil {
+		for _, nameserverStr := range append(append([]string{}, oneRestrictedDNS.NS...), oneRestrictedDNS.Fallback...) {
+			if err := validateResolverAddr(nameserverStr); err != nil {
 				log.Error().
 					Str("func", "getDNSConfig").
 					Err(err).
-					Msgf("Could not parse restricted nameserver IP: %s", nameserverStr)
-			}
-			restrictedResolvers[index] = &dnstype.Resolver{
-				Addr: nameserver.String(),
+					Msgf("Could not parse restricted nameserver: %s", nameserverStr)
+
+				continue
 			}
+			restrictedResolvers = append(restrictedResolvers, me.Organization.dnsResolver(nameserverStr))
 		}
 		dnsConfig.Routes[oneRestrictedDNS.Domain] = restrictedResolvers
 		domains = append(domains, oneRestrictedDNS.Domain)
 	}
+	for _, searchDomain := range me.Organization.SearchDomains {
+		if !containsStr(domains, searchDomain) {
+			domains = append(domains, searchDomain)
+		}
+	}
 	dnsConfig.Domains = domains
 
 	//cgao6: TODO
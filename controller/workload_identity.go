@@ -0,0 +1,478 @@
+package controller
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/rs/zerolog/log"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+const (
+	ErrWorkloadTokenMalformed   = Error("workload identity token is malformed")
+	ErrWorkloadTrustNotFound    = Error("no workload identity trust matches the token issuer and audience")
+	ErrWorkloadTrustAmbiguous   = Error("workload identity token matches more than one trust")
+	ErrWorkloadClaimsMismatch   = Error("workload identity token claims do not match the trust rules")
+	ErrWorkloadTrustInvalid     = Error("workload identity trust is invalid")
+	ErrWorkloadTrustAudienceDup = Error("workload identity audience is already in use")
+	ErrWorkloadIssuerForbidden  = Error("workload identity issuer must be a public https URL")
+
+	RegisterMethodWorkloadIdentity = "workload"
+
+	workloadTrustIDPrefix   = "mswif-"
+	workloadTrustIDLength   = 12
+	workloadProviderTimeout = 10 * time.Second
+)
+
+// WorkloadClaimRules 以声明名为键、glob模式为值，全部规则都匹配才接受令牌
+// 数组类型的声明（如groups）只要有一个元素匹配即可
+type WorkloadClaimRules map[string]string
+
+func (rules *WorkloadClaimRules) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, rules)
+	case string:
+		return json.Unmarshal([]byte(v), rules)
+	default:
+		return fmt.Errorf("cannot parse claim rules: unexpected data type %T", value)
+	}
+}
+
+func (rules WorkloadClaimRules) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(rules)
+	return string(bytes), err
+}
+
+func workloadClaimMatches(pattern string, claim interface{}) bool {
+	switch v := claim.(type) {
+	case string:
+		ok, err := path.Match(pattern, v)
+		return err == nil && ok
+	case []interface{}:
+		for _, item := range v {
+			if workloadClaimMatches(pattern, item) {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	default:
+		ok, err := path.Match(pattern, fmt.Sprint(v))
+		return err == nil && ok
+	}
+}
+
+// Match 检查已验证的令牌声明是否满足全部规则
+func (rules WorkloadClaimRules) Match(claims map[string]interface{}) bool {
+	for name, pattern := range rules {
+		if !workloadClaimMatches(pattern, claims[name]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// WorkloadIdentityTrust 表示组织信任的外部OIDC签发方（如GitHub Actions、Kubernetes服务账号）
+// 工作负载以该签发方签发的JWT代替授权密钥注册，注册的设备为自熄设备并带有Tags，服务端不保存任何密钥
+// 签发方与audience只在组织内未注销的信任关系中唯一
+type WorkloadIdentityTrust struct {
+	ID             uint64 `gorm:"primary_key"`
+	TrustID        string `gorm:"uniqueIndex"`
+	OrganizationID int64  `gorm:"index;uniqueIndex:idx_workload_org_issuer_audience,where:revoked_at IS NULL"`
+	CreatorID      int64
+	Creator        User
+	Description    string
+	Issuer         string `gorm:"uniqueIndex:idx_workload_org_issuer_audience"`
+	Audience       string `gorm:"uniqueIndex:idx_workload_org_issuer_audience"`
+	ClaimRules     WorkloadClaimRules
+	Tags           StringList
+
+	CreatedAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (h *Mirage) defaultWorkloadAudience(trustID string) string {
+	return fmt.Sprintf("https://%s/workload/%s", h.cfg.ServerURL, trustID)
+}
+
+// CreateWorkloadIdentityTrust 创建信任关系，未指定audience时生成一个唯一的audience
+func (h *Mirage) CreateWorkloadIdentityTrust(
+	creator *User,
+	issuer string,
+	audience string,
+	rules WorkloadClaimRules,
+	tags []string,
+	description string,
+) (*WorkloadIdentityTrust, error) {
+	if err := validateWorkloadIssuer(issuer); err != nil {
+		return nil, err
+	}
+	// 不带规则的信任会接受该签发方签发的任何令牌，对GitHub这样的公共签发方是不可接受的
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("%w: at least one claim rule is required", ErrWorkloadTrustInvalid)
+	}
+	for name, pattern := range rules {
+		if _, err := path.Match(pattern, ""); err != nil || name == "" {
+			return nil, fmt.Errorf("%w: bad claim rule %s=%s", ErrWorkloadTrustInvalid, name, pattern)
+		}
+	}
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("%w: at least one tag is required", ErrWorkloadTrustInvalid)
+	}
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, "tag:") {
+			return nil, fmt.Errorf("%w: '%s' did not begin with 'tag:'", ErrPreAuthKeyACLTagInvalid, tag)
+		}
+	}
+
+	trustID, err := randomHex(workloadTrustIDLength / 2)
+	if err != nil {
+		return nil, err
+	}
+	trustID = workloadTrustIDPrefix + trustID
+	if audience == "" {
+		audience = h.defaultWorkloadAudience(trustID)
+	}
+	var count int64
+	h.db.Model(&WorkloadIdentityTrust{}).
+		Where("organization_id = ? AND issuer = ? AND audience = ? AND revoked_at IS NULL",
+			creator.OrganizationID, issuer, audience).
+		Count(&count)
+	if count > 0 {
+		return nil, ErrWorkloadTrustAudienceDup
+	}
+
+	now := time.Now().UTC()
+	trust := WorkloadIdentityTrust{
+		TrustID:        trustID,
+		OrganizationID: creator.OrganizationID,
+		CreatorID:      creator.ID,
+		Creator:        *creator,
+		Description:    description,
+		Issuer:         issuer,
+		Audience:       audience,
+		ClaimRules:     rules,
+		Tags:           tags,
+		CreatedAt:      &now,
+	}
+	if err := h.db.Omit("Creator").Create(&trust).Error; err != nil {
+		return nil, err
+	}
+
+	return &trust, nil
+}
+
+// ListWorkloadIdentityTrusts returns all trusts (including revoked ones) of an organization.
+func (h *Mirage) ListWorkloadIdentityTrusts(orgID int64) ([]WorkloadIdentityTrust, error) {
+	trusts := []WorkloadIdentityTrust{}
+	err := h.db.Preload("Creator").Where(&WorkloadIdentityTrust{OrganizationID: orgID}).Find(&trusts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return trusts, nil
+}
+
+func (h *Mirage) RevokeWorkloadIdentityTrust(trust *WorkloadIdentityTrust) error {
+	now := time.Now().UTC()
+	trust.RevokedAt = &now
+
+	return h.db.Model(trust).Update("revoked_at", now).Error
+}
+
+// isWorkloadIdentityToken 授权密钥位置上出现的JWT视为工作负载身份令牌
+func isWorkloadIdentityToken(authKey string) bool {
+	return strings.HasPrefix(authKey, "eyJ") && strings.Count(authKey, ".") == 2
+}
+
+// unverifiedWorkloadClaims 仅用于在验签前确定签发方与audience，结果不可信任
+func unverifiedWorkloadClaims(rawToken string) (string, []string, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return "", nil, ErrWorkloadTokenMalformed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, ErrWorkloadTokenMalformed
+	}
+	claims := struct {
+		Issuer   string          `json:"iss"`
+		Audience json.RawMessage `json:"aud"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", nil, ErrWorkloadTokenMalformed
+	}
+	audiences := []string{}
+	var audience string
+	if err := json.Unmarshal(claims.Audience, &audience); err == nil {
+		audiences = append(audiences, audience)
+	} else if err := json.Unmarshal(claims.Audience, &audiences); err != nil {
+		return "", nil, ErrWorkloadTokenMalformed
+	}
+
+	return claims.Issuer, audiences, nil
+}
+
+// validateWorkloadIssuer 签发方须为https地址，且不能指向内网地址
+// 发现文档与公钥集由服务端按租户提供的地址获取，获取时仍会在建立连接前检查目标地址
+func validateWorkloadIssuer(issuer string) error {
+	u, err := url.Parse(issuer)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" || u.User != nil {
+		return fmt.Errorf("%w: %q", ErrWorkloadIssuerForbidden, issuer)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%w: %q", ErrWorkloadIssuerForbidden, issuer)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && !isPublicWebhookAddr(addr) {
+		return fmt.Errorf("%w: %q", ErrWorkloadIssuerForbidden, issuer)
+	}
+
+	return nil
+}
+
+// workloadProvider 缓存签发方的发现文档与公钥集，发现失败时不缓存以便下次重试
+// 公钥集会在之后的验证中按需刷新，因此不能使用带超时的ctx创建，超时由http.Client控制；
+// 客户端只能连接公网https地址，防止租户借签发方地址访问内网
+func (h *Mirage) workloadProvider(issuer string) (*oidc.Provider, error) {
+	if provider, ok := h.workloadProviders.Load(issuer); ok {
+		return provider, nil
+	}
+	if err := validateWorkloadIssuer(issuer); err != nil {
+		return nil, err
+	}
+	ctx := oidc.ClientContext(context.Background(), newPublicHTTPClient(workloadProviderTimeout))
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	provider, _ = h.workloadProviders.LoadOrStore(issuer, provider)
+
+	return provider, nil
+}
+
+// verifyWorkloadIdentityToken 找到匹配的信任关系，使用go-oidc验证签名、有效期与audience，再按声明规则选出唯一的信任关系
+func (h *Mirage) verifyWorkloadIdentityToken(rawToken string) (*WorkloadIdentityTrust, string, error) {
+	issuer, audiences, err := unverifiedWorkloadClaims(rawToken)
+	if err != nil {
+		return nil, "", err
+	}
+	trusts := []WorkloadIdentityTrust{}
+	err = h.db.Where("issuer = ? AND audience IN ? AND revoked_at IS NULL", issuer, audiences).
+		Find(&trusts).Error
+	if err != nil {
+		return nil, "", err
+	}
+	if len(trusts) == 0 {
+		return nil, "", ErrWorkloadTrustNotFound
+	}
+
+	provider, err := h.workloadProvider(issuer)
+	if err != nil {
+		return nil, "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), workloadProviderTimeout)
+	defer cancel()
+	// 不同组织可以信任相同的签发方与audience，以声明规则区分；同时匹配多个时拒绝
+	var (
+		trust   WorkloadIdentityTrust
+		subject string
+		matched int
+	)
+	for index := range trusts {
+		idToken, err := provider.Verifier(&oidc.Config{ClientID: trusts[index].Audience}).Verify(ctx, rawToken)
+		if err != nil {
+			return nil, "", err
+		}
+		claims := map[string]interface{}{}
+		if err := idToken.Claims(&claims); err != nil {
+			return nil, "", err
+		}
+		subject = idToken.Subject
+		if trusts[index].ClaimRules.Match(claims) {
+			trust = trusts[index]
+			matched++
+		}
+	}
+	if matched == 0 {
+		return nil, subject, ErrWorkloadClaimsMismatch
+	}
+	if matched > 1 {
+		return nil, subject, ErrWorkloadTrustAmbiguous
+	}
+
+	now := time.Now().UTC()
+	h.db.Model(&trust).Update("last_used_at", now)
+	trust.LastUsedAt = &now
+
+	return &trust, subject, nil
+}
+
+func (h *Mirage) writeRegisterUnauthorized(
+	writer http.ResponseWriter,
+	machineKey key.MachinePublic,
+) {
+	respBody, err := h.marshalResponse(tailcfg.RegisterResponse{MachineAuthorized: false}, machineKey)
+	if err != nil {
+		log.Error().
+			Caller().
+			Err(err).
+			Msg("Cannot encode message")
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(http.StatusUnauthorized)
+	_, err = writer.Write(respBody)
+	if err != nil {
+		log.Error().
+			Caller().
+			Err(err).
+			Msg("Failed to write response")
+	}
+}
+
+// handleWorkloadIdentityCommon 使用工作负载身份令牌注册设备
+// 设备归属于组织的Owner，以自熄、带标签的方式注册
+func (h *Mirage) handleWorkloadIdentityCommon(
+	writer http.ResponseWriter,
+	registerRequest tailcfg.RegisterRequest,
+	machineKey key.MachinePublic,
+	clientIP string,
+) {
+	trust, subject, err := h.verifyWorkloadIdentityToken(registerRequest.Auth.AuthKey)
+	if err != nil {
+		log.Error().
+			Caller().
+			Str("func", "handleWorkloadIdentityCommon").
+			Str("machine", registerRequest.Hostinfo.Hostname).
+			Str("client_ip", clientIP).
+			Str("subject", subject).
+			Err(err).
+			Msg("Failed authentication via workload identity")
+		h.writeRegisterUnauthorized(writer, machineKey)
+
+		return
+	}
+	owner, err := h.getOrgOwner(trust.OrganizationID)
+	if err != nil {
+		log.Error().
+			Caller().
+			Int64("org_id", trust.OrganizationID).
+			Err(err).
+			Msg("Cannot find organization owner for workload identity")
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+
+		return
+	}
+
+	nodeKey := NodePublicKeyStripPrefix(registerRequest.NodeKey)
+	machine, _ := h.GetUserMachineByMachineKey(machineKey, owner.toTailscaleUser().ID)
+	if machine != nil {
+		h.NotifyNaviOrgNodesChange(trust.OrganizationID, nodeKey, machine.NodeKey)
+
+		machine.NodeKey = nodeKey
+		machine.RegisterMethod = RegisterMethodWorkloadIdentity
+		machine.AuthKeyID = 0
+		machine.AuthKey = nil
+		if err := h.RefreshMachine(machine, registerRequest.Expiry); err != nil {
+			log.Error().
+				Caller().
+				Str("machine", machine.Hostname).
+				Err(err).
+				Msg("Failed to refresh machine")
+			http.Error(writer, "Internal server error", http.StatusInternalServerError)
+
+			return
+		}
+		if err := h.SetTags(machine, trust.Tags); err != nil {
+			log.Error().
+				Caller().
+				Str("machine", machine.Hostname).
+				Strs("aclTags", trust.Tags).
+				Err(err).
+				Msg("Failed to set tags after refreshing machine")
+			http.Error(writer, "Internal server error", http.StatusInternalServerError)
+
+			return
+		}
+	} else {
+		now := time.Now().UTC()
+		givenName := h.GenMachineName(registerRequest.Hostinfo.Hostname, owner.ID, trust.OrganizationID, MachinePublicKeyStripPrefix(machineKey))
+		newMachine := Machine{
+			Hostname:       registerRequest.Hostinfo.Hostname,
+			GivenName:      givenName,
+			UserID:         owner.ID,
+			MachineKey:     MachinePublicKeyStripPrefix(machineKey),
+			RegisterMethod: RegisterMethodWorkloadIdentity,
+			Expiry:         &registerRequest.Expiry,
+			NodeKey:        nodeKey,
+			LastSeen:       &now,
+			ForcedTags:     append([]string{}, trust.Tags...),
+		}
+		// 工作负载由信任策略授权，无需人工审批
+		newMachine.preApprove("workload-identity:" + trust.TrustID)
+		machine, err = h.RegisterMachine(newMachine)
+		if err != nil {
+			log.Error().
+				Caller().
+				Err(err).
+				Msg("could not register machine")
+			http.Error(writer, "Internal server error", http.StatusInternalServerError)
+
+			return
+		}
+		h.NotifyNaviOrgNodesChange(trust.OrganizationID, nodeKey, "")
+	}
+	h.setOrgLastStateChangeToNow(trust.OrganizationID)
+
+	resp := tailcfg.RegisterResponse{
+		MachineAuthorized: true,
+		User:              *owner.toTailscaleUser(),
+		Login:             *owner.toTailscaleLogin(),
+	}
+	respBody, err := h.marshalResponse(resp, machineKey)
+	if err != nil {
+		log.Error().
+			Caller().
+			Err(err).
+			Msg("Cannot encode message")
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	_, err = writer.Write(respBody)
+	if err != nil {
+		log.Error().
+			Caller().
+			Err(err).
+			Msg("Failed to write response")
+	}
+
+	log.Info().
+		Str("func", "handleWorkloadIdentityCommon").
+		Str("machine", registerRequest.Hostinfo.Hostname).
+		Str("trust", trust.TrustID).
+		Str("subject", subject).
+		Str("ips", strings.Join(machine.IPAddresses.ToStringSlice(), ", ")).
+		Msg("Successfully authenticated via workload identity")
+}